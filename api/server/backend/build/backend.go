@@ -25,9 +25,10 @@ type Backend struct {
 	imageComponent ImageComponent
 }
 
-// NewBackend creates a new build backend from components
-func NewBackend(components ImageComponent, builderBackend builder.Backend) *Backend {
-	manager := dockerfile.NewBuildManager(builderBackend)
+// NewBackend creates a new build backend from components. denylist is the
+// path of the file listing the digests of the files builds may not copy.
+func NewBackend(components ImageComponent, builderBackend builder.Backend, denylist string) *Backend {
+	manager := dockerfile.NewBuildManager(builderBackend, denylist)
 	return &Backend{imageComponent: components, manager: manager}
 }
 
@@ -69,6 +69,14 @@ func newImageBuildOptions(ctx context.Context, r *http.Request) (*types.ImageBui
 		options.ShmSize = shmSize
 	}
 
+	if r.Form.Get("copywarningthreshold") != "" {
+		threshold, err := strconv.Atoi(r.Form.Get("copywarningthreshold"))
+		if err != nil {
+			return nil, err
+		}
+		options.CopyWarningThreshold = threshold
+	}
+
 	if i := container.Isolation(r.FormValue("isolation")); i != "" {
 		if !container.Isolation.IsValid(i) {
 			return nil, fmt.Errorf("Unsupported isolation: %q", i)
@@ -2,6 +2,7 @@ package container
 
 import (
 	"io"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -45,6 +46,7 @@ type stateBackend interface {
 	ContainerUnpause(name string) error
 	ContainerUpdate(name string, hostConfig *container.HostConfig) (container.ContainerUpdateOKBody, error)
 	ContainerWait(ctx context.Context, name string, condition containerpkg.WaitCondition) (<-chan containerpkg.StateStatus, error)
+	ContainerWaitSince(ctx context.Context, name string, condition containerpkg.WaitCondition, since time.Time) (<-chan containerpkg.StateStatus, error)
 }
 
 // monitorBackend includes functions to implement to provide containers monitoring functionality.
@@ -1,15 +1,19 @@
 package container
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/docker/api"
+	"github.com/docker/docker/api/errors"
 	"github.com/docker/docker/api/server/httputils"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/backend"
@@ -283,35 +287,109 @@ func (s *containerRouter) postContainersUnpause(ctx context.Context, w http.Resp
 	return nil
 }
 
+// waitToken is handed out to clients of the wait endpoint so that they can
+// resume waiting after the connection was lost, e.g. because the daemon was
+// restarted.
+type waitToken struct {
+	Condition  container.WaitCondition
+	Since      time.Time
+	OutputTail int64 `json:",omitempty"`
+}
+
+// maxWaitOutputTail is the maximum number of lines of output returned by
+// the wait endpoint.
+const maxWaitOutputTail = 100
+
+func encodeWaitToken(t waitToken) (string, error) {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+func decodeWaitToken(s string) (waitToken, error) {
+	var t waitToken
+	b, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return t, fmt.Errorf("invalid wait token: %v", err)
+	}
+	if err := json.Unmarshal(b, &t); err != nil {
+		return t, fmt.Errorf("invalid wait token: %v", err)
+	}
+	return t, nil
+}
+
 func (s *containerRouter) postContainersWait(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	// Behavior changed in version 1.30 to handle wait condition and to
 	// return headers immediately.
 	version := httputils.VersionFromContext(ctx)
 	legacyBehavior := versions.LessThan(version, "1.30")
+	// Version 1.31 added resumable waits.
+	resumable := !versions.LessThan(version, "1.31")
 
-	// The wait condition defaults to "not-running".
-	waitCondition := containerpkg.WaitConditionNotRunning
+	token := waitToken{
+		Condition: container.WaitConditionNotRunning,
+		Since:     time.Now().UTC(),
+	}
+	resume := false
 	if !legacyBehavior {
 		if err := httputils.ParseForm(r); err != nil {
 			return err
 		}
-		switch container.WaitCondition(r.Form.Get("condition")) {
-		case container.WaitConditionNextExit:
-			waitCondition = containerpkg.WaitConditionNextExit
-		case container.WaitConditionRemoved:
-			waitCondition = containerpkg.WaitConditionRemoved
+		token.Condition = container.WaitCondition(r.Form.Get("condition"))
+		if resumable {
+			tail, err := httputils.Int64ValueOrDefault(r, "tail", 0)
+			if err != nil {
+				return errors.NewBadRequestError(err)
+			}
+			if tail < 0 || tail > maxWaitOutputTail {
+				return errors.NewBadRequestError(fmt.Errorf("tail must be between 0 and %d", maxWaitOutputTail))
+			}
+			token.OutputTail = tail
+		}
+		if t := r.Form.Get("token"); t != "" && resumable {
+			var err error
+			if token, err = decodeWaitToken(t); err != nil {
+				return errors.NewBadRequestError(err)
+			}
+			resume = true
 		}
 	}
 
+	// The wait condition defaults to "not-running".
+	waitCondition := containerpkg.WaitConditionNotRunning
+	switch token.Condition {
+	case container.WaitConditionNextExit:
+		waitCondition = containerpkg.WaitConditionNextExit
+	case container.WaitConditionRemoved:
+		waitCondition = containerpkg.WaitConditionRemoved
+	}
+
 	// Note: the context should get canceled if the client closes the
 	// connection since this handler has been wrapped by the
 	// router.WithCancel() wrapper.
-	waitC, err := s.backend.ContainerWait(ctx, vars["name"], waitCondition)
+	var (
+		waitC <-chan containerpkg.StateStatus
+		err   error
+	)
+	if resume {
+		waitC, err = s.backend.ContainerWaitSince(ctx, vars["name"], waitCondition, token.Since)
+	} else {
+		waitC, err = s.backend.ContainerWait(ctx, vars["name"], waitCondition)
+	}
 	if err != nil {
 		return err
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	if resumable {
+		encoded, err := encodeWaitToken(token)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Docker-Wait-Token", encoded)
+	}
 
 	if !legacyBehavior {
 		// Write response header immediately.
@@ -324,9 +402,37 @@ func (s *containerRouter) postContainersWait(ctx context.Context, w http.Respons
 	// Block on the result of the wait operation.
 	status := <-waitC
 
-	return json.NewEncoder(w).Encode(&container.ContainerWaitOKBody{
+	body := container.ContainerWaitOKBody{
 		StatusCode: int64(status.ExitCode()),
+	}
+	if body.StatusCode != 0 && token.OutputTail > 0 {
+		body.Output = s.readOutputTail(ctx, vars["name"], token.OutputTail)
+	}
+	return json.NewEncoder(w).Encode(&body)
+}
+
+// readOutputTail returns the last lines of the combined output of the
+// container name, or an empty string if its output cannot be read, e.g.
+// because its logging driver does not support reading.
+func (s *containerRouter) readOutputTail(ctx context.Context, name string, lines int64) string {
+	msgs, err := s.backend.ContainerLogs(ctx, name, &types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       strconv.FormatInt(lines, 10),
 	})
+	if err != nil {
+		logrus.Debugf("Error reading the output of container %s: %v", name, err)
+		return ""
+	}
+	var output bytes.Buffer
+	for msg := range msgs {
+		if msg.Err != nil {
+			logrus.Debugf("Error reading the output of container %s: %v", name, msg.Err)
+			continue
+		}
+		output.Write(msg.Line)
+	}
+	return output.String()
 }
 
 func (s *containerRouter) getContainersChanges(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
@@ -80,6 +80,14 @@ type ContainerLogsOptions struct {
 	Details    bool
 }
 
+// ContainerWaitOptions holds parameters to wait for containers.
+type ContainerWaitOptions struct {
+	Condition container.WaitCondition
+	// OutputTail is the number of lines of output of the container to
+	// return if its exit code is not zero.
+	OutputTail int
+}
+
 // ContainerRemoveOptions holds parameters to remove containers.
 type ContainerRemoveOptions struct {
 	RemoveVolumes bool
@@ -178,6 +186,11 @@ type ImageBuildOptions struct {
 	SecurityOpt []string
 	ExtraHosts  []string // List of extra hosts
 	Target      string
+	// CopyWarningThreshold is the number of files of a directory copied by
+	// COPY or ADD above which the build warns that it may be copying more
+	// than it needs. 0 uses the default threshold, and a negative value
+	// disables the warning.
+	CopyWarningThreshold int
 }
 
 // ImageBuildResponse holds information
@@ -11,6 +11,10 @@ package container
 // swagger:model ContainerWaitOKBody
 type ContainerWaitOKBody struct {
 
+	// The last lines of the combined output of the container, if its exit
+	// code is not zero and they were requested with the `tail` parameter.
+	Output string `json:"Output,omitempty"`
+
 	// Exit code of the container
 	// Required: true
 	StatusCode int64 `json:"StatusCode"`
@@ -1,5 +1,7 @@
 package container
 
+import "fmt"
+
 // WaitCondition is a type used to specify a container state for which
 // to wait.
 type WaitCondition string
@@ -20,3 +22,31 @@ const (
 	WaitConditionNextExit   WaitCondition = "next-exit"
 	WaitConditionRemoved    WaitCondition = "removed"
 )
+
+// ParseWaitCondition returns the WaitCondition named s, or an error if s is
+// not a known condition. An empty s is parsed as WaitConditionNotRunning.
+func ParseWaitCondition(s string) (WaitCondition, error) {
+	c := WaitCondition(s)
+	if c == "" {
+		return WaitConditionNotRunning, nil
+	}
+	if !c.IsValid() {
+		return "", fmt.Errorf("invalid wait condition %q: must be one of %q, %q or %q", s, WaitConditionNotRunning, WaitConditionNextExit, WaitConditionRemoved)
+	}
+	return c, nil
+}
+
+// String returns the name of the condition.
+func (c WaitCondition) String() string {
+	return string(c)
+}
+
+// IsValid indicates if the condition is a known one. The empty condition is
+// valid, and waits like WaitConditionNotRunning.
+func (c WaitCondition) IsValid() bool {
+	switch c {
+	case "", WaitConditionNotRunning, WaitConditionNextExit, WaitConditionRemoved:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package container
+
+import (
+	"testing"
+)
+
+func TestParseWaitCondition(t *testing.T) {
+	for s, expected := range map[string]WaitCondition{
+		"":            WaitConditionNotRunning,
+		"not-running": WaitConditionNotRunning,
+		"next-exit":   WaitConditionNextExit,
+		"removed":     WaitConditionRemoved,
+	} {
+		c, err := ParseWaitCondition(s)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %q: %v", s, err)
+		}
+		if c != expected {
+			t.Fatalf("Expected %q to be parsed as %q, got %q", s, expected, c)
+		}
+		if !c.IsValid() {
+			t.Fatalf("Expected %q to be valid", c)
+		}
+	}
+}
+
+func TestParseWaitConditionInvalid(t *testing.T) {
+	for _, s := range []string{"not_running", "Removed", "exited", " next-exit"} {
+		if _, err := ParseWaitCondition(s); err == nil {
+			t.Fatalf("Expected an error parsing %q", s)
+		}
+		if WaitCondition(s).IsValid() {
+			t.Fatalf("Expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestWaitConditionString(t *testing.T) {
+	if s := WaitConditionNextExit.String(); s != "next-exit" {
+		t.Fatalf("Expected next-exit, got %s", s)
+	}
+}
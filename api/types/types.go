@@ -558,3 +558,20 @@ type PushResult struct {
 type BuildResult struct {
 	ID string
 }
+
+// BuildCopyStats sums up the COPY and ADD instructions of a build. It is
+// sent as an aux message at the end of the build, before the BuildResult of
+// the final image.
+type BuildCopyStats struct {
+	// Steps is the number of COPY and ADD instructions which copied files,
+	// and Cached the number of the others, which were taken from the
+	// cache.
+	Steps  int
+	Cached int
+	// Files and Size are the number and the total size in bytes of the
+	// regular files copied by Steps.
+	Files int
+	Size  int64
+	// Duration is the time spent copying, in nanoseconds.
+	Duration time.Duration
+}
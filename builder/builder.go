@@ -6,11 +6,13 @@ package builder
 
 import (
 	"io"
+	"os"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/backend"
 	"github.com/docker/docker/api/types/container"
 	containerpkg "github.com/docker/docker/container"
+	"github.com/docker/docker/pkg/idtools"
 	"golang.org/x/net/context"
 )
 
@@ -44,9 +46,25 @@ type Backend interface {
 
 	// ContainerCopy copies/extracts a source FileInfo to a destination path inside a container
 	// specified by a container object.
+	// The copies are owned by the root of the container, unless ownership
+	// maps the IDs of the source entries to IDs in the container. The
+	// directories created to hold the destination are given dirMode, or
+	// 0755 if it is 0. If skipIdentical is set, the entries of the
+	// destination which already are copies of the source are left alone.
 	// TODO: extract in the builder instead of passing `decompress`
 	// TODO: use containerd/fs.changestream instead as a source
-	CopyOnBuild(containerID string, destPath string, srcRoot string, srcPath string, decompress bool) error
+	CopyOnBuild(containerID string, destPath string, srcRoot string, srcPath string, decompress bool, ownership *idtools.IDMappings, dirMode os.FileMode, skipIdentical bool) error
+	// SyncOnBuild copies a source directory like CopyOnBuild, but only
+	// writes the files of the destination which differ from the source and
+	// removes those which are not in the source.
+	SyncOnBuild(containerID string, destPath string, srcRoot string, srcPath string) error
+	// FreeSpaceOnBuild returns the number of bytes which can still be
+	// written to the filesystem of a container, or -1 if it is not known.
+	FreeSpaceOnBuild(containerID string) (int64, error)
+	// DigestsOnBuild returns the hex-encoded sha256 digests of the content
+	// of the regular files at paths in the filesystem of a container, by
+	// path. The paths which are not regular files are left out.
+	DigestsOnBuild(containerID string, paths []string) (map[string]string, error)
 
 	ImageCacheBuilder
 }
@@ -98,6 +116,14 @@ type Image interface {
 	RunConfig() *container.Config
 }
 
+// PlatformImage is an Image which knows the platform it was built for.
+type PlatformImage interface {
+	Image
+	// Platform returns the operating system and the architecture of the
+	// image, which are empty if they are not known.
+	Platform() (string, string)
+}
+
 // ReleaseableLayer is an image layer that can be mounted and released
 type ReleaseableLayer interface {
 	Release() error
@@ -39,13 +39,19 @@ var validCommitCommands = map[string]bool{
 type BuildManager struct {
 	backend   builder.Backend
 	pathCache pathCache // TODO: make this persistent
+	// denylist is the path of the file listing the digests of the files
+	// builds are not allowed to copy, if any.
+	denylist string
 }
 
-// NewBuildManager creates a BuildManager
-func NewBuildManager(b builder.Backend) *BuildManager {
+// NewBuildManager creates a BuildManager. denylist is the path of the file
+// listing the sha256 digests of the files COPY and ADD refuse to copy, or
+// an empty string.
+func NewBuildManager(b builder.Backend, denylist string) *BuildManager {
 	return &BuildManager{
 		backend:   b,
 		pathCache: &syncmap.Map{},
+		denylist:  denylist,
 	}
 }
 
@@ -56,6 +62,16 @@ func (bm *BuildManager) Build(ctx context.Context, config backend.BuildConfig) (
 		config.Options.Dockerfile = builder.DefaultDockerfileName
 	}
 
+	// The denylist is read for each build so that it can be updated
+	// without restarting the daemon.
+	var denylist digestDenylist
+	if bm.denylist != "" {
+		var err error
+		if denylist, err = loadDigestDenylist(bm.denylist); err != nil {
+			return nil, err
+		}
+	}
+
 	source, dockerfile, err := remotecontext.Detect(config)
 	if err != nil {
 		return nil, err
@@ -73,6 +89,7 @@ func (bm *BuildManager) Build(ctx context.Context, config backend.BuildConfig) (
 		ProgressWriter: config.ProgressWriter,
 		Backend:        bm.backend,
 		PathCache:      bm.pathCache,
+		Denylist:       denylist,
 	}
 	return newBuilder(ctx, builderOptions).build(source, dockerfile)
 }
@@ -83,6 +100,7 @@ type builderOptions struct {
 	Backend        builder.Backend
 	ProgressWriter backend.ProgressWriter
 	PathCache      pathCache
+	Denylist       digestDenylist
 }
 
 // Builder is a Dockerfile builder
@@ -105,6 +123,11 @@ type Builder struct {
 	pathCache        pathCache
 	containerManager *containerManager
 	imageProber      ImageProber
+	denylist         digestDenylist
+	// platform is the platform requested for the build, empty if none is.
+	platform buildPlatform
+	// copyStats sums up the COPY and ADD instructions of the build.
+	copyStats types.BuildCopyStats
 }
 
 // newBuilder creates a new Dockerfile builder from an optional dockerfile and a Options.
@@ -127,6 +150,7 @@ func newBuilder(clientCtx context.Context, options builderOptions) *Builder {
 		pathCache:        options.PathCache,
 		imageProber:      newImageProber(options.Backend, config.CacheFrom, config.NoCache),
 		containerManager: newContainerManager(options.Backend),
+		denylist:         options.Denylist,
 	}
 	return b
 }
@@ -143,6 +167,10 @@ func (b *Builder) build(source builder.Source, dockerfile *parser.Result) (*buil
 		return nil, err
 	}
 
+	if err := checkCopySources(dockerfile, source, b.pathCache, b.options.Target); err != nil {
+		return nil, err
+	}
+
 	dispatchState, err := b.dispatchDockerfileWithCancellation(dockerfile, source)
 	if err != nil {
 		return nil, err
@@ -169,6 +197,15 @@ func emitImageID(aux *streamformatter.AuxFormatter, state *dispatchState) error
 	return aux.Emit(types.BuildResult{ID: state.imageID})
 }
 
+// emitCopyStats emits an aux message with the stats of the COPY and ADD
+// instructions of the build, if it has any.
+func emitCopyStats(aux *streamformatter.AuxFormatter, stats types.BuildCopyStats) error {
+	if aux == nil || stats.Steps+stats.Cached == 0 {
+		return nil
+	}
+	return aux.Emit(stats)
+}
+
 func (b *Builder) dispatchDockerfileWithCancellation(dockerfile *parser.Result, source builder.Source) (*dispatchState, error) {
 	shlex := NewShellLex(dockerfile.EscapeToken)
 	state := newDispatchState()
@@ -218,6 +255,12 @@ func (b *Builder) dispatchDockerfileWithCancellation(dockerfile *parser.Result,
 		}
 	}
 
+	// The stats come before the final image, which clients take as the
+	// result of the build.
+	if err := emitCopyStats(b.Aux, b.copyStats); err != nil {
+		return nil, err
+	}
+
 	// Emit a final aux message for the final image
 	if err := emitImageID(b.Aux, state); err != nil {
 		return nil, err
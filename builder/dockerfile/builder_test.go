@@ -1,11 +1,22 @@
 package dockerfile
 
 import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/builder"
 	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/docker/builder/remotecontext"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/streamformatter"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestAddNodesForLabelOption(t *testing.T) {
@@ -32,3 +43,105 @@ func TestAddNodesForLabelOption(t *testing.T) {
 		assert.Equal(t, expected[i], v.Original)
 	}
 }
+
+func TestBuildChecksCopySourcesBeforePull(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	createTestTempFile(t, contextDir, "present", "present", 0644)
+	source, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	b := newBuilderWithMockBackend()
+	pulled := false
+	b.docker.(*MockBackend).getImageFunc = func(string) (builder.Image, builder.ReleaseableLayer, error) {
+		pulled = true
+		return &mockImage{id: "theid"}, &mockLayer{}, nil
+	}
+
+	dockerfile, err := parser.Parse(strings.NewReader("FROM busybox\nCOPY present /\nCOPY missing /\n"))
+	require.NoError(t, err)
+	_, err = b.build(source, dockerfile)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Dockerfile line 3")
+	assert.Contains(t, err.Error(), "missing")
+	assert.False(t, pulled, "expected the missing source to be reported before the base image is pulled")
+}
+
+func TestBuildEmitsCopyStats(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	require.NoError(t, os.MkdirAll(filepath.Join(contextDir, "dir", "sub"), 0755))
+	createTestTempFile(t, contextDir, "cached", "cached", 0644)
+	createTestTempFile(t, contextDir, "file", "hello", 0644)
+	createTestTempFile(t, contextDir, "dir/x", "12", 0644)
+	createTestTempFile(t, contextDir, "dir/sub/y", "345", 0644)
+	source, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	b := newBuilderWithMockBackend()
+	mockBackend := b.docker.(*MockBackend)
+	mockBackend.getImageFunc = func(string) (builder.Image, builder.ReleaseableLayer, error) {
+		return &mockImage{id: "base"}, &mockLayer{}, nil
+	}
+	mockBackend.containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+		return container.ContainerCreateCreatedBody{ID: "12345"}, nil
+	}
+	// Only the ADD is cached, as the cache is busted by the first miss.
+	mockBackend.makeImageCacheFunc = func(cacheFrom []string) builder.ImageCache {
+		return &mockImageCache{getCacheFunc: func(parentID string, cfg *container.Config) (string, error) {
+			if strings.Contains(strings.Join(cfg.Cmd, " "), "ADD") {
+				return "cached", nil
+			}
+			return "", nil
+		}}
+	}
+	b.imageProber = newImageProber(mockBackend, nil, false)
+	output := new(bytes.Buffer)
+	b.Aux = &streamformatter.AuxFormatter{Writer: output}
+
+	dockerfile, err := parser.Parse(strings.NewReader("FROM busybox\nADD cached /\nCOPY file /\nCOPY dir /dir/\n"))
+	require.NoError(t, err)
+	_, err = b.build(source, dockerfile)
+	require.NoError(t, err)
+
+	var messages []json.RawMessage
+	decoder := json.NewDecoder(output)
+	for decoder.More() {
+		var msg jsonmessage.JSONMessage
+		require.NoError(t, decoder.Decode(&msg))
+		require.NotNil(t, msg.Aux)
+		messages = append(messages, *msg.Aux)
+	}
+	require.Len(t, messages, 2)
+
+	var stats types.BuildCopyStats
+	require.NoError(t, json.Unmarshal(messages[0], &stats))
+	assert.Equal(t, 2, stats.Steps)
+	assert.Equal(t, 1, stats.Cached)
+	assert.Equal(t, 3, stats.Files)
+	assert.Equal(t, int64(10), stats.Size)
+	assert.True(t, stats.Duration > 0)
+
+	// The result of the build comes last.
+	var result types.BuildResult
+	require.NoError(t, json.Unmarshal(messages[1], &result))
+	assert.Equal(t, "cached", result.ID)
+}
+
+func TestCheckCopySourcesSkipsUncheckableInstructions(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	source, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	dockerfile, err := parser.Parse(strings.NewReader(`FROM busybox AS build
+ARG SRC=missing
+COPY ${SRC} /
+COPY --from=build /missing /
+FROM busybox AS final
+COPY missing /
+`))
+	require.NoError(t, err)
+	assert.NoError(t, checkCopySources(dockerfile, source, nil, "build"))
+	assert.Error(t, checkCopySources(dockerfile, source, nil, ""))
+}
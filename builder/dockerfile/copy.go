@@ -1,23 +1,40 @@
 package dockerfile
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/docker/docker/builder"
+	"github.com/docker/docker/builder/dockerfile/command"
+	"github.com/docker/docker/builder/dockerfile/parser"
 	"github.com/docker/docker/builder/remotecontext"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/fileutils"
+	"github.com/docker/docker/pkg/idtools"
 	"github.com/docker/docker/pkg/ioutils"
 	"github.com/docker/docker/pkg/progress"
 	"github.com/docker/docker/pkg/streamformatter"
 	"github.com/docker/docker/pkg/system"
 	"github.com/docker/docker/pkg/urlutil"
+	"github.com/docker/docker/registry"
+	"github.com/docker/go-units"
 	"github.com/pkg/errors"
 )
 
@@ -32,6 +49,9 @@ type copyInfo struct {
 	root string
 	path string
 	hash string
+	// parentDir is the directory below the destination the source is
+	// copied into, to preserve its leading directories (COPY --parents).
+	parentDir string
 }
 
 func newCopyInfoFromSource(source builder.Source, path string, hash string) copyInfo {
@@ -49,16 +69,167 @@ type copyInstruction struct {
 	infos                   []copyInfo
 	dest                    string
 	allowLocalDecompression bool
+	// extractDir makes the archives extracted into a directory of the
+	// destination named after them (ADD --extract-dir).
+	extractDir      bool
+	preserveParents bool
+	// sync makes the backend only write the files of the destination which
+	// differ from the source directory, and remove the others.
+	sync bool
+	// renames maps the files below the source directory to the paths they
+	// are copied to below the destination (COPY --map and --hash-names).
+	// The files it does not list keep their path, unless skipUnmatched is
+	// set.
+	renames       renameMap
+	skipUnmatched bool
+	// finalNewline is the pattern of the text files which were made to end
+	// with exactly one newline (COPY --final-newline), and textMode the
+	// flags telling which files are text (COPY --text and --binary).
+	finalNewline string
+	textMode     string
+	// capabilities are the file capabilities set on the copied files
+	// (COPY --cap).
+	capabilities string
+	// filter is the description of the filter of the copied files (COPY
+	// --max-size and --newer-than).
+	filter string
+	// manifest is the path of the manifest of the copied files in the
+	// image, and manifestInfo the staged manifest (COPY --manifest and
+	// --hash-names).
+	manifest     string
+	manifestInfo copyInfo
+	// checkSpace makes the copy fail before it starts if the sources do
+	// not fit in the space left in the container (COPY --check-space).
+	checkSpace bool
+	// ownership maps the IDs of the owners of the sources to the IDs of
+	// the owners of the copies, which are otherwise owned by root (COPY
+	// --uidmap and --gidmap), and ownershipMap are the flags it was
+	// parsed from.
+	ownership    *idtools.IDMappings
+	ownershipMap string
+	// dirMode is the mode of the directories created to hold the
+	// destination, 0 for the default of the backend (COPY --parent-mode).
+	dirMode os.FileMode
+	// skipIdentical makes the backend leave alone the files of the
+	// destination which already are copies of the source, so that they are
+	// not copied up into the layer (COPY --skip-identical).
+	skipIdentical bool
+	// verify lists the files the image must hold once the copy is done,
+	// with their digests (COPY --verify).
+	verify verifyManifest
 }
 
 // copier reads a raw COPY or ADD command, fetches remote sources using a downloader,
 // and creates a copyInstruction
 type copier struct {
-	imageSource *imageMount
-	source      builder.Source
-	pathCache   pathCache
-	download    sourceDownloader
-	tmpPaths    []string
+	imageSource     *imageMount
+	source          builder.Source
+	pathCache       pathCache
+	download        sourceDownloader
+	tmpPaths        []string
+	preserveParents bool
+	// strictSymlinks makes sources containing symlinks whose target does not
+	// exist in the source an error.
+	strictSymlinks bool
+	// excludes matches the paths excluded by the .dockerignore file of the
+	// build context. It is loaded on first use.
+	excludes       *fileutils.PatternMatcher
+	excludesLoaded bool
+	// explicitDotfiles makes wildcards only match the names starting with
+	// a dot if the pattern does as well, like in a shell.
+	explicitDotfiles bool
+	// fromArgs makes the sources the names of build args, whose values are
+	// provided by download.
+	fromArgs bool
+	// skipUnreadable makes walking the source skip the entries which cannot
+	// be read for lack of permissions, instead of failing.
+	skipUnreadable bool
+	// gitignore makes the files of the directories copied from the build
+	// context which are ignored by their .gitignore files excluded.
+	gitignore bool
+	// filter, if set, selects the files copied from the directories and
+	// wildcards of the sources.
+	filter *fileFilter
+	// preserveDirSymlinks makes the sources which are symlinks to
+	// directories and do not end with a slash copied as symlinks.
+	preserveDirSymlinks bool
+	// contentCacheKey makes the hashes of the sources only cover the
+	// paths and the content of their files, and not their mode or
+	// ownership.
+	contentCacheKey bool
+	// warnings receives the warnings about the directories copied with
+	// more than warnFiles files, or defaultCopyWarningThreshold if it is
+	// 0. Nothing is warned about if warnings is nil or warnFiles negative.
+	warnings  io.Writer
+	warnFiles int
+}
+
+// defaultCopyWarningThreshold is the number of files of a directory copied
+// by COPY or ADD above which the build warns that it may be copying more
+// than it needs, e.g. the .git directory of the build context.
+const defaultCopyWarningThreshold = 10000
+
+// fileFilter selects the files copied from directories and wildcards by
+// their size and modification time.
+type fileFilter struct {
+	// maxSize, if positive, is the size of the largest files copied.
+	maxSize int64
+	// newerThan, if not zero, makes only the files modified after it
+	// copied.
+	newerThan time.Time
+}
+
+// newFileFilter returns the filter of the values of the --max-size and
+// --newer-than flags, or nil if both are empty. The size is in bytes unless
+// it has a unit, e.g. "10M", and the time is a date, e.g. "2024-01-01",
+// taken in UTC, or an RFC 3339 timestamp.
+func newFileFilter(maxSize, newerThan, cmdName string) (*fileFilter, error) {
+	if maxSize == "" && newerThan == "" {
+		return nil, nil
+	}
+	f := &fileFilter{}
+	if maxSize != "" {
+		size, err := units.RAMInBytes(maxSize)
+		if err != nil || size <= 0 {
+			return nil, errors.Errorf("invalid value %q for %s --max-size: must be a positive size", maxSize, cmdName)
+		}
+		f.maxSize = size
+	}
+	if newerThan != "" {
+		t, err := time.Parse("2006-01-02", newerThan)
+		if err != nil {
+			if t, err = time.Parse(time.RFC3339Nano, newerThan); err != nil {
+				return nil, errors.Errorf("invalid value %q for %s --newer-than: must be a date or an RFC 3339 timestamp", newerThan, cmdName)
+			}
+		}
+		f.newerThan = t
+	}
+	return f, nil
+}
+
+// matches returns whether the file of info is copied. Directories always
+// are.
+func (f *fileFilter) matches(info os.FileInfo) bool {
+	if info.IsDir() {
+		return true
+	}
+	if f.maxSize > 0 && info.Size() > f.maxSize {
+		return false
+	}
+	return f.newerThan.IsZero() || info.ModTime().After(f.newerThan)
+}
+
+// String returns the flags of the filter, which are part of the cache key
+// of the copy.
+func (f *fileFilter) String() string {
+	var flags []string
+	if f.maxSize > 0 {
+		flags = append(flags, fmt.Sprintf("--max-size=%d", f.maxSize))
+	}
+	if !f.newerThan.IsZero() {
+		flags = append(flags, "--newer-than="+f.newerThan.UTC().Format(time.RFC3339Nano))
+	}
+	return strings.Join(flags, " ")
 }
 
 func copierFromDispatchRequest(req dispatchRequest, download sourceDownloader, imageSource *imageMount) copier {
@@ -67,13 +238,25 @@ func copierFromDispatchRequest(req dispatchRequest, download sourceDownloader, i
 		pathCache:   req.builder.pathCache,
 		download:    download,
 		imageSource: imageSource,
+		warnings:    req.builder.Stdout,
+		warnFiles:   req.builder.options.CopyWarningThreshold,
 	}
 }
 
+// contextCopierFromDispatchRequest returns a copier of the build context of
+// req, whatever the source of the copy, to read the files the flags of the
+// copy name, such as the mapping file of COPY --map.
+func contextCopierFromDispatchRequest(req dispatchRequest) *copier {
+	return &copier{source: req.source}
+}
+
 func (o *copier) createCopyInstruction(args []string, cmdName string) (copyInstruction, error) {
-	inst := copyInstruction{cmdName: cmdName}
+	inst := copyInstruction{cmdName: cmdName, preserveParents: o.preserveParents}
 	last := len(args) - 1
 
+	if args[last] == "" {
+		return inst, errors.Errorf("%s requires a non-empty destination", cmdName)
+	}
 	// Work in daemon-specific filepath semantics
 	inst.dest = filepath.FromSlash(args[last])
 
@@ -84,19 +267,462 @@ func (o *copier) createCopyInstruction(args []string, cmdName string) (copyInstr
 	if len(infos) > 1 && !strings.HasSuffix(inst.dest, string(os.PathSeparator)) {
 		return inst, errors.Errorf("When using %s with more than one source file, the destination must be a directory and end with a /", cmdName)
 	}
+	if inst.preserveParents && !strings.HasSuffix(inst.dest, string(os.PathSeparator)) {
+		return inst, errors.Errorf("When using %s --parents, the destination must be a directory and end with a /", cmdName)
+	}
 	inst.infos = infos
 	return inst, nil
 }
 
+// checkCopySources does a dry run of the COPY and ADD instructions of the
+// Dockerfile against source, so that missing sources, unreachable URLs and
+// invalid destinations are reported before any image is pulled or layer is
+// created. The instructions which depend on variables, on other stages or
+// on images, and those of the stages after target are left to the build.
+func checkCopySources(dockerfile *parser.Result, source builder.Source, pathCache pathCache, target string) error {
+	if source == nil {
+		return nil
+	}
+	shlex := NewShellLex(dockerfile.EscapeToken)
+	stageName := ""
+	for _, n := range dockerfile.AST.Children {
+		if n.Value == command.From {
+			if target != "" && strings.EqualFold(stageName, target) {
+				break
+			}
+			stageName, _ = parseBuildStageName(nodeWords(n))
+			continue
+		}
+		if n.Value != command.Copy && n.Value != command.Add {
+			continue
+		}
+		cmdName := strings.ToUpper(n.Value)
+		download := errOnSourceDownload
+		if n.Value == command.Add {
+			download = checkRemoteSource
+		}
+		o := &copier{source: source, pathCache: pathCache, download: download}
+		if !checkableCopyFlags(o, n.Flags) || strings.Contains(n.Original, "$") {
+			continue
+		}
+		processFunc := createProcessWordFunc(shlex, n.Value, nil)
+		var args []string
+		for _, word := range nodeWords(n) {
+			words, err := processFunc(word)
+			if err != nil {
+				return err
+			}
+			args = append(args, words...)
+		}
+		if len(args) < 2 {
+			return errAtLeastTwoArguments(cmdName)
+		}
+		_, err := o.createCopyInstruction(args, cmdName)
+		o.Cleanup()
+		if err != nil {
+			return errors.Wrapf(err, "Dockerfile line %d", n.StartLine)
+		}
+	}
+	return nil
+}
+
+// nodeWords returns the unprocessed arguments of the instruction n.
+func nodeWords(n *parser.Node) []string {
+	var words []string
+	for next := n.Next; next != nil; next = next.Next {
+		words = append(words, next.Value)
+	}
+	return words
+}
+
+// checkableCopyFlags configures o for the flags of a COPY or ADD instruction
+// and returns whether its sources can be checked before the build.
+func checkableCopyFlags(o *copier, flags []string) bool {
+	for _, flag := range flags {
+		name := strings.SplitN(strings.TrimPrefix(flag, "--"), "=", 2)[0]
+		switch name {
+		case "from", "from-args", "parents":
+			return false
+		case "skip-unreadable":
+			o.skipUnreadable = true
+		}
+	}
+	return true
+}
+
+// checkRemoteSource is a sourceDownloader which checks that srcURL is
+// reachable with a HEAD request, and provides an empty file in its place.
+// Servers which do not support HEAD requests are assumed to be reachable.
+func checkRemoteSource(srcURL string) (builder.Source, string, error) {
+	u, err := url.Parse(srcURL)
+	if err != nil {
+		return nil, "", err
+	}
+	filename := path.Base(u.Path)
+	if filename == "" || filename == "." || filename == "/" {
+		return nil, "", errors.Errorf("cannot determine filename from url: %s", u)
+	}
+	client, err := newDownloadClient(u)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := client.Head(srcURL)
+	if err != nil {
+		return nil, "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 && resp.StatusCode != http.StatusMethodNotAllowed && resp.StatusCode != http.StatusNotImplemented {
+		return nil, "", errors.Errorf("failed to HEAD %s: status code %d: %s", srcURL, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	return inlineSource(filename, "")
+}
+
+// renameMap maps the slash-separated paths of files below the source of
+// COPY --map to the paths they are copied to below the destination.
+type renameMap map[string]string
+
+// parseRenameMap parses a mapping file of COPY --map, which holds a
+// "<src> -> <dest>" pair per line. Empty lines and lines starting with "#"
+// are ignored.
+func parseRenameMap(r io.Reader) (renameMap, error) {
+	renames := make(renameMap)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "->", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("line %d: expected <src> -> <dest>, got %q", n, line)
+		}
+		var paths [2]string
+		for i, part := range parts {
+			p := path.Clean(strings.TrimSpace(part))
+			if p == "." || path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+				return nil, errors.Errorf("line %d: %q must be a relative path to a file below the directory", n, strings.TrimSpace(part))
+			}
+			paths[i] = p
+		}
+		if _, ok := renames[paths[0]]; ok {
+			return nil, errors.Errorf("line %d: %s is mapped more than once", n, paths[0])
+		}
+		renames[paths[0]] = paths[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return renames, nil
+}
+
+// loadRenameMap reads the mapping file name of COPY --map from the source.
+func (o *copier) loadRenameMap(name string) (renameMap, error) {
+	if o.source == nil {
+		return nil, errors.Errorf("missing build context")
+	}
+	fp, err := remotecontext.FullPath(o.source, name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the mapping file %s", name)
+	}
+	defer f.Close()
+	renames, err := parseRenameMap(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid mapping file %s", name)
+	}
+	return renames, nil
+}
+
+// checkRenameMap returns an error if inst does not copy a single directory
+// holding the files mapped by renames.
+func checkRenameMap(inst copyInstruction, renames renameMap) error {
+	if len(inst.infos) != 1 {
+		return errors.Errorf("%s --map requires a single source", inst.cmdName)
+	}
+	info := inst.infos[0]
+	src := filepath.Join(info.root, info.path)
+	if fi, err := os.Stat(src); err != nil || !fi.IsDir() {
+		return errors.Errorf("%s --map requires the source to be a directory", inst.cmdName)
+	}
+	var srcs []string
+	for p := range renames {
+		srcs = append(srcs, p)
+	}
+	sort.Strings(srcs)
+	for _, p := range srcs {
+		fi, err := os.Lstat(filepath.Join(src, filepath.FromSlash(p)))
+		if err != nil {
+			return errors.Errorf("%s --map failed: %s does not exist in %s", inst.cmdName, p, filepath.ToSlash(filepath.Clean(info.path)))
+		}
+		if fi.IsDir() {
+			return errors.Errorf("%s --map failed: %s is a directory, only files can be mapped", inst.cmdName, p)
+		}
+	}
+	return nil
+}
+
+// hash returns a hash of the mapping, for the cache.
+func (m renameMap) hash(skipUnmatched bool) string {
+	pairs := []string{fmt.Sprintf("skip-unmatched=%t", skipUnmatched)}
+	for src, dest := range m {
+		pairs = append(pairs, src+"->"+dest)
+	}
+	sort.Strings(pairs)
+	return hashStringSlice("map", pairs)
+}
+
+// binaryDetectionSize is how many bytes of a file are looked at to tell
+// whether it is binary, like git does.
+const binaryDetectionSize = 8000
+
+// looksBinary returns whether a file whose content is data is binary,
+// which is the case if it holds a NUL byte.
+func looksBinary(data []byte) bool {
+	if len(data) > binaryDetectionSize {
+		data = data[:binaryDetectionSize]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// matchesCopyPattern returns whether the file name, whose path in the source
+// is contextPath, is matched by pattern, either by its name or by its path.
+func matchesCopyPattern(pattern, name, contextPath string) bool {
+	matchBase, _ := filepath.Match(pattern, name)
+	matchPath, _ := path.Match(pattern, contextPath)
+	return matchBase || matchPath
+}
+
+// textMode tells which of the copied files are text, whose content may be
+// normalized, and which are binary, from comma-separated lists of patterns
+// of their names or paths (COPY --text and --binary). The binary patterns
+// take precedence. Once text patterns are given, the files they do not
+// match are binary; otherwise the files matching no pattern are detected
+// by their content.
+type textMode struct {
+	text   []string
+	binary []string
+}
+
+// parseTextMode parses the patterns of the text and the binary files. It
+// returns nil if there are none.
+func parseTextMode(text, binary string) (*textMode, error) {
+	if text == "" && binary == "" {
+		return nil, nil
+	}
+	mode := &textMode{}
+	for _, list := range []struct {
+		value    string
+		patterns *[]string
+	}{{text, &mode.text}, {binary, &mode.binary}} {
+		if list.value == "" {
+			continue
+		}
+		for _, pattern := range strings.Split(list.value, ",") {
+			if _, err := filepath.Match(pattern, ""); err != nil || pattern == "" {
+				return nil, errors.Errorf("invalid pattern %q", pattern)
+			}
+			*list.patterns = append(*list.patterns, pattern)
+		}
+	}
+	return mode, nil
+}
+
+// isText returns whether the file name, whose path in the source is
+// contextPath and whose content is data, is a text file.
+func (m *textMode) isText(name, contextPath string, data []byte) bool {
+	if m != nil {
+		for _, pattern := range m.binary {
+			if matchesCopyPattern(pattern, name, contextPath) {
+				return false
+			}
+		}
+		if len(m.text) > 0 {
+			for _, pattern := range m.text {
+				if matchesCopyPattern(pattern, name, contextPath) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return !looksBinary(data)
+}
+
+// String returns the flags the mode was parsed from, for the cache.
+func (m *textMode) String() string {
+	var flags []string
+	if len(m.text) > 0 {
+		flags = append(flags, "--text="+strings.Join(m.text, ","))
+	}
+	if len(m.binary) > 0 {
+		flags = append(flags, "--binary="+strings.Join(m.binary, ","))
+	}
+	return strings.Join(flags, " ")
+}
+
+// stageFinalNewlines returns infos with the sources holding text files
+// whose name or path matches pattern replaced by copies of them, in which
+// these files end with exactly one newline. Which files are text is told by
+// mode, which may be nil.
+func (o *copier) stageFinalNewlines(infos []copyInfo, pattern string, mode *textMode) ([]copyInfo, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, errors.Wrapf(err, "invalid pattern %q", pattern)
+	}
+	staged := make([]copyInfo, 0, len(infos))
+	for _, info := range infos {
+		tmpDir, err := ioutils.TempDir("", "docker-final-newline")
+		if err != nil {
+			return nil, err
+		}
+		o.tmpPaths = append(o.tmpPaths, tmpDir)
+
+		src := filepath.Join(info.root, info.path)
+		base := filepath.Base(info.path)
+		dst := filepath.Join(tmpDir, base)
+		fi, err := os.Stat(src)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		archiver := archive.NewDefaultArchiver()
+		if fi.IsDir() {
+			err = archiver.CopyWithTar(src, dst)
+		} else {
+			err = archiver.CopyFileWithTar(src, dst)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		err = filepath.Walk(dst, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(dst, p)
+			if err != nil {
+				return err
+			}
+			contextPath := filepath.ToSlash(filepath.Join(info.path, rel))
+			if !matchesCopyPattern(pattern, fi.Name(), contextPath) {
+				return nil
+			}
+			return normalizeFinalNewline(p, fi, func(data []byte) bool {
+				return mode.isText(fi.Name(), contextPath, data)
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+		staged = append(staged, copyInfo{root: tmpDir, path: base, hash: info.hash, parentDir: info.parentDir})
+	}
+	return staged, nil
+}
+
+// normalizeFinalNewline makes the file p end with exactly one newline if
+// isText tells it is a text file, keeping its mode and modification time.
+// Whether the newline is "\r\n" or "\n" depends on the last line ending of
+// the file. Empty files are left alone.
+func normalizeFinalNewline(p string, fi os.FileInfo, isText func(data []byte) bool) error {
+	data, err := ioutil.ReadFile(p)
+	if err != nil || len(data) == 0 || !isText(data) {
+		return err
+	}
+	trimmed := bytes.TrimRight(data, "\r\n")
+	eol := "\n"
+	if i := bytes.LastIndexByte(data, '\n'); i > 0 && data[i-1] == '\r' {
+		eol = "\r\n"
+	}
+	normalized := append(trimmed[:len(trimmed):len(trimmed)], eol...)
+	if bytes.Equal(normalized, data) {
+		return nil
+	}
+	if err := ioutil.WriteFile(p, normalized, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return system.Chtimes(p, fi.ModTime(), fi.ModTime())
+}
+
+// checkCaseCollisions returns an error listing the files placed below the
+// destination of inst whose paths only differ in case, as they overwrite
+// each other on a case-insensitive filesystem.
+func checkCaseCollisions(inst copyInstruction) error {
+	placed := make(map[string][]string)
+	place := func(p string) {
+		key := strings.ToLower(p)
+		for _, other := range placed[key] {
+			if other == p {
+				return
+			}
+		}
+		placed[key] = append(placed[key], p)
+	}
+
+	for _, info := range inst.infos {
+		src := filepath.Join(info.root, info.path)
+		fi, err := os.Lstat(src)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !fi.IsDir() {
+			place(filepath.Join(info.parentDir, filepath.Base(info.path)))
+			continue
+		}
+		// The content of directories is copied, not the directories.
+		err = filepath.Walk(src, func(path string, _ os.FileInfo, err error) error {
+			if err != nil || path == src {
+				return err
+			}
+			rel, err := filepath.Rel(src, path)
+			if err != nil {
+				return err
+			}
+			place(filepath.Join(info.parentDir, rel))
+			return nil
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	var collisions []string
+	for _, paths := range placed {
+		if len(paths) > 1 {
+			sort.Strings(paths)
+			collisions = append(collisions, strings.Join(paths, ", "))
+		}
+	}
+	if len(collisions) == 0 {
+		return nil
+	}
+	sort.Strings(collisions)
+	return errors.Errorf("%s failed: files only differing in case would overwrite each other: %s", inst.cmdName, strings.Join(collisions, "; "))
+}
+
 // getCopyInfosForSourcePaths iterates over the source files and calculate the info
 // needed to copy (e.g. hash value if cached)
 func (o *copier) getCopyInfosForSourcePaths(sources []string) ([]copyInfo, error) {
 	var infos []copyInfo
 	for _, orig := range sources {
+		var base string
+		if o.preserveParents {
+			var err error
+			if orig, base, err = splitParentsBase(orig); err != nil {
+				return nil, err
+			}
+		}
 		subinfos, err := o.getCopyInfoForSourcePath(orig)
 		if err != nil {
 			return nil, err
 		}
+		if o.preserveParents {
+			for i := range subinfos {
+				if subinfos[i].parentDir, err = o.parentDirOf(base, subinfos[i].path); err != nil {
+					return nil, err
+				}
+			}
+		}
 		infos = append(infos, subinfos...)
 	}
 
@@ -106,8 +732,50 @@ func (o *copier) getCopyInfosForSourcePaths(sources []string) ([]copyInfo, error
 	return infos, nil
 }
 
+// splitParentsBase splits a source of COPY --parents into the path to copy
+// and the base its leading directories are preserved from. The base is
+// marked with a "/./" component, e.g. "src/./app/main.go" is copied to
+// "<dest>/app/main.go". Without a marker, all leading directories are kept.
+func splitParentsBase(orig string) (string, string, error) {
+	slashed := filepath.ToSlash(orig)
+	i := strings.Index(slashed, "/./")
+	if i < 0 {
+		return orig, "", nil
+	}
+	base := slashed[:i]
+	if containsWildcards(base) {
+		return "", "", errors.Errorf("the base of %s must not contain wildcards", orig)
+	}
+	return filepath.FromSlash(slashed[:i] + slashed[i+2:]), filepath.FromSlash(base), nil
+}
+
+// parentDirOf returns the directory below the destination a source at path
+// is copied into when its leading directories from base are preserved.
+// The contents of a directory are copied into the directory itself.
+func (o *copier) parentDirOf(base, path string) (string, error) {
+	fi, err := remotecontext.StatAt(o.source, path)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Clean(string(os.PathSeparator) + path)
+	if !fi.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+	rel, err := filepath.Rel(filepath.Clean(string(os.PathSeparator)+base), dir)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return "", errors.Errorf("%s is outside of the base %s", path, base)
+	}
+	if rel == "." {
+		return "", nil
+	}
+	return rel, nil
+}
+
 func (o *copier) getCopyInfoForSourcePath(orig string) ([]copyInfo, error) {
-	if !urlutil.IsURL(orig) {
+	if !o.fromArgs && !urlutil.IsURL(orig) {
 		return o.calcCopyInfo(orig, true)
 	}
 	remote, path, err := o.download(orig)
@@ -161,7 +829,25 @@ func (o *copier) calcCopyInfo(origPath string, allowWildcards bool) ([]copyInfo,
 		return o.copyWithWildcards(origPath)
 	}
 
-	if imageSource != nil && imageSource.ImageID() != "" {
+	if o.strictSymlinks {
+		if err := checkSymlinks(o.source, origPath); err != nil {
+			return nil, err
+		}
+	}
+
+	// A trailing slash always designates the contents of the directory.
+	if o.preserveDirSymlinks && !strings.HasSuffix(origPath, string(os.PathSeparator)) {
+		info, ok, err := o.stageDirSymlink(origPath)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return newCopyInfos(info), nil
+		}
+	}
+
+	// The cached hashes are the ones of the unfiltered sources.
+	if imageSource != nil && imageSource.ImageID() != "" && o.filter == nil && !o.contentCacheKey {
 		// return a cached copy if one exists
 		if h, ok := o.pathCache.Load(imageSource.ImageID() + origPath); ok {
 			return newCopyInfos(newCopyInfoFromSource(o.source, origPath, h.(string))), nil
@@ -169,7 +855,7 @@ func (o *copier) calcCopyInfo(origPath string, allowWildcards bool) ([]copyInfo,
 	}
 
 	// Deal with the single file case
-	copyInfo, err := copyInfoForFile(o.source, origPath)
+	copyInfo, err := copyInfoForFile(o.hashedSource(), origPath)
 	switch {
 	case err != nil:
 		return nil, err
@@ -179,27 +865,193 @@ func (o *copier) calcCopyInfo(origPath string, allowWildcards bool) ([]copyInfo,
 	}
 
 	// TODO: remove, handle dirs in Hash()
-	subfiles, err := walkSource(o.source, origPath)
+	excludes, err := o.loadExcludes()
 	if err != nil {
 		return nil, err
 	}
+	subfiles, skipped, stats, err := walkSource(o.hashedSource(), origPath, excludes, o.skipper(origPath), o.skipUnreadable)
+	if err != nil {
+		return nil, err
+	}
+	o.warnLargeSource(origPath, stats)
 
+	// The skipped files are left out of the hash, so that changing them
+	// does not invalidate the cache.
 	hash := hashStringSlice("dir", subfiles)
+	if len(skipped) > 0 {
+		info, err := o.stageWithout(origPath, hash, skipped)
+		if err != nil {
+			return nil, err
+		}
+		return newCopyInfos(info), nil
+	}
 	o.storeInPathCache(imageSource, origPath, hash)
 	return newCopyInfos(newCopyInfoFromSource(o.source, origPath, hash)), nil
 }
 
+// skipFunc returns whether an entry of a directory being copied is left
+// out of the copy. rel is the path of the entry relative to the source.
+type skipFunc func(rel string, info os.FileInfo) (bool, error)
+
+// skipper returns the skipFunc of the copy of the directory origPath of the
+// source, or nil if every entry is copied.
+func (o *copier) skipper(origPath string) skipFunc {
+	var gitignore *gitignoreMatcher
+	if o.gitignore {
+		gitignore = newGitignoreMatcher(o.source, origPath)
+	}
+	filter := o.filter
+	if gitignore == nil && filter == nil {
+		return nil
+	}
+	return func(rel string, info os.FileInfo) (bool, error) {
+		if filter != nil && !filter.matches(info) {
+			logrus.Debugf("Skipping %s: filtered out by %s", filepath.ToSlash(rel), filter)
+			return true, nil
+		}
+		if gitignore != nil {
+			return gitignore.Matches(rel, info.IsDir())
+		}
+		return false, nil
+	}
+}
+
+// stageWithout returns the copyInfo of a copy of the directory origPath of
+// the source without the skipped paths, relative to the source.
+func (o *copier) stageWithout(origPath, hash string, skipped []string) (copyInfo, error) {
+	tmpDir, err := ioutils.TempDir("", "docker-copy-skipped")
+	if err != nil {
+		return copyInfo{}, err
+	}
+	o.tmpPaths = append(o.tmpPaths, tmpDir)
+
+	src, err := remotecontext.FullPath(o.source, origPath)
+	if err != nil {
+		return copyInfo{}, err
+	}
+	var patterns []string
+	for _, p := range skipped {
+		rel, err := filepath.Rel(origPath, p)
+		if err != nil {
+			return copyInfo{}, err
+		}
+		patterns = append(patterns, literalPattern(rel))
+	}
+	// The copy keeps the path of the directory, which COPY --parents
+	// depends on.
+	dst := filepath.Join(tmpDir, origPath)
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return copyInfo{}, err
+	}
+	tarStream, err := archive.TarWithOptions(src, &archive.TarOptions{ExcludePatterns: patterns})
+	if err != nil {
+		return copyInfo{}, err
+	}
+	defer tarStream.Close()
+	if err := archive.NewDefaultArchiver().Untar(tarStream, dst, &archive.TarOptions{}); err != nil {
+		return copyInfo{}, err
+	}
+	return copyInfo{root: tmpDir, path: origPath, hash: hash}, nil
+}
+
+// stageDirSymlink returns the copyInfo of a directory holding a copy of the
+// symlink origPath of the source, so that copying it creates the symlink in
+// the destination. ok is false if origPath is not a symlink to a directory.
+func (o *copier) stageDirSymlink(origPath string) (info copyInfo, ok bool, err error) {
+	dir, err := remotecontext.FullPath(o.source, filepath.Dir(origPath))
+	if err != nil {
+		return copyInfo{}, false, err
+	}
+	name := filepath.Base(origPath)
+	fullPath := filepath.Join(dir, name)
+	if fi, err := os.Lstat(fullPath); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		// Missing sources are reported by the copy.
+		return copyInfo{}, false, nil
+	}
+	if fi, err := remotecontext.StatAt(o.source, origPath); err != nil || !fi.IsDir() {
+		return copyInfo{}, false, nil
+	}
+	target, err := os.Readlink(fullPath)
+	if err != nil {
+		return copyInfo{}, false, errors.WithStack(err)
+	}
+
+	tmpDir, err := ioutils.TempDir("", "docker-dir-symlink")
+	if err != nil {
+		return copyInfo{}, false, err
+	}
+	o.tmpPaths = append(o.tmpPaths, tmpDir)
+	if err := os.Symlink(target, filepath.Join(tmpDir, name)); err != nil {
+		return copyInfo{}, false, errors.WithStack(err)
+	}
+	// The link is copied as the only entry of the directory, so the
+	// target is never followed.
+	hash := hashStringSlice("symlink", []string{name, target})
+	return copyInfo{root: tmpDir, path: ".", hash: hash}, true, nil
+}
+
+// loadExcludes returns the matcher of the .dockerignore file of the build
+// context, or nil when copying from an image or if there is none.
+func (o *copier) loadExcludes() (*fileutils.PatternMatcher, error) {
+	if o.imageSource != nil || o.excludesLoaded {
+		return o.excludes, nil
+	}
+	patterns, err := remotecontext.ReadDockerignore(o.source)
+	if err != nil {
+		return nil, err
+	}
+	if len(patterns) > 0 {
+		if o.excludes, err = fileutils.NewPatternMatcher(patterns); err != nil {
+			return nil, err
+		}
+	}
+	o.excludesLoaded = true
+	return o.excludes, nil
+}
+
+// isExcluded returns whether rel is excluded by excludes, and logs the
+// pattern excluding it.
+func isExcluded(excludes *fileutils.PatternMatcher, rel string) (bool, error) {
+	if excludes == nil {
+		return false, nil
+	}
+	pattern, err := excludes.MatchingPattern(rel)
+	if err != nil || pattern == nil {
+		return false, err
+	}
+	logrus.Debugf("Skipping %s: excluded by .dockerignore pattern %q", filepath.ToSlash(rel), pattern.String())
+	return true, nil
+}
+
+// hashedSource returns the source the hashes of the sources are computed
+// from.
+func (o *copier) hashedSource() builder.Source {
+	if o.contentCacheKey {
+		return contentHashSource{o.source}
+	}
+	return o.source
+}
+
+// storeInPathCache caches the hash of the source path of the image im. The
+// hash only covers the source, so the flags of the instruction are not part
+// of the key: those changing the copied files are part of the cache key of
+// the instruction instead (see performCopy).
 func (o *copier) storeInPathCache(im *imageMount, path string, hash string) {
-	if im != nil {
+	// The cached hashes are the ones of the default cache key.
+	if im != nil && !o.contentCacheKey {
 		o.pathCache.Store(im.ImageID()+path, hash)
 	}
 }
 
 func (o *copier) copyWithWildcards(origPath string) ([]copyInfo, error) {
+	excludes, err := o.loadExcludes()
+	if err != nil {
+		return nil, err
+	}
 	var copyInfos []copyInfo
 	if err := filepath.Walk(o.source.Root(), func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			return err
+			return handleWalkError(o.source, path, info, err, o.skipUnreadable)
 		}
 		rel, err := remotecontext.Rel(o.source.Root(), path)
 		if err != nil {
@@ -212,6 +1064,16 @@ func (o *copier) copyWithWildcards(origPath string) ([]copyInfo, error) {
 		if match, _ := filepath.Match(origPath, rel); !match {
 			return nil
 		}
+		if o.explicitDotfiles && !matchesDotfiles(origPath, rel) {
+			return nil
+		}
+		if excluded, err := isExcluded(excludes, rel); err != nil || excluded {
+			return err
+		}
+		if o.filter != nil && !o.filter.matches(info) {
+			logrus.Debugf("Skipping %s: filtered out by %s", filepath.ToSlash(rel), o.filter)
+			return nil
+		}
 
 		// Note we set allowWildcards to false in case the name has
 		// a * in it
@@ -227,6 +1089,20 @@ func (o *copier) copyWithWildcards(origPath string) ([]copyInfo, error) {
 	return copyInfos, nil
 }
 
+// matchesDotfiles returns whether each component of rel starting with a dot
+// is matched by a component of pattern which starts with a dot as well.
+// pattern must match rel.
+func matchesDotfiles(pattern, rel string) bool {
+	patternParts := strings.Split(pattern, string(os.PathSeparator))
+	relParts := strings.Split(rel, string(os.PathSeparator))
+	for i, part := range relParts {
+		if strings.HasPrefix(part, ".") && (i >= len(patternParts) || !strings.HasPrefix(patternParts[i], ".")) {
+			return false
+		}
+	}
+	return true
+}
+
 func copyInfoForFile(source builder.Source, path string) (copyInfo, error) {
 	fi, err := remotecontext.StatAt(source, path)
 	if err != nil {
@@ -236,6 +1112,8 @@ func copyInfoForFile(source builder.Source, path string) (copyInfo, error) {
 	if fi.IsDir() {
 		return copyInfo{}, nil
 	}
+	// The hash covers the tar header of the file as well as its content, so
+	// a change of mode or ownership alone also invalidates the cache.
 	hash, err := source.Hash(path)
 	if err != nil {
 		return copyInfo{}, err
@@ -243,17 +1121,130 @@ func copyInfoForFile(source builder.Source, path string) (copyInfo, error) {
 	return newCopyInfoFromSource(source, path, "file:"+hash), nil
 }
 
+// contentHashSource is a builder.Source whose hashes only cover the path, the
+// type and the content of the files, unlike those of the build contexts which
+// also cover their mode and ownership (COPY --cache-key=content).
+type contentHashSource struct {
+	builder.Source
+}
+
+// Hash returns the hash of the file at path, following symlinks as the
+// build contexts do.
+func (s contentHashSource) Hash(path string) (string, error) {
+	fullPath, err := remotecontext.FullPath(s.Source, path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := remotecontext.Rel(s.Root(), fullPath)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Lstat(fullPath)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	typ := "other"
+	switch {
+	case fi.Mode().IsRegular():
+		typ = "file"
+	case fi.IsDir():
+		typ = "dir"
+	}
+	fmt.Fprintf(h, "%s\x00%s\x00", filepath.ToSlash(rel), typ)
+	if fi.Mode().IsRegular() {
+		f, err := os.Open(fullPath)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		if _, err := io.Copy(h, f); err != nil {
+			return "", errors.Wrapf(err, "failed to hash %s", filepath.ToSlash(rel))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkSymlinks returns an error naming the first symlink at or below path
+// in source whose target does not exist in source.
+func checkSymlinks(source builder.Source, path string) error {
+	checkSymlink := func(fullPath string) error {
+		rel, err := remotecontext.Rel(source.Root(), fullPath)
+		if err != nil {
+			return err
+		}
+		if _, err := remotecontext.StatAt(source, rel); err != nil {
+			target, _ := os.Readlink(fullPath)
+			return errors.Errorf("%s is a broken symlink: its target %s does not exist in the source", filepath.ToSlash(rel), target)
+		}
+		return nil
+	}
+
+	if fi, err := os.Lstat(filepath.Join(source.Root(), path)); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		if err := checkSymlink(filepath.Join(source.Root(), path)); err != nil {
+			return err
+		}
+	}
+	fp, err := remotecontext.FullPath(source, path)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(fp, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Sources which do not exist are reported by the copy.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		return checkSymlink(path)
+	})
+}
+
+// handleWalkError returns the error to return from a walk of source for
+// err, which occurred while walking path. If skipUnreadable is set and err
+// is a permission error, the entry is skipped with a warning instead.
+func handleWalkError(source builder.Source, path string, info os.FileInfo, err error, skipUnreadable bool) error {
+	if !skipUnreadable || !os.IsPermission(err) {
+		return err
+	}
+	if rel, relErr := remotecontext.Rel(source.Root(), path); relErr == nil {
+		path = rel
+	}
+	logrus.Warnf("Skipping %s: %v", filepath.ToSlash(path), err)
+	if info != nil && info.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// sourceStats counts the regular files walked by walkSource, and their size.
+type sourceStats struct {
+	files int
+	size  int64
+}
+
+// walkSource returns the hashes of the files below origPath in source,
+// skipping the paths matched by excludes, and the unreadable ones if
+// skipUnreadable is set. It also returns the paths, relative to source,
+// skipped by skip, if it is not nil, which are not hashed, and the stats of
+// the files hashed.
 // TODO: dedupe with copyWithWildcards()
-func walkSource(source builder.Source, origPath string) ([]string, error) {
+func walkSource(source builder.Source, origPath string, excludes *fileutils.PatternMatcher, skip skipFunc, skipUnreadable bool) ([]string, []string, sourceStats, error) {
+	var stats sourceStats
 	fp, err := remotecontext.FullPath(source, origPath)
 	if err != nil {
-		return nil, err
+		return nil, nil, stats, err
 	}
 	// Must be a dir
-	var subfiles []string
+	var subfiles, skipped []string
 	err = filepath.Walk(fp, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			return err
+			return handleWalkError(source, path, info, err, skipUnreadable)
 		}
 		rel, err := remotecontext.Rel(source.Root(), path)
 		if err != nil {
@@ -262,20 +1253,62 @@ func walkSource(source builder.Source, origPath string) ([]string, error) {
 		if rel == "." {
 			return nil
 		}
+		if excluded, err := isExcluded(excludes, rel); err != nil {
+			return err
+		} else if excluded {
+			// Paths below an excluded directory can be included again
+			// by an exclusion pattern.
+			if info.IsDir() && !excludes.Exclusions() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if skip != nil {
+			if skipEntry, err := skip(rel, info); err != nil {
+				return err
+			} else if skipEntry {
+				skipped = append(skipped, rel)
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
 		hash, err := source.Hash(rel)
 		if err != nil {
 			return nil
 		}
 		// we already checked handleHash above
 		subfiles = append(subfiles, hash)
+		if info.Mode().IsRegular() {
+			stats.files++
+			stats.size += info.Size()
+		}
 		return nil
 	})
 	if err != nil {
-		return nil, err
+		return nil, nil, stats, err
 	}
 
 	sort.Strings(subfiles)
-	return subfiles, nil
+	return subfiles, skipped, stats, nil
+}
+
+// warnLargeSource warns if the directory origPath of the source, whose
+// files stats counts, holds more files than the threshold of the copy.
+func (o *copier) warnLargeSource(origPath string, stats sourceStats) {
+	threshold := o.warnFiles
+	if threshold == 0 {
+		threshold = defaultCopyWarningThreshold
+	}
+	if o.warnings == nil || threshold < 0 || stats.files <= threshold {
+		return
+	}
+	if origPath == "" {
+		origPath = "."
+	}
+	fmt.Fprintf(o.warnings, "[Warning] %s holds %d files (%s), consider excluding the files the build does not need with a .dockerignore file\n",
+		filepath.ToSlash(origPath), stats.files, units.HumanSize(float64(stats.size)))
 }
 
 type sourceDownloader func(string) (builder.Source, string, error)
@@ -290,6 +1323,101 @@ func errOnSourceDownload(_ string) (builder.Source, string, error) {
 	return nil, "", errors.New("source can't be a URL for COPY")
 }
 
+// newBuildArgSourceProvider returns a sourceDownloader which provides the
+// value of a build arg as a file named after it.
+func newBuildArgSourceProvider(args *buildArgs) sourceDownloader {
+	return func(name string) (builder.Source, string, error) {
+		if name == "" || filepath.Base(name) != name {
+			return nil, "", errors.Errorf("invalid build arg name %q", name)
+		}
+		value, ok := args.GetAllAllowed()[name]
+		if !ok {
+			return nil, "", errors.Errorf("build arg %s is not defined", name)
+		}
+		return inlineSource(name, value)
+	}
+}
+
+// inlineSource returns a source holding a single file name with content.
+// The file has a fixed mode and modification time, so that its hash only
+// depends on its name and content.
+func inlineSource(name, content string) (remote builder.Source, p string, err error) {
+	tmpDir, err := ioutils.TempDir("", "docker-inline")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+	tmpFileName := filepath.Join(tmpDir, name)
+	if err = ioutil.WriteFile(tmpFileName, []byte(content), 0644); err != nil {
+		return
+	}
+	if err = os.Chmod(tmpFileName, 0644); err != nil {
+		return
+	}
+	if err = system.Chtimes(tmpFileName, time.Time{}, time.Time{}); err != nil {
+		return
+	}
+	lc, err := remotecontext.NewLazyContext(tmpDir)
+	return lc, name, err
+}
+
+// newDownloadClient returns the client to download u with, which uses the
+// proxy settings of the daemon and trusts the CA certificates configured
+// for the host of u in the same way as for registries. The redirects it
+// follows are checked with checkDownloadRedirect.
+func newDownloadClient(u *url.URL) (*http.Client, error) {
+	var tlsConfig *tls.Config
+	if u.Scheme == "https" {
+		var err error
+		if tlsConfig, err = registry.NewHostTLSConfig(u.Host); err != nil {
+			return nil, errors.Wrapf(err, "failed to load the certificates of %s", u.Host)
+		}
+	}
+	return &http.Client{
+		Transport:     registry.NewTransport(tlsConfig),
+		CheckRedirect: checkDownloadRedirect,
+	}, nil
+}
+
+// maxDownloadRedirects is the maximum number of redirects followed to
+// download a remote source.
+const maxDownloadRedirects = 10
+
+// checkDownloadRedirect checks each redirect followed to download a remote
+// source, whose Location is resolved against the URL of the request it
+// answers, even if it is relative. Only http and https URLs are followed,
+// and redirects from https to http are refused as the request would then
+// be sent in clear.
+func checkDownloadRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > maxDownloadRedirects {
+		return errors.Errorf("stopped after %d redirects", maxDownloadRedirects)
+	}
+	prev := via[len(via)-1].URL
+	switch req.URL.Scheme {
+	case "https":
+	case "http":
+		if prev.Scheme == "https" {
+			return errors.Errorf("refusing the redirect from %s to %s: it would downgrade https to http", prev, req.URL)
+		}
+	default:
+		return errors.Errorf("refusing the redirect from %s to %s: only http and https URLs are supported", prev, req.URL)
+	}
+	logrus.Debugf("[BUILDER] following the redirect from %s to %s", prev, req.URL)
+	return nil
+}
+
+// manifestMediaType is the content type of the responses of remote sources
+// which list the URLs of a set of files to download, as a JSON array.
+// Relative URLs are resolved against the URL of the manifest.
+const manifestMediaType = "application/vnd.docker.build.manifest.v1+json"
+
+// maxManifestSize is the maximum size of a manifest of remote files.
+const maxManifestSize = 1 << 20
+
 func downloadSource(output io.Writer, stdout io.Writer, srcURL string) (remote builder.Source, p string, err error) {
 	u, err := url.Parse(srcURL)
 	if err != nil {
@@ -301,10 +1429,15 @@ func downloadSource(output io.Writer, stdout io.Writer, srcURL string) (remote b
 		return
 	}
 
-	resp, err := remotecontext.GetWithStatusError(srcURL)
+	client, err := newDownloadClient(u)
 	if err != nil {
 		return
 	}
+	resp, err := remotecontext.ClientGetWithStatusError(client, srcURL)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
 
 	// Prepare file in a tmp dir
 	tmpDir, err := ioutils.TempDir("", "docker-remote")
@@ -316,22 +1449,92 @@ func downloadSource(output io.Writer, stdout io.Writer, srcURL string) (remote b
 			os.RemoveAll(tmpDir)
 		}
 	}()
-	tmpFileName := filepath.Join(tmpDir, filename)
-	tmpFile, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+
+	// A manifest is downloaded as a directory holding the files it lists,
+	// whose content is copied like the one of any other directory.
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == manifestMediaType {
+		err = downloadManifest(output, u, resp.Body, filepath.Join(tmpDir, filename))
+	} else {
+		err = saveDownload(output, resp, filepath.Join(tmpDir, filename))
+	}
 	if err != nil {
 		return
 	}
+	// TODO: how important is this random blank line to the output?
+	fmt.Fprintln(stdout)
+
+	lc, err := remotecontext.NewLazyContext(tmpDir)
+	return lc, filename, err
+}
+
+// downloadManifest downloads the files listed by the manifest read from
+// body, which was downloaded from u, into the directory dir.
+func downloadManifest(output io.Writer, u *url.URL, body io.Reader, dir string) error {
+	var refs []string
+	if err := json.NewDecoder(io.LimitReader(body, maxManifestSize)).Decode(&refs); err != nil {
+		return errors.Wrapf(err, "failed to read the manifest of %s", u)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+
+	// The manifest is checked before anything is downloaded.
+	var names []string
+	fileURLs := make(map[string]*url.URL)
+	for _, ref := range refs {
+		fileURL, err := u.Parse(ref)
+		if err != nil {
+			return errors.Wrapf(err, "invalid URL %q in the manifest of %s", ref, u)
+		}
+		if fileURL.Scheme != "http" && fileURL.Scheme != "https" {
+			return errors.Errorf("invalid URL %q in the manifest of %s: only http and https URLs are supported", ref, u)
+		}
+		name := path.Base(fileURL.Path)
+		if name == "" || name == "." || name == "/" || name == ".." {
+			return errors.Errorf("cannot determine filename from url %q in the manifest of %s", ref, u)
+		}
+		if other, ok := fileURLs[name]; ok {
+			return errors.Errorf("the manifest of %s lists several files named %s: %s and %s", u, name, other, fileURL)
+		}
+		names = append(names, name)
+		fileURLs[name] = fileURL
+	}
+
+	for _, name := range names {
+		fileURL := fileURLs[name]
+		client, err := newDownloadClient(fileURL)
+		if err != nil {
+			return err
+		}
+		resp, err := remotecontext.ClientGetWithStatusError(client, fileURL.String())
+		if err != nil {
+			return err
+		}
+		err = saveDownload(output, resp, filepath.Join(dir, filepath.FromSlash(name)))
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return system.Chtimes(dir, time.Time{}, time.Time{})
+}
+
+// saveDownload writes the body of resp to the file p, whose mtime is set to
+// the Last-Modified header of resp if present.
+func saveDownload(output io.Writer, resp *http.Response, p string) error {
+	tmpFile, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
 
 	progressOutput := streamformatter.NewJSONProgressOutput(output, true)
 	progressReader := progress.NewProgressReader(resp.Body, progressOutput, resp.ContentLength, "", "Downloading")
 	// Download and dump result to tmp file
 	// TODO: add filehash directly
-	if _, err = io.Copy(tmpFile, progressReader); err != nil {
+	if _, err := io.Copy(tmpFile, progressReader); err != nil {
 		tmpFile.Close()
-		return
+		return err
 	}
-	// TODO: how important is this random blank line to the output?
-	fmt.Fprintln(stdout)
 
 	// Set the mtime to the Last-Modified header value if present
 	// Otherwise just remove atime and mtime
@@ -348,10 +1551,5 @@ func downloadSource(output io.Writer, stdout io.Writer, srcURL string) (remote b
 
 	tmpFile.Close()
 
-	if err = system.Chtimes(tmpFileName, mTime, mTime); err != nil {
-		return
-	}
-
-	lc, err := remotecontext.NewLazyContext(tmpDir)
-	return lc, filename, err
+	return system.Chtimes(p, mTime, mTime)
 }
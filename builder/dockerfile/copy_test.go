@@ -0,0 +1,198 @@
+package dockerfile
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// trustServerCA makes the downloads trust the certificate of server, and
+// returns the function restoring the configured CAs.
+func trustServerCA(t *testing.T, server *httptest.Server) func() {
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	certsDir, err := ioutil.TempDir("", "builder-certs")
+	require.NoError(t, err)
+	hostDir := filepath.Join(certsDir, u.Host)
+	require.NoError(t, os.MkdirAll(hostDir, 0755))
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.TLS.Certificates[0].Certificate[0]})
+	require.NoError(t, ioutil.WriteFile(filepath.Join(hostDir, "ca.crt"), ca, 0644))
+
+	oldCertsDir := registry.CertsDir
+	registry.CertsDir = certsDir
+	return func() {
+		registry.CertsDir = oldCertsDir
+		os.RemoveAll(certsDir)
+	}
+}
+
+func TestDownloadSourceTrustsConfiguredCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "internal artifact")
+	}))
+	defer server.Close()
+
+	_, _, err := downloadSource(ioutil.Discard, ioutil.Discard, server.URL+"/artifact")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "certificate")
+
+	defer trustServerCA(t, server)()
+	source, filename, err := downloadSource(ioutil.Discard, ioutil.Discard, server.URL+"/artifact")
+	require.NoError(t, err)
+	defer os.RemoveAll(source.Root())
+	assert.Equal(t, "artifact", filename)
+	data, err := ioutil.ReadFile(filepath.Join(source.Root(), filename))
+	require.NoError(t, err)
+	assert.Equal(t, "internal artifact", string(data))
+}
+
+func TestDownloadSourceManifest(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/deps/manifest.json":
+			w.Header().Set("Content-Type", manifestMediaType)
+			fmt.Fprintf(w, `["lib.so", "../tools/tool", "%s/other/data.txt"]`, server.URL)
+		case "/deps/lib.so", "/tools/tool", "/other/data.txt":
+			fmt.Fprintf(w, "content of %s", r.URL.Path)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	source, filename, err := downloadSource(ioutil.Discard, ioutil.Discard, server.URL+"/deps/manifest.json")
+	require.NoError(t, err)
+	defer os.RemoveAll(source.Root())
+
+	dir := filepath.Join(source.Root(), filename)
+	fi, err := os.Stat(dir)
+	require.NoError(t, err)
+	assert.True(t, fi.IsDir())
+	for name, path := range map[string]string{"lib.so": "/deps/lib.so", "tool": "/tools/tool", "data.txt": "/other/data.txt"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.Equal(t, "content of "+path, string(data))
+	}
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+}
+
+func TestDownloadSourceInvalidManifest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", manifestMediaType)
+		switch r.URL.Path {
+		case "/duplicate.json":
+			fmt.Fprint(w, `["a/file", "b/file"]`)
+		case "/missing.json":
+			fmt.Fprint(w, `["missing"]`)
+		case "/scheme.json":
+			fmt.Fprint(w, `["file:///etc/passwd"]`)
+		case "/invalid.json":
+			fmt.Fprint(w, `{"files": []}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	for manifest, expected := range map[string]string{
+		"duplicate.json": "lists several files named file",
+		"missing.json":   "404",
+		"scheme.json":    "only http and https URLs are supported",
+		"invalid.json":   "failed to read the manifest",
+	} {
+		_, _, err := downloadSource(ioutil.Discard, ioutil.Discard, server.URL+"/"+manifest)
+		if assert.Error(t, err, manifest) {
+			assert.Contains(t, err.Error(), expected, manifest)
+		}
+	}
+}
+
+func TestDownloadSourceRedirects(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "plain artifact")
+	}))
+	defer plain.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n int
+		switch {
+		case r.URL.Path == "/start":
+			// Relative redirects are resolved against the current hop.
+			http.Redirect(w, r, "dir/next", http.StatusFound)
+		case r.URL.Path == "/dir/next":
+			w.Header().Set("Location", "../final")
+			w.WriteHeader(http.StatusMovedPermanently)
+		case r.URL.Path == "/final":
+			fmt.Fprint(w, "redirected artifact")
+		case r.URL.Path == "/file":
+			http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+		case r.URL.Path == "/plain":
+			http.Redirect(w, r, plain.URL+"/artifact", http.StatusFound)
+		default:
+			if _, err := fmt.Sscanf(r.URL.Path, "/loop/%d", &n); err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			if n == 0 {
+				fmt.Fprint(w, "looped artifact")
+				return
+			}
+			http.Redirect(w, r, fmt.Sprintf("/loop/%d", n-1), http.StatusFound)
+		}
+	}))
+	defer server.Close()
+
+	for _, testcase := range []struct {
+		path, filename, content, err string
+	}{
+		{path: "/start", filename: "start", content: "redirected artifact"},
+		// Redirects to another http server are followed.
+		{path: "/plain", filename: "plain", content: "plain artifact"},
+		{path: "/file", err: "only http and https URLs are supported"},
+		// Up to 10 redirects are followed.
+		{path: "/loop/10", filename: "10", content: "looped artifact"},
+		{path: "/loop/11", err: "stopped after 10 redirects"},
+	} {
+		source, filename, err := downloadSource(ioutil.Discard, ioutil.Discard, server.URL+testcase.path)
+		if testcase.err != "" {
+			if assert.Error(t, err, testcase.path) {
+				assert.Contains(t, err.Error(), testcase.err, testcase.path)
+			}
+			continue
+		}
+		require.NoError(t, err, testcase.path)
+		defer os.RemoveAll(source.Root())
+		assert.Equal(t, testcase.filename, filename, testcase.path)
+		data, err := ioutil.ReadFile(filepath.Join(source.Root(), filename))
+		require.NoError(t, err)
+		assert.Equal(t, testcase.content, string(data), testcase.path)
+	}
+}
+
+func TestDownloadSourceRedirectDowngrade(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "plain artifact")
+	}))
+	defer plain.Close()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, plain.URL+"/artifact", http.StatusFound)
+	}))
+	defer server.Close()
+	defer trustServerCA(t, server)()
+
+	_, _, err := downloadSource(ioutil.Discard, ioutil.Discard, server.URL+"/artifact")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "it would downgrade https to http")
+}
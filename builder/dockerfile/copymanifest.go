@@ -0,0 +1,111 @@
+package dockerfile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/pkg/ioutils"
+	"github.com/docker/docker/pkg/symlink"
+	"github.com/pkg/errors"
+)
+
+// stageManifest adds to inst the manifest of the files it copies, to be
+// written at the path manifest of the image (COPY --manifest). The manifest
+// lists the sha256 digest and the absolute path in the image of each copied
+// regular file, sorted by path, in the format of sha256sum(1), so that
+// "sha256sum -c" checks them. The destination of inst must be a directory.
+func (o *copier) stageManifest(inst *copyInstruction, manifest, workingDir string) error {
+	if !strings.HasSuffix(inst.dest, string(os.PathSeparator)) {
+		return errors.New("the destination must be a directory and end with a /")
+	}
+	if strings.HasSuffix(manifest, "/") {
+		return errors.Errorf("%s is not a file path", manifest)
+	}
+	dest, err := normaliseDest(inst.cmdName, workingDir, inst.dest)
+	if err != nil {
+		return err
+	}
+
+	digests := make(map[string]string)
+	for _, info := range inst.infos {
+		infoDest := dest
+		if info.parentDir != "" {
+			infoDest = filepath.Join(dest, info.parentDir)
+		}
+		// Like the copy, follow the source if it is a symlink.
+		src, err := symlink.FollowSymlinkInScope(filepath.Join(info.root, info.path), info.root)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(src)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !fi.IsDir() {
+			target := filepath.Join(infoDest, filepath.Base(info.path))
+			if digests[target], err = fileDigest(src); err != nil {
+				return err
+			}
+			continue
+		}
+		err = filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(src, p)
+			if err != nil {
+				return err
+			}
+			digests[filepath.Join(infoDest, rel)], err = fileDigest(p)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	paths := make([]string, 0, len(digests))
+	for p := range digests {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var content []byte
+	for _, p := range paths {
+		content = append(content, fmt.Sprintf("%s  %s\n", digests[p], filepath.ToSlash(p))...)
+	}
+
+	tmpDir, err := ioutils.TempDir("", "docker-copy-manifest")
+	if err != nil {
+		return err
+	}
+	o.tmpPaths = append(o.tmpPaths, tmpDir)
+	name := filepath.Base(filepath.FromSlash(manifest))
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, name), content, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	inst.manifest = manifest
+	inst.manifestInfo = copyInfo{root: tmpDir, path: name}
+	return nil
+}
+
+// fileDigest returns the hex-encoded sha256 digest of the content of the file
+// at path.
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errors.Wrapf(err, "failed to read %s", path)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
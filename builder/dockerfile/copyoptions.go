@@ -0,0 +1,293 @@
+package dockerfile
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/docker/docker/pkg/urlutil"
+	"github.com/pkg/errors"
+)
+
+const (
+	// dotfilesAll makes wildcards match names starting with a dot, as
+	// filepath.Match does. It is the default.
+	dotfilesAll = "all"
+	// dotfilesExplicit makes wildcards only match names starting with a
+	// dot if the pattern starts with a dot as well, as in a shell.
+	dotfilesExplicit = "explicit"
+)
+
+const (
+	// dirSymlinksFollow makes COPY copy the contents of the directory a
+	// source symlink points to, with or without a trailing slash. It is the
+	// default.
+	dirSymlinksFollow = "follow"
+	// dirSymlinksPreserve makes COPY copy a source symlink to a directory
+	// as a symlink into the destination, unless the source ends with a
+	// slash.
+	dirSymlinksPreserve = "preserve"
+)
+
+const (
+	// cacheKeyFull makes the cache key of COPY cover the paths, the content,
+	// the mode and the ownership of the files. It is the default.
+	cacheKeyFull = "full"
+	// cacheKeyContent makes the cache key of COPY only cover the paths and
+	// the content of the files.
+	cacheKeyContent = "content"
+)
+
+const (
+	// mapUnmatchedCopy makes COPY --map copy the files the mapping does not
+	// list with their path. It is the default.
+	mapUnmatchedCopy = "copy"
+	// mapUnmatchedSkip makes COPY --map only copy the files the mapping
+	// lists.
+	mapUnmatchedSkip = "skip"
+)
+
+// copyOptions are the flags of a COPY or ADD instruction, once parsed and
+// checked to be usable together. The flags the instruction does not have
+// are left to their zero value.
+type copyOptions struct {
+	explicitDotfiles bool
+	skipUnreadable   bool
+
+	// Flags of ADD.
+	noExtract  bool
+	extractDir bool
+	tarIndex   string
+	tarMembers []string
+
+	// Flags of COPY.
+	from                *Flag
+	fromArgs            bool
+	parents             bool
+	sync                bool
+	strictSymlinks      bool
+	strictCase          bool
+	gitignore           bool
+	filter              *fileFilter
+	preserveDirSymlinks bool
+	contentCacheKey     bool
+	renameMap           string
+	skipUnmatched       bool
+	finalNewline        string
+	textModes           *textMode
+	capabilities        string
+	fileCaps            fileCapabilities
+	manifest            string
+	hashNames           string
+	verify              string
+	checkSpace          bool
+	ownership           *idtools.IDMappings
+	ownershipMap        string
+	dirMode             os.FileMode
+	skipIdentical       bool
+}
+
+// parseAddOptions parses the flags of the ADD instruction of req.
+func parseAddOptions(req dispatchRequest) (*copyOptions, error) {
+	flDotfiles := req.flags.AddString("dotfiles", dotfilesAll)
+	flSkipUnreadable := req.flags.AddBool("skip-unreadable", false)
+	flNoExtract := req.flags.AddBool("no-extract", false)
+	flExtractDir := req.flags.AddBool("extract-dir", false)
+	flTarIndex := req.flags.AddString("tar-index", "")
+	flTarMembers := req.flags.AddString("tar-members", "")
+	if err := req.flags.Parse(); err != nil {
+		return nil, err
+	}
+
+	opts := &copyOptions{
+		skipUnreadable: flSkipUnreadable.IsTrue(),
+		noExtract:      flNoExtract.IsTrue(),
+		extractDir:     flExtractDir.IsTrue(),
+		tarIndex:       flTarIndex.Value,
+	}
+	if opts.noExtract && opts.extractDir {
+		return nil, errors.New("ADD --extract-dir cannot be used with --no-extract")
+	}
+	if flTarIndex.Value != "" || flTarMembers.Value != "" {
+		if flTarIndex.Value == "" || flTarMembers.Value == "" {
+			return nil, errors.New("ADD --tar-index and --tar-members must be used together")
+		}
+		if opts.noExtract {
+			return nil, errors.New("ADD --tar-index cannot be used with --no-extract")
+		}
+		if len(req.args) != 2 || !urlutil.IsURL(req.args[0]) {
+			return nil, errors.New("ADD --tar-index requires a single URL source")
+		}
+		opts.tarMembers = strings.Split(flTarMembers.Value, ",")
+	}
+	var err error
+	if opts.explicitDotfiles, err = parseDotfiles(flDotfiles.Value, "ADD"); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// parseCopyOptions parses the flags of the COPY instruction of req.
+func parseCopyOptions(req dispatchRequest) (*copyOptions, error) {
+	flDotfiles := req.flags.AddString("dotfiles", dotfilesAll)
+	flSkipUnreadable := req.flags.AddBool("skip-unreadable", false)
+	flFrom := req.flags.AddString("from", "")
+	flFromArgs := req.flags.AddBool("from-args", false)
+	flParents := req.flags.AddBool("parents", false)
+	flSync := req.flags.AddBool("sync", false)
+	flStrictSymlinks := req.flags.AddBool("strict-symlinks", false)
+	flStrictCase := req.flags.AddBool("strict-case", false)
+	flGitignore := req.flags.AddBool("gitignore", false)
+	flMaxSize := req.flags.AddString("max-size", "")
+	flNewerThan := req.flags.AddString("newer-than", "")
+	flDirSymlinks := req.flags.AddString("dir-symlinks", dirSymlinksFollow)
+	flCacheKey := req.flags.AddString("cache-key", cacheKeyFull)
+	flMap := req.flags.AddString("map", "")
+	flMapUnmatched := req.flags.AddString("map-unmatched", mapUnmatchedCopy)
+	flFinalNewline := req.flags.AddString("final-newline", "")
+	flText := req.flags.AddString("text", "")
+	flBinary := req.flags.AddString("binary", "")
+	flCap := req.flags.AddString("cap", "")
+	flManifest := req.flags.AddString("manifest", "")
+	flHashNames := req.flags.AddString("hash-names", "")
+	flVerify := req.flags.AddString("verify", "")
+	flCheckSpace := req.flags.AddBool("check-space", false)
+	flUIDMap := req.flags.AddString("uidmap", "")
+	flGIDMap := req.flags.AddString("gidmap", "")
+	flParentMode := req.flags.AddString("parent-mode", "")
+	flSkipIdentical := req.flags.AddBool("skip-identical", false)
+	if err := req.flags.Parse(); err != nil {
+		return nil, err
+	}
+
+	opts := &copyOptions{
+		skipUnreadable:      flSkipUnreadable.IsTrue(),
+		from:                flFrom,
+		fromArgs:            flFromArgs.IsTrue(),
+		parents:             flParents.IsTrue(),
+		sync:                flSync.IsTrue(),
+		strictSymlinks:      flStrictSymlinks.IsTrue(),
+		strictCase:          flStrictCase.IsTrue(),
+		gitignore:           flGitignore.IsTrue(),
+		preserveDirSymlinks: flDirSymlinks.Value == dirSymlinksPreserve,
+		contentCacheKey:     flCacheKey.Value == cacheKeyContent,
+		renameMap:           flMap.Value,
+		skipUnmatched:       flMapUnmatched.Value == mapUnmatchedSkip,
+		finalNewline:        flFinalNewline.Value,
+		capabilities:        flCap.Value,
+		manifest:            flManifest.Value,
+		hashNames:           flHashNames.Value,
+		verify:              flVerify.Value,
+		checkSpace:          flCheckSpace.IsTrue(),
+		skipIdentical:       flSkipIdentical.IsTrue(),
+	}
+	if opts.gitignore && (flFrom.IsUsed() || opts.fromArgs) {
+		return nil, errors.New("COPY --gitignore cannot be used with --from or --from-args")
+	}
+	if opts.fromArgs && (flFrom.IsUsed() || opts.sync) {
+		return nil, errors.New("COPY --from-args cannot be used with --from or --sync")
+	}
+	if opts.renameMap != "" && (opts.sync || opts.parents || opts.fromArgs) {
+		return nil, errors.New("COPY --map cannot be used with --sync, --parents or --from-args")
+	}
+	if opts.manifest != "" && opts.renameMap != "" {
+		return nil, errors.New("COPY --manifest cannot be used with --map")
+	}
+	if opts.hashNames != "" && (opts.renameMap != "" || opts.manifest != "" || opts.sync || opts.parents || opts.fromArgs) {
+		return nil, errors.New("COPY --hash-names cannot be used with --map, --manifest, --sync, --parents or --from-args")
+	}
+	if opts.skipIdentical && opts.sync {
+		return nil, errors.New("COPY --skip-identical cannot be used with --sync, which already skips the identical files")
+	}
+	if flMapUnmatched.Value != mapUnmatchedCopy && flMapUnmatched.Value != mapUnmatchedSkip {
+		return nil, errors.Errorf("invalid value %q for COPY --map-unmatched: must be %q or %q", flMapUnmatched.Value, mapUnmatchedCopy, mapUnmatchedSkip)
+	}
+	if flDirSymlinks.Value != dirSymlinksFollow && flDirSymlinks.Value != dirSymlinksPreserve {
+		return nil, errors.Errorf("invalid value %q for COPY --dir-symlinks: must be %q or %q", flDirSymlinks.Value, dirSymlinksFollow, dirSymlinksPreserve)
+	}
+	if opts.preserveDirSymlinks && (opts.sync || opts.parents) {
+		return nil, errors.New("COPY --dir-symlinks=preserve cannot be used with --sync or --parents")
+	}
+	if flCacheKey.Value != cacheKeyFull && flCacheKey.Value != cacheKeyContent {
+		return nil, errors.Errorf("invalid value %q for COPY --cache-key: must be %q or %q", flCacheKey.Value, cacheKeyFull, cacheKeyContent)
+	}
+	if (flText.Value != "" || flBinary.Value != "") && opts.finalNewline == "" {
+		return nil, errors.New("COPY --text and --binary require --final-newline")
+	}
+
+	var err error
+	if opts.textModes, err = parseTextMode(flText.Value, flBinary.Value); err != nil {
+		return nil, errors.Wrap(err, "invalid value for COPY --text or --binary")
+	}
+	if opts.capabilities != "" {
+		if opts.fileCaps, err = parseFileCapabilities(opts.capabilities); err != nil {
+			return nil, errors.Wrap(err, "invalid value for COPY --cap")
+		}
+	}
+	if opts.filter, err = newFileFilter(flMaxSize.Value, flNewerThan.Value, "COPY"); err != nil {
+		return nil, err
+	}
+	if flParentMode.Value != "" {
+		if opts.sync {
+			return nil, errors.New("COPY --parent-mode cannot be used with --sync")
+		}
+		if opts.dirMode, err = parseDirMode(flParentMode.Value); err != nil {
+			return nil, errors.Wrap(err, "invalid value for COPY --parent-mode")
+		}
+	}
+	if flUIDMap.Value != "" || flGIDMap.Value != "" {
+		if opts.sync {
+			return nil, errors.New("COPY --uidmap and --gidmap cannot be used with --sync")
+		}
+		if opts.ownership, err = parseOwnershipMap(flUIDMap.Value, flGIDMap.Value); err != nil {
+			return nil, err
+		}
+		opts.ownershipMap = fmt.Sprintf("--uidmap=%s --gidmap=%s", flUIDMap.Value, flGIDMap.Value)
+	}
+	if opts.explicitDotfiles, err = parseDotfiles(flDotfiles.Value, "COPY"); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// parseDotfiles returns whether the value of the --dotfiles flag makes
+// wildcards only match the names starting with a dot explicitly.
+func parseDotfiles(value, cmdName string) (bool, error) {
+	switch value {
+	case dotfilesAll:
+		return false, nil
+	case dotfilesExplicit:
+		return true, nil
+	}
+	return false, errors.Errorf("invalid value %q for %s --dotfiles: must be %q or %q", value, cmdName, dotfilesAll, dotfilesExplicit)
+}
+
+// parseDirMode parses the octal mode of the directories COPY --parent-mode
+// creates. Only the permission bits may be set.
+func parseDirMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return 0, errors.Errorf("%q is not an octal mode", value)
+	}
+	if mode == 0 || os.FileMode(mode)&^os.ModePerm != 0 {
+		return 0, errors.Errorf("%q must be a mode between 1 and 0777", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// newCopier returns the copier of req configured by the options.
+func (opts *copyOptions) newCopier(req dispatchRequest, download sourceDownloader, imageSource *imageMount) copier {
+	o := copierFromDispatchRequest(req, download, imageSource)
+	o.explicitDotfiles = opts.explicitDotfiles
+	o.skipUnreadable = opts.skipUnreadable
+	o.fromArgs = opts.fromArgs
+	o.preserveParents = opts.parents
+	o.strictSymlinks = opts.strictSymlinks
+	o.gitignore = opts.gitignore
+	o.filter = opts.filter
+	o.preserveDirSymlinks = opts.preserveDirSymlinks
+	o.contentCacheKey = opts.contentCacheKey
+	return o
+}
@@ -0,0 +1,83 @@
+package dockerfile
+
+import (
+	"bufio"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/symlink"
+	"github.com/pkg/errors"
+)
+
+// digestDenylist is the set of the hex-encoded sha256 digests of the files
+// builds are not allowed to copy into images.
+type digestDenylist map[string]struct{}
+
+// loadDigestDenylist reads the denylist in the file at path. The file lists
+// one digest per line, optionally prefixed with "sha256:" and followed by
+// the name of the file, so that the output of sha256sum(1) can be used
+// as is. Empty lines and lines starting with # are ignored.
+func loadDigestDenylist(path string) (digestDenylist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open the builder denylist")
+	}
+	defer f.Close()
+
+	denylist := make(digestDenylist)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		digest := strings.ToLower(strings.TrimPrefix(fields[0], "sha256:"))
+		if b, err := hex.DecodeString(digest); err != nil || len(b) != 32 {
+			return nil, errors.Errorf("invalid sha256 digest %q on line %d of the builder denylist %s", fields[0], n, path)
+		}
+		denylist[digest] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read the builder denylist")
+	}
+	return denylist, nil
+}
+
+// check returns an error naming the first regular file of the sources of
+// inst whose digest is denied.
+func (l digestDenylist) check(inst copyInstruction) error {
+	if len(l) == 0 {
+		return nil
+	}
+	for _, info := range inst.infos {
+		// Like the copy, follow the source if it is a symlink.
+		src, err := symlink.FollowSymlinkInScope(filepath.Join(info.root, info.path), info.root)
+		if err != nil {
+			return err
+		}
+		err = filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.Mode().IsRegular() {
+				return err
+			}
+			digest, err := fileDigest(p)
+			if err != nil {
+				return err
+			}
+			if _, denied := l[digest]; !denied {
+				return nil
+			}
+			rel, err := filepath.Rel(src, p)
+			if err != nil {
+				return err
+			}
+			return errors.Errorf("%s failed: %s is denied by the daemon, its digest sha256:%s is on the builder denylist",
+				inst.cmdName, filepath.ToSlash(filepath.Join(info.path, rel)), digest)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -10,6 +10,8 @@ package dockerfile
 import (
 	"bytes"
 	"fmt"
+	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"sort"
@@ -144,18 +146,23 @@ func add(req dispatchRequest) error {
 		return errAtLeastTwoArguments("ADD")
 	}
 
-	if err := req.flags.Parse(); err != nil {
+	opts, err := parseAddOptions(req)
+	if err != nil {
 		return err
 	}
 
 	downloader := newRemoteSourceDownloader(req.builder.Output, req.builder.Stdout)
-	copier := copierFromDispatchRequest(req, downloader, nil)
+	if opts.tarIndex != "" {
+		downloader = newTarIndexDownloader(req.builder.Output, req.builder.Stdout, opts.tarIndex, opts.tarMembers)
+	}
+	copier := opts.newCopier(req, downloader, nil)
 	defer copier.Cleanup()
 	copyInstruction, err := copier.createCopyInstruction(req.args, "ADD")
 	if err != nil {
 		return err
 	}
-	copyInstruction.allowLocalDecompression = true
+	copyInstruction.allowLocalDecompression = !opts.noExtract
+	copyInstruction.extractDir = opts.extractDir
 
 	return req.builder.performCopy(req.state, copyInstruction)
 }
@@ -169,22 +176,102 @@ func dispatchCopy(req dispatchRequest) error {
 		return errAtLeastTwoArguments("COPY")
 	}
 
-	flFrom := req.flags.AddString("from", "")
-	if err := req.flags.Parse(); err != nil {
+	opts, err := parseCopyOptions(req)
+	if err != nil {
 		return err
 	}
 
-	im, err := req.builder.getImageMount(flFrom)
+	im, err := req.builder.getImageMount(opts.from)
 	if err != nil {
-		return errors.Wrapf(err, "invalid from flag value %s", flFrom.Value)
+		return errors.Wrapf(err, "invalid from flag value %s", opts.from.Value)
 	}
 
-	copier := copierFromDispatchRequest(req, errOnSourceDownload, im)
+	download := errOnSourceDownload
+	if opts.fromArgs {
+		download = newBuildArgSourceProvider(req.builder.buildArgs)
+	}
+	copier := opts.newCopier(req, download, im)
 	defer copier.Cleanup()
 	copyInstruction, err := copier.createCopyInstruction(req.args, "COPY")
 	if err != nil {
 		return err
 	}
+	if opts.sync {
+		if len(copyInstruction.infos) != 1 {
+			return errors.New("COPY --sync requires a single source")
+		}
+		copyInstruction.sync = true
+	}
+	if opts.filter != nil {
+		copyInstruction.filter = opts.filter.String()
+	}
+	if opts.renameMap != "" {
+		// The mapping file is always read from the build context.
+		renames, err := contextCopierFromDispatchRequest(req).loadRenameMap(opts.renameMap)
+		if err != nil {
+			return err
+		}
+		if err := checkRenameMap(copyInstruction, renames); err != nil {
+			return err
+		}
+		copyInstruction.renames = renames
+		copyInstruction.skipUnmatched = opts.skipUnmatched
+	}
+	if opts.strictCase {
+		if err := checkCaseCollisions(copyInstruction); err != nil {
+			return err
+		}
+	}
+	if opts.finalNewline != "" {
+		if copyInstruction.infos, err = copier.stageFinalNewlines(copyInstruction.infos, opts.finalNewline, opts.textModes); err != nil {
+			return errors.Wrap(err, "COPY --final-newline failed")
+		}
+		copyInstruction.finalNewline = opts.finalNewline
+		if opts.textModes != nil {
+			copyInstruction.textMode = opts.textModes.String()
+		}
+	}
+	if opts.capabilities != "" {
+		if copyInstruction.infos, err = copier.stageFileCapabilities(copyInstruction.infos, opts.fileCaps); err != nil {
+			return errors.Wrap(err, "COPY --cap failed")
+		}
+		copyInstruction.capabilities = opts.capabilities
+	}
+	// The manifest lists the files as they are copied, after staging.
+	if opts.manifest != "" {
+		if err := copier.stageManifest(&copyInstruction, opts.manifest, req.state.runConfig.WorkingDir); err != nil {
+			return errors.Wrap(err, "COPY --manifest failed")
+		}
+	}
+	// The names are hashed after staging as well, and the manifest of
+	// --hash-names takes the place of the one of --manifest.
+	if opts.hashNames != "" {
+		if err := copier.stageHashNames(&copyInstruction, opts.hashNames); err != nil {
+			return errors.Wrap(err, "COPY --hash-names failed")
+		}
+	}
+	if opts.verify != "" {
+		// Like the mapping file, the manifest is always read from the
+		// build context.
+		var dest string
+		if strings.HasSuffix(copyInstruction.dest, string(os.PathSeparator)) {
+			normalised, err := normaliseDest(copyInstruction.cmdName, req.state.runConfig.WorkingDir, copyInstruction.dest)
+			if err != nil {
+				return err
+			}
+			dest = filepath.ToSlash(normalised)
+		}
+		manifest, err := contextCopierFromDispatchRequest(req).loadVerifyManifest(opts.verify, dest)
+		if err != nil {
+			return errors.Wrap(err, "COPY --verify failed")
+		}
+		copyInstruction.verify = manifest
+	}
+	copyInstruction.checkSpace = opts.checkSpace
+	copyInstruction.dirMode = opts.dirMode
+	copyInstruction.skipIdentical = opts.skipIdentical
+	copyInstruction.ownership = opts.ownership
+	copyInstruction.ownershipMap = opts.ownershipMap
 
 	return req.builder.performCopy(req.state, copyInstruction)
 }
@@ -203,7 +290,9 @@ func (b *Builder) getImageMount(fromFlag *Flag) (*imageMount, error) {
 	if stage != nil {
 		imageRefOrID = stage.ImageID()
 	}
-	return b.imageSources.Get(imageRefOrID)
+	// Any other value is an image, pulled if it is missing or the build
+	// forces pulls, like the image of a FROM.
+	return b.imageSources.Get(imageRefOrID, stage != nil)
 }
 
 // FROM imagename[:tag | @digest] [AS build-stage-name]
@@ -278,7 +367,7 @@ func (b *Builder) getFromImage(shlex *ShellLex, name string) (builder.Image, err
 		}
 		return scratchImage, nil
 	}
-	imageMount, err := b.imageSources.Get(name)
+	imageMount, err := b.imageSources.Get(name, false)
 	if err != nil {
 		return nil, err
 	}
@@ -1,19 +1,33 @@
 package dockerfile
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"bytes"
 	"context"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/backend"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/strslice"
 	"github.com/docker/docker/builder"
 	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/docker/builder/remotecontext"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/idtools"
 	"github.com/docker/docker/pkg/system"
 	"github.com/docker/docker/pkg/testutil"
 	"github.com/docker/go-connections/nat"
@@ -518,3 +532,1208 @@ func TestRunWithBuildArgs(t *testing.T) {
 	// Check that runConfig.Cmd has not been modified by run
 	assert.Equal(t, origCmd, req.state.runConfig.Cmd)
 }
+
+// newCopyContext returns the directory of a build context holding the files,
+// its source and the function removing it.
+func newCopyContext(t *testing.T, files map[string]string) (string, builder.Source, func()) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	for name, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Join(contextDir, filepath.Dir(name)), 0755))
+		createTestTempFile(t, contextDir, name, content, 0644)
+	}
+	source, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+	return contextDir, source, cleanup
+}
+
+// newCopyBuilder returns a builder whose copies miss the cache and run in
+// the container 12345.
+func newCopyBuilder() (*Builder, *MockBackend) {
+	b := newBuilderWithMockBackend()
+	mockBackend := b.docker.(*MockBackend)
+	b.imageProber = newImageProber(mockBackend, nil, true)
+	mockBackend.containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+		return container.ContainerCreateCreatedBody{ID: "12345"}, nil
+	}
+	return b, mockBackend
+}
+
+func copyReq(b *Builder, source builder.Source, flags []string, args ...string) dispatchRequest {
+	req := defaultDispatchReq(b, args...)
+	req.flags = NewBFlagsWithArgs(flags)
+	req.source = source
+	return req
+}
+
+// recordSources returns a CopyOnBuild function appending the copied sources
+// to sources.
+func recordSources(sources *[]string) func(containerID, destPath, srcRoot, srcPath string, decompress bool) error {
+	return func(containerID, destPath, srcRoot, srcPath string, decompress bool) error {
+		*sources = append(*sources, filepath.ToSlash(filepath.Clean(srcPath)))
+		return nil
+	}
+}
+
+// imageFiles returns a CopyOnBuild function storing the files it copies in
+// files, by their path in the image, with their content, or with the
+// target of the symlinks prefixed with "-> ". Like the daemon, it follows
+// the sources which are symlinks and copies the content of directories.
+func imageFiles(files map[string]string) func(containerID, destPath, srcRoot, srcPath string, decompress bool) error {
+	return func(containerID, destPath, srcRoot, srcPath string, decompress bool) error {
+		dest := filepath.ToSlash(destPath)
+		root, err := filepath.EvalSymlinks(filepath.Join(srcRoot, srcPath))
+		if err != nil {
+			return err
+		}
+		return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			name := dest
+			if p != root {
+				rel, err := filepath.Rel(root, p)
+				if err != nil {
+					return err
+				}
+				name = path.Join(dest, filepath.ToSlash(rel))
+			} else if strings.HasSuffix(dest, "/") {
+				name = path.Join(dest, filepath.Base(srcPath))
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				target, err := os.Readlink(p)
+				files[name] = "-> " + target
+				return err
+			}
+			data, err := ioutil.ReadFile(p)
+			files[name] = string(data)
+			return err
+		})
+	}
+}
+
+func TestParseCopyOptions(t *testing.T) {
+	for _, testcase := range []struct {
+		cmdName  string
+		args     []string
+		flags    []string
+		expected string
+	}{
+		{"ADD", []string{"https://example.com/sdk.tar", "/opt/"}, []string{"--tar-index=sdk.tar.idx"}, "ADD --tar-index and --tar-members must be used together"},
+		{"ADD", []string{"https://example.com/sdk.tar", "/opt/"}, []string{"--tar-members=bin"}, "ADD --tar-index and --tar-members must be used together"},
+		{"ADD", []string{"https://example.com/sdk.tar", "/opt/"}, []string{"--tar-index=sdk.tar.idx", "--tar-members=bin", "--no-extract"}, "ADD --tar-index cannot be used with --no-extract"},
+		{"ADD", []string{"sdk.tar", "/opt/"}, []string{"--tar-index=sdk.tar.idx", "--tar-members=bin"}, "ADD --tar-index requires a single URL source"},
+		{"ADD", []string{"https://example.com/sdk.tar", "https://example.com/other.tar", "/opt/"}, []string{"--tar-index=sdk.tar.idx", "--tar-members=bin"}, "ADD --tar-index requires a single URL source"},
+		{"ADD", []string{"tool-1.0.tar", "/opt/"}, []string{"--extract-dir", "--no-extract"}, "ADD --extract-dir cannot be used with --no-extract"},
+		{"ADD", []string{"app", "/app/"}, []string{"--dotfiles=some"}, `invalid value "some" for ADD --dotfiles: must be "all" or "explicit"`},
+		{"ADD", []string{"app", "/app/"}, []string{"--from=busybox"}, "Unknown flag: from"},
+		{"COPY", []string{"app", "/app/"}, []string{"--dotfiles=some"}, `invalid value "some" for COPY --dotfiles: must be "all" or "explicit"`},
+		{"COPY", []string{"app", "/app/"}, []string{"--gitignore", "--from=busybox"}, "COPY --gitignore cannot be used with --from or --from-args"},
+		{"COPY", []string{"CONFIG", "/app/"}, []string{"--from-args", "--sync"}, "COPY --from-args cannot be used with --from or --sync"},
+		{"COPY", []string{"src/", "/app/"}, []string{"--map=rename.txt", "--parents"}, "COPY --map cannot be used with --sync, --parents or --from-args"},
+		{"COPY", []string{"src/", "/app/"}, []string{"--map=rename.txt", "--map-unmatched=drop"}, `invalid value "drop" for COPY --map-unmatched: must be "copy" or "skip"`},
+		{"COPY", []string{"src", "/app/"}, []string{"--manifest=/checksums.sha256", "--map=rename.txt"}, "COPY --manifest cannot be used with --map"},
+		{"COPY", []string{"assets/", "/srv/"}, []string{"--hash-names=assets.json", "--manifest=checksums.sha256"}, "COPY --hash-names cannot be used with --map, --manifest, --sync, --parents or --from-args"},
+		{"COPY", []string{"file", "/dest/"}, []string{"--skip-identical", "--sync"}, "COPY --skip-identical cannot be used with --sync, which already skips the identical files"},
+		{"COPY", []string{"current", "/app/"}, []string{"--dir-symlinks=copy"}, `invalid value "copy" for COPY --dir-symlinks: must be "follow" or "preserve"`},
+		{"COPY", []string{"current", "/app/"}, []string{"--dir-symlinks=preserve", "--sync"}, "COPY --dir-symlinks=preserve cannot be used with --sync or --parents"},
+		{"COPY", []string{"src", "/app/"}, []string{"--cache-key=mtime"}, `invalid value "mtime" for COPY --cache-key: must be "full" or "content"`},
+		{"COPY", []string{"app", "/app/"}, []string{"--text=*.sh"}, "COPY --text and --binary require --final-newline"},
+		{"COPY", []string{"app", "/app/"}, []string{"--final-newline=*", "--text=*.sh,["}, "invalid value for COPY --text or --binary"},
+		{"COPY", []string{"app", "/app/"}, []string{"--cap=cap_bogus"}, "invalid value for COPY --cap"},
+		{"COPY", []string{"app", "/app/"}, []string{"--max-size=0"}, `invalid value "0" for COPY --max-size: must be a positive size`},
+		{"COPY", []string{"file", "/dest/"}, []string{"--parent-mode=rwx"}, `invalid value for COPY --parent-mode: "rwx" is not an octal mode`},
+		{"COPY", []string{"file", "/dest/"}, []string{"--parent-mode=0"}, `invalid value for COPY --parent-mode: "0" must be a mode between 1 and 0777`},
+		{"COPY", []string{"file", "/dest/"}, []string{"--parent-mode=4755"}, `invalid value for COPY --parent-mode: "4755" must be a mode between 1 and 0777`},
+		{"COPY", []string{"file", "/dest/"}, []string{"--parent-mode=0700", "--sync"}, "COPY --parent-mode cannot be used with --sync"},
+		{"COPY", []string{"file", "/dest/"}, []string{"--uidmap=1000"}, `invalid value for COPY --uidmap: "1000" is not of the form <source>:<destination>[:<count>]`},
+		{"COPY", []string{"file", "/dest/"}, []string{"--gidmap=1000:-1"}, `invalid value for COPY --gidmap: "-1" is not a valid ID in "1000:-1"`},
+		{"COPY", []string{"file", "/dest/"}, []string{"--uidmap=1000:0:0"}, `invalid value for COPY --uidmap: the count of "1000:0:0" must be positive`},
+		{"COPY", []string{"file", "/dest/"}, []string{"--uidmap=1000:0:10,1005:100"}, `invalid value for COPY --uidmap: "1005:100" overlaps 1000:0:10`},
+		{"COPY", []string{"file", "/dest/"}, []string{"--uidmap=1000:0", "--sync"}, "COPY --uidmap and --gidmap cannot be used with --sync"},
+	} {
+		parse := parseCopyOptions
+		if testcase.cmdName == "ADD" {
+			parse = parseAddOptions
+		}
+		req := defaultDispatchReq(newBuilderWithMockBackend(), testcase.args...)
+		req.flags = NewBFlagsWithArgs(testcase.flags)
+		_, err := parse(req)
+		if assert.Error(t, err, "%s %v", testcase.cmdName, testcase.flags) {
+			assert.Contains(t, err.Error(), testcase.expected)
+		}
+	}
+}
+
+func TestAddNoExtract(t *testing.T) {
+	_, source, cleanup := newCopyContext(t, map[string]string{"app.tar.gz": "not really an archive"})
+	defer cleanup()
+
+	for _, testcase := range []struct {
+		flags      []string
+		decompress bool
+	}{
+		{flags: nil, decompress: true},
+		{flags: []string{"--no-extract"}, decompress: false},
+		{flags: []string{"--no-extract=false"}, decompress: true},
+	} {
+		b, mockBackend := newCopyBuilder()
+		var calls int
+		mockBackend.copyOnBuildFunc = func(containerID, destPath, srcRoot, srcPath string, decompress bool) error {
+			calls++
+			assert.Equal(t, "app.tar.gz", srcPath)
+			assert.Equal(t, testcase.decompress, decompress, "flags: %v", testcase.flags)
+			return nil
+		}
+
+		require.NoError(t, add(copyReq(b, source, testcase.flags, "app.tar.gz", "/opt/app.tar.gz")))
+		assert.Equal(t, 1, calls)
+	}
+}
+
+func TestAddExtractDir(t *testing.T) {
+	tarStream, err := archive.Generate("bin/tool", "tool", "README", "readme")
+	require.NoError(t, err)
+	tarData, err := ioutil.ReadAll(tarStream)
+	require.NoError(t, err)
+	contextDir, source, cleanup := newCopyContext(t, map[string]string{"tool-1.0.tar": string(tarData), "notes.txt": "notes"})
+	defer cleanup()
+	rootfs, cleanupRootfs := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanupRootfs()
+
+	b, mockBackend := newCopyBuilder()
+	// Like the daemon, extract the archives into the destination.
+	dests := make(map[string]string)
+	mockBackend.copyOnBuildFunc = func(containerID, destPath, srcRoot, srcPath string, decompress bool) error {
+		dests[srcPath] = destPath
+		src := filepath.Join(srcRoot, srcPath)
+		if decompress && archive.IsArchivePath(src) {
+			return archive.NewDefaultArchiver().UntarPath(src, filepath.Join(rootfs, destPath))
+		}
+		return nil
+	}
+
+	require.NoError(t, add(copyReq(b, source, []string{"--extract-dir"}, "tool-1.0.tar", "notes.txt", "/opt/")))
+	assert.Equal(t, map[string]string{"tool-1.0.tar": "/opt/tool-1.0/", "notes.txt": "/opt/"}, dests)
+	for name, expected := range map[string]string{"bin/tool": "tool", "README": "readme"} {
+		content, err := ioutil.ReadFile(filepath.Join(rootfs, "opt", "tool-1.0", name))
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(content))
+	}
+
+	for name, expected := range map[string]string{
+		"app.tar.gz":    "app",
+		"app.tgz":       "app",
+		"app.tar.xz.gz": "app",
+		"App.TAR.BZ2":   "App",
+		"app-1.0.zst":   "app-1.0",
+		"archive":       "archive",
+		".tar":          ".tar",
+	} {
+		createTestTempFile(t, contextDir, name, string(tarData), 0644)
+		dir, ok := extractDirName(copyInfo{root: contextDir, path: name})
+		assert.True(t, ok, name)
+		assert.Equal(t, expected, dir, name)
+	}
+	_, ok := extractDirName(copyInfo{root: contextDir, path: "notes.txt"})
+	assert.False(t, ok)
+}
+
+func TestCopyDestinationWithPlatformArgs(t *testing.T) {
+	_, source, cleanup := newCopyContext(t, map[string]string{"bin": "binary"})
+	defer cleanup()
+
+	result, err := parser.Parse(strings.NewReader("COPY bin /opt/${TARGETARCH}/bin/\n"))
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name      string
+		requested buildPlatform
+		baseImage *mockImage
+		expected  string
+	}{
+		{"requested", buildPlatform{OS: "linux", Architecture: "amd64"}, &mockImage{os: "linux", arch: "arm64"}, "amd64"},
+		{"base image", buildPlatform{}, &mockImage{os: "linux", arch: "arm64"}, "arm64"},
+		{"daemon", buildPlatform{}, &mockImage{}, runtime.GOARCH},
+	} {
+		b, mockBackend := newCopyBuilder()
+		b.platform = tc.requested
+		var dest string
+		mockBackend.copyOnBuildFunc = func(containerID, destPath, srcRoot, srcPath string, decompress bool) error {
+			dest = destPath
+			return nil
+		}
+
+		_, err := b.dispatch(dispatchOptions{
+			state:   &dispatchState{runConfig: &container.Config{}, baseImage: tc.baseImage},
+			stepMsg: formatStep(0, 1),
+			node:    result.AST.Children[0],
+			shlex:   NewShellLex(parser.DefaultEscapeToken),
+			source:  source,
+		})
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, filepath.FromSlash("/opt/"+tc.expected+"/bin/"), dest, tc.name)
+	}
+}
+
+func TestCopyRejectsEmptyDestination(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	req := defaultDispatchReq(b, "bin", "")
+	err := dispatchCopy(req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "requires a non-empty destination")
+}
+
+func TestCopyParents(t *testing.T) {
+	_, source, cleanup := newCopyContext(t, map[string]string{
+		"src/app/main.go":      "src/app/main.go",
+		"src/app/flags.go":     "src/app/flags.go",
+		"src/lib/util/util.go": "src/lib/util/util.go",
+		"src/main.go":          "src/main.go",
+		"docs/README":          "docs/README",
+		"main.go":              "main.go",
+	})
+	defer cleanup()
+
+	for _, testcase := range []struct {
+		args     []string
+		expected map[string]string
+		err      string
+	}{
+		{
+			args:     []string{"src/app/main.go", "/build/"},
+			expected: map[string]string{"/build/src/app/main.go": "src/app/main.go"},
+		},
+		{
+			args:     []string{"./src/./app/main.go", "docs/README", "/build/"},
+			expected: map[string]string{"/build/app/main.go": "src/app/main.go", "/build/docs/README": "docs/README"},
+		},
+		{
+			args:     []string{"src/*/*.go", "/build/"},
+			expected: map[string]string{"/build/src/app/main.go": "src/app/main.go", "/build/src/app/flags.go": "src/app/flags.go"},
+		},
+		{
+			args:     []string{"src/./*/util", "/build/"},
+			expected: map[string]string{"/build/lib/util/util.go": "src/lib/util/util.go"},
+		},
+		{args: []string{"src/main.go", "/build"}, err: "the destination must be a directory and end with a /"},
+		{args: []string{"s*/./main.go", "/build/"}, err: "must not contain wildcards"},
+		{args: []string{"src/./../main.go", "/build/"}, err: "outside of the base"},
+	} {
+		b, mockBackend := newCopyBuilder()
+		files := make(map[string]string)
+		mockBackend.copyOnBuildFunc = imageFiles(files)
+
+		err := dispatchCopy(copyReq(b, source, []string{"--parents"}, testcase.args...))
+		if testcase.err != "" {
+			if assert.Error(t, err, "COPY --parents %v", testcase.args) {
+				assert.Contains(t, err.Error(), testcase.err)
+			}
+			continue
+		}
+		require.NoError(t, err, "COPY --parents %v", testcase.args)
+		assert.Equal(t, testcase.expected, files, "COPY --parents %v", testcase.args)
+	}
+}
+
+func TestCopySync(t *testing.T) {
+	_, source, cleanup := newCopyContext(t, map[string]string{"src/main.go": "main", "README": "readme"})
+	defer cleanup()
+
+	b, mockBackend := newCopyBuilder()
+	mockBackend.copyOnBuildFunc = func(containerID, destPath, srcRoot, srcPath string, decompress bool) error {
+		t.Errorf("COPY --sync must not call CopyOnBuild")
+		return nil
+	}
+	var synced []string
+	mockBackend.syncOnBuildFunc = func(containerID, destPath, srcRoot, srcPath string) error {
+		synced = append(synced, filepath.ToSlash(filepath.Clean(srcPath)), destPath)
+		return nil
+	}
+
+	require.NoError(t, dispatchCopy(copyReq(b, source, []string{"--sync"}, "src", "/app/src/")))
+	assert.Equal(t, []string{"src", "/app/src/"}, synced)
+
+	err := dispatchCopy(copyReq(b, source, []string{"--sync"}, "src", "README", "/app/"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "COPY --sync requires a single source")
+	}
+}
+
+func TestCopyStrictSymlinks(t *testing.T) {
+	contextDir, source, cleanup := newCopyContext(t, map[string]string{"dir/file": "file"})
+	defer cleanup()
+	require.NoError(t, os.MkdirAll(filepath.Join(contextDir, "broken"), 0755))
+	createTestSymlink(t, contextDir, "dir/valid", "file")
+	createTestSymlink(t, contextDir, "broken/link", "missing")
+	createTestSymlink(t, contextDir, "toplevel", "broken/missing")
+
+	for _, testcase := range []struct {
+		flags    []string
+		src      string
+		expected string
+	}{
+		{flags: []string{"--strict-symlinks"}, src: "dir"},
+		{flags: nil, src: "broken"},
+		{flags: []string{"--strict-symlinks"}, src: "broken", expected: "broken/link is a broken symlink: its target missing does not exist"},
+		{flags: []string{"--strict-symlinks"}, src: "toplevel", expected: "toplevel is a broken symlink: its target broken/missing does not exist"},
+		{flags: []string{"--strict-symlinks"}, src: "b*", expected: "broken/link is a broken symlink"},
+	} {
+		b, _ := newCopyBuilder()
+		err := dispatchCopy(copyReq(b, source, testcase.flags, testcase.src, "/dest/"))
+		if testcase.expected == "" {
+			assert.NoError(t, err, "COPY %v %s", testcase.flags, testcase.src)
+			continue
+		}
+		if assert.Error(t, err, "COPY %v %s", testcase.flags, testcase.src) {
+			assert.Contains(t, err.Error(), testcase.expected)
+		}
+	}
+}
+
+func TestCopyLogsDockerignoreExclusions(t *testing.T) {
+	_, source, cleanup := newCopyContext(t, map[string]string{
+		".dockerignore":  "dir/*.log\n!dir/keep.log\ndir/secret\n",
+		"dir/debug.log":  "debug",
+		"dir/keep.log":   "keep",
+		"dir/secret/key": "key",
+	})
+	defer cleanup()
+
+	var logs bytes.Buffer
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetOutput(&logs)
+	logrus.SetLevel(logrus.DebugLevel)
+
+	b, mockBackend := newCopyBuilder()
+	var copied []string
+	mockBackend.copyOnBuildFunc = recordSources(&copied)
+
+	require.NoError(t, dispatchCopy(copyReq(b, source, nil, "dir/*.log", "/dest/")))
+	assert.Equal(t, []string{"dir/keep.log"}, copied)
+	assert.Contains(t, logs.String(), `Skipping dir/debug.log: excluded by .dockerignore pattern \"dir/*.log\"`)
+	assert.NotContains(t, logs.String(), "Skipping dir/keep.log")
+
+	logs.Reset()
+	require.NoError(t, dispatchCopy(copyReq(b, source, nil, "dir", "/dest/")))
+	assert.Contains(t, logs.String(), `Skipping dir/secret: excluded by .dockerignore pattern \"dir/secret\"`)
+}
+
+func TestCopyWildcardDotfiles(t *testing.T) {
+	_, source, cleanup := newCopyContext(t, map[string]string{
+		".hidden":     "hidden",
+		"visible":     "visible",
+		"dir/.hidden": "hidden",
+		"dir/visible": "visible",
+	})
+	defer cleanup()
+
+	for _, testcase := range []struct {
+		flags    []string
+		src      string
+		expected []string
+		err      string
+	}{
+		{flags: nil, src: "*", expected: []string{".hidden", "dir", "visible"}},
+		{flags: []string{"--dotfiles=all"}, src: "dir/*", expected: []string{"dir/.hidden", "dir/visible"}},
+		{flags: []string{"--dotfiles=explicit"}, src: "*", expected: []string{"dir", "visible"}},
+		{flags: []string{"--dotfiles=explicit"}, src: "dir/*", expected: []string{"dir/visible"}},
+		{flags: []string{"--dotfiles=explicit"}, src: ".*", expected: []string{".hidden"}},
+		{flags: []string{"--dotfiles=explicit"}, src: "*/.*", expected: []string{"dir/.hidden"}},
+		{flags: []string{"--dotfiles=explicit"}, src: "?hidden", err: "no source files were specified"},
+	} {
+		b, mockBackend := newCopyBuilder()
+		var copied []string
+		mockBackend.copyOnBuildFunc = recordSources(&copied)
+
+		err := dispatchCopy(copyReq(b, source, testcase.flags, testcase.src, "/dest/"))
+		if testcase.err != "" {
+			if assert.Error(t, err, "COPY %v %s", testcase.flags, testcase.src) {
+				assert.Contains(t, err.Error(), testcase.err)
+			}
+			continue
+		}
+		require.NoError(t, err, "COPY %v %s", testcase.flags, testcase.src)
+		assert.Equal(t, testcase.expected, copied, "COPY %v %s", testcase.flags, testcase.src)
+	}
+}
+
+func TestCopyStrictCase(t *testing.T) {
+	_, source, cleanup := newCopyContext(t, map[string]string{
+		"File.txt":     "upper",
+		"file.txt":     "lower",
+		"dir/file.txt": "lower",
+		"other.txt":    "other",
+	})
+	defer cleanup()
+
+	for _, testcase := range []struct {
+		flags    []string
+		args     []string
+		expected string
+	}{
+		// Collisions are only checked on demand.
+		{flags: nil, args: []string{"File.txt", "file.txt", "/dest/"}},
+		{flags: []string{"--strict-case"}, args: []string{"File.txt", "file.txt", "/dest/"}, expected: "files only differing in case would overwrite each other: File.txt, file.txt"},
+		{flags: []string{"--strict-case"}, args: []string{"*.txt", "/dest/"}, expected: "File.txt, file.txt"},
+		{flags: []string{"--strict-case"}, args: []string{"dir", "File.txt", "/dest/"}, expected: "File.txt, file.txt"},
+		{flags: []string{"--strict-case"}, args: []string{"file.txt", "dir", "other.txt", "/dest/"}},
+	} {
+		b, _ := newCopyBuilder()
+		err := dispatchCopy(copyReq(b, source, testcase.flags, testcase.args...))
+		if testcase.expected == "" {
+			assert.NoError(t, err, "COPY %v %v", testcase.flags, testcase.args)
+			continue
+		}
+		if assert.Error(t, err, "COPY %v %v", testcase.flags, testcase.args) {
+			assert.Contains(t, err.Error(), testcase.expected)
+			assert.NotContains(t, err.Error(), "other.txt")
+		}
+	}
+}
+
+func TestCopySkipUnreadable(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Getuid() == 0 {
+		t.Skip("permissions are not enforced")
+	}
+	contextDir, source, cleanup := newCopyContext(t, map[string]string{"file.txt": "content", "dir/file.txt": "content"})
+	defer cleanup()
+	unreadable := filepath.Join(contextDir, "dir", "unreadable")
+	require.NoError(t, os.MkdirAll(unreadable, 0755))
+	require.NoError(t, os.Chmod(unreadable, 0))
+	defer os.Chmod(unreadable, 0755)
+
+	for _, testcase := range []struct {
+		flags    []string
+		src      string
+		expected []string
+	}{
+		{flags: nil, src: "*.txt"},
+		{flags: nil, src: "dir"},
+		{flags: []string{"--skip-unreadable"}, src: "*.txt", expected: []string{"file.txt"}},
+		{flags: []string{"--skip-unreadable"}, src: "dir", expected: []string{"dir"}},
+	} {
+		b, mockBackend := newCopyBuilder()
+		var copied []string
+		mockBackend.copyOnBuildFunc = recordSources(&copied)
+
+		err := dispatchCopy(copyReq(b, source, testcase.flags, testcase.src, "/dest/"))
+		if testcase.expected == nil {
+			assert.Error(t, err, "COPY %v %s", testcase.flags, testcase.src)
+			continue
+		}
+		require.NoError(t, err, "COPY %v %s", testcase.flags, testcase.src)
+		assert.Equal(t, testcase.expected, copied, "COPY %v %s", testcase.flags, testcase.src)
+	}
+}
+
+func TestCopyFromArgs(t *testing.T) {
+	copyArg := func(value string) (map[string]string, string) {
+		b, mockBackend := newCopyBuilder()
+		var cmd string
+		mockBackend.containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+			cmd = strings.Join(config.Config.Cmd, " ")
+			return container.ContainerCreateCreatedBody{ID: "12345"}, nil
+		}
+		files := make(map[string]string)
+		mockBackend.copyOnBuildFunc = imageFiles(files)
+		b.buildArgs.AddArg("CONFIG", &value)
+
+		require.NoError(t, dispatchCopy(copyReq(b, nil, []string{"--from-args"}, "CONFIG", "/etc/app.conf")))
+		return files, cmd
+	}
+
+	files, cmd := copyArg("key=value\n")
+	assert.Equal(t, map[string]string{"/etc/app.conf": "key=value\n"}, files)
+	// The cache key only depends on the value of the build arg.
+	_, sameCmd := copyArg("key=value\n")
+	assert.Equal(t, cmd, sameCmd)
+	files, otherCmd := copyArg("key=other\n")
+	assert.Equal(t, map[string]string{"/etc/app.conf": "key=other\n"}, files)
+	assert.NotEqual(t, cmd, otherCmd)
+
+	err := dispatchCopy(copyReq(newBuilderWithMockBackend(), nil, []string{"--from-args"}, "MISSING", "/etc/app.conf"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "build arg MISSING is not defined")
+	}
+}
+
+func TestCopyMap(t *testing.T) {
+	_, source, cleanup := newCopyContext(t, map[string]string{
+		"src/bin/tool-linux-amd64": "tool",
+		"src/README.md":            "readme",
+		"src/LICENSE":              "license",
+		"rename.txt":               "# packaging layout\nbin/tool-linux-amd64 -> usr/bin/tool\nREADME.md -> usr/share/doc/tool/README\n",
+		"missing.txt":              "bin/tool-linux-arm64 -> usr/bin/tool\n",
+	})
+	defer cleanup()
+
+	for _, testcase := range []struct {
+		flags    []string
+		expected map[string]string
+		err      string
+	}{
+		{
+			flags: []string{"--map=rename.txt"},
+			expected: map[string]string{
+				"/dest/usr/bin/tool":              "tool",
+				"/dest/usr/share/doc/tool/README": "readme",
+				"/dest/LICENSE":                   "license",
+			},
+		},
+		{
+			flags: []string{"--map=rename.txt", "--map-unmatched=skip"},
+			expected: map[string]string{
+				"/dest/usr/bin/tool":              "tool",
+				"/dest/usr/share/doc/tool/README": "readme",
+			},
+		},
+		{flags: []string{"--map=missing.txt"}, err: "bin/tool-linux-arm64 does not exist in src"},
+	} {
+		b, mockBackend := newCopyBuilder()
+		files := make(map[string]string)
+		mockBackend.copyOnBuildFunc = imageFiles(files)
+
+		err := dispatchCopy(copyReq(b, source, testcase.flags, "src/", "/dest/"))
+		if testcase.err != "" {
+			if assert.Error(t, err, "%v", testcase.flags) {
+				assert.Contains(t, err.Error(), testcase.err)
+			}
+			continue
+		}
+		require.NoError(t, err, "%v", testcase.flags)
+		assert.Equal(t, testcase.expected, files, "%v", testcase.flags)
+	}
+}
+
+func TestParseRenameMap(t *testing.T) {
+	renames, err := parseRenameMap(strings.NewReader("a -> b\n\n# comment\n ./dir/c->d/e \n"))
+	require.NoError(t, err)
+	assert.Equal(t, renameMap{"a": "b", "dir/c": "d/e"}, renames)
+
+	for _, invalid := range []string{"a b", "a -> ../b", "/a -> b", "a -> b\na -> c", "-> b"} {
+		_, err := parseRenameMap(strings.NewReader(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestCopyHashNames(t *testing.T) {
+	assets := map[string]string{
+		"app.js":        "console.log()",
+		"app.min.js":    "console.log()",
+		"css/site.css":  "body{}",
+		"LICENSE":       "license",
+		"css/.htaccess": "deny",
+	}
+	files := make(map[string]string)
+	for name, content := range assets {
+		files["assets/"+name] = content
+	}
+	_, source, cleanup := newCopyContext(t, files)
+	defer cleanup()
+
+	b, mockBackend := newCopyBuilder()
+	copied := make(map[string]string)
+	mockBackend.copyOnBuildFunc = imageFiles(copied)
+
+	req := copyReq(b, source, []string{"--hash-names=assets.json"}, "assets/", "/srv/")
+	req.state.runConfig.WorkingDir = "/app"
+	require.NoError(t, dispatchCopy(req))
+
+	hashed := map[string]string{
+		"app.js":        "app.%s.js",
+		"app.min.js":    "app.min.%s.js",
+		"css/site.css":  "css/site.%s.css",
+		"LICENSE":       "LICENSE.%s",
+		"css/.htaccess": "css/.htaccess.%s",
+	}
+	expected := make(map[string]string)
+	for name, content := range assets {
+		sum := sha256.Sum256([]byte(content))
+		hashed[name] = fmt.Sprintf(hashed[name], hex.EncodeToString(sum[:])[:8])
+		expected["/srv/"+hashed[name]] = content
+	}
+	var names map[string]string
+	require.NoError(t, json.Unmarshal([]byte(copied["/app/assets.json"]), &names))
+	assert.Equal(t, hashed, names)
+	delete(copied, "/app/assets.json")
+	assert.Equal(t, expected, copied)
+
+	for _, testcase := range []struct {
+		args     []string
+		flags    []string
+		expected string
+	}{
+		{
+			args:     []string{"assets/app.js", "/srv/"},
+			flags:    []string{"--hash-names=assets.json"},
+			expected: "COPY --hash-names failed: the source must be a directory",
+		},
+		{
+			args:     []string{"assets/", "/srv/"},
+			flags:    []string{"--hash-names=assets/"},
+			expected: "COPY --hash-names failed: assets/ is not a file path",
+		},
+	} {
+		err := dispatchCopy(copyReq(newBuilderWithMockBackend(), source, testcase.flags, testcase.args...))
+		assert.EqualError(t, err, testcase.expected)
+	}
+}
+
+func TestCopyFinalNewline(t *testing.T) {
+	files := map[string]string{
+		"conf/none.conf":   "key=value",
+		"conf/one.conf":    "key=value\n",
+		"conf/many.conf":   "key=value\n\n\n",
+		"conf/crlf.conf":   "key=value\r\n\r\n",
+		"conf/empty.conf":  "",
+		"conf/binary.conf": "key\x00value",
+		"conf/other.txt":   "other",
+		"app/run.sh":       "run",
+		"app/nul.sh":       "run\x00",
+		"app/app.conf":     "key=value",
+		"app/data.bin":     "data",
+		"app/bin/tool.sh":  "tool",
+	}
+	contextDir, source, cleanup := newCopyContext(t, files)
+	defer cleanup()
+
+	for _, testcase := range []struct {
+		flags    []string
+		src      string
+		expected map[string]string
+	}{
+		{
+			flags: []string{"--final-newline=*.conf"},
+			src:   "conf",
+			expected: map[string]string{
+				"/dest/none.conf":   "key=value\n",
+				"/dest/one.conf":    "key=value\n",
+				"/dest/many.conf":   "key=value\n",
+				"/dest/crlf.conf":   "key=value\r\n",
+				"/dest/empty.conf":  "",
+				"/dest/binary.conf": "key\x00value",
+				"/dest/other.txt":   "other",
+			},
+		},
+		// Only the declared text files are normalized, even when they
+		// look binary, and the binary patterns take precedence.
+		{
+			flags: []string{"--final-newline=*", "--text=*.sh", "--binary=app/bin/*"},
+			src:   "app",
+			expected: map[string]string{
+				"/dest/run.sh":      "run\n",
+				"/dest/nul.sh":      "run\x00\n",
+				"/dest/app.conf":    "key=value",
+				"/dest/data.bin":    "data",
+				"/dest/bin/tool.sh": "tool",
+			},
+		},
+		// Without text patterns, the files which are not declared binary
+		// are detected by their content.
+		{
+			flags: []string{"--final-newline=*", "--binary=*.bin"},
+			src:   "app",
+			expected: map[string]string{
+				"/dest/run.sh":      "run\n",
+				"/dest/nul.sh":      "run\x00",
+				"/dest/app.conf":    "key=value\n",
+				"/dest/data.bin":    "data",
+				"/dest/bin/tool.sh": "tool\n",
+			},
+		},
+	} {
+		b, mockBackend := newCopyBuilder()
+		copied := make(map[string]string)
+		mockBackend.copyOnBuildFunc = imageFiles(copied)
+
+		require.NoError(t, dispatchCopy(copyReq(b, source, testcase.flags, testcase.src, "/dest/")), "%v", testcase.flags)
+		assert.Equal(t, testcase.expected, copied, "%v", testcase.flags)
+	}
+
+	// The files of the build context are left alone.
+	for name, content := range files {
+		data, err := ioutil.ReadFile(filepath.Join(contextDir, name))
+		require.NoError(t, err)
+		assert.Equal(t, content, string(data), name)
+	}
+}
+
+func TestCopyGitignore(t *testing.T) {
+	files := map[string]string{
+		"app/.gitignore":                "node_modules/\n*.log\n!keep.log\n",
+		"app/main.js":                   "main",
+		"app/debug.log":                 "debug",
+		"app/keep.log":                  "keep",
+		"app/node_modules/dep/index.js": "dep",
+		"app/src/.gitignore":            "# nested\nbuild/\n/local.txt\n",
+		"app/src/lib.js":                "lib",
+		"app/src/local.txt":             "local",
+		"app/src/build/out.js":          "out",
+		"app/src/sub/local.txt":         "sub",
+	}
+	contextDir, source, cleanup := newCopyContext(t, files)
+	defer cleanup()
+
+	b, mockBackend := newCopyBuilder()
+	copied := make(map[string]string)
+	mockBackend.copyOnBuildFunc = imageFiles(copied)
+
+	require.NoError(t, dispatchCopy(copyReq(b, source, []string{"--gitignore"}, "app", "/app/")))
+	expected := make(map[string]string)
+	for _, name := range []string{".gitignore", "keep.log", "main.js", "src/.gitignore", "src/lib.js", "src/sub/local.txt"} {
+		expected["/app/"+name] = files["app/"+name]
+	}
+	assert.Equal(t, expected, copied)
+
+	// The ignored files are not part of the cache hash, but the option
+	// is as soon as it ignores a file.
+	hashOf := func(gitignore bool) string {
+		source, err := remotecontext.NewLazyContext(contextDir)
+		require.NoError(t, err)
+		o := copier{source: source, gitignore: gitignore}
+		defer o.Cleanup()
+		infos, err := o.calcCopyInfo("app", false)
+		require.NoError(t, err)
+		require.Len(t, infos, 1)
+		return infos[0].hash
+	}
+	hash := hashOf(true)
+	assert.NotEqual(t, hashOf(false), hash)
+	createTestTempFile(t, contextDir, "app/debug.log", "changed", 0644)
+	assert.Equal(t, hash, hashOf(true))
+	createTestTempFile(t, contextDir, "app/main.js", "changed", 0644)
+	assert.NotEqual(t, hash, hashOf(true))
+}
+
+func TestCopyFilters(t *testing.T) {
+	contextDir, source, cleanup := newCopyContext(t, map[string]string{
+		"sizes/small": "small",
+		"sizes/limit": strings.Repeat("x", 1024),
+		"sizes/large": strings.Repeat("x", 1025),
+	})
+	defer cleanup()
+	cutoff := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, os.MkdirAll(filepath.Join(contextDir, "times", "sub"), 0755))
+	for name, mtime := range map[string]time.Time{
+		"times/old":       cutoff.Add(-time.Second),
+		"times/cutoff":    cutoff,
+		"times/new":       cutoff.Add(time.Second),
+		"times/sub/newer": cutoff.Add(time.Hour),
+	} {
+		createTestTempFile(t, contextDir, name, name, 0644)
+		require.NoError(t, os.Chtimes(filepath.Join(contextDir, name), mtime, mtime))
+	}
+
+	for _, testcase := range []struct {
+		flags    []string
+		src      string
+		expected []string
+	}{
+		{flags: []string{"--max-size=1k"}, src: "sizes", expected: []string{"/dest/limit", "/dest/small"}},
+		{flags: []string{"--max-size=1024"}, src: "sizes/*", expected: []string{"/dest/limit", "/dest/small"}},
+		{flags: []string{"--newer-than=2024-01-01"}, src: "times", expected: []string{"/dest/new", "/dest/sub/newer"}},
+		{flags: []string{"--newer-than=2024-01-01T00:00:00.5Z"}, src: "times/*", expected: []string{"/dest/new", "/dest/newer"}},
+		{flags: []string{"--newer-than=2024-01-01T01:00:00+01:00"}, src: "times/cutoff", expected: []string{"/dest/cutoff"}},
+	} {
+		b, mockBackend := newCopyBuilder()
+		copied := make(map[string]string)
+		mockBackend.copyOnBuildFunc = imageFiles(copied)
+
+		require.NoError(t, dispatchCopy(copyReq(b, source, testcase.flags, testcase.src, "/dest/")), "%v", testcase.flags)
+		var names []string
+		for name := range copied {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		assert.Equal(t, testcase.expected, names, "%v %s", testcase.flags, testcase.src)
+	}
+}
+
+func TestFileFilter(t *testing.T) {
+	f, err := newFileFilter("", "", "COPY")
+	require.NoError(t, err)
+	assert.Nil(t, f)
+
+	f, err = newFileFilter("10M", "2024-01-01T01:00:00+01:00", "COPY")
+	require.NoError(t, err)
+	assert.Equal(t, "--max-size=10485760 --newer-than=2024-01-01T00:00:00Z", f.String())
+
+	for _, testcase := range []struct {
+		maxSize, newerThan, expected string
+	}{
+		{maxSize: "0", expected: `invalid value "0" for COPY --max-size: must be a positive size`},
+		{maxSize: "big", expected: `invalid value "big" for COPY --max-size: must be a positive size`},
+		{newerThan: "yesterday", expected: `invalid value "yesterday" for COPY --newer-than: must be a date or an RFC 3339 timestamp`},
+	} {
+		_, err := newFileFilter(testcase.maxSize, testcase.newerThan, "COPY")
+		assert.EqualError(t, err, testcase.expected)
+	}
+}
+
+func TestCopyDirSymlinks(t *testing.T) {
+	contextDir, source, cleanup := newCopyContext(t, map[string]string{
+		"releases/1.2/bin/app": "app",
+		"releases/1.2/README":  "readme",
+	})
+	defer cleanup()
+	createTestSymlink(t, contextDir, "current", "releases/1.2")
+
+	contents := map[string]string{"/app/README": "readme", "/app/bin/app": "app"}
+	symlink := map[string]string{"/app/current": "-> releases/1.2"}
+	for _, testcase := range []struct {
+		flags    []string
+		src      string
+		expected map[string]string
+	}{
+		{src: "current", expected: contents},
+		{src: "current/", expected: contents},
+		{flags: []string{"--dir-symlinks=follow"}, src: "current", expected: contents},
+		{flags: []string{"--dir-symlinks=preserve"}, src: "current", expected: symlink},
+		{flags: []string{"--dir-symlinks=preserve"}, src: "current/", expected: contents},
+		{flags: []string{"--dir-symlinks=preserve"}, src: "curr*", expected: symlink},
+		{flags: []string{"--dir-symlinks=preserve"}, src: "releases/1.2", expected: contents},
+	} {
+		b, mockBackend := newCopyBuilder()
+		copied := make(map[string]string)
+		mockBackend.copyOnBuildFunc = imageFiles(copied)
+
+		require.NoError(t, dispatchCopy(copyReq(b, source, testcase.flags, testcase.src, "/app/")), "%v %s", testcase.flags, testcase.src)
+		assert.Equal(t, testcase.expected, copied, "%v %s", testcase.flags, testcase.src)
+	}
+
+	// The hash of a preserved symlink is the one of its target path.
+	o := copier{source: source, preserveDirSymlinks: true}
+	defer o.Cleanup()
+	infos, err := o.calcCopyInfo("current", false)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, hashStringSlice("symlink", []string{"current", "releases/1.2"}), infos[0].hash)
+}
+
+func TestCopyCacheKey(t *testing.T) {
+	contextDir, _, cleanup := newCopyContext(t, map[string]string{"src/main.go": "package main", "src/sub/lib.go": "package sub"})
+	defer cleanup()
+
+	// A fresh context is used for each hash, as the hashes are cached.
+	hashOf := func(contentCacheKey bool, path string) string {
+		source, err := remotecontext.NewLazyContext(contextDir)
+		require.NoError(t, err)
+		o := copier{source: source, contentCacheKey: contentCacheKey}
+		defer o.Cleanup()
+		infos, err := o.calcCopyInfo(path, true)
+		require.NoError(t, err)
+		require.Len(t, infos, 1)
+		return infos[0].hash
+	}
+	paths := []string{"src", "src/main.go"}
+	full := make(map[string]string)
+	content := make(map[string]string)
+	for _, p := range paths {
+		full[p] = hashOf(false, p)
+		content[p] = hashOf(true, p)
+		assert.NotEqual(t, full[p], content[p], p)
+	}
+
+	// Only the modification times change: both cache keys hit.
+	mtime := time.Now().Add(-24 * time.Hour)
+	for _, name := range []string{"src", "src/sub", "src/main.go", "src/sub/lib.go"} {
+		require.NoError(t, os.Chtimes(filepath.Join(contextDir, name), mtime, mtime))
+	}
+	for _, p := range paths {
+		assert.Equal(t, full[p], hashOf(false, p), p)
+		assert.Equal(t, content[p], hashOf(true, p), p)
+	}
+
+	// Only the mode changes: only the content cache key hits.
+	require.NoError(t, os.Chmod(filepath.Join(contextDir, "src", "main.go"), 0755))
+	for _, p := range paths {
+		assert.NotEqual(t, full[p], hashOf(false, p), p)
+		assert.Equal(t, content[p], hashOf(true, p), p)
+	}
+
+	// The content changes: no cache key hits.
+	createTestTempFile(t, contextDir, "src/main.go", "package main // changed", 0755)
+	for _, p := range paths {
+		assert.NotEqual(t, content[p], hashOf(true, p), p)
+	}
+}
+
+func TestCopyCacheKeyFlags(t *testing.T) {
+	_, source, cleanup := newCopyContext(t, map[string]string{"app.conf": "key=value"})
+	defer cleanup()
+
+	b := newBuilderWithMockBackend()
+	require.NoError(t, b.buildStages.add("", &mockImage{id: "base"}))
+	mockBackend := b.docker.(*MockBackend)
+	var cmd strslice.StrSlice
+	mockBackend.makeImageCacheFunc = func(_ []string) builder.ImageCache {
+		return &mockImageCache{
+			getCacheFunc: func(parentID string, cfg *container.Config) (string, error) {
+				cmd = cfg.Cmd
+				return "cached", nil
+			},
+		}
+	}
+	cacheKey := func(flags ...string) string {
+		// Probing again after a hit needs a fresh prober.
+		b.imageProber = newImageProber(mockBackend, nil, false)
+		require.NoError(t, dispatchCopy(copyReq(b, source, flags, "app.conf", "/etc/")))
+		return strings.Join(cmd, " ")
+	}
+
+	// Copies of the same source differing only by their flags must not
+	// share their cache entries.
+	keys := make(map[string][]string)
+	for _, flags := range [][]string{
+		nil,
+		{"--final-newline=*.conf"},
+		{"--final-newline=*"},
+		{"--final-newline=*", "--text=*.conf"},
+		{"--final-newline=*", "--binary=*.conf"},
+		{"--parents"},
+		{"--skip-identical"},
+	} {
+		key := cacheKey(flags...)
+		assert.NotContains(t, keys, key, "%v and %v", flags, keys[key])
+		keys[key] = flags
+		assert.Equal(t, key, cacheKey(flags...), "%v", flags)
+	}
+}
+
+func TestCopyWarnsOnLargeSource(t *testing.T) {
+	files := make(map[string]string)
+	for i := 0; i < 5; i++ {
+		files[fmt.Sprintf(".git/objects/%d", i)] = "1234"
+	}
+	_, source, cleanup := newCopyContext(t, files)
+	defer cleanup()
+
+	b, _ := newCopyBuilder()
+	for _, testcase := range []struct {
+		threshold int
+		expected  string
+	}{
+		{threshold: 4, expected: "[Warning] . holds 5 files (20B), consider excluding the files the build does not need with a .dockerignore file\n"},
+		{threshold: 5},
+		{threshold: 0},
+		{threshold: -1},
+	} {
+		stdout := new(bytes.Buffer)
+		b.Stdout = stdout
+		b.options.CopyWarningThreshold = testcase.threshold
+		require.NoError(t, dispatchCopy(copyReq(b, source, nil, ".", "/app/")))
+		if testcase.expected == "" {
+			assert.NotContains(t, stdout.String(), "[Warning]", "threshold %d", testcase.threshold)
+			continue
+		}
+		assert.Contains(t, stdout.String(), testcase.expected, "threshold %d", testcase.threshold)
+	}
+}
+
+func TestCopyCheckSpace(t *testing.T) {
+	_, source, cleanup := newCopyContext(t, map[string]string{
+		"data/a.bin": strings.Repeat("a", 3072),
+		"data/b.bin": strings.Repeat("b", 1024),
+	})
+	defer cleanup()
+
+	for _, testcase := range []struct {
+		flags   []string
+		free    int64
+		checked bool
+		err     string
+	}{
+		// The destination is too small: nothing is copied.
+		{flags: []string{"--check-space"}, free: 2048, checked: true, err: "insufficient space to copy 4KiB: only 2KiB left"},
+		{flags: []string{"--check-space"}, free: 4096, checked: true},
+		// The space left is unknown.
+		{flags: []string{"--check-space"}, free: -1, checked: true},
+		{flags: nil, free: 2048, checked: false},
+	} {
+		b, mockBackend := newCopyBuilder()
+		var copied []string
+		mockBackend.copyOnBuildFunc = recordSources(&copied)
+		checked := false
+		mockBackend.freeSpaceFunc = func(containerID string) (int64, error) {
+			assert.Equal(t, "12345", containerID)
+			checked = true
+			return testcase.free, nil
+		}
+
+		err := dispatchCopy(copyReq(b, source, testcase.flags, "data", "/data/"))
+		assert.Equal(t, testcase.checked, checked, "%v %d", testcase.flags, testcase.free)
+		if testcase.err != "" {
+			assert.EqualError(t, err, testcase.err)
+			assert.Empty(t, copied)
+			continue
+		}
+		require.NoError(t, err, "%v %d", testcase.flags, testcase.free)
+		assert.Equal(t, []string{"data"}, copied)
+	}
+}
+
+func TestCopyManifest(t *testing.T) {
+	files := map[string]string{
+		"src/main.go":    "package main",
+		"src/sub/lib.go": "package sub",
+		"README":         "readme",
+	}
+	_, source, cleanup := newCopyContext(t, files)
+	defer cleanup()
+
+	b, mockBackend := newCopyBuilder()
+	copied := make(map[string]string)
+	record := imageFiles(copied)
+	var dests []string
+	mockBackend.copyOnBuildFunc = func(containerID, destPath, srcRoot, srcPath string, decompress bool) error {
+		dests = append(dests, destPath)
+		return record(containerID, destPath, srcRoot, srcPath, decompress)
+	}
+
+	req := copyReq(b, source, []string{"--manifest=checksums.sha256"}, "src", "README", "dest/")
+	req.state.runConfig.WorkingDir = "/app"
+	require.NoError(t, dispatchCopy(req))
+	assert.Equal(t, []string{"/app/dest/", "/app/dest/", "/app/checksums.sha256"}, dests)
+
+	digest := func(name string) string {
+		sum := sha256.Sum256([]byte(files[name]))
+		return hex.EncodeToString(sum[:])
+	}
+	assert.Equal(t, map[string]string{
+		"/app/dest/README":      "readme",
+		"/app/dest/main.go":     "package main",
+		"/app/dest/sub/lib.go":  "package sub",
+		"/app/checksums.sha256": digest("README") + "  /app/dest/README\n" + digest("src/main.go") + "  /app/dest/main.go\n" + digest("src/sub/lib.go") + "  /app/dest/sub/lib.go\n",
+	}, copied)
+
+	err := dispatchCopy(copyReq(b, source, []string{"--manifest=/checksums.sha256"}, "README", "/app/README"))
+	assert.EqualError(t, err, "COPY --manifest failed: the destination must be a directory and end with a /")
+}
+
+func TestCopyDeniedDigest(t *testing.T) {
+	contextDir, source, cleanup := newCopyContext(t, map[string]string{"app/main": "main", "app/lib/evil.so": "evil"})
+	defer cleanup()
+
+	sum := sha256.Sum256([]byte("evil"))
+	digest := hex.EncodeToString(sum[:])
+	denylistFile := createTestTempFile(t, contextDir, "denylist",
+		"# known bad\n\nsha256:"+strings.ToUpper(digest)+"\n"+digest+"  evil.so\n", 0644)
+	denylist, err := loadDigestDenylist(denylistFile)
+	require.NoError(t, err)
+	assert.Equal(t, digestDenylist{digest: {}}, denylist)
+
+	b, _ := newCopyBuilder()
+	b.denylist = denylist
+
+	for _, testcase := range []struct {
+		src      string
+		expected string
+	}{
+		{src: "app/main"},
+		{src: "app", expected: "COPY failed: app/lib/evil.so is denied by the daemon, its digest sha256:" + digest + " is on the builder denylist"},
+		{src: "app/lib/evil.so", expected: "COPY failed: app/lib/evil.so is denied by the daemon, its digest sha256:" + digest + " is on the builder denylist"},
+	} {
+		err := dispatchCopy(copyReq(b, source, nil, testcase.src, "/dest/"))
+		if testcase.expected == "" {
+			assert.NoError(t, err, testcase.src)
+			continue
+		}
+		assert.EqualError(t, err, testcase.expected, testcase.src)
+	}
+
+	createTestTempFile(t, contextDir, "invalid", "sha256:1234\n", 0644)
+	_, err = loadDigestDenylist(filepath.Join(contextDir, "invalid"))
+	assert.EqualError(t, err, `invalid sha256 digest "sha256:1234" on line 1 of the builder denylist `+filepath.Join(contextDir, "invalid"))
+}
+
+// TestCopyBackendOptions checks the options of the copy passed to the
+// backend, and the command of its cache key.
+func TestCopyBackendOptions(t *testing.T) {
+	_, source, cleanup := newCopyContext(t, map[string]string{"file": "file"})
+	defer cleanup()
+
+	for _, testcase := range []struct {
+		flags         []string
+		dest          string
+		ownership     *idtools.IDMappings
+		dirMode       os.FileMode
+		skipIdentical bool
+	}{
+		{dest: "/dest/"},
+		{
+			flags:     []string{"--uidmap=1000:0:10,2000:100", "--gidmap=1000:0"},
+			dest:      "/dest/",
+			ownership: idtools.NewIDMappingsFromMaps([]idtools.IDMap{{HostID: 1000, ContainerID: 0, Size: 10}, {HostID: 2000, ContainerID: 100, Size: 1}}, []idtools.IDMap{{HostID: 1000, ContainerID: 0, Size: 1}}),
+		},
+		{flags: []string{"--parent-mode=0700"}, dest: "/secret/dir/", dirMode: 0700},
+		{flags: []string{"--skip-identical"}, dest: "/dest/", skipIdentical: true},
+	} {
+		b, mockBackend := newCopyBuilder()
+		var cmd string
+		mockBackend.containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+			cmd = strings.Join(config.Config.Cmd, " ")
+			return container.ContainerCreateCreatedBody{ID: "12345"}, nil
+		}
+
+		require.NoError(t, dispatchCopy(copyReq(b, source, testcase.flags, "file", testcase.dest)), "%v", testcase.flags)
+		assert.Equal(t, testcase.ownership, mockBackend.copyOwnership, "%v", testcase.flags)
+		assert.Equal(t, testcase.dirMode, mockBackend.copyDirMode, "%v", testcase.flags)
+		assert.Equal(t, testcase.skipIdentical, mockBackend.copySkipIdentical, "%v", testcase.flags)
+		assert.Equal(t, testcase.skipIdentical, strings.Contains(cmd, "COPY --skip-identical "), "%v", testcase.flags)
+	}
+}
+
+func TestCopyVerify(t *testing.T) {
+	files := map[string]string{
+		"src/main.go":    "package main",
+		"src/sub/lib.go": "package sub",
+	}
+	digest := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+	files["good.sha256"] = "# expected files\n" +
+		digest("package main") + "  main.go\n" +
+		digest("package sub") + " */app/dest/sub/lib.go\n"
+	files["bad.sha256"] = digest("package main") + "  main.go\n" +
+		digest("package other") + "  sub/lib.go\n" +
+		digest("missing") + "  missing.go\n"
+	files["relative.sha256"] = digest("package main") + "  main.go\n"
+	_, source, cleanup := newCopyContext(t, files)
+	defer cleanup()
+
+	b, mockBackend := newCopyBuilder()
+	// The container holds the copies of the files of src.
+	var verified []string
+	mockBackend.digestsFunc = func(containerID string, paths []string) (map[string]string, error) {
+		verified = paths
+		digests := make(map[string]string)
+		for _, p := range paths {
+			if content, ok := files["src/"+strings.TrimPrefix(p, "/app/dest/")]; ok {
+				digests[p] = digest(content)
+			}
+		}
+		return digests, nil
+	}
+
+	req := copyReq(b, source, []string{"--verify=good.sha256"}, "src", "dest/")
+	req.state.runConfig.WorkingDir = "/app"
+	require.NoError(t, dispatchCopy(req))
+	assert.Equal(t, []string{"/app/dest/main.go", "/app/dest/sub/lib.go"}, verified)
+
+	req = copyReq(b, source, []string{"--verify=bad.sha256"}, "src", "dest/")
+	req.state.runConfig.WorkingDir = "/app"
+	err := dispatchCopy(req)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "COPY --verify failed")
+		assert.Contains(t, err.Error(), "/app/dest/missing.go is missing")
+		assert.Contains(t, err.Error(), "/app/dest/sub/lib.go has digest sha256:"+digest("package sub")+" instead of sha256:"+digest("package other"))
+		assert.NotContains(t, err.Error(), "main.go")
+	}
+
+	err = dispatchCopy(copyReq(b, source, []string{"--verify=relative.sha256"}, "src/main.go", "/app/main.go"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "main.go is relative but the destination is not a directory ending with a /")
+	}
+}
@@ -156,6 +156,11 @@ func (b *Builder) dispatch(options dispatchOptions) (*dispatchState, error) {
 
 	runConfigEnv := options.state.runConfig.Env
 	envs := append(runConfigEnv, b.buildArgs.FilterAllowed(runConfigEnv)...)
+	if cmd == command.Add || cmd == command.Copy {
+		// The destination may depend on the platform being built for,
+		// e.g. COPY bin /opt/${TARGETARCH}/bin/
+		envs = append(envs, b.targetPlatform(options.state).envs()...)
+	}
 	processFunc := createProcessWordFunc(options.shlex, cmd, envs)
 	words, err := getDispatchArgsFromNode(ast, processFunc, msg)
 	if err != nil {
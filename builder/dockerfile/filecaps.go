@@ -0,0 +1,144 @@
+package dockerfile
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/ioutils"
+	"github.com/docker/docker/pkg/system"
+	"github.com/pkg/errors"
+	"github.com/syndtr/gocapability/capability"
+)
+
+const (
+	// capabilityXattr is the extended attribute holding the capabilities
+	// of a file.
+	capabilityXattr = "security.capability"
+	// vfsCapRevision2 and vfsCapFlagsEffective are the header of the
+	// vfs_cap_data structure stored in capabilityXattr, which lists the
+	// capabilities as two sets of 64 bits.
+	vfsCapRevision2      = 0x02000000
+	vfsCapFlagsEffective = 0x000001
+)
+
+// fileCapabilities are the capabilities set on the files copied by COPY
+// --cap.
+type fileCapabilities struct {
+	caps        []capability.Cap
+	effective   bool
+	permitted   bool
+	inheritable bool
+}
+
+// parseFileCapabilities parses capabilities in the textual form of
+// setcap(8), a comma-separated list of capability names followed by "+" or
+// "=" and the e, i and p flags, e.g. "cap_net_bind_service+ep".
+func parseFileCapabilities(s string) (fileCapabilities, error) {
+	var fc fileCapabilities
+	i := strings.IndexAny(s, "+=")
+	if i < 0 {
+		return fc, errors.Errorf("invalid capabilities %q: expected <caps>+<flags>", s)
+	}
+	names, flags := s[:i], s[i+1:]
+	if flags == "" {
+		return fc, errors.Errorf("invalid capabilities %q: no flags", s)
+	}
+	for _, flag := range flags {
+		switch flag {
+		case 'e':
+			fc.effective = true
+		case 'i':
+			fc.inheritable = true
+		case 'p':
+			fc.permitted = true
+		default:
+			return fc, errors.Errorf("invalid capabilities %q: unknown flag %q", s, flag)
+		}
+	}
+	if !fc.permitted && !fc.inheritable {
+		return fc, errors.Errorf("invalid capabilities %q: the p or i flag is required", s)
+	}
+	for _, name := range strings.Split(names, ",") {
+		c, ok := capabilityByName(name)
+		if !ok {
+			return fc, errors.Errorf("invalid capabilities %q: unknown capability %q", s, name)
+		}
+		fc.caps = append(fc.caps, c)
+	}
+	return fc, nil
+}
+
+// capabilityByName returns the capability named name, e.g.
+// "cap_net_bind_service". The case of name does not matter.
+func capabilityByName(name string) (capability.Cap, bool) {
+	name = strings.ToLower(name)
+	if !strings.HasPrefix(name, "cap_") {
+		return 0, false
+	}
+	for _, c := range capability.List() {
+		if "cap_"+c.String() == name {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// xattr returns the value of capabilityXattr setting the capabilities.
+func (fc fileCapabilities) xattr() []byte {
+	var permitted, inheritable uint64
+	for _, c := range fc.caps {
+		if fc.permitted {
+			permitted |= 1 << uint(c)
+		}
+		if fc.inheritable {
+			inheritable |= 1 << uint(c)
+		}
+	}
+	magic := uint32(vfsCapRevision2)
+	if fc.effective {
+		magic |= vfsCapFlagsEffective
+	}
+	data := make([]byte, 20)
+	binary.LittleEndian.PutUint32(data[0:], magic)
+	binary.LittleEndian.PutUint32(data[4:], uint32(permitted))
+	binary.LittleEndian.PutUint32(data[8:], uint32(inheritable))
+	binary.LittleEndian.PutUint32(data[12:], uint32(permitted>>32))
+	binary.LittleEndian.PutUint32(data[16:], uint32(inheritable>>32))
+	return data
+}
+
+// stageFileCapabilities returns infos with the sources replaced by copies
+// of them carrying the capabilities fc, which the copy into the image
+// preserves. The sources must be files.
+func (o *copier) stageFileCapabilities(infos []copyInfo, fc fileCapabilities) ([]copyInfo, error) {
+	staged := make([]copyInfo, 0, len(infos))
+	for _, info := range infos {
+		src := filepath.Join(info.root, info.path)
+		fi, err := os.Stat(src)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil, errors.Errorf("%s is not a file", filepath.ToSlash(info.path))
+		}
+
+		tmpDir, err := ioutils.TempDir("", "docker-file-caps")
+		if err != nil {
+			return nil, err
+		}
+		o.tmpPaths = append(o.tmpPaths, tmpDir)
+		base := filepath.Base(info.path)
+		dst := filepath.Join(tmpDir, base)
+		if err := archive.NewDefaultArchiver().CopyFileWithTar(src, dst); err != nil {
+			return nil, err
+		}
+		if err := system.Lsetxattr(dst, capabilityXattr, fc.xattr(), 0); err != nil {
+			return nil, errors.Wrapf(err, "failed to set the capabilities of %s", filepath.ToSlash(info.path))
+		}
+		staged = append(staged, copyInfo{root: tmpDir, path: base, hash: info.hash, parentDir: info.parentDir})
+	}
+	return staged, nil
+}
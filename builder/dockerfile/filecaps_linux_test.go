@@ -0,0 +1,51 @@
+package dockerfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/builder/remotecontext"
+	"github.com/docker/docker/pkg/system"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyCap(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("setting file capabilities requires root")
+	}
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	createTestTempFile(t, contextDir, "server", "#!/bin/sh\n", 0755)
+	source, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	b := newBuilderWithMockBackend()
+	mockBackend := b.docker.(*MockBackend)
+	b.imageProber = newImageProber(mockBackend, nil, true)
+	mockBackend.containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+		return container.ContainerCreateCreatedBody{ID: "12345"}, nil
+	}
+	var capabilities []byte
+	mockBackend.copyOnBuildFunc = func(containerID, destPath, srcRoot, srcPath string, decompress bool) error {
+		var err error
+		capabilities, err = system.Lgetxattr(filepath.Join(srcRoot, srcPath), capabilityXattr)
+		return err
+	}
+
+	req := defaultDispatchReq(b, "server", "/usr/bin/server")
+	req.flags = NewBFlagsWithArgs([]string{"--cap=cap_net_bind_service+ep"})
+	req.source = source
+	require.NoError(t, dispatchCopy(req))
+	// Revision 2 with the effective flag, and CAP_NET_BIND_SERVICE (10)
+	// permitted.
+	assert.Equal(t, []byte{1, 0, 0, 2, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, capabilities)
+
+	// The file of the build context is left alone.
+	original, err := system.Lgetxattr(filepath.Join(contextDir, "server"), capabilityXattr)
+	require.NoError(t, err)
+	assert.Nil(t, original)
+}
@@ -0,0 +1,39 @@
+package dockerfile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/gocapability/capability"
+)
+
+func TestParseFileCapabilities(t *testing.T) {
+	fc, err := parseFileCapabilities("CAP_NET_RAW,cap_net_admin=eip")
+	require.NoError(t, err)
+	assert.Equal(t, fileCapabilities{
+		caps:        []capability.Cap{capability.CAP_NET_RAW, capability.CAP_NET_ADMIN},
+		effective:   true,
+		permitted:   true,
+		inheritable: true,
+	}, fc)
+
+	for value, expected := range map[string]string{
+		"cap_net_bind_service":    `invalid capabilities "cap_net_bind_service": expected <caps>+<flags>`,
+		"cap_net_bind_service+":   `invalid capabilities "cap_net_bind_service+": no flags`,
+		"cap_net_bind_service+ex": `invalid capabilities "cap_net_bind_service+ex": unknown flag 'x'`,
+		"cap_net_bind_service+e":  `invalid capabilities "cap_net_bind_service+e": the p or i flag is required`,
+		"cap_fly+ep":              `invalid capabilities "cap_fly+ep": unknown capability "cap_fly"`,
+		"net_bind_service+ep":     `invalid capabilities "net_bind_service+ep": unknown capability "net_bind_service"`,
+		"cap_chown,,cap_kill+ep":  `invalid capabilities "cap_chown,,cap_kill+ep": unknown capability ""`,
+	} {
+		_, err := parseFileCapabilities(value)
+		assert.EqualError(t, err, expected, value)
+	}
+}
+
+func TestFileCapabilitiesXattr(t *testing.T) {
+	fc := fileCapabilities{caps: []capability.Cap{capability.CAP_SYSLOG}, inheritable: true}
+	// CAP_SYSLOG (34) is in the upper set.
+	assert.Equal(t, []byte{0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0}, fc.xattr())
+}
@@ -0,0 +1,172 @@
+package dockerfile
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/builder"
+	"github.com/docker/docker/builder/remotecontext"
+	"github.com/pkg/errors"
+)
+
+// gitignoreRule is a pattern of a .gitignore file.
+type gitignoreRule struct {
+	pattern string
+	// negate makes the paths matched by the pattern included again.
+	negate bool
+	// dirOnly makes the pattern only match directories.
+	dirOnly bool
+	// anchored makes the pattern match the path relative to the directory
+	// of the .gitignore file rather than the name of the file.
+	anchored bool
+}
+
+// parseGitignore parses the patterns of a .gitignore file. Empty lines and
+// lines starting with "#" are ignored. The "**" wildcard is only supported
+// as a leading "**/".
+func parseGitignore(r io.Reader) ([]gitignoreRule, error) {
+	var rules []gitignoreRule
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule gitignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		switch {
+		case strings.HasPrefix(line, "/"):
+			rule.anchored = true
+			line = strings.TrimLeft(line, "/")
+		case strings.HasPrefix(line, "**/"):
+			line = strings.TrimPrefix(line, "**/")
+			rule.anchored = strings.Contains(line, "/")
+		default:
+			rule.anchored = strings.Contains(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			return nil, errors.Errorf("line %d: invalid pattern %q", n, scanner.Text())
+		}
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// matches returns whether the rule matches the slash-separated path p,
+// relative to the directory of its .gitignore file.
+func (r gitignoreRule) matches(p string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if !r.anchored {
+		p = path.Base(p)
+	}
+	match, _ := path.Match(r.pattern, p)
+	return match
+}
+
+// gitignoreMatcher matches the paths ignored by the .gitignore files of a
+// directory of the build context and of its subdirectories (COPY
+// --gitignore). The .gitignore files of the directories above it are not
+// taken into account.
+type gitignoreMatcher struct {
+	source builder.Source
+	// base is the directory, relative to the build context.
+	base  string
+	rules map[string][]gitignoreRule
+}
+
+func newGitignoreMatcher(source builder.Source, base string) *gitignoreMatcher {
+	return &gitignoreMatcher{source: source, base: base, rules: make(map[string][]gitignoreRule)}
+}
+
+// rulesOf returns the rules of the .gitignore file of dir, relative to the
+// build context.
+func (m *gitignoreMatcher) rulesOf(dir string) ([]gitignoreRule, error) {
+	if rules, ok := m.rules[dir]; ok {
+		return rules, nil
+	}
+	fp, err := remotecontext.FullPath(m.source, filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fp)
+	if os.IsNotExist(err) {
+		m.rules[dir] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules, err := parseGitignore(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid .gitignore file in %s", filepath.ToSlash(dir))
+	}
+	m.rules[dir] = rules
+	return rules, nil
+}
+
+// Matches returns whether rel, relative to the build context, is ignored by
+// the .gitignore files of the directories between the base of m and rel. As
+// with git, the rules of the deeper files override the others, and the
+// last matching rule of a file wins.
+func (m *gitignoreMatcher) Matches(rel string, isDir bool) (bool, error) {
+	sub, err := filepath.Rel(m.base, rel)
+	if err != nil || sub == "." || strings.HasPrefix(sub, "..") {
+		return false, err
+	}
+	parts := strings.Split(filepath.ToSlash(sub), "/")
+	ignored := false
+	dir := m.base
+	for i := range parts {
+		rules, err := m.rulesOf(dir)
+		if err != nil {
+			return false, err
+		}
+		p := strings.Join(parts[i:], "/")
+		for _, rule := range rules {
+			if rule.matches(p, isDir) {
+				ignored = !rule.negate
+			}
+		}
+		dir = filepath.Join(dir, parts[i])
+	}
+	if ignored {
+		logrus.Debugf("Skipping %s: ignored by .gitignore", filepath.ToSlash(rel))
+	}
+	return ignored, nil
+}
+
+// literalPattern returns the pattern of pkg/fileutils matching exactly p.
+func literalPattern(p string) string {
+	escaped := make([]byte, 0, len(p))
+	for i := 0; i < len(p); i++ {
+		if strings.IndexByte(`*?[\`, p[i]) >= 0 {
+			escaped = append(escaped, '\\')
+		}
+		escaped = append(escaped, p[i])
+	}
+	return string(escaped)
+}
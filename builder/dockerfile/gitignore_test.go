@@ -0,0 +1,50 @@
+package dockerfile
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitignoreRules(t *testing.T) {
+	rules, err := parseGitignore(strings.NewReader("# comment\n\n*.o\n/root.txt\nbuild/\ndocs/*.md\n**/tmp\n!keep.o\n\\#hash\n"))
+	require.NoError(t, err)
+	for _, testcase := range []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{path: "main.o", ignored: true},
+		{path: "sub/main.o", ignored: true},
+		{path: "keep.o"},
+		{path: "sub/keep.o"},
+		{path: "root.txt", ignored: true},
+		{path: "sub/root.txt"},
+		{path: "build", isDir: true, ignored: true},
+		{path: "sub/build", isDir: true, ignored: true},
+		{path: "build"},
+		{path: "docs/index.md", ignored: true},
+		{path: "sub/docs/index.md"},
+		{path: "sub/tmp", isDir: true, ignored: true},
+		{path: "#hash", ignored: true},
+		{path: "main.c"},
+	} {
+		ignored := false
+		for _, rule := range rules {
+			if rule.matches(testcase.path, testcase.isDir) {
+				ignored = !rule.negate
+			}
+		}
+		assert.Equal(t, testcase.ignored, ignored, testcase.path)
+	}
+
+	_, err = parseGitignore(strings.NewReader("ok\n[invalid\n"))
+	assert.EqualError(t, err, `line 2: invalid pattern "[invalid"`)
+}
+
+func TestLiteralPattern(t *testing.T) {
+	assert.Equal(t, `a\*b\?c\[d\\e`, literalPattern(`a*b?c[d\e`))
+	assert.Equal(t, "plain/path", literalPattern("plain/path"))
+}
@@ -0,0 +1,104 @@
+package dockerfile
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/ioutils"
+	"github.com/pkg/errors"
+)
+
+// hashNameLength is the number of hex digits of the digest of a file put in
+// its name by COPY --hash-names.
+const hashNameLength = 8
+
+// hashedName returns the slash-separated path p with the first digits of the
+// hex-encoded digest inserted before the extension of its base name, e.g.
+// "js/app.<sha8>.js" for "js/app.js". Names without an extension get the
+// digits as an extension.
+func hashedName(p, digest string) string {
+	dir, base := path.Split(p)
+	ext := path.Ext(base)
+	if ext == base {
+		// A dotfile, e.g. ".env", has no extension.
+		ext = ""
+	}
+	return dir + base[:len(base)-len(ext)] + "." + digest[:hashNameLength] + ext
+}
+
+// stageHashNames makes inst copy the regular files below its source
+// directory to names holding the digest of their content, and adds to inst
+// the manifest mapping their paths below the destination to the hashed ones,
+// to be written at the path manifest of the image (COPY --hash-names). The
+// manifest is a JSON object, e.g. {"js/app.js": "js/app.0123abcd.js"}. The
+// other entries keep their name. The digests are taken of the files as they
+// are copied, so stageHashNames is to be called after the sources are
+// staged.
+func (o *copier) stageHashNames(inst *copyInstruction, manifest string) error {
+	if len(inst.infos) != 1 {
+		return errors.New("a single source is required")
+	}
+	if strings.HasSuffix(manifest, "/") {
+		return errors.Errorf("%s is not a file path", manifest)
+	}
+	info := inst.infos[0]
+	src := filepath.Join(info.root, info.path)
+	if fi, err := os.Stat(src); err != nil || !fi.IsDir() {
+		return errors.New("the source must be a directory")
+	}
+
+	renames := make(renameMap)
+	sources := make(map[string]bool)
+	err := filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		sources[rel] = true
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		digest, err := fileDigest(p)
+		if err != nil {
+			return err
+		}
+		renames[rel] = hashedName(rel, digest)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// A source already named after the digest of another would be
+	// overwritten by it.
+	for from, to := range renames {
+		if sources[to] {
+			return errors.Errorf("%s would overwrite %s", from, to)
+		}
+	}
+
+	content, err := json.MarshalIndent(renames, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmpDir, err := ioutils.TempDir("", "docker-copy-hash-names")
+	if err != nil {
+		return err
+	}
+	o.tmpPaths = append(o.tmpPaths, tmpDir)
+	name := filepath.Base(filepath.FromSlash(manifest))
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, name), append(content, '\n'), 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	inst.renames = renames
+	inst.manifest = manifest
+	inst.manifestInfo = copyInfo{root: tmpDir, path: name}
+	return nil
+}
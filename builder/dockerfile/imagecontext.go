@@ -14,12 +14,13 @@ import (
 )
 
 type buildStage struct {
-	id     string
-	config *container.Config
+	id       string
+	config   *container.Config
+	platform buildPlatform
 }
 
 func newBuildStageFromImage(image builder.Image) *buildStage {
-	return &buildStage{id: image.ImageID(), config: image.RunConfig()}
+	return &buildStage{id: image.ImageID(), config: image.RunConfig(), platform: imagePlatform(image)}
 }
 
 func (b *buildStage) ImageID() string {
@@ -30,12 +31,16 @@ func (b *buildStage) RunConfig() *container.Config {
 	return b.config
 }
 
+func (b *buildStage) Platform() (string, string) {
+	return b.platform.OS, b.platform.Architecture
+}
+
 func (b *buildStage) update(imageID string, runConfig *container.Config) {
 	b.id = imageID
 	b.config = runConfig
 }
 
-var _ builder.Image = &buildStage{}
+var _ builder.PlatformImage = &buildStage{}
 
 // buildStages tracks each stage of a build so they can be retrieved by index
 // or by name.
@@ -94,20 +99,25 @@ func (s *buildStages) update(imageID string, runConfig *container.Config) {
 	s.sequence[len(s.sequence)-1].update(imageID, runConfig)
 }
 
-type getAndMountFunc func(string) (builder.Image, builder.ReleaseableLayer, error)
+// getAndMountFunc returns an image and its layer from a reference or an ID.
+// When localOnly is true the image is never pulled.
+type getAndMountFunc func(idOrRef string, localOnly bool) (builder.Image, builder.ReleaseableLayer, error)
 
 // imageSources mounts images and provides a cache for mounted images. It tracks
 // all images so they can be unmounted at the end of the build.
 type imageSources struct {
 	byImageID map[string]*imageMount
-	getImage  getAndMountFunc
-	cache     pathCache // TODO: remove
+	// byRef maps the references images were got by to their IDs, so that
+	// an image is only pulled once per build.
+	byRef    map[string]string
+	getImage getAndMountFunc
+	cache    pathCache // TODO: remove
 }
 
 func newImageSources(ctx context.Context, options builderOptions) *imageSources {
-	getAndMount := func(idOrRef string) (builder.Image, builder.ReleaseableLayer, error) {
+	getAndMount := func(idOrRef string, localOnly bool) (builder.Image, builder.ReleaseableLayer, error) {
 		return options.Backend.GetImageAndReleasableLayer(ctx, idOrRef, backend.GetImageAndLayerOptions{
-			ForcePull:  options.Options.PullParent,
+			ForcePull:  options.Options.PullParent && !localOnly,
 			AuthConfig: options.Options.AuthConfigs,
 			Output:     options.ProgressWriter.Output,
 		})
@@ -115,19 +125,41 @@ func newImageSources(ctx context.Context, options builderOptions) *imageSources
 
 	return &imageSources{
 		byImageID: make(map[string]*imageMount),
+		byRef:     make(map[string]string),
 		getImage:  getAndMount,
 	}
 }
 
-func (m *imageSources) Get(idOrRef string) (*imageMount, error) {
+// Get returns the mount of the image idOrRef, getting it with getImage the
+// first time it is asked for. localOnly is true for the images of the
+// stages of the build, which only exist locally and must not be pulled
+// even when the build forces pulls (--pull).
+func (m *imageSources) Get(idOrRef string, localOnly bool) (*imageMount, error) {
 	if im, ok := m.byImageID[idOrRef]; ok {
 		return im, nil
 	}
+	if id, ok := m.byRef[idOrRef]; ok {
+		return m.byImageID[id], nil
+	}
 
-	image, layer, err := m.getImage(idOrRef)
+	image, layer, err := m.getImage(idOrRef, localOnly)
 	if err != nil {
 		return nil, err
 	}
+	if idOrRef != image.ImageID() {
+		m.byRef[idOrRef] = image.ImageID()
+	}
+	// The image may already be in use through another reference, e.g. by
+	// name and by ID. Keep using the existing layer so the image is only
+	// mounted once for the whole build.
+	if im, ok := m.byImageID[image.ImageID()]; ok {
+		if layer != nil {
+			if err := layer.Release(); err != nil {
+				return nil, errors.Wrapf(err, "failed to release duplicate layer for %s", image.ImageID())
+			}
+		}
+		return im, nil
+	}
 	im := newImageMount(image, layer)
 	m.byImageID[image.ImageID()] = im
 	return im, nil
@@ -0,0 +1,120 @@
+package dockerfile
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/builder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingLayer is a builder.ReleaseableLayer recording how often it was
+// mounted and released.
+type countingLayer struct {
+	mounts   int
+	releases int
+}
+
+func (l *countingLayer) Release() error {
+	l.releases++
+	return nil
+}
+
+func (l *countingLayer) Mount() (string, error) {
+	l.mounts++
+	return "mountPath", nil
+}
+
+func newCountingImageSources(layers *[]*countingLayer) *imageSources {
+	return &imageSources{
+		byImageID: make(map[string]*imageMount),
+		byRef:     make(map[string]string),
+		getImage: func(idOrRef string, localOnly bool) (builder.Image, builder.ReleaseableLayer, error) {
+			layer := &countingLayer{}
+			*layers = append(*layers, layer)
+			return &mockImage{id: "sha256:builder"}, layer, nil
+		},
+	}
+}
+
+func TestCopyFromSameStageMountsOnce(t *testing.T) {
+	var layers []*countingLayer
+	b := newBuilderWithMockBackend()
+	b.imageSources = newCountingImageSources(&layers)
+	require.NoError(t, b.buildStages.add("builder", &mockImage{id: "sha256:builder"}))
+	require.NoError(t, b.buildStages.add("", &mockImage{id: "sha256:final"}))
+
+	for i := 0; i < 3; i++ {
+		flags := NewBFlagsWithArgs([]string{"--from=builder"})
+		flFrom := flags.AddString("from", "")
+		require.NoError(t, flags.Parse())
+		im, err := b.getImageMount(flFrom)
+		require.NoError(t, err)
+		_, err = im.Source()
+		require.NoError(t, err)
+	}
+
+	require.Len(t, layers, 1)
+	assert.Equal(t, 1, layers[0].mounts)
+	assert.Equal(t, 0, layers[0].releases)
+
+	require.NoError(t, b.imageSources.Unmount())
+	assert.Equal(t, 1, layers[0].releases)
+}
+
+func TestImageSourcesReusesImageMountedByAnotherReference(t *testing.T) {
+	var layers []*countingLayer
+	sources := newCountingImageSources(&layers)
+
+	first, err := sources.Get("builder:latest", false)
+	require.NoError(t, err)
+	_, err = first.Source()
+	require.NoError(t, err)
+
+	second, err := sources.Get("builder", false)
+	require.NoError(t, err)
+	assert.True(t, first == second)
+	_, err = second.Source()
+	require.NoError(t, err)
+
+	require.Len(t, layers, 2)
+	assert.Equal(t, 1, layers[0].mounts)
+	assert.Equal(t, 0, layers[1].mounts)
+	assert.Equal(t, 1, layers[1].releases)
+
+	require.NoError(t, sources.Unmount())
+	assert.Equal(t, 1, layers[0].releases)
+}
+
+func TestCopyFromImagePullsOnlyImages(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	localOnly := make(map[string]bool)
+	b.imageSources = &imageSources{
+		byImageID: make(map[string]*imageMount),
+		byRef:     make(map[string]string),
+		getImage: func(idOrRef string, local bool) (builder.Image, builder.ReleaseableLayer, error) {
+			_, seen := localOnly[idOrRef]
+			require.False(t, seen, "%s must only be got once", idOrRef)
+			localOnly[idOrRef] = local
+			return &mockImage{id: "sha256:" + strings.TrimPrefix(idOrRef, "sha256:")}, &countingLayer{}, nil
+		},
+	}
+	require.NoError(t, b.buildStages.add("builder", &mockImage{id: "sha256:builder"}))
+	require.NoError(t, b.buildStages.add("", &mockImage{id: "sha256:final"}))
+
+	for _, from := range []string{"builder", "registry.example.com/tools:1.0", "0", "registry.example.com/tools:1.0"} {
+		flags := NewBFlagsWithArgs([]string{"--from=" + from})
+		flFrom := flags.AddString("from", "")
+		require.NoError(t, flags.Parse())
+		_, err := b.getImageMount(flFrom)
+		require.NoError(t, err)
+	}
+
+	// The image of a stage is never pulled, even with --pull, and an image
+	// is pulled at most once per build.
+	assert.Equal(t, map[string]bool{
+		"sha256:builder":                 true,
+		"registry.example.com/tools:1.0": false,
+	}, localOnly)
+}
@@ -7,12 +7,19 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/backend"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/docker/pkg/symlink"
+	"github.com/docker/go-units"
 	"github.com/pkg/errors"
 )
 
@@ -65,16 +72,88 @@ func (b *Builder) commitContainer(dispatchState *dispatchState, id string, conta
 }
 
 func (b *Builder) performCopy(state *dispatchState, inst copyInstruction) error {
+	// Checked before probing the cache, so that an image built before a
+	// digest was denied is not reused either.
+	if err := b.denylist.check(inst); err != nil {
+		return err
+	}
+
 	srcHash := getSourceHashFromInfos(inst.infos)
 
+	// Archives are extracted by default, so only a copy which preserves
+	// them needs to be told apart in the cache.
+	cmdName := inst.cmdName
+	if cmdName == "ADD" && !inst.allowLocalDecompression {
+		cmdName += " --no-extract"
+	}
+	if inst.extractDir {
+		cmdName += " --extract-dir"
+	}
+	if inst.sync {
+		cmdName += " --sync"
+	}
+	// The directories the sources are copied into depend on the base
+	// they were given with, which the hashes of the sources do not cover.
+	if inst.preserveParents {
+		cmdName += " --parents"
+		var parents []string
+		for _, info := range inst.infos {
+			parents = append(parents, info.hash+":"+filepath.ToSlash(info.parentDir))
+		}
+		srcHash = hashStringSlice("parents", parents)
+	}
+	// The hashes of the sources are the ones of the original files.
+	if inst.finalNewline != "" {
+		cmdName += " --final-newline=" + inst.finalNewline
+	}
+	if inst.textMode != "" {
+		cmdName += " " + inst.textMode
+	}
+	if inst.capabilities != "" {
+		cmdName += " --cap=" + inst.capabilities
+	}
+	// The filter may leave out files whose hashes are not part of the
+	// hash of the sources.
+	if inst.filter != "" {
+		cmdName += " " + inst.filter
+	}
+	if inst.ownershipMap != "" {
+		cmdName += " " + inst.ownershipMap
+	}
+	if inst.dirMode != 0 {
+		cmdName += fmt.Sprintf(" --parent-mode=%o", inst.dirMode)
+	}
+	// The content is the same, but not the changes of the layer.
+	if inst.skipIdentical {
+		cmdName += " --skip-identical"
+	}
+	// The manifest is derived from the copied files.
+	if inst.manifest != "" {
+		cmdName += " --manifest=" + inst.manifest
+	}
+	// A layer built with another manifest was not verified against it.
+	if inst.verify != nil {
+		cmdName += " --verify=" + inst.verify.hash()
+	}
+	// The paths the files are copied to depend on the mapping.
+	if inst.renames != nil {
+		cmdName += " --map"
+		srcHash = hashStringSlice("renamed", []string{srcHash, inst.renames.hash(inst.skipUnmatched)})
+	}
+
 	// TODO: should this have been using origPaths instead of srcHash in the comment?
 	runConfigWithCommentCmd := copyRunConfig(
 		state.runConfig,
-		withCmdCommentString(fmt.Sprintf("%s %s in %s ", inst.cmdName, srcHash, inst.dest)))
+		withCmdCommentString(fmt.Sprintf("%s %s in %s ", cmdName, srcHash, inst.dest)))
 	containerID, err := b.probeAndCreate(state, runConfigWithCommentCmd)
-	if err != nil || containerID == "" {
+	if err != nil {
 		return err
 	}
+	if containerID == "" {
+		b.copyStats.Cached++
+		return nil
+	}
+	start := time.Now()
 
 	// Twiddle the destination when it's a relative path - meaning, make it
 	// relative to the WORKINGDIR
@@ -83,14 +162,205 @@ func (b *Builder) performCopy(state *dispatchState, inst copyInstruction) error
 		return err
 	}
 
-	for _, info := range inst.infos {
-		if err := b.docker.CopyOnBuild(containerID, dest, info.root, info.path, inst.allowLocalDecompression); err != nil {
+	// The sources are checked to be in scope before they are walked.
+	infoDests := make([]string, len(inst.infos))
+	for i, info := range inst.infos {
+		infoDest := dest
+		if info.parentDir != "" {
+			infoDest = filepath.Join(dest, info.parentDir) + string(os.PathSeparator)
+		}
+		if inst.extractDir {
+			if name, ok := extractDirName(info); ok {
+				infoDest = filepath.Join(infoDest, name) + string(os.PathSeparator)
+			}
+		}
+		if err := validateCopyInfoScope(infoDest, info); err != nil {
+			return err
+		}
+		infoDests[i] = infoDest
+	}
+
+	// The sources are only walked if their stats are used.
+	var stats sourceStats
+	if inst.checkSpace || b.Aux != nil {
+		if stats, err = sourcesStats(inst.infos); err != nil {
+			return err
+		}
+	}
+	if inst.checkSpace {
+		if err := b.checkFreeSpace(containerID, stats.size); err != nil {
+			return err
+		}
+	}
+
+	for i, info := range inst.infos {
+		infoDest := infoDests[i]
+		if inst.renames != nil {
+			if err := b.copyRenamed(containerID, dest, info, inst); err != nil {
+				return err
+			}
+			continue
+		}
+		if inst.sync {
+			if err := b.docker.SyncOnBuild(containerID, infoDest, info.root, info.path); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := b.docker.CopyOnBuild(containerID, infoDest, info.root, info.path, inst.allowLocalDecompression, inst.ownership, inst.dirMode, inst.skipIdentical); err != nil {
+			return err
+		}
+	}
+	if inst.manifest != "" {
+		manifestDest, err := normaliseDest(inst.cmdName, state.runConfig.WorkingDir, inst.manifest)
+		if err != nil {
+			return err
+		}
+		if err := b.docker.CopyOnBuild(containerID, manifestDest, inst.manifestInfo.root, inst.manifestInfo.path, false, nil, inst.dirMode, false); err != nil {
+			return err
+		}
+	}
+	if inst.verify != nil {
+		if err := b.verifyCopy(containerID, inst.verify); err != nil {
 			return err
 		}
 	}
+	b.copyStats.Steps++
+	b.copyStats.Files += stats.files
+	b.copyStats.Size += stats.size
+	b.copyStats.Duration += time.Since(start)
 	return b.commitContainer(state, containerID, runConfigWithCommentCmd)
 }
 
+// checkFreeSpace returns an error if size bytes, the size of the files of
+// the sources of a copy, do not fit in the space left in the container, so
+// that a copy which would fill the storage of the layer fails before it
+// starts. Nothing is checked if the backend cannot tell the space left.
+func (b *Builder) checkFreeSpace(containerID string, size int64) error {
+	free, err := b.docker.FreeSpaceOnBuild(containerID)
+	if err != nil {
+		return err
+	}
+	if free < 0 {
+		logrus.Debugf("[BUILDER] not checking the space left in container %s: unknown", containerID)
+		return nil
+	}
+	if size > free {
+		return errors.Errorf("insufficient space to copy %s: only %s left", units.BytesSize(float64(size)), units.BytesSize(float64(free)))
+	}
+	return nil
+}
+
+// sourcesStats returns the number and the total size of the regular files of
+// the sources of infos, following the sources which are symlinks like the
+// copy does. The archives which are extracted are counted as they are.
+func sourcesStats(infos []copyInfo) (sourceStats, error) {
+	var stats sourceStats
+	for _, info := range infos {
+		src, err := symlink.FollowSymlinkInScope(filepath.Join(info.root, info.path), info.root)
+		if err != nil {
+			return stats, err
+		}
+		err = filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.Mode().IsRegular() {
+				stats.files++
+				stats.size += fi.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return stats, errors.WithStack(err)
+		}
+	}
+	return stats, nil
+}
+
+// copyRenamed copies the files below the directory of info into dest, at
+// the paths the renames of inst map them to. The files they do not list are
+// copied at their path below the directory, unless inst.skipUnmatched is set.
+func (b *Builder) copyRenamed(containerID, dest string, info copyInfo, inst copyInstruction) error {
+	src := filepath.Join(info.root, info.path)
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target, ok := inst.renames[filepath.ToSlash(rel)]
+		if !ok {
+			if inst.skipUnmatched {
+				return nil
+			}
+			target = filepath.ToSlash(rel)
+		}
+		fileDest := filepath.Join(dest, filepath.FromSlash(target))
+		if !isPathInScope(dest, fileDest) {
+			return errors.Errorf("Forbidden destination outside of %s: %s", dest, target)
+		}
+		return b.docker.CopyOnBuild(containerID, fileDest, info.root, filepath.Join(info.path, rel), false, inst.ownership, inst.dirMode, inst.skipIdentical)
+	})
+}
+
+// archiveExtensions are the extensions trimmed from the names of the archives
+// to name the directories they are extracted into.
+var archiveExtensions = []string{".tgz", ".tbz2", ".txz", ".tar", ".gz", ".bz2", ".xz", ".zst"}
+
+// extractDirName returns the name of the directory ADD --extract-dir
+// extracts the source of info into, which is the name of the archive
+// without its extensions, and false if the source is not extracted.
+func extractDirName(info copyInfo) (string, bool) {
+	// Like the copy, follow the source if it is a symlink.
+	src, err := symlink.FollowSymlinkInScope(filepath.Join(info.root, info.path), info.root)
+	if err != nil {
+		return "", false
+	}
+	if fi, err := os.Stat(src); err != nil || fi.IsDir() || !archive.IsArchivePath(src) {
+		return "", false
+	}
+	name := filepath.Base(info.path)
+	for trimmed := true; trimmed; {
+		trimmed = false
+		for _, ext := range archiveExtensions {
+			if len(name) > len(ext) && strings.EqualFold(name[len(name)-len(ext):], ext) {
+				name = name[:len(name)-len(ext)]
+				trimmed = true
+			}
+		}
+	}
+	return name, true
+}
+
+// validateCopyInfoScope makes sure that neither the source of a copy nor the
+// entry it creates below dest can escape their root, which could otherwise be
+// achieved with a crafted source path such as "../escape" or "dir/..".
+func validateCopyInfoScope(dest string, info copyInfo) error {
+	if !isPathInScope(info.root, filepath.Join(info.root, info.path)) {
+		return errors.Errorf("Forbidden path outside the build context: %s", info.path)
+	}
+	// When copying into a directory, the backend creates the entry using
+	// the base name of the source.
+	if strings.HasSuffix(dest, string(os.PathSeparator)) {
+		if !isPathInScope(dest, filepath.Join(dest, filepath.Base(info.path))) {
+			return errors.Errorf("Forbidden destination outside of %s: %s", dest, info.path)
+		}
+	}
+	return nil
+}
+
+// isPathInScope returns whether the cleaned path p is root or below it.
+func isPathInScope(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
 // For backwards compat, if there's just one info then use it as the
 // cache look-up string, otherwise hash 'em all into one
 func getSourceHashFromInfos(infos []copyInfo) string {
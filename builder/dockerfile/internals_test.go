@@ -2,6 +2,8 @@ package dockerfile
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/docker/docker/api/types"
@@ -128,3 +130,99 @@ func TestCopyRunConfig(t *testing.T) {
 	}
 
 }
+
+func TestPerformCopyRejectsPathsOutsideScope(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+
+	var testcases = []struct {
+		doc           string
+		path          string
+		dest          string
+		expectedError string
+	}{
+		{
+			doc:           "source escaping the context",
+			path:          "../escape",
+			dest:          "/dest/",
+			expectedError: "Forbidden path outside the build context",
+		},
+		{
+			doc:           "source base name escaping the destination",
+			path:          "dir/..",
+			dest:          "/dest/",
+			expectedError: "Forbidden destination outside of",
+		},
+		{
+			doc:  "source within the context",
+			path: "dir/file",
+			dest: "/dest/",
+		},
+	}
+
+	for _, testcase := range testcases {
+		b := newBuilderWithMockBackend()
+		mockBackend := b.docker.(*MockBackend)
+		b.imageProber = newImageProber(mockBackend, nil, true)
+		mockBackend.containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+			return container.ContainerCreateCreatedBody{ID: "12345"}, nil
+		}
+		copied := false
+		mockBackend.copyOnBuildFunc = func(containerID, destPath, srcRoot, srcPath string, decompress bool) error {
+			copied = true
+			return nil
+		}
+
+		inst := copyInstruction{
+			cmdName: "COPY",
+			infos:   []copyInfo{{root: contextDir, path: filepath.FromSlash(testcase.path), hash: "file:hash"}},
+			dest:    filepath.FromSlash(testcase.dest),
+		}
+		err := b.performCopy(&dispatchState{runConfig: &container.Config{}}, inst)
+		if testcase.expectedError == "" {
+			assert.NoError(t, err, testcase.doc)
+			assert.True(t, copied, testcase.doc)
+			continue
+		}
+		require.Error(t, err, testcase.doc)
+		assert.Contains(t, err.Error(), testcase.expectedError, testcase.doc)
+		assert.False(t, copied, testcase.doc)
+	}
+}
+
+func TestCopyCacheBustedByModeChange(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	file := createTestTempFile(t, contextDir, "script.sh", "echo hello", 0644)
+
+	cached := map[string]string{}
+	build := func() (hit bool) {
+		b := newBuilderWithMockBackend()
+		mockBackend := b.docker.(*MockBackend)
+		mockBackend.makeImageCacheFunc = func(_ []string) builder.ImageCache {
+			return &mockImageCache{getCacheFunc: func(parentID string, cfg *container.Config) (string, error) {
+				return cached[fmt.Sprint(cfg.Cmd)], nil
+			}}
+		}
+		b.imageProber = newImageProber(mockBackend, nil, false)
+		require.NoError(t, b.buildStages.add("", &mockImage{id: "base"}))
+		mockBackend.containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+			cached[fmt.Sprint(config.Config.Cmd)] = "cached-image"
+			return container.ContainerCreateCreatedBody{ID: "12345"}, nil
+		}
+
+		source, err := remotecontext.NewLazyContext(contextDir)
+		require.NoError(t, err)
+		req := defaultDispatchReq(b, "script.sh", "/usr/local/bin/")
+		req.source = source
+		require.NoError(t, dispatchCopy(req))
+		return req.state.imageID == "cached-image"
+	}
+
+	assert.False(t, build())
+	assert.True(t, build())
+
+	require.NoError(t, os.Chmod(file, 0755))
+	assert.False(t, build(), "changing the mode of a source must invalidate the cache")
+	assert.True(t, build())
+}
@@ -2,12 +2,14 @@ package dockerfile
 
 import (
 	"io"
+	"os"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/backend"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/builder"
 	containerpkg "github.com/docker/docker/container"
+	"github.com/docker/docker/pkg/idtools"
 	"golang.org/x/net/context"
 )
 
@@ -17,6 +19,16 @@ type MockBackend struct {
 	commitFunc          func(string, *backend.ContainerCommitConfig) (string, error)
 	getImageFunc        func(string) (builder.Image, builder.ReleaseableLayer, error)
 	makeImageCacheFunc  func(cacheFrom []string) builder.ImageCache
+	copyOnBuildFunc     func(containerID, destPath, srcRoot, srcPath string, decompress bool) error
+	syncOnBuildFunc     func(containerID, destPath, srcRoot, srcPath string) error
+	freeSpaceFunc       func(containerID string) (int64, error)
+	digestsFunc         func(containerID string, paths []string) (map[string]string, error)
+	// copyOwnership, copyDirMode and copySkipIdentical are the ownership
+	// mapping, the directory mode and the skipIdentical flag of the last
+	// CopyOnBuild.
+	copyOwnership     *idtools.IDMappings
+	copyDirMode       os.FileMode
+	copySkipIdentical bool
 }
 
 func (m *MockBackend) ContainerAttachRaw(cID string, stdin io.ReadCloser, stdout, stderr io.Writer, stream bool, attached chan struct{}) error {
@@ -57,10 +69,37 @@ func (m *MockBackend) ContainerCreateWorkdir(containerID string) error {
 	return nil
 }
 
-func (m *MockBackend) CopyOnBuild(containerID string, destPath string, srcRoot string, srcPath string, decompress bool) error {
+func (m *MockBackend) CopyOnBuild(containerID string, destPath string, srcRoot string, srcPath string, decompress bool, ownership *idtools.IDMappings, dirMode os.FileMode, skipIdentical bool) error {
+	m.copyOwnership = ownership
+	m.copyDirMode = dirMode
+	m.copySkipIdentical = skipIdentical
+	if m.copyOnBuildFunc != nil {
+		return m.copyOnBuildFunc(containerID, destPath, srcRoot, srcPath, decompress)
+	}
 	return nil
 }
 
+func (m *MockBackend) SyncOnBuild(containerID string, destPath string, srcRoot string, srcPath string) error {
+	if m.syncOnBuildFunc != nil {
+		return m.syncOnBuildFunc(containerID, destPath, srcRoot, srcPath)
+	}
+	return nil
+}
+
+func (m *MockBackend) FreeSpaceOnBuild(containerID string) (int64, error) {
+	if m.freeSpaceFunc != nil {
+		return m.freeSpaceFunc(containerID)
+	}
+	return -1, nil
+}
+
+func (m *MockBackend) DigestsOnBuild(containerID string, paths []string) (map[string]string, error) {
+	if m.digestsFunc != nil {
+		return m.digestsFunc(containerID, paths)
+	}
+	return map[string]string{}, nil
+}
+
 func (m *MockBackend) GetImageAndReleasableLayer(ctx context.Context, refOrID string, opts backend.GetImageAndLayerOptions) (builder.Image, builder.ReleaseableLayer, error) {
 	if m.getImageFunc != nil {
 		return m.getImageFunc(refOrID)
@@ -79,6 +118,8 @@ func (m *MockBackend) MakeImageCache(cacheFrom []string) builder.ImageCache {
 type mockImage struct {
 	id     string
 	config *container.Config
+	os     string
+	arch   string
 }
 
 func (i *mockImage) ImageID() string {
@@ -89,6 +130,10 @@ func (i *mockImage) RunConfig() *container.Config {
 	return i.config
 }
 
+func (i *mockImage) Platform() (string, string) {
+	return i.os, i.arch
+}
+
 type mockImageCache struct {
 	getCacheFunc func(parentID string, cfg *container.Config) (string, error)
 }
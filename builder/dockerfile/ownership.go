@@ -0,0 +1,57 @@
+package dockerfile
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/pkg/errors"
+)
+
+// parseOwnershipMap parses the ID mappings of COPY --uidmap and --gidmap.
+// Each is a comma-separated list of <source>:<destination>[:<count>] ranges,
+// mapping the count IDs from source, 1 by default, to the IDs from
+// destination. The ranges of the sources must not overlap.
+func parseOwnershipMap(uidmap, gidmap string) (*idtools.IDMappings, error) {
+	uids, err := parseIDRanges(uidmap)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid value for COPY --uidmap")
+	}
+	gids, err := parseIDRanges(gidmap)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid value for COPY --gidmap")
+	}
+	return idtools.NewIDMappingsFromMaps(uids, gids), nil
+}
+
+func parseIDRanges(value string) ([]idtools.IDMap, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var maps []idtools.IDMap
+	for _, r := range strings.Split(value, ",") {
+		fields := strings.Split(r, ":")
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, errors.Errorf("%q is not of the form <source>:<destination>[:<count>]", r)
+		}
+		ids := []int{0, 0, 1}
+		for i, field := range fields {
+			id, err := strconv.Atoi(field)
+			if err != nil || id < 0 {
+				return nil, errors.Errorf("%q is not a valid ID in %q", field, r)
+			}
+			ids[i] = id
+		}
+		if ids[2] == 0 {
+			return nil, errors.Errorf("the count of %q must be positive", r)
+		}
+		m := idtools.IDMap{HostID: ids[0], ContainerID: ids[1], Size: ids[2]}
+		for _, other := range maps {
+			if m.HostID < other.HostID+other.Size && other.HostID < m.HostID+m.Size {
+				return nil, errors.Errorf("%q overlaps %d:%d:%d", r, other.HostID, other.ContainerID, other.Size)
+			}
+		}
+		maps = append(maps, m)
+	}
+	return maps, nil
+}
@@ -0,0 +1,67 @@
+package dockerfile
+
+import (
+	"runtime"
+	"strings"
+
+	"github.com/docker/docker/builder"
+)
+
+// buildPlatform is the platform a build produces an image for. Its values
+// are made available to the ADD and COPY instructions through the
+// TARGETPLATFORM, TARGETOS, TARGETARCH and TARGETVARIANT variables.
+type buildPlatform struct {
+	OS           string
+	Architecture string
+	Variant      string
+}
+
+// defaultBuildPlatform returns the platform of the daemon.
+func defaultBuildPlatform() buildPlatform {
+	return buildPlatform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+}
+
+// imagePlatform returns the platform of image, empty if it is not known.
+func imagePlatform(image builder.Image) buildPlatform {
+	if image, ok := image.(builder.PlatformImage); ok {
+		os, arch := image.Platform()
+		if os != "" && arch != "" {
+			return buildPlatform{OS: os, Architecture: arch}
+		}
+	}
+	return buildPlatform{}
+}
+
+// targetPlatform returns the platform the current stage is built for: the
+// requested one, else the one of the base image of the stage, else the one
+// of the daemon.
+func (b *Builder) targetPlatform(state *dispatchState) buildPlatform {
+	if b.platform.OS != "" {
+		return b.platform
+	}
+	if p := imagePlatform(state.baseImage); p.OS != "" {
+		return p
+	}
+	return defaultBuildPlatform()
+}
+
+// String returns the platform in the os/arch[/variant] form.
+func (p buildPlatform) String() string {
+	parts := []string{p.OS, p.Architecture}
+	if p.Variant != "" {
+		parts = append(parts, p.Variant)
+	}
+	return strings.Join(parts, "/")
+}
+
+// envs returns the platform variables in the KEY=value form used for
+// substitution. Variables set in the environment or through build args
+// take precedence, so these must be appended after them.
+func (p buildPlatform) envs() []string {
+	return []string{
+		"TARGETPLATFORM=" + p.String(),
+		"TARGETOS=" + p.OS,
+		"TARGETARCH=" + p.Architecture,
+		"TARGETVARIANT=" + p.Variant,
+	}
+}
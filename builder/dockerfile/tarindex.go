@@ -0,0 +1,278 @@
+package dockerfile
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/builder"
+	"github.com/docker/docker/builder/remotecontext"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/ioutils"
+	"github.com/docker/docker/pkg/progress"
+	"github.com/docker/docker/pkg/streamformatter"
+	"github.com/docker/docker/pkg/system"
+	"github.com/pkg/errors"
+)
+
+// maxTarIndexSize is the maximum size of the index of a remote tar archive
+// read by ADD --tar-index.
+const maxTarIndexSize = 16 << 20
+
+// tarIndexEntry is an entry of the index of a tar archive: the member name,
+// whose headers start at offset in the archive and which spans size bytes,
+// headers, content and padding included.
+type tarIndexEntry struct {
+	name   string
+	offset int64
+	size   int64
+}
+
+// cleanTarName returns the name of a member of a tar archive, or of a member
+// requested from it, without its leading "./" or "/" and trailing "/".
+func cleanTarName(name string) string {
+	name = path.Clean("/" + name)
+	return strings.TrimPrefix(name, "/")
+}
+
+// parseTarIndex parses the index of a tar archive read from r. Each line of
+// the index is of the form "<offset> <size> <name>", empty lines and lines
+// starting with "#" being ignored.
+func parseTarIndex(r io.Reader) ([]tarIndexEntry, error) {
+	var entries []tarIndexEntry
+	scanner := bufio.NewScanner(io.LimitReader(r, maxTarIndexSize))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return nil, errors.Errorf("line %d: expected <offset> <size> <name>", n)
+		}
+		offset, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || offset < 0 {
+			return nil, errors.Errorf("line %d: invalid offset %q", n, fields[0])
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || size <= 0 {
+			return nil, errors.Errorf("line %d: invalid size %q", n, fields[1])
+		}
+		name := cleanTarName(fields[2])
+		if name == "" {
+			return nil, errors.Errorf("line %d: invalid name %q", n, fields[2])
+		}
+		entries = append(entries, tarIndexEntry{name: name, offset: offset, size: size})
+	}
+	return entries, errors.WithStack(scanner.Err())
+}
+
+// selectTarMembers returns the entries of index holding the members, and the
+// entries below those which are directories, in the order of the archive.
+func selectTarMembers(index []tarIndexEntry, members []string) ([]tarIndexEntry, error) {
+	var selected []tarIndexEntry
+	for _, member := range members {
+		member = cleanTarName(member)
+		found := false
+		for _, entry := range index {
+			if member == "" || entry.name == member || strings.HasPrefix(entry.name, member+"/") {
+				selected = append(selected, entry)
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("%s is not in the index", member)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].offset < selected[j].offset
+	})
+	// Members requested several times, e.g. as part of a directory and by
+	// name, are fetched once.
+	var deduped []tarIndexEntry
+	for _, entry := range selected {
+		if len(deduped) == 0 || deduped[len(deduped)-1] != entry {
+			deduped = append(deduped, entry)
+		}
+	}
+	return deduped, nil
+}
+
+// newTarIndexDownloader returns a sourceDownloader which downloads the
+// members of a remote tar archive listed by the index at indexURL, resolved
+// against the URL of the archive, with range requests, so that the rest of
+// the archive is not downloaded (ADD --tar-index). The members are extracted
+// into a directory named after the archive, whose content is copied like the
+// one of any other directory.
+func newTarIndexDownloader(output, stdout io.Writer, indexURL string, members []string) sourceDownloader {
+	return func(srcURL string) (builder.Source, string, error) {
+		return downloadTarMembers(output, stdout, srcURL, indexURL, members)
+	}
+}
+
+func downloadTarMembers(output, stdout io.Writer, srcURL, indexURL string, members []string) (remote builder.Source, p string, err error) {
+	u, err := url.Parse(srcURL)
+	if err != nil {
+		return
+	}
+	filename := filepath.Base(filepath.FromSlash(u.Path))
+	if filename == "" || filename == "." || filename == string(filepath.Separator) {
+		err = errors.Errorf("cannot determine filename from url: %s", u)
+		return
+	}
+	iu, err := u.Parse(indexURL)
+	if err != nil {
+		err = errors.Wrapf(err, "invalid tar index URL %q", indexURL)
+		return
+	}
+	if iu.Scheme != "http" && iu.Scheme != "https" {
+		err = errors.Errorf("invalid tar index URL %q: only http and https URLs are supported", indexURL)
+		return
+	}
+
+	index, err := downloadTarIndex(iu)
+	if err != nil {
+		return
+	}
+	entries, err := selectTarMembers(index, members)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to select the members of %s", u)
+		return
+	}
+
+	tmpDir, err := ioutils.TempDir("", "docker-remote")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+	if err = extractTarMembers(output, u, entries, filepath.Join(tmpDir, filename)); err != nil {
+		return
+	}
+	fmt.Fprintln(stdout)
+
+	lc, err := remotecontext.NewLazyContext(tmpDir)
+	return lc, filename, err
+}
+
+// downloadTarIndex downloads and parses the index of a tar archive from u.
+func downloadTarIndex(u *url.URL) ([]tarIndexEntry, error) {
+	client, err := newDownloadClient(u)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := remotecontext.ClientGetWithStatusError(client, u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	index, err := parseTarIndex(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the tar index %s", u)
+	}
+	return index, nil
+}
+
+// extractTarMembers downloads the entries of the tar archive at u and
+// extracts them into the directory dir. The downloaded entries are checked
+// to be the ones the index lists before anything is extracted.
+func extractTarMembers(output io.Writer, u *url.URL, entries []tarIndexEntry, dir string) error {
+	f, err := ioutil.TempFile("", "docker-tar-members")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	client, err := newDownloadClient(u)
+	if err != nil {
+		return err
+	}
+	progressOutput := streamformatter.NewJSONProgressOutput(output, true)
+	for _, entry := range entries {
+		if err := downloadTarRange(client, progressOutput, u, entry, f); err != nil {
+			return err
+		}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := checkTarMembers(f, entries); err != nil {
+		return errors.Wrapf(err, "the tar index does not match %s", u)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	if err := archive.Untar(f, dir, &archive.TarOptions{NoLchown: true}); err != nil {
+		return err
+	}
+	return system.Chtimes(dir, time.Time{}, time.Time{})
+}
+
+// downloadTarRange appends the bytes of entry in the archive at u to w.
+func downloadTarRange(client *http.Client, progressOutput progress.Output, u *url.URL, entry tarIndexEntry, w io.Writer) error {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", entry.offset, entry.offset+entry.size-1))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode < 400:
+		return errors.Errorf("failed to GET %s: the server does not support range requests", u)
+	default:
+		return errors.Errorf("failed to GET %s with status %s", u, resp.Status)
+	}
+	progressReader := progress.NewProgressReader(ioutil.NopCloser(io.LimitReader(resp.Body, entry.size)), progressOutput, entry.size, "", "Downloading "+entry.name)
+	n, err := io.Copy(w, progressReader)
+	if err != nil {
+		return err
+	}
+	if n != entry.size {
+		return errors.Errorf("failed to GET %s: got %d bytes of %s instead of %d", u, n, entry.name, entry.size)
+	}
+	return nil
+}
+
+// checkTarMembers checks that the tar stream r holds the entries, in order.
+func checkTarMembers(r io.Reader, entries []tarIndexEntry) error {
+	tr := tar.NewReader(r)
+	for _, entry := range entries {
+		hdr, err := tr.Next()
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", entry.name)
+		}
+		if name := cleanTarName(hdr.Name); name != entry.name {
+			return errors.Errorf("found %s instead of %s", name, entry.name)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		return errors.New("unexpected data after the members")
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package dockerfile
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// indexedTar returns a tar archive of the files, whose names ending with a
+// slash are directories, and its index.
+func indexedTar(t *testing.T, files [][2]string) ([]byte, string) {
+	var buf bytes.Buffer
+	var index bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	offset := -1
+	var name string
+	for _, file := range files {
+		require.NoError(t, tw.Flush())
+		if offset >= 0 {
+			fmt.Fprintf(&index, "%d %d %s\n", offset, buf.Len()-offset, name)
+		}
+		offset, name = buf.Len(), file[0]
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(file[1])), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(name, "/") {
+			hdr.Mode, hdr.Typeflag = 0755, tar.TypeDir
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(file[1]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Flush())
+	fmt.Fprintf(&index, "%d %d %s\n", offset, buf.Len()-offset, name)
+	require.NoError(t, tw.Close())
+	return buf.Bytes(), index.String()
+}
+
+func TestDownloadTarMembers(t *testing.T) {
+	archive, index := indexedTar(t, [][2]string{
+		{"bin/", ""},
+		{"bin/tool", "tool binary"},
+		{"share/", ""},
+		{"share/big.dat", strings.Repeat("x", 1<<20)},
+		{"README", "readme"},
+	})
+	var (
+		mu     sync.Mutex
+		ranges []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dist/app.tar":
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+			http.ServeContent(w, r, "app.tar", time.Time{}, bytes.NewReader(archive))
+		case "/dist/app.tar.idx":
+			fmt.Fprint(w, index)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	download := newTarIndexDownloader(ioutil.Discard, ioutil.Discard, "app.tar.idx", []string{"bin", "./README"})
+	source, filename, err := download(server.URL + "/dist/app.tar")
+	require.NoError(t, err)
+	defer os.RemoveAll(source.Root())
+
+	dir := filepath.Join(source.Root(), filename)
+	for name, expected := range map[string]string{"bin/tool": "tool binary", "README": "readme"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+	_, err = os.Stat(filepath.Join(dir, "share"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Each member is fetched on its own, the archive never as a whole.
+	require.Len(t, ranges, 3)
+	for _, r := range ranges {
+		assert.True(t, strings.HasPrefix(r, "bytes="), r)
+	}
+}
+
+func TestDownloadTarMembersErrors(t *testing.T) {
+	archive, index := indexedTar(t, [][2]string{
+		{"a", "content of a"},
+		{"b", "content of b"},
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ranged.tar":
+			http.ServeContent(w, r, "ranged.tar", time.Time{}, bytes.NewReader(archive))
+		case "/unranged.tar":
+			w.Write(archive)
+		case "/index":
+			fmt.Fprint(w, index)
+		case "/shifted":
+			// The entry of b is listed under another name.
+			fmt.Fprint(w, strings.Replace(index, " b\n", " a-as-b\n", 1))
+		case "/invalid":
+			fmt.Fprint(w, "0 a\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		archive, index, member, expected string
+	}{
+		{"ranged.tar", "index", "c", "c is not in the index"},
+		{"unranged.tar", "index", "a", "does not support range requests"},
+		{"ranged.tar", "shifted", "a-as-b", "the tar index does not match"},
+		{"ranged.tar", "invalid", "a", "expected <offset> <size> <name>"},
+		{"ranged.tar", "missing", "a", "404"},
+		{"ranged.tar", "file:///etc/passwd", "a", "only http and https URLs are supported"},
+	} {
+		download := newTarIndexDownloader(ioutil.Discard, ioutil.Discard, tc.index, []string{tc.member})
+		_, _, err := download(server.URL + "/" + tc.archive)
+		if assert.Error(t, err, tc.index) {
+			assert.Contains(t, err.Error(), tc.expected, tc.index)
+		}
+	}
+}
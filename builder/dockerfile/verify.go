@@ -0,0 +1,130 @@
+package dockerfile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/builder/remotecontext"
+	"github.com/pkg/errors"
+)
+
+// maxVerifyErrors is the maximum number of files reported by a failed COPY
+// --verify.
+const maxVerifyErrors = 10
+
+// verifyManifest maps the absolute paths of files in the image to the
+// hex-encoded sha256 digests of their expected content (COPY --verify).
+type verifyManifest map[string]string
+
+// parseVerifyManifest parses a manifest read from r in the format of
+// sha256sum(1), as written by COPY --manifest: each line holds the digest
+// and the path of a file, separated by two spaces, or by a space and a "*".
+// Relative paths are below dest, the slash-separated absolute destination
+// directory of the copy, and are an error if dest is empty as the destination
+// is not a directory. Empty lines and lines starting with "#" are ignored.
+func parseVerifyManifest(r io.Reader, dest string) (verifyManifest, error) {
+	manifest := make(verifyManifest)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 || len(parts[1]) < 2 || (parts[1][0] != ' ' && parts[1][0] != '*') {
+			return nil, errors.Errorf("line %d: expected <sha256>  <path>, got %q", n, line)
+		}
+		digest := strings.ToLower(parts[0])
+		if len(digest) != 64 || strings.Trim(digest, "0123456789abcdef") != "" {
+			return nil, errors.Errorf("line %d: invalid sha256 digest %q", n, parts[0])
+		}
+		p := parts[1][1:]
+		if !path.IsAbs(p) {
+			if dest == "" {
+				return nil, errors.Errorf("line %d: %s is relative but the destination is not a directory ending with a /", n, p)
+			}
+			p = path.Join(dest, p)
+		}
+		p = path.Clean(p)
+		if _, ok := manifest[p]; ok {
+			return nil, errors.Errorf("line %d: %s is listed more than once", n, p)
+		}
+		manifest[p] = digest
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(manifest) == 0 {
+		return nil, errors.New("no file is listed")
+	}
+	return manifest, nil
+}
+
+// loadVerifyManifest reads the manifest name of COPY --verify from the
+// source, with its relative paths below dest, which is empty if the
+// destination is not a directory.
+func (o *copier) loadVerifyManifest(name, dest string) (verifyManifest, error) {
+	if o.source == nil {
+		return nil, errors.Errorf("missing build context")
+	}
+	fp, err := remotecontext.FullPath(o.source, name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the manifest %s", name)
+	}
+	defer f.Close()
+	manifest, err := parseVerifyManifest(f, dest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid manifest %s", name)
+	}
+	return manifest, nil
+}
+
+// hash returns a hash of the manifest, for the cache.
+func (m verifyManifest) hash() string {
+	var pairs []string
+	for p, digest := range m {
+		pairs = append(pairs, digest+"  "+p)
+	}
+	sort.Strings(pairs)
+	return hashStringSlice("verify", pairs)
+}
+
+// verifyCopy checks that the files listed by manifest are in the container
+// and have the expected content, once the copy is done.
+func (b *Builder) verifyCopy(containerID string, manifest verifyManifest) error {
+	paths := make([]string, 0, len(manifest))
+	for p := range manifest {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	digests, err := b.docker.DigestsOnBuild(containerID, paths)
+	if err != nil {
+		return err
+	}
+	var failures []string
+	for _, p := range paths {
+		digest, ok := digests[p]
+		switch {
+		case !ok:
+			failures = append(failures, fmt.Sprintf("%s is missing", p))
+		case digest != manifest[p]:
+			failures = append(failures, fmt.Sprintf("%s has digest sha256:%s instead of sha256:%s", p, digest, manifest[p]))
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	if len(failures) > maxVerifyErrors {
+		failures = append(failures[:maxVerifyErrors], fmt.Sprintf("and %d more", len(failures)-maxVerifyErrors))
+	}
+	return errors.Errorf("COPY --verify failed: %s", strings.Join(failures, "; "))
+}
@@ -116,19 +116,10 @@ func newURLRemote(url string, dockerfilePath string, progressReader func(in io.R
 }
 
 func removeDockerfile(c modifiableContext, filesToRemove ...string) error {
-	f, err := openAt(c, ".dockerignore")
-	// Note that a missing .dockerignore file isn't treated as an error
-	switch {
-	case os.IsNotExist(err):
-		return nil
-	case err != nil:
+	excludes, err := ReadDockerignore(c)
+	if err != nil || excludes == nil {
 		return err
 	}
-	excludes, err := dockerignore.ReadAll(f)
-	if err != nil {
-		return err
-	}
-	f.Close()
 	filesToRemove = append([]string{".dockerignore"}, filesToRemove...)
 	for _, fileToRemove := range filesToRemove {
 		if rm, _ := fileutils.Matches(fileToRemove, excludes); rm {
@@ -140,6 +131,21 @@ func removeDockerfile(c modifiableContext, filesToRemove ...string) error {
 	return nil
 }
 
+// ReadDockerignore returns the patterns of the .dockerignore file of the
+// source, or nil if it has none.
+func ReadDockerignore(source builder.Source) ([]string, error) {
+	f, err := openAt(source, ".dockerignore")
+	// Note that a missing .dockerignore file isn't treated as an error
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	defer f.Close()
+	return dockerignore.ReadAll(f)
+}
+
 func readAndParseDockerfile(name string, rc io.Reader) (*parser.Result, error) {
 	br := bufio.NewReader(rc)
 	if _, err := br.Peek(1); err != nil {
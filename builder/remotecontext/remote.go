@@ -69,7 +69,13 @@ func MakeRemoteContext(remoteURL string, contentTypeHandlers map[string]func(io.
 // GetWithStatusError does an http.Get() and returns an error if the
 // status code is 4xx or 5xx.
 func GetWithStatusError(url string) (resp *http.Response, err error) {
-	if resp, err = http.Get(url); err != nil {
+	return ClientGetWithStatusError(http.DefaultClient, url)
+}
+
+// ClientGetWithStatusError is like GetWithStatusError, but does the request
+// with client.
+func ClientGetWithStatusError(client *http.Client, url string) (resp *http.Response, err error) {
+	if resp, err = client.Get(url); err != nil {
 		return nil, err
 	}
 	if resp.StatusCode < 400 {
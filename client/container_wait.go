@@ -3,16 +3,20 @@ package client
 import (
 	"encoding/json"
 	"net/url"
+	"strconv"
+	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/versions"
 )
 
 // ContainerWait waits until the specified container is in a certain state
 // indicated by the given condition, either "not-running" (default),
-// "next-exit", or "removed".
+// "next-exit", or "removed". An error is returned on the error channel,
+// without contacting the daemon, if condition is not one of those.
 //
 // If this client's API version is beforer 1.30, condition is ignored and
 // ContainerWait will return immediately with the two channels, as the server
@@ -25,7 +29,28 @@ import (
 // wait request or in getting the response. This allows the caller to
 // sychronize ContainerWait with other calls, such as specifying a
 // "next-exit" condition before issuing a ContainerStart request.
+//
+// If this client's API version is at least 1.31 and the connection to the
+// daemon is lost while waiting, for example because the daemon is restarted,
+// ContainerWait reconnects and resumes the wait. The exit status is still
+// reported if the container exited while the daemon was unavailable, as long
+// as the container was not removed.
 func (cli *Client) ContainerWait(ctx context.Context, containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+	return cli.ContainerWaitWithOptions(ctx, containerID, types.ContainerWaitOptions{Condition: condition})
+}
+
+// ContainerWaitWithOptions is like ContainerWait, with options. If
+// options.OutputTail is set and the client's API version is at least 1.31,
+// the last options.OutputTail lines of the output of the container are
+// returned with its exit status if it is not zero.
+func (cli *Client) ContainerWaitWithOptions(ctx context.Context, containerID string, options types.ContainerWaitOptions) (<-chan container.ContainerWaitOKBody, <-chan error) {
+	condition := options.Condition
+	if _, err := container.ParseWaitCondition(string(condition)); err != nil {
+		errC := make(chan error, 1)
+		errC <- err
+		return make(chan container.ContainerWaitOKBody), errC
+	}
+
 	if versions.LessThan(cli.ClientVersion(), "1.30") {
 		return cli.legacyContainerWait(ctx, containerID)
 	}
@@ -35,6 +60,9 @@ func (cli *Client) ContainerWait(ctx context.Context, containerID string, condit
 
 	query := url.Values{}
 	query.Set("condition", string(condition))
+	if options.OutputTail > 0 && !versions.LessThan(cli.ClientVersion(), "1.31") {
+		query.Set("tail", strconv.Itoa(options.OutputTail))
+	}
 
 	resp, err := cli.post(ctx, "/containers/"+containerID+"/wait", query, nil, nil)
 	if err != nil {
@@ -47,8 +75,15 @@ func (cli *Client) ContainerWait(ctx context.Context, containerID string, condit
 		defer ensureReaderClosed(resp)
 		var res container.ContainerWaitOKBody
 		if err := json.NewDecoder(resp.body).Decode(&res); err != nil {
-			errC <- err
-			return
+			token := resp.header.Get("Docker-Wait-Token")
+			if token == "" || ctx.Err() != nil {
+				errC <- err
+				return
+			}
+			if res, err = cli.resumeContainerWait(ctx, containerID, token); err != nil {
+				errC <- err
+				return
+			}
 		}
 
 		resultC <- res
@@ -57,6 +92,52 @@ func (cli *Client) ContainerWait(ctx context.Context, containerID string, condit
 	return resultC, errC
 }
 
+var (
+	// waitResumeTimeout is how long resumeContainerWait keeps trying to
+	// reconnect to the daemon.
+	waitResumeTimeout = 60 * time.Second
+	// waitResumeInterval is the delay between reconnection attempts.
+	waitResumeInterval = time.Second
+)
+
+// resumeContainerWait re-attaches to a wait identified by token after the
+// connection to the daemon was lost.
+func (cli *Client) resumeContainerWait(ctx context.Context, containerID, token string) (container.ContainerWaitOKBody, error) {
+	var res container.ContainerWaitOKBody
+
+	query := url.Values{}
+	query.Set("token", token)
+
+	deadline := time.Now().Add(waitResumeTimeout)
+	for {
+		select {
+		case <-ctx.Done():
+			return res, ctx.Err()
+		case <-time.After(waitResumeInterval):
+		}
+
+		resp, err := cli.post(ctx, "/containers/"+containerID+"/wait", query, nil, nil)
+		if err != nil {
+			ensureReaderClosed(resp)
+			if IsErrConnectionFailed(err) && time.Now().Before(deadline) {
+				continue
+			}
+			return res, err
+		}
+
+		err = json.NewDecoder(resp.body).Decode(&res)
+		ensureReaderClosed(resp)
+		if err == nil {
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			return res, err
+		}
+		// The connection was lost again, start over.
+		deadline = time.Now().Add(waitResumeTimeout)
+	}
+}
+
 // legacyContainerWait returns immediately and doesn't have an option to wait
 // until the container is removed.
 func (cli *Client) legacyContainerWait(ctx context.Context, containerID string) (<-chan container.ContainerWaitOKBody, <-chan error) {
@@ -3,14 +3,18 @@ package client
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 
 	"golang.org/x/net/context"
@@ -62,6 +66,113 @@ func TestContainerWait(t *testing.T) {
 	}
 }
 
+func TestContainerWaitWithOutputTail(t *testing.T) {
+	client := &Client{
+		version: "1.31",
+		client: newMockClient(func(req *http.Request) (*http.Response, error) {
+			if tail := req.URL.Query().Get("tail"); tail != "5" {
+				return nil, fmt.Errorf("tail not set in URL query properly. Expected '5', got %s", tail)
+			}
+			b, err := json.Marshal(container.ContainerWaitOKBody{
+				StatusCode: 1,
+				Output:     "failed\n",
+			})
+			if err != nil {
+				return nil, err
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(bytes.NewReader(b)),
+			}, nil
+		}),
+	}
+
+	resultC, errC := client.ContainerWaitWithOptions(context.Background(), "container_id", types.ContainerWaitOptions{OutputTail: 5})
+	select {
+	case err := <-errC:
+		t.Fatal(err)
+	case result := <-resultC:
+		if result.StatusCode != 1 || result.Output != "failed\n" {
+			t.Fatalf("expected a status code equal to '1' and output 'failed', got %d and %q", result.StatusCode, result.Output)
+		}
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestContainerWaitResume(t *testing.T) {
+	defer func(interval time.Duration) { waitResumeInterval = interval }(waitResumeInterval)
+	waitResumeInterval = time.Millisecond
+
+	attempts := 0
+	client := &Client{
+		version: "1.31",
+		client: newMockClient(func(req *http.Request) (*http.Response, error) {
+			attempts++
+			switch attempts {
+			case 1:
+				// The daemon goes away while the wait is in progress.
+				header := http.Header{}
+				header.Set("Docker-Wait-Token", "token")
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     header,
+					Body:       ioutil.NopCloser(failingReader{}),
+				}, nil
+			case 2:
+				return nil, &net.OpError{Op: "dial", Net: "unix", Err: errors.New("connection refused")}
+			}
+			if token := req.URL.Query().Get("token"); token != "token" {
+				return nil, fmt.Errorf("expected token 'token', got '%s'", token)
+			}
+			b, err := json.Marshal(container.ContainerWaitOKBody{
+				StatusCode: 3,
+			})
+			if err != nil {
+				return nil, err
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(bytes.NewReader(b)),
+			}, nil
+		}),
+	}
+
+	resultC, errC := client.ContainerWait(context.Background(), "container_id", container.WaitConditionNextExit)
+	select {
+	case err := <-errC:
+		t.Fatal(err)
+	case result := <-resultC:
+		if result.StatusCode != 3 {
+			t.Fatalf("expected a status code equal to '3', got %d", result.StatusCode)
+		}
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 requests, got %d", attempts)
+	}
+}
+
+func TestContainerWaitInvalidCondition(t *testing.T) {
+	client := &Client{
+		client: newMockClient(func(req *http.Request) (*http.Response, error) {
+			return nil, fmt.Errorf("expected no request to be made, got %s", req.URL)
+		}),
+	}
+	resultC, errC := client.ContainerWait(context.Background(), "container_id", "not_running")
+	select {
+	case result := <-resultC:
+		t.Fatalf("expected to not get a wait result, got %d", result.StatusCode)
+	case err := <-errC:
+		if !strings.Contains(err.Error(), `invalid wait condition "not_running"`) {
+			t.Fatalf("expected an invalid wait condition error, got %v", err)
+		}
+	}
+}
+
 func ExampleClient_ContainerWait_withTimeout() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -96,6 +96,9 @@ func (cli *Client) imageBuildOptionsToQuery(options types.ImageBuildOptions) (ur
 	query.Set("shmsize", strconv.FormatInt(options.ShmSize, 10))
 	query.Set("dockerfile", options.Dockerfile)
 	query.Set("target", options.Target)
+	if options.CopyWarningThreshold != 0 {
+		query.Set("copywarningthreshold", strconv.Itoa(options.CopyWarningThreshold))
+	}
 
 	ulimitsJSON, err := json.Marshal(options.Ulimits)
 	if err != nil {
@@ -245,6 +245,26 @@ func (s *State) Wait(ctx context.Context, condition WaitCondition) <-chan StateS
 	return resultC
 }
 
+// WaitSince is like Wait, but is used to resume a wait which began at since
+// and got interrupted, e.g. by a daemon restart. If the container stopped
+// after since and has not been started again, the result is sent right away
+// as the stop the original wait was interested in has already happened.
+func (s *State) WaitSince(ctx context.Context, condition WaitCondition, since time.Time) <-chan StateStatus {
+	s.Lock()
+	if condition < WaitConditionRemoved && !s.Running && s.FinishedAt.After(since) {
+		resultC := make(chan StateStatus, 1)
+		resultC <- StateStatus{
+			exitCode: s.ExitCode(),
+			err:      s.Err(),
+		}
+		s.Unlock()
+		return resultC
+	}
+	s.Unlock()
+
+	return s.Wait(ctx, condition)
+}
+
 // IsRunning returns whether the running flag is set. Used by Container to check whether a container is running.
 func (s *State) IsRunning() bool {
 	s.Lock()
@@ -5,15 +5,18 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/container"
+	"github.com/docker/docker/layer"
 	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/docker/pkg/chrootarchive"
 	"github.com/docker/docker/pkg/idtools"
 	"github.com/docker/docker/pkg/ioutils"
 	"github.com/docker/docker/pkg/symlink"
 	"github.com/docker/docker/pkg/system"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
@@ -367,7 +370,26 @@ func (daemon *Daemon) containerCopy(container *container.Container, resource str
 // specified by a container object.
 // TODO: make sure callers don't unnecessarily convert destPath with filepath.FromSlash (Copy does it already).
 // CopyOnBuild should take in abstract paths (with slashes) and the implementation should convert it to OS-specific paths.
-func (daemon *Daemon) CopyOnBuild(cID, destPath, srcRoot, srcPath string, decompress bool) error {
+func (daemon *Daemon) CopyOnBuild(cID, destPath, srcRoot, srcPath string, decompress bool, ownership *idtools.IDMappings, dirMode os.FileMode, skipIdentical bool) error {
+	c, err := daemon.GetContainer(cID)
+	if err != nil {
+		return err
+	}
+	err = daemon.Mount(c)
+	if err != nil {
+		return err
+	}
+	defer daemon.Unmount(c)
+
+	return daemon.copyOnBuild(c, destPath, srcRoot, srcPath, decompress, ownership, dirMode, skipIdentical)
+}
+
+// copyOnBuild implements CopyOnBuild for a container whose filesystem is
+// mounted. The directories it creates to hold the destination are given
+// dirMode, or copyDirMode if it is 0. If skipIdentical is set, the entries
+// of the destination which are already copies of those of the source are
+// left alone, as SyncOnBuild does.
+func (daemon *Daemon) copyOnBuild(c *container.Container, destPath, srcRoot, srcPath string, decompress bool, ownership *idtools.IDMappings, dirMode os.FileMode, skipIdentical bool) error {
 	fullSrcPath, err := symlink.FollowSymlinkInScope(filepath.Join(srcRoot, srcPath), srcRoot)
 	if err != nil {
 		return err
@@ -376,20 +398,15 @@ func (daemon *Daemon) CopyOnBuild(cID, destPath, srcRoot, srcPath string, decomp
 	destExists := true
 	destDir := false
 	rootIDs := daemon.idMappings.RootPair()
+	owner := copyOwner{root: rootIDs, ownership: ownership, idMappings: daemon.idMappings}
 
 	// Work in daemon-local OS specific file paths
 	destPath = filepath.FromSlash(destPath)
 
-	c, err := daemon.GetContainer(cID)
-	if err != nil {
-		return err
-	}
-	err = daemon.Mount(c)
-	if err != nil {
-		return err
-	}
-	defer daemon.Unmount(c)
-
+	// Symlinks in the destination, including a destination which is itself
+	// a symlink to a directory, are resolved within the container's rootfs,
+	// so that the decisions below are made for the target of the link and
+	// entries are placed inside it rather than replacing the link.
 	dest, err := c.GetResourcePath(destPath)
 	if err != nil {
 		return err
@@ -421,10 +438,19 @@ func (daemon *Daemon) CopyOnBuild(cID, destPath, srcRoot, srcPath string, decomp
 
 	if src.IsDir() {
 		// copy as directory
+		if err := mkdirAllForCopy(destPath, rootIDs, dirMode); err != nil {
+			return err
+		}
+		if skipIdentical {
+			return syncDirectory(archiver, fullSrcPath, destPath, owner, false)
+		}
 		if err := archiver.CopyWithTar(fullSrcPath, destPath); err != nil {
 			return err
 		}
-		return fixPermissions(fullSrcPath, destPath, rootIDs.UID, rootIDs.GID, destExists)
+		if err := fixPermissions(fullSrcPath, destPath, owner, destExists); err != nil {
+			return err
+		}
+		return fixTimes(fullSrcPath, destPath, destExists)
 	}
 	if decompress && archive.IsArchivePath(fullSrcPath) {
 		// Only try to untar if it is a file and that we've been told to decompress (when ADD-ing a remote file)
@@ -453,12 +479,214 @@ func (daemon *Daemon) CopyOnBuild(cID, destPath, srcRoot, srcPath string, decomp
 		destPath = filepath.Join(destPath, filepath.Base(srcPath))
 	}
 
-	if err := idtools.MkdirAllAndChownNew(filepath.Dir(destPath), 0755, rootIDs); err != nil {
+	if err := mkdirAllForCopy(filepath.Dir(destPath), rootIDs, dirMode); err != nil {
 		return err
 	}
+	if skipIdentical {
+		return syncEntry(archiver, fullSrcPath, destPath, src, owner)
+	}
 	if err := archiver.CopyFileWithTar(fullSrcPath, destPath); err != nil {
 		return err
 	}
+	if err := fixPermissions(fullSrcPath, destPath, owner, destExists); err != nil {
+		return err
+	}
+	return fixTimes(fullSrcPath, destPath, destExists)
+}
+
+// copyOwner gives the owner on the host of the copies of the entries of a
+// source. They are owned by the root of the container, unless ownership maps
+// the IDs of the entries in the source to IDs in the container (COPY --uidmap
+// and --gidmap). The IDs it does not map are still mapped to root.
+type copyOwner struct {
+	root       idtools.IDPair
+	ownership  *idtools.IDMappings
+	idMappings *idtools.IDMappings
+}
+
+// mapCopyID returns the ID maps maps id to, or 0 if it does not map it.
+func mapCopyID(id int, maps []idtools.IDMap) int {
+	for _, m := range maps {
+		if id >= m.HostID && id < m.HostID+m.Size {
+			return m.ContainerID + id - m.HostID
+		}
+	}
+	return 0
+}
+
+// copyDirMode is the default mode of the directories created by CopyOnBuild
+// and SyncOnBuild to hold their destination. The entries copied from the
+// source keep the mode they have there.
+const copyDirMode = 0755
+
+// mkdirAllForCopy creates the directory path and its missing parents owned
+// by ids. They are given mode, or copyDirMode if it is 0, whatever the umask
+// of the daemon, so that the result of a copy does not depend on it. The
+// directories which already exist are left alone.
+func mkdirAllForCopy(path string, ids idtools.IDPair, mode os.FileMode) error {
+	if mode == 0 {
+		mode = copyDirMode
+	}
+	var missing []string
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		if _, err := os.Lstat(p); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		missing = append(missing, p)
+		if filepath.Dir(p) == p {
+			break
+		}
+	}
+	if err := idtools.MkdirAllAndChownNew(path, mode, ids); err != nil {
+		return err
+	}
+	for _, p := range missing {
+		if err := os.Chmod(p, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FreeSpaceOnBuild returns the number of bytes which can still be written to
+// the filesystem of a container, or -1 if its storage driver cannot tell.
+func (daemon *Daemon) FreeSpaceOnBuild(cID string) (int64, error) {
+	c, err := daemon.GetContainer(cID)
+	if err != nil {
+		return 0, err
+	}
+	if c.RWLayer == nil {
+		return -1, nil
+	}
+	return layer.FreeSpace(c.RWLayer)
+}
+
+// DigestsOnBuild returns the hex-encoded sha256 digests of the content of the
+// regular files at paths in the filesystem of a container, by path. Symlinks
+// are followed within the container; the paths which do not exist or are not
+// regular files are left out.
+func (daemon *Daemon) DigestsOnBuild(cID string, paths []string) (map[string]string, error) {
+	c, err := daemon.GetContainer(cID)
+	if err != nil {
+		return nil, err
+	}
+	if err := daemon.Mount(c); err != nil {
+		return nil, err
+	}
+	defer daemon.Unmount(c)
+
+	digests := make(map[string]string)
+	for _, p := range paths {
+		resolved, err := c.GetResourcePath(filepath.FromSlash(p))
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(resolved)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		f, err := os.Open(resolved)
+		if err != nil {
+			return nil, err
+		}
+		dgst, err := digest.Canonical.FromReader(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		digests[p] = dgst.Hex()
+	}
+	return digests, nil
+}
+
+// SyncOnBuild copies a source directory to a destination path inside a
+// container like CopyOnBuild, but only writes the entries of the destination
+// which differ from the source and removes those which are not in the
+// source. Sources which are not directories are copied with CopyOnBuild.
+func (daemon *Daemon) SyncOnBuild(cID, destPath, srcRoot, srcPath string) error {
+	c, err := daemon.GetContainer(cID)
+	if err != nil {
+		return err
+	}
+	err = daemon.Mount(c)
+	if err != nil {
+		return err
+	}
+	defer daemon.Unmount(c)
+
+	return daemon.syncOnBuild(c, destPath, srcRoot, srcPath)
+}
 
-	return fixPermissions(fullSrcPath, destPath, rootIDs.UID, rootIDs.GID, destExists)
+// syncOnBuild implements SyncOnBuild for a container whose filesystem is
+// mounted.
+func (daemon *Daemon) syncOnBuild(c *container.Container, destPath, srcRoot, srcPath string) error {
+	fullSrcPath, err := symlink.FollowSymlinkInScope(filepath.Join(srcRoot, srcPath), srcRoot)
+	if err != nil {
+		return err
+	}
+	src, err := os.Stat(fullSrcPath)
+	if err != nil {
+		return err
+	}
+	if !src.IsDir() {
+		return daemon.copyOnBuild(c, destPath, srcRoot, srcPath, false, nil, 0, false)
+	}
+
+	dest, err := c.GetResourcePath(filepath.FromSlash(destPath))
+	if err != nil {
+		return err
+	}
+	rootIDs := daemon.idMappings.RootPair()
+	if err := mkdirAllForCopy(dest, rootIDs, 0); err != nil {
+		return err
+	}
+	archiver := chrootarchive.NewArchiver(daemon.idMappings)
+	return syncDirectory(archiver, fullSrcPath, dest, copyOwner{root: rootIDs, idMappings: daemon.idMappings}, true)
+}
+
+// fixTimes restores the modification time of every entry copied from source
+// to destination. The tar stream used for the copy only carries whole
+// seconds, so the times are set again from the source with nanosecond
+// precision where the destination filesystem supports it. This also fixes
+// directories, as populating a directory resets its mtime to the time of the
+// copy. Like fixPermissions, the walk root is left alone if it is a directory
+// which existed before the copy.
+func fixTimes(source, destination string, destExisted bool) error {
+	destStat, err := os.Stat(destination)
+	if err != nil {
+		return err
+	}
+	fixDestination := !destExisted || !destStat.IsDir()
+
+	return filepath.Walk(source, func(fullpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fixDestination && source == fullpath {
+			return nil
+		}
+
+		cleaned, err := filepath.Rel(source, fullpath)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(destination, cleaned)
+		mtime := info.ModTime()
+		if info.Mode()&os.ModeSymlink != 0 {
+			ts := syscall.NsecToTimespec(mtime.UnixNano())
+			if err := system.LUtimesNano(path, []syscall.Timespec{ts, ts}); err != nil && err != system.ErrNotSupportedPlatform {
+				return err
+			}
+			return nil
+		}
+		return system.Chtimes(path, mtime, mtime)
+	})
 }
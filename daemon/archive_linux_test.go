@@ -0,0 +1,58 @@
+// +build linux
+
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/system"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyPreservesNanosecondTimes(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-fix-times")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "src")
+	dst := filepath.Join(tmp, "dst")
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "dir"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "dir", "file"), []byte("content"), 0644))
+	require.NoError(t, os.Symlink("file", filepath.Join(src, "dir", "link")))
+
+	mtime := time.Date(2001, 1, 1, 0, 0, 0, 123456789, time.UTC)
+	for _, p := range []string{"dir/file", "dir", "."} {
+		require.NoError(t, system.Chtimes(filepath.Join(src, p), mtime, mtime))
+	}
+	fi, err := os.Stat(filepath.Join(src, "dir", "file"))
+	require.NoError(t, err)
+	if !fi.ModTime().Equal(mtime) {
+		t.Skip("the filesystem of the temporary directory does not support nanosecond timestamps")
+	}
+
+	// Copy like the builder does, with a tar stream.
+	require.NoError(t, archive.NewDefaultArchiver().CopyWithTar(src, dst))
+	require.NoError(t, fixTimes(src, dst, false))
+	for _, p := range []string{"dir/file", "dir", "."} {
+		fi, err := os.Stat(filepath.Join(dst, p))
+		require.NoError(t, err)
+		assert.True(t, fi.ModTime().Equal(mtime), "%s: expected mtime %s, got %s", p, mtime, fi.ModTime())
+	}
+	target, err := os.Readlink(filepath.Join(dst, "dir", "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "file", target)
+
+	// Single files are fixed as well.
+	file := filepath.Join(tmp, "file")
+	require.NoError(t, archive.NewDefaultArchiver().CopyFileWithTar(filepath.Join(src, "dir", "file"), file))
+	require.NoError(t, fixTimes(filepath.Join(src, "dir", "file"), file, false))
+	fi, err = os.Stat(file)
+	require.NoError(t, err)
+	assert.True(t, fi.ModTime().Equal(mtime), "expected mtime %s, got %s", mtime, fi.ModTime())
+}
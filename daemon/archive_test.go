@@ -0,0 +1,66 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/system"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFixTimes(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-fix-times")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "src")
+	dst := filepath.Join(tmp, "dst")
+	for _, root := range []string{src, dst} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, "a", "b"), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, "a", "b", "file"), []byte("content"), 0644))
+	}
+
+	times := map[string]time.Time{
+		".":   time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC),
+		"a":   time.Date(2002, 2, 2, 0, 0, 0, 0, time.UTC),
+		"a/b": time.Date(2003, 3, 3, 0, 0, 0, 0, time.UTC),
+	}
+	for p, mtime := range times {
+		require.NoError(t, system.Chtimes(filepath.Join(src, p), mtime, mtime))
+	}
+
+	require.NoError(t, fixTimes(src, dst, false))
+	for p, mtime := range times {
+		fi, err := os.Stat(filepath.Join(dst, p))
+		require.NoError(t, err)
+		assert.True(t, fi.ModTime().Equal(mtime), "%s: expected mtime %s, got %s", p, mtime, fi.ModTime())
+	}
+}
+
+func TestFixTimesExistingDestination(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-fix-times")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "src")
+	dst := filepath.Join(tmp, "dst")
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "a"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dst, "a"), 0755))
+
+	old := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, system.Chtimes(src, old, old))
+	require.NoError(t, system.Chtimes(filepath.Join(src, "a"), old, old))
+
+	require.NoError(t, fixTimes(src, dst, true))
+
+	fi, err := os.Stat(dst)
+	require.NoError(t, err)
+	assert.False(t, fi.ModTime().Equal(old), "pre-existing destination must not be modified")
+	fi, err = os.Stat(filepath.Join(dst, "a"))
+	require.NoError(t, err)
+	assert.True(t, fi.ModTime().Equal(old))
+}
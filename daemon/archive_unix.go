@@ -3,10 +3,17 @@
 package daemon
 
 import (
+	"bytes"
+	"io"
 	"os"
 	"path/filepath"
+	"syscall"
 
 	"github.com/docker/docker/container"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/docker/docker/pkg/system"
+	"github.com/pkg/errors"
 )
 
 // checkIfPathIsInAVolume checks if the path is in a volume. If it is, it
@@ -25,7 +32,7 @@ func checkIfPathIsInAVolume(container *container.Container, absPath string) (boo
 	return toVolume, nil
 }
 
-func fixPermissions(source, destination string, uid, gid int, destExisted bool) error {
+func fixPermissions(source, destination string, owner copyOwner, destExisted bool) error {
 	// If the destination didn't already exist, or the destination isn't a
 	// directory, then we should Lchown the destination. Otherwise, we shouldn't
 	// Lchown the destination.
@@ -40,6 +47,9 @@ func fixPermissions(source, destination string, uid, gid int, destExisted bool)
 	// We Walk on the source rather than on the destination because we don't
 	// want to change permissions on things we haven't created or modified.
 	return filepath.Walk(source, func(fullpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		// Do not alter the walk root iff. it existed before, as it doesn't fall under
 		// the domain of "things we should chown".
 		if !doChownDestination && (source == fullpath) {
@@ -52,11 +62,229 @@ func fixPermissions(source, destination string, uid, gid int, destExisted bool)
 			return err
 		}
 
+		ids, err := owner.of(info)
+		if err != nil {
+			return err
+		}
 		fullpath = filepath.Join(destination, cleaned)
-		return os.Lchown(fullpath, uid, gid)
+		return os.Lchown(fullpath, ids.UID, ids.GID)
 	})
 }
 
+// of returns the owner on the host of the copy of the source entry info.
+func (o copyOwner) of(info os.FileInfo) (idtools.IDPair, error) {
+	if o.ownership == nil {
+		return o.root, nil
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return o.root, nil
+	}
+	ids := idtools.IDPair{
+		UID: mapCopyID(int(st.Uid), o.ownership.UIDs()),
+		GID: mapCopyID(int(st.Gid), o.ownership.GIDs()),
+	}
+	host, err := o.idMappings.ToHost(ids)
+	if err != nil {
+		return host, errors.Wrapf(err, "cannot own %s by %d:%d", info.Name(), ids.UID, ids.GID)
+	}
+	return host, nil
+}
+
+// syncDirectory makes destination a copy of the directory source owned as
+// owner tells, like copying it and calling fixPermissions would, but only
+// writes the entries of destination which differ from source, and removes
+// those which are not in source if prune is set. Entries which are left
+// alone are not copied up into the layer of the container, so that it only
+// holds the changes.
+func syncDirectory(archiver *archive.Archiver, source, destination string, owner copyOwner, prune bool) error {
+	if prune {
+		if err := removeEntriesNotIn(source, destination); err != nil {
+			return err
+		}
+	}
+
+	if err := filepath.Walk(source, func(srcPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, srcPath)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			// The destination itself is handled like an existing
+			// directory by fixPermissions.
+			return nil
+		}
+		return syncEntry(archiver, srcPath, filepath.Join(destination, rel), info, owner)
+	}); err != nil {
+		return err
+	}
+
+	// Directories are populated before the times of the copied ones can be
+	// restored, and only those which differ are touched.
+	return filepath.Walk(source, func(srcPath string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() || srcPath == source {
+			return err
+		}
+		rel, err := filepath.Rel(source, srcPath)
+		if err != nil {
+			return err
+		}
+		destPath := filepath.Join(destination, rel)
+		destInfo, err := os.Lstat(destPath)
+		if err != nil {
+			return err
+		}
+		if destInfo.ModTime().Equal(info.ModTime()) {
+			return nil
+		}
+		return system.Chtimes(destPath, info.ModTime(), info.ModTime())
+	})
+}
+
+// syncEntry makes destPath a copy of the source entry srcPath, whose info
+// is info, owned as owner tells, unless it already is one. Only the metadata
+// of an entry with the same type and content is fixed, if needed. The
+// content of directories is left to the caller.
+func syncEntry(archiver *archive.Archiver, srcPath, destPath string, info os.FileInfo, owner copyOwner) error {
+	ids, err := owner.of(info)
+	if err != nil {
+		return err
+	}
+	destInfo, err := os.Lstat(destPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if destInfo != nil && destInfo.Mode()&os.ModeType != info.Mode()&os.ModeType {
+		if err := os.RemoveAll(destPath); err != nil {
+			return err
+		}
+		destInfo = nil
+	}
+
+	switch {
+	case info.IsDir():
+		if destInfo == nil {
+			if err := os.Mkdir(destPath, info.Mode().Perm()); err != nil {
+				return err
+			}
+			if err := os.Chmod(destPath, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return os.Lchown(destPath, ids.UID, ids.GID)
+		}
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(srcPath)
+		if err != nil {
+			return err
+		}
+		if destInfo != nil {
+			if destTarget, err := os.Readlink(destPath); err == nil && destTarget == target {
+				break
+			}
+			if err := os.Remove(destPath); err != nil {
+				return err
+			}
+		}
+		if err := os.Symlink(target, destPath); err != nil {
+			return err
+		}
+		return os.Lchown(destPath, ids.UID, ids.GID)
+	default:
+		if destInfo != nil && info.Mode().IsRegular() {
+			same, err := sameContent(srcPath, destPath, info, destInfo)
+			if err != nil {
+				return err
+			}
+			if same {
+				break
+			}
+		}
+		if err := archiver.CopyFileWithTar(srcPath, destPath); err != nil {
+			return err
+		}
+		return os.Lchown(destPath, ids.UID, ids.GID)
+	}
+
+	// The entry is left in place, only fix its metadata if needed.
+	if info.Mode()&os.ModeSymlink == 0 && destInfo.Mode().Perm() != info.Mode().Perm() {
+		if err := os.Chmod(destPath, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	if st, ok := destInfo.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != ids.UID || int(st.Gid) != ids.GID {
+		return os.Lchown(destPath, ids.UID, ids.GID)
+	}
+	return nil
+}
+
+// removeEntriesNotIn removes the entries of destination which do not exist
+// in source, or which are directories that are not directories in source.
+func removeEntriesNotIn(source, destination string) error {
+	return filepath.Walk(destination, func(destPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(destination, destPath)
+		if err != nil || rel == "." {
+			return err
+		}
+		srcInfo, err := os.Lstat(filepath.Join(source, rel))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if srcInfo != nil && (!info.IsDir() || srcInfo.IsDir()) {
+			return nil
+		}
+		if err := os.RemoveAll(destPath); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// sameContent returns whether the regular files a and b have the same size
+// and content.
+func sameContent(a, b string, aInfo, bInfo os.FileInfo) (bool, error) {
+	if !bInfo.Mode().IsRegular() || aInfo.Size() != bInfo.Size() {
+		return false, nil
+	}
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA := make([]byte, 32*1024)
+	bufB := make([]byte, 32*1024)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
 // isOnlineFSOperationPermitted returns an error if an online filesystem operation
 // is not permitted.
 func (daemon *Daemon) isOnlineFSOperationPermitted(container *container.Container) error {
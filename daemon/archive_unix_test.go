@@ -0,0 +1,375 @@
+//go:build !windows
+// +build !windows
+
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/container"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/docker/docker/pkg/reexec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	reexec.Init()
+}
+
+func TestCopyOnBuildIntoSymlinkToDirectory(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("copying into a container filesystem requires root")
+	}
+
+	tmp, err := ioutil.TempDir("", "docker-copy-on-build")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	srcRoot := filepath.Join(tmp, "context")
+	require.NoError(t, os.MkdirAll(filepath.Join(srcRoot, "dir"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(srcRoot, "file"), []byte("file"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(srcRoot, "dir", "nested"), []byte("nested"), 0644))
+
+	rootfs := filepath.Join(tmp, "rootfs")
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "real", "dir"), 0755))
+	require.NoError(t, os.Symlink("/real/dir", filepath.Join(rootfs, "dest")))
+
+	daemon := &Daemon{idMappings: &idtools.IDMappings{}}
+	c := &container.Container{BaseFS: rootfs}
+
+	for _, testcase := range []struct {
+		destPath string
+		srcPath  string
+		expected string
+	}{
+		{destPath: "/dest", srcPath: "file", expected: "real/dir/file"},
+		{destPath: "/dest/", srcPath: "file", expected: "real/dir/file"},
+		{destPath: "/dest", srcPath: "dir", expected: "real/dir/nested"},
+	} {
+		require.NoError(t, daemon.copyOnBuild(c, testcase.destPath, srcRoot, testcase.srcPath, false, nil, 0, false))
+		_, err := os.Stat(filepath.Join(rootfs, testcase.expected))
+		assert.NoError(t, err, "COPY %s %s", testcase.srcPath, testcase.destPath)
+
+		fi, err := os.Lstat(filepath.Join(rootfs, "dest"))
+		require.NoError(t, err)
+		assert.True(t, fi.Mode()&os.ModeSymlink != 0, "the destination symlink must be kept")
+		require.NoError(t, os.RemoveAll(filepath.Join(rootfs, testcase.expected)))
+	}
+}
+
+func TestSyncOnBuildOnlyWritesChangedFiles(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("copying into a container filesystem requires root")
+	}
+
+	tmp, err := ioutil.TempDir("", "docker-sync-on-build")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	srcRoot := filepath.Join(tmp, "context")
+	require.NoError(t, os.MkdirAll(filepath.Join(srcRoot, "src", "dir"), 0755))
+	for name, content := range map[string]string{
+		"src/unchanged":  "unchanged",
+		"src/changed":    "new content",
+		"src/added":      "added",
+		"src/dir/nested": "nested",
+	} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(srcRoot, name), []byte(content), 0644))
+	}
+	require.NoError(t, os.Symlink("unchanged", filepath.Join(srcRoot, "src", "link")))
+
+	rootfs := filepath.Join(tmp, "rootfs")
+	dest := filepath.Join(rootfs, "app")
+	require.NoError(t, os.MkdirAll(filepath.Join(dest, "removed-dir"), 0755))
+	for name, content := range map[string]string{
+		"unchanged":        "unchanged",
+		"changed":          "old content",
+		"removed":          "removed",
+		"removed-dir/file": "removed",
+	} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dest, name), []byte(content), 0644))
+	}
+	marker := time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(filepath.Join(dest, "unchanged"), marker, marker))
+
+	daemon := &Daemon{idMappings: &idtools.IDMappings{}}
+	c := &container.Container{BaseFS: rootfs}
+	require.NoError(t, daemon.syncOnBuild(c, "/app", srcRoot, "src"))
+
+	for name, expected := range map[string]string{
+		"unchanged":  "unchanged",
+		"changed":    "new content",
+		"added":      "added",
+		"dir/nested": "nested",
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(dest, name))
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(content), name)
+	}
+	target, err := os.Readlink(filepath.Join(dest, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "unchanged", target)
+
+	fi, err := os.Stat(filepath.Join(dest, "unchanged"))
+	require.NoError(t, err)
+	assert.True(t, fi.ModTime().Equal(marker), "an unchanged file must not be rewritten")
+
+	for _, name := range []string{"removed", "removed-dir"} {
+		_, err := os.Lstat(filepath.Join(dest, name))
+		assert.True(t, os.IsNotExist(err), "%s must be removed", name)
+	}
+}
+
+func TestCopyOnBuildSkipsIdenticalFiles(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("copying into a container filesystem requires root")
+	}
+
+	tmp, err := ioutil.TempDir("", "docker-copy-on-build")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	srcRoot := filepath.Join(tmp, "context")
+	require.NoError(t, os.MkdirAll(filepath.Join(srcRoot, "src", "dir"), 0755))
+	for name, content := range map[string]string{
+		"src/unchanged":     "unchanged",
+		"src/changed":       "new content",
+		"src/added":         "added",
+		"src/dir/unchanged": "nested",
+		"single":            "single",
+	} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(srcRoot, name), []byte(content), 0644))
+	}
+
+	rootfs := filepath.Join(tmp, "rootfs")
+	dest := filepath.Join(rootfs, "app")
+	require.NoError(t, os.MkdirAll(filepath.Join(dest, "dir"), 0755))
+	for name, content := range map[string]string{
+		"unchanged":     "unchanged",
+		"changed":       "old content",
+		"kept":          "kept",
+		"dir/unchanged": "nested",
+		"single":        "single",
+	} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dest, name), []byte(content), 0644))
+	}
+	marker := time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)
+	inodes := make(map[string]uint64)
+	for _, name := range []string{"unchanged", "changed", "dir/unchanged", "single"} {
+		p := filepath.Join(dest, name)
+		require.NoError(t, os.Chtimes(p, marker, marker))
+		fi, err := os.Stat(p)
+		require.NoError(t, err)
+		inodes[name] = fi.Sys().(*syscall.Stat_t).Ino
+	}
+
+	daemon := &Daemon{idMappings: &idtools.IDMappings{}}
+	c := &container.Container{BaseFS: rootfs}
+	require.NoError(t, daemon.copyOnBuild(c, "/app", srcRoot, "src", false, nil, 0, true))
+	require.NoError(t, daemon.copyOnBuild(c, "/app/", srcRoot, "single", false, nil, 0, true))
+
+	for name, expected := range map[string]string{
+		"unchanged":     "unchanged",
+		"changed":       "new content",
+		"added":         "added",
+		"kept":          "kept",
+		"dir/unchanged": "nested",
+		"single":        "single",
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(dest, name))
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(content), name)
+	}
+	for name, rewritten := range map[string]bool{
+		"unchanged":     false,
+		"dir/unchanged": false,
+		"single":        false,
+		"changed":       true,
+	} {
+		fi, err := os.Stat(filepath.Join(dest, name))
+		require.NoError(t, err)
+		same := fi.ModTime().Equal(marker) && fi.Sys().(*syscall.Stat_t).Ino == inodes[name]
+		assert.Equal(t, !rewritten, same, "%s rewritten: %t", name, !same)
+	}
+}
+
+func TestCopyOnBuildModesIgnoreUmask(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("copying into a container filesystem requires root")
+	}
+
+	tmp, err := ioutil.TempDir("", "docker-copy-on-build")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	srcRoot := filepath.Join(tmp, "context")
+	require.NoError(t, os.MkdirAll(filepath.Join(srcRoot, "dir", "sub"), 0755))
+	require.NoError(t, os.Chmod(filepath.Join(srcRoot, "dir", "sub"), 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(srcRoot, "file"), []byte("file"), 0640))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(srcRoot, "dir", "sub", "nested"), []byte("nested"), 0600))
+
+	daemon := &Daemon{idMappings: &idtools.IDMappings{}}
+	copyWithUmask := func(umask int) map[string]os.FileMode {
+		rootfs := filepath.Join(tmp, fmt.Sprintf("rootfs-%o", umask))
+		require.NoError(t, os.Mkdir(rootfs, 0755))
+		c := &container.Container{BaseFS: rootfs}
+
+		old := syscall.Umask(umask)
+		defer syscall.Umask(old)
+		require.NoError(t, daemon.copyOnBuild(c, "/a/b/", srcRoot, "file", false, nil, 0, false))
+		require.NoError(t, daemon.copyOnBuild(c, "/c/d", srcRoot, "dir", false, nil, 0, false))
+		require.NoError(t, daemon.syncOnBuild(c, "/e/f", srcRoot, "dir"))
+
+		modes := make(map[string]os.FileMode)
+		err := filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
+			if err != nil || path == rootfs {
+				return err
+			}
+			rel, err := filepath.Rel(rootfs, path)
+			modes[rel] = info.Mode()
+			return err
+		})
+		require.NoError(t, err)
+		return modes
+	}
+
+	modes := copyWithUmask(022)
+	assert.Equal(t, modes, copyWithUmask(077))
+	assert.Equal(t, os.ModeDir|0755, modes["a"])
+	assert.Equal(t, os.ModeDir|0755, modes["a/b"])
+	assert.Equal(t, os.FileMode(0640), modes["a/b/file"])
+	assert.Equal(t, os.ModeDir|0755, modes["c/d"])
+	assert.Equal(t, os.ModeDir|0750, modes["c/d/sub"])
+	assert.Equal(t, os.FileMode(0600), modes["c/d/sub/nested"])
+	assert.Equal(t, os.ModeDir|0755, modes["e/f"])
+	assert.Equal(t, os.ModeDir|0750, modes["e/f/sub"])
+}
+
+func TestCopyOnBuildParentDirMode(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("copying into a container filesystem requires root")
+	}
+
+	tmp, err := ioutil.TempDir("", "docker-copy-on-build")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	srcRoot := filepath.Join(tmp, "context")
+	require.NoError(t, os.MkdirAll(srcRoot, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(srcRoot, "file"), []byte("file"), 0644))
+
+	rootfs := filepath.Join(tmp, "rootfs")
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "existing"), 0755))
+	daemon := &Daemon{idMappings: &idtools.IDMappings{}}
+	c := &container.Container{BaseFS: rootfs}
+	require.NoError(t, daemon.copyOnBuild(c, "/existing/a/b/", srcRoot, "file", false, nil, 0700, false))
+
+	for name, expected := range map[string]os.FileMode{
+		"existing":          os.ModeDir | 0755,
+		"existing/a":        os.ModeDir | 0700,
+		"existing/a/b":      os.ModeDir | 0700,
+		"existing/a/b/file": 0644,
+	} {
+		fi, err := os.Lstat(filepath.Join(rootfs, name))
+		require.NoError(t, err)
+		assert.Equal(t, expected, fi.Mode(), name)
+	}
+}
+
+func TestCopyOnBuildRemapsOwnership(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("copying into a container filesystem requires root")
+	}
+
+	tmp, err := ioutil.TempDir("", "docker-copy-on-build")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	srcRoot := filepath.Join(tmp, "context")
+	require.NoError(t, os.MkdirAll(filepath.Join(srcRoot, "dir", "sub"), 0755))
+	owners := map[string]idtools.IDPair{
+		"dir":            {UID: 1000, GID: 1000},
+		"dir/sub":        {UID: 1001, GID: 1000},
+		"dir/sub/nested": {UID: 1001, GID: 2000},
+		"dir/other":      {UID: 3000, GID: 3000},
+	}
+	for name, ids := range owners {
+		p := filepath.Join(srcRoot, name)
+		if name == "dir/sub/nested" || name == "dir/other" {
+			require.NoError(t, ioutil.WriteFile(p, []byte(name), 0644))
+		}
+		require.NoError(t, os.Lchown(p, ids.UID, ids.GID))
+	}
+
+	rootfs := filepath.Join(tmp, "rootfs")
+	require.NoError(t, os.MkdirAll(rootfs, 0755))
+	daemon := &Daemon{idMappings: &idtools.IDMappings{}}
+	c := &container.Container{BaseFS: rootfs}
+	ownership := idtools.NewIDMappingsFromMaps(
+		[]idtools.IDMap{{HostID: 1000, ContainerID: 0, Size: 2}},
+		[]idtools.IDMap{{HostID: 1000, ContainerID: 50, Size: 1}, {HostID: 2000, ContainerID: 60, Size: 1}},
+	)
+	require.NoError(t, daemon.copyOnBuild(c, "/dest", srcRoot, "dir", false, ownership, 0, false))
+
+	// The IDs which are not mapped are owned by root.
+	for name, expected := range map[string]idtools.IDPair{
+		"dest":            {UID: 0, GID: 50},
+		"dest/sub":        {UID: 1, GID: 50},
+		"dest/sub/nested": {UID: 1, GID: 60},
+		"dest/other":      {UID: 0, GID: 0},
+	} {
+		fi, err := os.Lstat(filepath.Join(rootfs, name))
+		require.NoError(t, err)
+		st := fi.Sys().(*syscall.Stat_t)
+		assert.Equal(t, expected, idtools.IDPair{UID: int(st.Uid), GID: int(st.Gid)}, name)
+	}
+}
+
+func TestCopyOnBuildExtractsZstdArchive(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("copying into a container filesystem requires root")
+	}
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd not present")
+	}
+
+	tmp, err := ioutil.TempDir("", "docker-copy-on-build")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	content := filepath.Join(tmp, "content")
+	require.NoError(t, os.MkdirAll(filepath.Join(content, "dir"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(content, "dir", "file"), []byte("zstd"), 0644))
+
+	srcRoot := filepath.Join(tmp, "context")
+	require.NoError(t, os.MkdirAll(srcRoot, 0755))
+	rdr, err := archive.Tar(content, archive.Uncompressed)
+	require.NoError(t, err)
+	defer rdr.Close()
+	out, err := os.Create(filepath.Join(srcRoot, "content.tar.zst"))
+	require.NoError(t, err)
+	defer out.Close()
+	cmd := exec.Command("zstd", "-q", "-c")
+	cmd.Stdin = rdr
+	cmd.Stdout = out
+	require.NoError(t, cmd.Run())
+
+	rootfs := filepath.Join(tmp, "rootfs")
+	require.NoError(t, os.MkdirAll(rootfs, 0755))
+	daemon := &Daemon{idMappings: &idtools.IDMappings{}}
+	c := &container.Container{BaseFS: rootfs}
+	require.NoError(t, daemon.copyOnBuild(c, "/dest/", srcRoot, "content.tar.zst", true, nil, 0, false))
+
+	extracted, err := ioutil.ReadFile(filepath.Join(rootfs, "dest", "dir", "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "zstd", string(extracted))
+}
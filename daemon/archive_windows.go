@@ -2,9 +2,11 @@ package daemon
 
 import (
 	"errors"
+	"os"
 
 	containertypes "github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/container"
+	"github.com/docker/docker/pkg/archive"
 )
 
 // checkIfPathIsInAVolume checks if the path is in a volume. If it is, it
@@ -17,11 +19,19 @@ func checkIfPathIsInAVolume(container *container.Container, absPath string) (boo
 	return false, nil
 }
 
-func fixPermissions(source, destination string, uid, gid int, destExisted bool) error {
+func fixPermissions(source, destination string, owner copyOwner, destExisted bool) error {
 	// chown is not supported on Windows
 	return nil
 }
 
+func syncDirectory(archiver *archive.Archiver, source, destination string, owner copyOwner, prune bool) error {
+	return errors.New("copying only changed files is not supported on Windows")
+}
+
+func syncEntry(archiver *archive.Archiver, srcPath, destPath string, info os.FileInfo, owner copyOwner) error {
+	return errors.New("copying only changed files is not supported on Windows")
+}
+
 // isOnlineFSOperationPermitted returns an error if an online filesystem operation
 // is not permitted (such as stat or for copying). Running Hyper-V containers
 // cannot have their file-system interrogated from the host as the filter is
@@ -158,6 +158,10 @@ type CommonConfig struct {
 	SwarmDefaultAdvertiseAddr string `json:"swarm-default-advertise-addr"`
 	MetricsAddress            string `json:"metrics-addr"`
 
+	// BuilderDenylist is the path of a file listing the sha256 digests of
+	// the files builds are not allowed to copy into images.
+	BuilderDenylist string `json:"builder-denylist,omitempty"`
+
 	LogConfig
 	BridgeConfig // bridgeConfig holds bridge network specific configuration.
 	registry.ServiceOptions
@@ -0,0 +1,158 @@
+package graphdriver
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/docker/go-metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	applyDiffBytesPerSecond   *prometheus.HistogramVec
+	applyDiffEntriesPerSecond *prometheus.HistogramVec
+)
+
+func init() {
+	ns := metrics.NewNamespace("engine", "graphdriver", nil)
+	applyDiffBytesPerSecond = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "engine",
+		Subsystem: "graphdriver",
+		Name:      "apply_diff_bytes_per_second",
+		Help:      "The number of bytes of diff each layer is applied at per second",
+		Buckets:   prometheus.ExponentialBuckets(1<<20, 4, 8),
+	}, []string{"driver", "layer_size"})
+	applyDiffEntriesPerSecond = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "engine",
+		Subsystem: "graphdriver",
+		Name:      "apply_diff_entries_per_second",
+		Help:      "The number of diff entries each layer is applied at per second",
+		Buckets:   prometheus.ExponentialBuckets(10, 4, 8),
+	}, []string{"driver", "layer_size"})
+	ns.Add(applyDiffBytesPerSecond)
+	ns.Add(applyDiffEntriesPerSecond)
+	metrics.Register(ns)
+}
+
+// layerSizeBuckets are the upper bounds of the layer_size label of the
+// ApplyDiff metrics, with the label of the layers below them.
+var layerSizeBuckets = []struct {
+	limit int64
+	label string
+}{
+	{1 << 20, "<1MiB"},
+	{10 << 20, "<10MiB"},
+	{100 << 20, "<100MiB"},
+	{1 << 30, "<1GiB"},
+}
+
+// layerSizeLabel returns the layer_size label of a diff of size bytes.
+func layerSizeLabel(size int64) string {
+	for _, b := range layerSizeBuckets {
+		if size < b.limit {
+			return b.label
+		}
+	}
+	return ">=1GiB"
+}
+
+// applyMetricsDriver wraps a Driver and records the throughput of the diffs
+// it applies.
+type applyMetricsDriver struct {
+	Driver
+}
+
+// applyMetricsDiffGetterDriver is an applyMetricsDriver which keeps the
+// DiffGetter method of the driver it wraps.
+type applyMetricsDiffGetterDriver struct {
+	*applyMetricsDriver
+	getter DiffGetterDriver
+}
+
+func (d *applyMetricsDiffGetterDriver) DiffGetter(id string) (FileGetCloser, error) {
+	return d.getter.DiffGetter(id)
+}
+
+// WithApplyDiffMetrics returns a Driver which records the number of bytes
+// and of tar entries per second each diff d applies is applied at, in the
+// engine_graphdriver_apply_diff_bytes_per_second and
+// engine_graphdriver_apply_diff_entries_per_second histograms. The
+// observations are labeled with the name of d and the size of the diff.
+// Counting the entries parses the diff a second time, so this is meant for
+// benchmarking rather than for production daemons. The returned driver
+// keeps the Capabilities and DiffGetter methods of d, if it has them.
+func WithApplyDiffMetrics(d Driver) Driver {
+	md := &applyMetricsDriver{Driver: d}
+	if getter, ok := d.(DiffGetterDriver); ok {
+		return &applyMetricsDiffGetterDriver{applyMetricsDriver: md, getter: getter}
+	}
+	return md
+}
+
+// Capabilities returns the capabilities of the underlying driver.
+func (d *applyMetricsDriver) Capabilities() Capabilities {
+	if capDriver, ok := d.Driver.(CapabilityDriver); ok {
+		return capDriver.Capabilities()
+	}
+	return Capabilities{}
+}
+
+// ApplyDiff applies the diff and, if it succeeds, records its throughput.
+func (d *applyMetricsDriver) ApplyDiff(id, parent string, diff io.Reader) (int64, error) {
+	counter := newTarEntryCounter()
+	start := time.Now()
+	size, err := d.Driver.ApplyDiff(id, parent, io.TeeReader(diff, counter))
+	elapsed := time.Since(start).Seconds()
+	bytes, entries := counter.Close()
+	if err != nil || elapsed <= 0 {
+		return size, err
+	}
+	label := layerSizeLabel(bytes)
+	applyDiffBytesPerSecond.WithLabelValues(d.String(), label).Observe(float64(bytes) / elapsed)
+	applyDiffEntriesPerSecond.WithLabelValues(d.String(), label).Observe(float64(entries) / elapsed)
+	return size, nil
+}
+
+// tarEntryCounter counts the bytes written to it and the entries of the tar
+// stream they make up.
+type tarEntryCounter struct {
+	pw      *io.PipeWriter
+	bytes   int64
+	entries int
+	done    chan struct{}
+}
+
+func newTarEntryCounter() *tarEntryCounter {
+	pr, pw := io.Pipe()
+	c := &tarEntryCounter{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		tr := tar.NewReader(pr)
+		for {
+			if _, err := tr.Next(); err != nil {
+				break
+			}
+			c.entries++
+		}
+		// Keep consuming what is left so that writes never block, even
+		// if the stream is not a valid tar.
+		io.Copy(ioutil.Discard, pr)
+	}()
+	return c
+}
+
+func (c *tarEntryCounter) Write(p []byte) (int, error) {
+	c.bytes += int64(len(p))
+	c.pw.Write(p)
+	return len(p), nil
+}
+
+// Close ends the stream and returns the number of bytes and of entries that
+// were written.
+func (c *tarEntryCounter) Close() (int64, int) {
+	c.pw.Close()
+	<-c.done
+	return c.bytes, c.entries
+}
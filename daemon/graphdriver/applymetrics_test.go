@@ -0,0 +1,101 @@
+package graphdriver
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/archive"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// discardDriver is a Driver whose ApplyDiff reads the diff and throws it
+// away, or fails with err.
+type discardDriver struct {
+	Driver
+	err error
+}
+
+func (d *discardDriver) String() string {
+	return "discard"
+}
+
+func (d *discardDriver) ApplyDiff(id, parent string, diff io.Reader) (int64, error) {
+	n, _ := io.Copy(ioutil.Discard, diff)
+	time.Sleep(time.Millisecond)
+	return n, d.err
+}
+
+// histogramSamples returns the number and the sum of the observations of
+// a histogram.
+func histogramSamples(t *testing.T, metric interface {
+	Write(*dto.Metric) error
+}) (uint64, float64) {
+	var m dto.Metric
+	require.NoError(t, metric.Write(&m))
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestApplyDiffMetrics(t *testing.T) {
+	bytesHistogram := applyDiffBytesPerSecond.WithLabelValues("discard", "<1MiB")
+	entriesHistogram := applyDiffEntriesPerSecond.WithLabelValues("discard", "<1MiB")
+	bytesCount, bytesSum := histogramSamples(t, bytesHistogram)
+	entriesCount, entriesSum := histogramSamples(t, entriesHistogram)
+
+	d := WithApplyDiffMetrics(&discardDriver{})
+	diff, err := archive.Generate("a", "foo", "b", "bar", "dir/c", "baz")
+	require.NoError(t, err)
+	_, err = d.ApplyDiff("layer1", "", diff)
+	require.NoError(t, err)
+
+	count, sum := histogramSamples(t, bytesHistogram)
+	assert.Equal(t, bytesCount+1, count)
+	assert.True(t, sum > bytesSum)
+	count, sum = histogramSamples(t, entriesHistogram)
+	assert.Equal(t, entriesCount+1, count)
+	assert.True(t, sum > entriesSum)
+
+	failing := WithApplyDiffMetrics(&discardDriver{err: errors.New("boom")})
+	diff, err = archive.Generate("a", "foo")
+	require.NoError(t, err)
+	_, err = failing.ApplyDiff("layer2", "", diff)
+	assert.EqualError(t, err, "boom")
+	count, _ = histogramSamples(t, bytesHistogram)
+	assert.Equal(t, bytesCount+1, count)
+}
+
+func TestApplyDiffMetricsInvalidTar(t *testing.T) {
+	d := WithApplyDiffMetrics(&discardDriver{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := d.ApplyDiff("layer1", "", io.LimitReader(zeroReader{}, 1<<20))
+		assert.NoError(t, err)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("ApplyDiff blocked on a diff which is not a tar")
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestLayerSizeLabel(t *testing.T) {
+	assert.Equal(t, "<1MiB", layerSizeLabel(0))
+	assert.Equal(t, "<10MiB", layerSizeLabel(1<<20))
+	assert.Equal(t, "<100MiB", layerSizeLabel(50<<20))
+	assert.Equal(t, "<1GiB", layerSizeLabel(100<<20))
+	assert.Equal(t, ">=1GiB", layerSizeLabel(5<<30))
+}
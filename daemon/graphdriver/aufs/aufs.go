@@ -46,6 +46,7 @@ import (
 	"github.com/docker/docker/pkg/idtools"
 	"github.com/docker/docker/pkg/locker"
 	mountpk "github.com/docker/docker/pkg/mount"
+	"github.com/docker/docker/pkg/parsers"
 	"github.com/docker/docker/pkg/system"
 
 	rsystem "github.com/opencontainers/runc/libcontainer/system"
@@ -78,11 +79,16 @@ type Driver struct {
 	pathCache     map[string]string
 	naiveDiff     graphdriver.DiffDriver
 	locker        *locker.Locker
+	forceUnmount  graphdriver.ForceUnmount
 }
 
 // Init returns a new AUFS driver.
 // An error is returned if AUFS is not supported.
 func Init(root string, options []string, uidMaps, gidMaps []idtools.IDMap) (graphdriver.Driver, error) {
+	forceUnmount, err := parseOptions(options)
+	if err != nil {
+		return nil, err
+	}
 
 	// Try to load the aufs kernel module
 	if err := supportsAufs(); err != nil {
@@ -93,9 +99,7 @@ func Init(root string, options []string, uidMaps, gidMaps []idtools.IDMap) (grap
 	if err != nil {
 		return nil, err
 	}
-	if fsName, ok := graphdriver.FsNames[fsMagic]; ok {
-		backingFs = fsName
-	}
+	backingFs = graphdriver.FsName(fsMagic)
 
 	switch fsMagic {
 	case graphdriver.FsMagicAufs, graphdriver.FsMagicBtrfs, graphdriver.FsMagicEcryptfs:
@@ -110,12 +114,13 @@ func Init(root string, options []string, uidMaps, gidMaps []idtools.IDMap) (grap
 	}
 
 	a := &Driver{
-		root:      root,
-		uidMaps:   uidMaps,
-		gidMaps:   gidMaps,
-		pathCache: make(map[string]string),
-		ctr:       graphdriver.NewRefCounter(graphdriver.NewFsChecker(graphdriver.FsMagicAufs)),
-		locker:    locker.New(),
+		root:         root,
+		uidMaps:      uidMaps,
+		gidMaps:      gidMaps,
+		pathCache:    make(map[string]string),
+		ctr:          graphdriver.NewRefCounter(graphdriver.NewFsChecker(graphdriver.FsMagicAufs)),
+		locker:       locker.New(),
+		forceUnmount: forceUnmount,
 	}
 
 	rootUID, rootGID, err := idtools.GetRootUIDGID(uidMaps, gidMaps)
@@ -147,6 +152,35 @@ func Init(root string, options []string, uidMaps, gidMaps []idtools.IDMap) (grap
 	return a, nil
 }
 
+// parseOptions parses the options of the driver. Options which are not
+// prefixed with "aufs." are ignored, as they always were.
+func parseOptions(options []string) (graphdriver.ForceUnmount, error) {
+	var forceUnmount graphdriver.ForceUnmount
+	for _, option := range options {
+		key, val, err := parsers.ParseKeyValueOpt(option)
+		if err != nil {
+			return forceUnmount, err
+		}
+		key = strings.ToLower(key)
+		switch key {
+		case "aufs.force_unmount_after":
+			after, err := time.ParseDuration(val)
+			if err != nil {
+				return forceUnmount, err
+			}
+			if after < 0 {
+				return forceUnmount, fmt.Errorf("aufs: invalid value for %s: %s", key, val)
+			}
+			forceUnmount.After = after
+		default:
+			if strings.HasPrefix(key, "aufs.") {
+				return forceUnmount, fmt.Errorf("aufs: Unknown option %s", key)
+			}
+		}
+	}
+	return forceUnmount, nil
+}
+
 // Return a nil error if the kernel supports aufs
 // We cannot modprobe because inside dind modprobe fails
 // to run
@@ -193,6 +227,11 @@ func (a *Driver) Status() [][2]string {
 	}
 }
 
+// SupportsMountIsolation returns true, as layers are only mounted by Get.
+func (a *Driver) SupportsMountIsolation() bool {
+	return true
+}
+
 // GetMetadata not implemented
 func (a *Driver) GetMetadata(id string) (map[string]string, error) {
 	return nil, nil
@@ -527,10 +566,12 @@ func (a *Driver) unmount(mountPath string) error {
 	if mounted, err := a.mounted(mountPath); err != nil || !mounted {
 		return err
 	}
-	if err := Unmount(mountPath); err != nil {
-		return err
-	}
-	return nil
+	return a.forceUnmount.Unmount(mountPath, func(flags int) error {
+		if flags == 0 {
+			return Unmount(mountPath)
+		}
+		return syscall.Unmount(mountPath, flags)
+	})
 }
 
 func (a *Driver) mounted(mountpoint string) (bool, error) {
@@ -0,0 +1,67 @@
+package graphdriver
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+// ChangesSinceDriver is the interface for drivers which can efficiently
+// report the changes made to a layer after a point in time, e.g. by
+// scanning the modification times of an overlay upper directory.
+type ChangesSinceDriver interface {
+	// ChangesSince produces a list of the changes of the specified layer
+	// which were made after since.
+	ChangesSince(id string, since time.Time) ([]archive.Change, error)
+}
+
+// ChangesSince produces a list of the changes between the specified layer
+// and its parent layer which may be "" that were made after since. This
+// allows cheaply polling a container's writable layer for new changes.
+// Drivers which do not implement ChangesSinceDriver have the result of
+// Changes filtered by modification time.
+func ChangesSince(d Driver, id, parent string, since time.Time) ([]archive.Change, error) {
+	if cd, ok := d.(ChangesSinceDriver); ok {
+		return cd.ChangesSince(id, since)
+	}
+
+	changes, err := d.Changes(id, parent)
+	if err != nil {
+		return nil, err
+	}
+	root, err := d.Get(id, "")
+	if err != nil {
+		return nil, err
+	}
+	defer d.Put(id)
+
+	return FilterChangesSince(root, changes, since)
+}
+
+// FilterChangesSince returns the changes whose path below root was modified
+// after since. Deleted paths which do not exist below root, as opposed to
+// being represented by a whiteout, are considered modified when their
+// parent directory was.
+func FilterChangesSince(root string, changes []archive.Change, since time.Time) ([]archive.Change, error) {
+	var filtered []archive.Change
+	for _, change := range changes {
+		p := filepath.Join(root, change.Path)
+		fi, err := os.Lstat(p)
+		if err != nil && os.IsNotExist(err) && change.Kind == archive.ChangeDelete {
+			fi, err = os.Lstat(filepath.Dir(p))
+		}
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed concurrently; it will show up in a later poll.
+				continue
+			}
+			return nil, err
+		}
+		if fi.ModTime().After(since) {
+			filtered = append(filtered, change)
+		}
+	}
+	return filtered, nil
+}
@@ -0,0 +1,57 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/system"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangesSince(t *testing.T) {
+	d, _, cleanup := newVfsDriver(t)
+	defer cleanup()
+
+	require.NoError(t, d.Create("parent", "", nil))
+	diff, err := archive.Generate("removed", "content")
+	require.NoError(t, err)
+	_, err = d.ApplyDiff("parent", "", diff)
+	require.NoError(t, err)
+	require.NoError(t, d.Create("child", "parent", nil))
+
+	earlier := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	later := time.Date(2002, 1, 1, 0, 0, 0, 0, time.UTC)
+	since := time.Date(2001, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	dir, err := d.Get("child", "")
+	require.NoError(t, err)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sub", "first"), []byte("first"), 0644))
+	require.NoError(t, system.Chtimes(filepath.Join(dir, "sub", "first"), earlier, earlier))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sub", "second"), []byte("second"), 0644))
+	require.NoError(t, system.Chtimes(filepath.Join(dir, "sub", "second"), later, later))
+	require.NoError(t, system.Chtimes(filepath.Join(dir, "sub"), earlier, earlier))
+	require.NoError(t, os.Remove(filepath.Join(dir, "removed")))
+	require.NoError(t, d.Put("child"))
+
+	changes, err := graphdriver.ChangesSince(d, "child", "parent", since)
+	require.NoError(t, err)
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	assert.Equal(t, []archive.Change{
+		{Path: "/removed", Kind: archive.ChangeDelete},
+		{Path: "/sub/second", Kind: archive.ChangeAdd},
+	}, changes)
+
+	changes, err = graphdriver.ChangesSince(d, "child", "parent", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+}
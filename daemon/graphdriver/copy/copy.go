@@ -1,6 +1,8 @@
 // +build linux
 
-package overlay
+// Package copy copies the directory trees of layers, preserving their
+// metadata.
+package copy
 
 import (
 	"fmt"
@@ -14,10 +16,13 @@ import (
 	rsystem "github.com/opencontainers/runc/libcontainer/system"
 )
 
-type copyFlags int
+// Flags control how DirCopy copies files.
+type Flags int
 
 const (
-	copyHardlink copyFlags = 1 << iota
+	// Hardlink makes DirCopy hardlink regular files instead of copying
+	// their content.
+	Hardlink Flags = 1 << iota
 )
 
 func copyRegular(srcPath, dstPath string, mode os.FileMode) error {
@@ -51,7 +56,9 @@ func copyXattr(srcPath, dstPath, attr string) error {
 	return nil
 }
 
-func copyDir(srcDir, dstDir string, flags copyFlags) error {
+// DirCopy copies the tree rooted at srcDir to dstDir, with the ownership,
+// permissions, times and the xattrs used by overlay of its entries.
+func DirCopy(srcDir, dstDir string, flags Flags) error {
 	err := filepath.Walk(srcDir, func(srcPath string, f os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -77,7 +84,7 @@ func copyDir(srcDir, dstDir string, flags copyFlags) error {
 
 		switch f.Mode() & os.ModeType {
 		case 0: // Regular file
-			if flags&copyHardlink != 0 {
+			if flags&Hardlink != 0 {
 				isHardlink = true
 				if err := os.Link(srcPath, dstPath); err != nil {
 					return err
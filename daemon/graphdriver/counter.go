@@ -57,3 +57,16 @@ func (c *RefCounter) incdec(path string, infoOp func(minfo *minfo)) int {
 	c.mu.Unlock()
 	return count
 }
+
+// Active returns the paths whose ref count is above zero.
+func (c *RefCounter) Active() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var paths []string
+	for path, m := range c.counts {
+		if m.count > 0 {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
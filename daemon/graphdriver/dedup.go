@@ -0,0 +1,216 @@
+package graphdriver
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/ioutils"
+	"github.com/opencontainers/go-digest"
+)
+
+// errDedupNotSupported is returned by linkLayer when the content of a layer
+// cannot be shared with another one.
+var errDedupNotSupported = errors.New("layers cannot share their content")
+
+// dedupLayer is the record of a layer of a dedupDriver.
+type dedupLayer struct {
+	Parent string        `json:"parent,omitempty"`
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+	// Shared is set if the layer shares the content of another one.
+	Shared bool `json:"shared,omitempty"`
+}
+
+// dedupDriver wraps a Driver and makes layers whose diffs are identical
+// share their files.
+type dedupDriver struct {
+	Driver
+	root string
+	path string
+
+	mu     sync.Mutex
+	layers map[string]dedupLayer
+}
+
+// dedupDiffGetterDriver is a dedupDriver which keeps the DiffGetter method of
+// the driver it wraps.
+type dedupDiffGetterDriver struct {
+	*dedupDriver
+	getter DiffGetterDriver
+}
+
+func (d *dedupDiffGetterDriver) DiffGetter(id string) (FileGetCloser, error) {
+	return d.getter.DiffGetter(id)
+}
+
+// dedupPath returns the path of the file recording the diffs of the layers
+// of the driver name, which is kept next to its home directory in root.
+func dedupPath(root, name string) string {
+	return filepath.Join(root, name+"-dedup.json")
+}
+
+// WithDeduplication returns a Driver which hashes the diffs applied with
+// ApplyDiff, and hardlinks the files of a layer whose diff was already
+// applied on top of the same parent instead of extracting it again. The
+// digests of the diffs are recorded in root. The files of layers are only
+// shared on Linux, when the driver stores them as plain directories on the
+// same filesystem, e.g. vfs; otherwise the diffs are applied as usual. The
+// returned driver implements ReclaimableSpaceDriver, accounting for the
+// shared files, and keeps the Capabilities and DiffGetter methods of d, if
+// it has them.
+func WithDeduplication(d Driver, root string) (Driver, error) {
+	dd := &dedupDriver{
+		Driver: d,
+		root:   root,
+		path:   dedupPath(root, d.String()),
+		layers: make(map[string]dedupLayer),
+	}
+	data, err := ioutil.ReadFile(dd.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &dd.layers); err != nil {
+			return nil, err
+		}
+	}
+	if getter, ok := d.(DiffGetterDriver); ok {
+		return &dedupDiffGetterDriver{dedupDriver: dd, getter: getter}, nil
+	}
+	return dd, nil
+}
+
+// Capabilities returns the capabilities of the underlying driver.
+func (d *dedupDriver) Capabilities() Capabilities {
+	if capDriver, ok := d.Driver.(CapabilityDriver); ok {
+		return capDriver.Capabilities()
+	}
+	return Capabilities{}
+}
+
+// save records the layers of the driver. It must be called with mu held.
+func (d *dedupDriver) save() error {
+	data, err := json.Marshal(d.layers)
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(d.path, data, 0600)
+}
+
+// lookup returns the ID of a layer other than id on top of parent whose
+// diff has the digest dgst, or "" if there is none.
+func (d *dedupDriver) lookup(id, parent string, dgst digest.Digest) (string, dedupLayer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for other, l := range d.layers {
+		if other != id && l.Parent == parent && l.Digest == dgst && d.Driver.Exists(other) {
+			return other, l
+		}
+	}
+	return "", dedupLayer{}
+}
+
+// share makes the layer id share the files of the layer other.
+func (d *dedupDriver) share(id, other string) error {
+	dir, err := d.Driver.Get(id, "")
+	if err != nil {
+		return err
+	}
+	defer d.Driver.Put(id)
+	otherDir, err := d.Driver.Get(other, "")
+	if err != nil {
+		return err
+	}
+	defer d.Driver.Put(other)
+	return linkLayer(otherDir, dir)
+}
+
+// ApplyDiff applies diff to the layer id, or makes it share the files of a
+// layer on top of the same parent which diff was already applied to.
+func (d *dedupDriver) ApplyDiff(id, parent string, diff io.Reader) (int64, error) {
+	// The diff is spooled to know its digest before it is applied.
+	spool, err := ioutil.TempFile(d.root, "dedup-")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+	digester := digest.Canonical.Digester()
+	if _, err := io.Copy(io.MultiWriter(spool, digester.Hash()), diff); err != nil {
+		return 0, err
+	}
+	dgst := digester.Digest()
+
+	layer := dedupLayer{Parent: parent, Digest: dgst}
+	if other, l := d.lookup(id, parent, dgst); other != "" {
+		err := d.share(id, other)
+		if err == nil {
+			logrus.Debugf("[graphdriver] layer %s shares the content of layer %s (%s)", id, other, dgst)
+			layer.Size = l.Size
+			layer.Shared = true
+		} else if err != errDedupNotSupported {
+			return 0, err
+		}
+	}
+	if !layer.Shared {
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if layer.Size, err = d.Driver.ApplyDiff(id, parent, spool); err != nil {
+			return 0, err
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.layers[id] = layer
+	if err := d.save(); err != nil {
+		return 0, err
+	}
+	return layer.Size, nil
+}
+
+// Remove removes the layer id. The files it shares with other layers are
+// kept until they are removed as well.
+func (d *dedupDriver) Remove(id string) error {
+	if err := d.Driver.Remove(id); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.layers[id]; !ok {
+		return nil
+	}
+	delete(d.layers, id)
+	return d.save()
+}
+
+// Status returns the status of the underlying driver with the number of
+// layers sharing the content of another one appended.
+func (d *dedupDriver) Status() [][2]string {
+	d.mu.Lock()
+	shared := 0
+	for _, l := range d.layers {
+		if l.Shared {
+			shared++
+		}
+	}
+	d.mu.Unlock()
+	return append(d.Driver.Status(), [2]string{"Deduplicated Layers", strconv.Itoa(shared)})
+}
+
+// ReclaimableSpace returns the space removing the layers unusedIDs of the
+// underlying driver would free, if it supports it. The layers share their
+// content with hardlinks, which are only counted once.
+func (d *dedupDriver) ReclaimableSpace(unusedIDs []string) (int64, error) {
+	return ReclaimableSpace(d.Driver, unusedIDs)
+}
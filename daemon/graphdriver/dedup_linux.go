@@ -0,0 +1,38 @@
+package graphdriver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/docker/docker/daemon/graphdriver/copy"
+)
+
+// linkLayer replaces the content of the layer directory dst with hardlinks
+// to the files of the layer directory src. It returns errDedupNotSupported
+// if they are not on the same filesystem, e.g. because they are mounts, in
+// which case dst is left alone.
+func linkLayer(src, dst string) error {
+	var srcStat, dstStat syscall.Stat_t
+	if err := syscall.Stat(src, &srcStat); err != nil {
+		return err
+	}
+	if err := syscall.Stat(dst, &dstStat); err != nil {
+		return err
+	}
+	if srcStat.Dev != dstStat.Dev {
+		return errDedupNotSupported
+	}
+
+	entries, err := ioutil.ReadDir(dst)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dst, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return copy.DirCopy(src, dst, copy.Hardlink)
+}
@@ -0,0 +1,76 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// applyFiles creates the layer id on top of parent with a diff holding
+// files.
+func applyFiles(t *testing.T, d graphdriver.Driver, id, parent string, files ...string) int64 {
+	require.NoError(t, d.Create(id, parent, nil))
+	diff, err := archive.Generate(files...)
+	require.NoError(t, err)
+	size, err := d.ApplyDiff(id, parent, diff)
+	require.NoError(t, err)
+	return size
+}
+
+func TestDeduplicationSharesIdenticalLayers(t *testing.T) {
+	base, home, cleanup := newVfsDriver(t)
+	defer cleanup()
+	d, err := graphdriver.WithDeduplication(base, home)
+	require.NoError(t, err)
+
+	applyFiles(t, d, "base", "", "base", "base content")
+	size := applyFiles(t, d, "layer1", "base", "dir/file", "content")
+	assert.Equal(t, size, applyFiles(t, d, "layer2", "base", "dir/file", "content"))
+	applyFiles(t, d, "other", "base", "dir/file", "other content")
+
+	stat := func(id, path string) os.FileInfo {
+		fi, err := os.Stat(filepath.Join(home, "dir", id, path))
+		require.NoError(t, err)
+		return fi
+	}
+	assert.True(t, os.SameFile(stat("layer1", "dir/file"), stat("layer2", "dir/file")))
+	assert.True(t, os.SameFile(stat("layer1", "base"), stat("layer2", "base")))
+	assert.False(t, os.SameFile(stat("layer1", "dir/file"), stat("other", "dir/file")))
+	assert.Contains(t, d.Status(), [2]string{"Deduplicated Layers", "1"})
+
+	// The shared files outlive the removal of the layer they come from,
+	// including after a restart.
+	require.NoError(t, d.Remove("layer1"))
+	d, err = graphdriver.WithDeduplication(base, home)
+	require.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(home, "dir", "layer2", "dir", "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+	applyFiles(t, d, "layer3", "base", "dir/file", "content")
+	assert.True(t, os.SameFile(stat("layer2", "dir/file"), stat("layer3", "dir/file")))
+}
+
+func TestDeduplicationRequiresSameParent(t *testing.T) {
+	base, home, cleanup := newVfsDriver(t)
+	defer cleanup()
+	d, err := graphdriver.WithDeduplication(base, home)
+	require.NoError(t, err)
+
+	applyFiles(t, d, "base1", "", "base1", "")
+	applyFiles(t, d, "base2", "", "base2", "")
+	applyFiles(t, d, "layer1", "base1", "file", "content")
+	applyFiles(t, d, "layer2", "base2", "file", "content")
+
+	_, err = os.Stat(filepath.Join(home, "dir", "layer2", "base1"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(home, "dir", "layer2", "base2"))
+	assert.NoError(t, err)
+}
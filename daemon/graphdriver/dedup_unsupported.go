@@ -0,0 +1,8 @@
+// +build !linux
+
+package graphdriver
+
+// linkLayer is not supported on this platform.
+func linkLayer(src, dst string) error {
+	return errDedupNotSupported
+}
@@ -0,0 +1,190 @@
+package graphdriver
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/mount"
+)
+
+// DiagnosticsDriver is the interface for drivers which can gather their
+// state for support requests.
+type DiagnosticsDriver interface {
+	// Diagnostics writes a tarball of the state of the driver to w. The
+	// tarball holds no data of the layers and nothing sensitive, such as
+	// the options of the driver, so that it can be attached to public
+	// issues.
+	Diagnostics(w io.Writer) error
+}
+
+// Diagnostics writes the diagnostics bundle of d to w if d supports it, and
+// returns ErrNotSupported otherwise.
+func Diagnostics(d ProtoDriver, w io.Writer) error {
+	if dd, ok := d.(DiagnosticsDriver); ok {
+		return dd.Diagnostics(w)
+	}
+	return ErrNotSupported
+}
+
+// DiagnosticsFile is a file of a diagnostics bundle.
+type DiagnosticsFile struct {
+	Name string
+	Data []byte
+}
+
+// WriteDiagnostics writes a tarball holding files to w.
+func WriteDiagnostics(w io.Writer, files []DiagnosticsFile) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:     f.Name,
+			Mode:     0644,
+			Size:     int64(len(f.Data)),
+			ModTime:  now,
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.Data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// CommonDiagnostics returns the files of the diagnostics bundle of the
+// driver d whose home directory is home, which are the same for all the
+// drivers:
+//
+//   - status.txt, the Status of the driver
+//   - filesystem.txt, the filesystem of home
+//   - mounts.txt, the mounts of the host below home, and the one holding it
+//   - dirs.txt, the number of entries of home and of its subdirectories
+//   - errors.txt, the last errors recorded in errs
+//
+// The problems met gathering a file are written to it.
+func CommonDiagnostics(d ProtoDriver, home string, errs *ErrorLog) []DiagnosticsFile {
+	var status bytes.Buffer
+	fmt.Fprintf(&status, "Driver: %s\n", d.String())
+	for _, kv := range d.Status() {
+		fmt.Fprintf(&status, "%s: %s\n", kv[0], kv[1])
+	}
+
+	var fs bytes.Buffer
+	if magic, err := GetFSMagic(home); err != nil {
+		fmt.Fprintf(&fs, "error: %v\n", err)
+	} else {
+		fmt.Fprintf(&fs, "%s (%#x)\n", FsName(magic), uint32(magic))
+	}
+
+	var errors bytes.Buffer
+	for _, entry := range errs.Entries() {
+		fmt.Fprintln(&errors, entry)
+	}
+
+	return []DiagnosticsFile{
+		{Name: "status.txt", Data: status.Bytes()},
+		{Name: "filesystem.txt", Data: fs.Bytes()},
+		{Name: "mounts.txt", Data: mountsDiagnostics(home)},
+		{Name: "dirs.txt", Data: dirsDiagnostics(home)},
+		{Name: "errors.txt", Data: errors.Bytes()},
+	}
+}
+
+// mountsDiagnostics lists the mounts below home, and the one holding it.
+// Their sources are left out.
+func mountsDiagnostics(home string) []byte {
+	var buf bytes.Buffer
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		fmt.Fprintf(&buf, "error: %v\n", err)
+		return buf.Bytes()
+	}
+	var holding *mount.Info
+	for _, m := range mounts {
+		if isPathBelow(home, m.Mountpoint) && (holding == nil || len(m.Mountpoint) > len(holding.Mountpoint)) {
+			holding = m
+		}
+	}
+	for _, m := range mounts {
+		if m == holding || isPathBelow(m.Mountpoint, home) {
+			fmt.Fprintf(&buf, "%s %s %s %s\n", m.Mountpoint, m.Fstype, m.Opts, m.VfsOpts)
+		}
+	}
+	return buf.Bytes()
+}
+
+// isPathBelow returns whether p is dir or below it.
+func isPathBelow(p, dir string) bool {
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+string(filepath.Separator))
+}
+
+// dirsDiagnostics counts the entries of home and of its subdirectories.
+func dirsDiagnostics(home string) []byte {
+	var buf bytes.Buffer
+	items, err := ioutil.ReadDir(home)
+	if err != nil {
+		fmt.Fprintf(&buf, "error: %v\n", err)
+		return buf.Bytes()
+	}
+	fmt.Fprintf(&buf, ". %d\n", len(items))
+	for _, item := range items {
+		if !item.IsDir() {
+			continue
+		}
+		f, err := os.Open(filepath.Join(home, item.Name()))
+		if err != nil {
+			fmt.Fprintf(&buf, "%s error: %v\n", item.Name(), err)
+			continue
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(&buf, "%s error: %v\n", item.Name(), err)
+			continue
+		}
+		fmt.Fprintf(&buf, "%s %d\n", item.Name(), len(names))
+	}
+	return buf.Bytes()
+}
+
+// errorLogSize is the number of errors an ErrorLog keeps.
+const errorLogSize = 50
+
+// ErrorLog keeps the last errors of a driver for its diagnostics bundle.
+// The zero value is ready to use.
+type ErrorLog struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+// Record records the error err of the operation op, if err is not nil.
+func (l *ErrorLog) Record(op string, err error) {
+	if err == nil {
+		return
+	}
+	entry := fmt.Sprintf("%s %s: %v", time.Now().UTC().Format(time.RFC3339), op, err)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) == errorLogSize {
+		l.entries = append(l.entries[:0], l.entries[1:]...)
+	}
+	l.entries = append(l.entries, entry)
+}
+
+// Entries returns the errors recorded, the oldest first.
+func (l *ErrorLog) Entries() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.entries...)
+}
@@ -0,0 +1,75 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readBundle returns the files of the diagnostics bundle r, by name.
+func readBundle(t *testing.T, r io.Reader) map[string]string {
+	files := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		files[hdr.Name] = string(data)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	root, err := ioutil.TempDir("", "graphdriver-diagnostics")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	d, err := graphdriver.New("vfs", nil, graphdriver.Options{Root: root})
+	require.NoError(t, err)
+	defer d.Cleanup()
+	require.NoError(t, d.Create("layer", "", nil))
+	assert.Error(t, d.Create("child", "missing", nil))
+
+	var buf bytes.Buffer
+	require.NoError(t, graphdriver.Diagnostics(d, &buf))
+	files := readBundle(t, &buf)
+	for _, name := range []string{"status.txt", "filesystem.txt", "mounts.txt", "dirs.txt", "errors.txt"} {
+		assert.Contains(t, files, name)
+	}
+	assert.Contains(t, files["status.txt"], "Driver: vfs\n")
+	assert.NotEmpty(t, files["filesystem.txt"])
+	assert.Contains(t, files["dirs.txt"], "dir 1\n")
+	assert.Contains(t, files["errors.txt"], "create child: missing")
+}
+
+func TestDiagnosticsNotSupported(t *testing.T) {
+	assert.Equal(t, graphdriver.ErrNotSupported, graphdriver.Diagnostics(upgradeDriver{}, ioutil.Discard))
+}
+
+func TestErrorLog(t *testing.T) {
+	var l graphdriver.ErrorLog
+	l.Record("remove", nil)
+	assert.Empty(t, l.Entries())
+
+	for i := 0; i < 60; i++ {
+		l.Record("remove", errors.New(fmt.Sprint(i)))
+	}
+	entries := l.Entries()
+	require.Len(t, entries, 50)
+	assert.Contains(t, entries[0], "remove: 10")
+	assert.Contains(t, entries[49], "remove: 59")
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/Sirupsen/logrus"
@@ -27,6 +28,9 @@ const (
 var (
 	// All registered drivers
 	drivers map[string]InitFunc
+	// The priority weights of the drivers registered with
+	// RegisterWithPriority
+	weights map[string]int
 
 	// ErrNotSupported returned when driver is not supported.
 	ErrNotSupported = errors.New("driver not supported")
@@ -36,6 +40,20 @@ var (
 	ErrIncompatibleFS = fmt.Errorf("backing file system is unsupported for this graph driver")
 )
 
+// NotSupportedError is returned by the drivers which cannot be used on the
+// host for a reason more specific than ErrNotSupported, ErrPrerequisites or
+// ErrIncompatibleFS tell, and which the user can act upon. Like them, it
+// makes New try the next driver when none is chosen explicitly, and New
+// lists it in its error if no driver can be used.
+type NotSupportedError struct {
+	Driver string
+	Reason string
+}
+
+func (e *NotSupportedError) Error() string {
+	return fmt.Sprintf("%s is not supported: %s", e.Driver, e.Reason)
+}
+
 //CreateOpts contains optional arguments for Create() and CreateReadWrite()
 // methods.
 type CreateOpts struct {
@@ -90,7 +108,9 @@ type ProtoDriver interface {
 // DiffDriver is the interface to use to implement graph diffs
 type DiffDriver interface {
 	// Diff produces an archive of the changes between the specified
-	// layer and its parent layer which may be "".
+	// layer and its parent layer which may be "". The archive must be
+	// produced as it is read rather than buffered, so that the memory used
+	// does not depend on the size of the layer.
 	Diff(id, parent string) (io.ReadCloser, error)
 	// Changes produces a list of changes between the specified layer
 	// and its parent layer. If parent is "", then all changes will be ADD changes.
@@ -138,6 +158,17 @@ type DiffGetterDriver interface {
 	DiffGetter(id string) (FileGetCloser, error)
 }
 
+// MountIsolationDriver is the interface for layered file system drivers
+// whose layers can be mounted in an isolated mount namespace, which requires
+// that layers are only mounted by Get and accessed by the driver through the
+// path Get returns.
+type MountIsolationDriver interface {
+	Driver
+	// SupportsMountIsolation returns whether the driver can mount layers in
+	// an isolated mount namespace.
+	SupportsMountIsolation() bool
+}
+
 // FileGetCloser extends the storage.FileGetter interface with a Close method
 // for cleaning up.
 type FileGetCloser interface {
@@ -154,6 +185,7 @@ type Checker interface {
 
 func init() {
 	drivers = make(map[string]InitFunc)
+	weights = make(map[string]int)
 }
 
 // Register registers an InitFunc for the driver.
@@ -166,6 +198,69 @@ func Register(name string, initFunc InitFunc) error {
 	return nil
 }
 
+// priorityWeightStep is the difference between the weights of two drivers
+// next to each other in the default priority list.
+const priorityWeightStep = 10
+
+// RegisterWithPriority registers an InitFunc for the driver, which is tried
+// when no driver is configured in the order of its weight: the drivers with
+// a higher weight are tried first. The drivers of the default priority list
+// have weights too, see PriorityWeight, so that a driver can be tried
+// right before or after one of them.
+func RegisterWithPriority(name string, initFunc InitFunc, weight int) error {
+	if err := Register(name, initFunc); err != nil {
+		return err
+	}
+	weights[name] = weight
+	return nil
+}
+
+// PriorityWeight returns the weight of the driver name in the order the
+// drivers are tried when no driver is configured, and false if it is not
+// tried. The weights of the drivers of the default priority list decrease
+// by 10 from the first one down to 10 for the last one.
+func PriorityWeight(name string) (int, bool) {
+	if weight, ok := weights[name]; ok {
+		return weight, true
+	}
+	for i, n := range priority {
+		if n == name {
+			return (len(priority) - i) * priorityWeightStep, true
+		}
+	}
+	return 0, false
+}
+
+// priorityList returns the drivers of the default priority list and the
+// drivers registered with a weight, by decreasing weight. The drivers of
+// the default list come first among the drivers of the same weight.
+func priorityList() []string {
+	names := append([]string(nil), priority...)
+	var weighted []string
+	for name := range weights {
+		if !isDefaultPriority(name) {
+			weighted = append(weighted, name)
+		}
+	}
+	sort.Strings(weighted)
+	names = append(names, weighted...)
+	sort.SliceStable(names, func(i, j int) bool {
+		wi, _ := PriorityWeight(names[i])
+		wj, _ := PriorityWeight(names[j])
+		return wi > wj
+	})
+	return names
+}
+
+func isDefaultPriority(name string) bool {
+	for _, n := range priority {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
 // GetDriver initializes and returns the registered driver
 func GetDriver(name string, pg plugingetter.PluginGetter, config Options) (Driver, error) {
 	if initFunc, exists := drivers[name]; exists {
@@ -196,10 +291,166 @@ type Options struct {
 	UIDMaps             []idtools.IDMap
 	GIDMaps             []idtools.IDMap
 	ExperimentalEnabled bool
+	// EncryptionKey, if set, makes the driver store layer data encrypted
+	// at rest using this key. See WithEncryption.
+	EncryptionKey []byte
+	// IsolateMounts makes the driver mount layers in a mount namespace of
+	// its own where the platform and the driver support it, so that the
+	// mounts are not visible on the host and do not outlive the daemon.
+	// See WithMountNamespace.
+	IsolateMounts bool
+	// RWLayerPoolSize, if set, is the number of empty read-write layers the
+	// driver keeps ready on top of each parent read-write layers are
+	// created on. See WithRWLayerPool.
+	RWLayerPoolSize int
+	// SyncMode controls whether the driver syncs the layers it writes to
+	// disk. Syncing less makes pulling images faster, at the cost of
+	// losing or corrupting the layers written right before a crash. It
+	// defaults to SyncFull. See WithSyncMode.
+	SyncMode SyncMode
+	// Deduplicate makes layers whose diffs are identical share their
+	// files. See WithDeduplication.
+	Deduplicate bool
+	// ApplyDiffMetrics makes the driver record the throughput of the diffs
+	// it applies in the metrics registry. See WithApplyDiffMetrics.
+	ApplyDiffMetrics bool
+	// MaxConcurrentLayerIO, if positive, is the number of diffs the driver
+	// applies and generates at the same time, the others waiting for their
+	// turn. See WithIOThrottle.
+	MaxConcurrentLayerIO int
+	// TrimOnRemove makes the driver discard the blocks freed by the
+	// removal of a layer right away. See WithTrimOnRemove.
+	TrimOnRemove bool
+	// RejectLoopbackRoot makes New fail when Root is on a loopback device,
+	// which it only warns about otherwise.
+	RejectLoopbackRoot bool
+	// Reconcile makes the driver remove or repair the layers left in an
+	// inconsistent state by an unclean shutdown when it is initialized.
+	// See ReconcileDriver.
+	Reconcile bool
+	// Tenant, if set, isolates the layers of the driver from those of the
+	// other tenants sharing Root, by keeping them and the state of the
+	// driver in the Tenant subdirectory of Root. Drivers used by prior
+	// daemons are only looked for in that subdirectory.
+	Tenant string
+	// ShardLayers makes the driver keep the directories of its layers in
+	// subdirectories named after the first characters of the layer ids.
+	// The layers of a prior daemon are moved to the layout in use when the
+	// driver is initialized. See ShardedLayoutDriver.
+	ShardLayers bool
+}
+
+// tenantRoot returns the directory the driver of the tenant of config keeps
+// its layers in.
+func tenantRoot(config Options) (string, error) {
+	if config.Tenant == "" {
+		return config.Root, nil
+	}
+	if config.Tenant == "." || config.Tenant == ".." || strings.ContainsAny(config.Tenant, `/\`) {
+		return "", fmt.Errorf("invalid storage driver tenant %q", config.Tenant)
+	}
+	return filepath.Join(config.Root, config.Tenant), nil
 }
 
 // New creates the driver and initializes it at the specified root.
 func New(name string, pg plugingetter.PluginGetter, config Options) (Driver, error) {
+	root, err := tenantRoot(config)
+	if err != nil {
+		return nil, err
+	}
+	config.Root = root
+	driver, err := newDriver(name, pg, config)
+	if err != nil {
+		return driver, err
+	}
+	// The layers of plugins are not stored in the root.
+	if _, builtin := drivers[driver.String()]; builtin {
+		if err := checkLoopbackRoot(config.Root, config.RejectLoopbackRoot); err != nil {
+			driver.Cleanup()
+			return nil, err
+		}
+		if err := checkIDMappings(config.Root, driver.String(), config.UIDMaps, config.GIDMaps); err != nil {
+			driver.Cleanup()
+			return nil, err
+		}
+		if err := checkLayout(config.Root, driver); err != nil {
+			driver.Cleanup()
+			return nil, err
+		}
+		if err := SetShardedLayout(driver, config.ShardLayers); err != nil {
+			driver.Cleanup()
+			return nil, errShardedLayout(driver.String(), err)
+		}
+	}
+	syncMode, err := ParseSyncMode(string(config.SyncMode))
+	if err != nil {
+		driver.Cleanup()
+		return nil, err
+	}
+	if config.Reconcile {
+		ids, err := Reconcile(driver)
+		if err != nil {
+			driver.Cleanup()
+			return nil, fmt.Errorf("failed to reconcile the layers of %s: %v", driver, err)
+		}
+		if len(ids) > 0 {
+			logrus.Warnf("[graphdriver] removed or repaired the inconsistent layers %s", strings.Join(ids, ", "))
+		}
+	}
+	// Encrypted right on top of the driver, whose layer directories it
+	// decrypts. The decrypted copies are mounted on the host, where the
+	// driver could not see them if its mounts were isolated.
+	if config.EncryptionKey != nil {
+		if config.IsolateMounts {
+			driver.Cleanup()
+			return nil, fmt.Errorf("encryption cannot be used with isolated mounts")
+		}
+		encrypted := WithEncryption(driver, config.EncryptionKey)
+		if err := encrypted.(*encryptedDriver).err; err != nil {
+			driver.Cleanup()
+			return nil, err
+		}
+		driver = encrypted
+	}
+	if config.IsolateMounts {
+		isolated, err := WithMountNamespace(driver)
+		if err != nil {
+			driver.Cleanup()
+			return nil, err
+		}
+		driver = isolated
+	}
+	if config.RWLayerPoolSize > 0 {
+		pooled, err := WithRWLayerPool(driver, config.Root, config.RWLayerPoolSize)
+		if err != nil {
+			driver.Cleanup()
+			return nil, err
+		}
+		driver = pooled
+	}
+	if config.Deduplicate {
+		deduplicated, err := WithDeduplication(driver, config.Root)
+		if err != nil {
+			driver.Cleanup()
+			return nil, err
+		}
+		driver = deduplicated
+	}
+	if config.ApplyDiffMetrics {
+		driver = WithApplyDiffMetrics(driver)
+	}
+	// Throttled after the metrics are recorded, so that they do not count
+	// the time spent waiting.
+	driver = WithIOThrottle(driver, config.MaxConcurrentLayerIO)
+	if config.TrimOnRemove {
+		driver = WithTrimOnRemove(driver, config.Root)
+	}
+	// Syncing last makes sure that the writes of the other wrappers are
+	// synced as well.
+	return WithSyncMode(driver, config.Root, syncMode), nil
+}
+
+func newDriver(name string, pg plugingetter.PluginGetter, config Options) (Driver, error) {
 	if name != "" {
 		logrus.Debugf("[graphdriver] trying provided driver: %s", name) // so the logs show specified driver
 		return GetDriver(name, pg, config)
@@ -207,7 +458,8 @@ func New(name string, pg plugingetter.PluginGetter, config Options) (Driver, err
 
 	// Guess for prior driver
 	driversMap := scanPriorDrivers(config.Root)
-	for _, name := range priority {
+	order := priorityList()
+	for _, name := range order {
 		if name == "vfs" {
 			// don't use vfs even if there is state present.
 			continue
@@ -236,16 +488,35 @@ func New(name string, pg plugingetter.PluginGetter, config Options) (Driver, err
 				return nil, fmt.Errorf("%s contains several valid graphdrivers: %s; Please cleanup or explicitly choose storage driver (-s <DRIVER>)", config.Root, strings.Join(driversSlice, ", "))
 			}
 
-			logrus.Infof("[graphdriver] using prior storage driver: %s", name)
+			if version := driversMap[name]; version != "" {
+				logrus.Infof("[graphdriver] using prior storage driver: %s (layout version %s)", name, version)
+			} else {
+				logrus.Infof("[graphdriver] using prior storage driver: %s", name)
+			}
 			return driver, nil
 		}
 	}
 
+	// The specific reasons the drivers were rejected for, to tell the user
+	// what to fix if none can be used.
+	var reasons []string
+	rejected := func(err error) bool {
+		if !isDriverNotSupported(err) {
+			return false
+		}
+		if _, ok := err.(*NotSupportedError); ok {
+			reasons = append(reasons, err.Error())
+		}
+		return true
+	}
+
 	// Check for priority drivers first
-	for _, name := range priority {
+	tried := make(map[string]bool)
+	for _, name := range order {
+		tried[name] = true
 		driver, err := getBuiltinDriver(name, config.Root, config.DriverOptions, config.UIDMaps, config.GIDMaps)
 		if err != nil {
-			if isDriverNotSupported(err) {
+			if rejected(err) {
 				continue
 			}
 			return nil, err
@@ -255,32 +526,47 @@ func New(name string, pg plugingetter.PluginGetter, config Options) (Driver, err
 
 	// Check all registered drivers if no priority driver is found
 	for name, initFunc := range drivers {
+		if tried[name] {
+			continue
+		}
 		driver, err := initFunc(filepath.Join(config.Root, name), config.DriverOptions, config.UIDMaps, config.GIDMaps)
 		if err != nil {
-			if isDriverNotSupported(err) {
+			if rejected(err) {
 				continue
 			}
 			return nil, err
 		}
 		return driver, nil
 	}
+	if len(reasons) > 0 {
+		return nil, fmt.Errorf("No supported storage backend found: %s", strings.Join(reasons, "; "))
+	}
 	return nil, fmt.Errorf("No supported storage backend found")
 }
 
 // isDriverNotSupported returns true if the error initializing
 // the graph driver is a non-supported error.
 func isDriverNotSupported(err error) bool {
+	if _, ok := err.(*NotSupportedError); ok {
+		return true
+	}
 	return err == ErrNotSupported || err == ErrPrerequisites || err == ErrIncompatibleFS
 }
 
-// scanPriorDrivers returns an un-ordered scan of directories of prior storage drivers
-func scanPriorDrivers(root string) map[string]bool {
-	driversMap := make(map[string]bool)
+// scanPriorDrivers returns an un-ordered scan of directories of prior storage drivers,
+// mapped to the layout version recorded for them, or "" if there is none.
+// Whether the layers in the directories are sharded does not matter.
+func scanPriorDrivers(root string) map[string]string {
+	driversMap := make(map[string]string)
 
 	for driver := range drivers {
 		p := filepath.Join(root, driver)
 		if _, err := os.Stat(p); err == nil && driver != "vfs" {
-			driversMap[driver] = true
+			version, err := readLayoutVersion(root, driver)
+			if err != nil {
+				logrus.Warnf("[graphdriver] %v", err)
+			}
+			driversMap[driver] = version
 		}
 	}
 	return driversMap
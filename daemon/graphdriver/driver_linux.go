@@ -67,6 +67,7 @@ var (
 		FsMagicAufs:        "aufs",
 		FsMagicBtrfs:       "btrfs",
 		FsMagicCramfs:      "cramfs",
+		FsMagicEcryptfs:    "ecryptfs",
 		FsMagicExtfs:       "extfs",
 		FsMagicF2fs:        "f2fs",
 		FsMagicGPFS:        "gpfs",
@@ -95,6 +96,27 @@ func GetFSMagic(rootpath string) (FsMagic, error) {
 	return FsMagic(buf.Type), nil
 }
 
+// FsName returns the name of the filesystem identified by magic, or
+// "<unknown>" if it is not known.
+func FsName(magic FsMagic) string {
+	if name, ok := FsNames[magic]; ok {
+		return name
+	}
+	return "<unknown>"
+}
+
+// BackingFilesystem returns the name of the filesystem the driver home
+// directory root resides on. This is the filesystem which determines
+// whether a driver can be used, and which is reported by drivers in
+// their status.
+func BackingFilesystem(root string) (string, error) {
+	magic, err := GetFSMagic(root)
+	if err != nil {
+		return "", err
+	}
+	return FsName(magic), nil
+}
+
 // NewFsChecker returns a checker configured for the provied FsMagic
 func NewFsChecker(t FsMagic) Checker {
 	return &fsChecker{
@@ -0,0 +1,204 @@
+package graphdriver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFsName(t *testing.T) {
+	for magic, name := range map[FsMagic]string{
+		FsMagic(0x0000EF53): "extfs",
+		FsMagic(0x58465342): "xfs",
+		FsMagic(0x9123683E): "btrfs",
+		FsMagic(0x2fc12fc1): "zfs",
+		FsMagic(0x01021994): "tmpfs",
+		FsMagic(0x794C7630): "overlayfs",
+		FsMagic(0x0000f15f): "ecryptfs",
+		FsMagic(0x12345678): "<unknown>",
+	} {
+		assert.Equal(t, name, FsName(magic), "magic %#x", uint32(magic))
+	}
+}
+
+func TestBackingFilesystem(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "graphdriver-backingfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	magic, err := GetFSMagic(filepath.Join(tmp, "root"))
+	require.NoError(t, err)
+	name, err := BackingFilesystem(filepath.Join(tmp, "root"))
+	require.NoError(t, err)
+	assert.Equal(t, FsName(magic), name)
+
+	_, err = BackingFilesystem(filepath.Join(tmp, "missing", "root"))
+	assert.Error(t, err)
+}
+
+// namedDriver is a Driver which only has a name.
+type namedDriver struct {
+	Driver
+	name string
+}
+
+func (d *namedDriver) String() string {
+	return d.name
+}
+
+// registerNamedDriver registers a namedDriver, with weight if it is not
+// nil, and returns the function unregistering it.
+func registerNamedDriver(t *testing.T, name string, weight *int) func() {
+	initFunc := func(home string, options []string, uidMaps, gidMaps []idtools.IDMap) (Driver, error) {
+		return &namedDriver{name: name}, nil
+	}
+	if weight != nil {
+		require.NoError(t, RegisterWithPriority(name, initFunc, *weight))
+	} else {
+		require.NoError(t, Register(name, initFunc))
+	}
+	return func() {
+		delete(drivers, name)
+		delete(weights, name)
+	}
+}
+
+func TestRegisterWithPriority(t *testing.T) {
+	root, err := ioutil.TempDir("", "graphdriver-priority")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	zfsWeight, ok := PriorityWeight("zfs")
+	require.True(t, ok)
+	vfsWeight, _ := PriorityWeight("vfs")
+	assert.True(t, zfsWeight > vfsWeight)
+	_, ok = PriorityWeight("unknown")
+	assert.False(t, ok)
+
+	// zfs is registered in place of the real driver, which is not built
+	// into the tests.
+	defer registerNamedDriver(t, "zfs", nil)()
+	d, err := newDriver("", nil, Options{Root: root})
+	require.NoError(t, err)
+	assert.Equal(t, "zfs", d.String())
+
+	// A driver with a lower weight is only tried afterwards.
+	lower := zfsWeight - 1
+	defer registerNamedDriver(t, "lower", &lower)()
+	d, err = newDriver("", nil, Options{Root: root})
+	require.NoError(t, err)
+	assert.Equal(t, "zfs", d.String())
+
+	higher := zfsWeight + 1
+	defer registerNamedDriver(t, "higher", &higher)()
+	d, err = newDriver("", nil, Options{Root: root})
+	require.NoError(t, err)
+	assert.Equal(t, "higher", d.String())
+
+	order := priorityList()
+	index := func(name string) int {
+		for i, n := range order {
+			if n == name {
+				return i
+			}
+		}
+		t.Fatalf("%s is not in %v", name, order)
+		return -1
+	}
+	assert.Equal(t, index("zfs")-1, index("higher"))
+	assert.Equal(t, index("zfs")+1, index("lower"))
+	assert.True(t, index("lower") < index("vfs"))
+
+	assert.Error(t, RegisterWithPriority("higher", nil, 0))
+}
+
+func TestNewListsNotSupportedReasons(t *testing.T) {
+	root, err := ioutil.TempDir("", "graphdriver-notsupported")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	// Only zfs and btrfs are registered, the drivers of the other tests
+	// being set aside.
+	registered := drivers
+	drivers = make(map[string]InitFunc)
+	defer func() {
+		drivers = registered
+	}()
+	register := func(name string, err error) {
+		require.NoError(t, Register(name, func(home string, options []string, uidMaps, gidMaps []idtools.IDMap) (Driver, error) {
+			return nil, err
+		}))
+	}
+	notSupported := &NotSupportedError{Driver: "zfs", Reason: "the backing xfs filesystem is formatted without d_type support."}
+	register("zfs", notSupported)
+	register("btrfs", ErrNotSupported)
+
+	_, err = newDriver("", nil, Options{Root: root})
+	assert.EqualError(t, err, "No supported storage backend found: zfs is not supported: the backing xfs filesystem is formatted without d_type support.")
+
+	_, err = newDriver("zfs", nil, Options{Root: root})
+	assert.Equal(t, notSupported, err)
+}
+
+// getterDriver is a namedDriver with the optional methods the wrappers of
+// the package keep.
+type getterDriver struct {
+	namedDriver
+	ids []string
+}
+
+func (d *getterDriver) DiffGetter(id string) (FileGetCloser, error) {
+	d.ids = append(d.ids, id)
+	return nil, nil
+}
+
+func (d *getterDriver) Capabilities() Capabilities {
+	return Capabilities{ReproducesExactDiffs: true}
+}
+
+func (d *getterDriver) SupportsMountIsolation() bool {
+	return true
+}
+
+func (d *getterDriver) Cleanup() error {
+	return nil
+}
+
+func TestWrappersKeepOptionalMethods(t *testing.T) {
+	root, err := ioutil.TempDir("", "graphdriver-wrappers")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	base := &getterDriver{namedDriver: namedDriver{name: "getter"}}
+	var d Driver = base
+	for _, tc := range []struct {
+		name string
+		wrap func(Driver) (Driver, error)
+	}{
+		{"mountns", WithMountNamespace},
+		{"rwpool", func(d Driver) (Driver, error) { return WithRWLayerPool(d, root, 1) }},
+		{"dedup", func(d Driver) (Driver, error) { return WithDeduplication(d, root) }},
+		{"remote", func(d Driver) (Driver, error) { return WithRemoteLayers(d, root, nil) }},
+		{"lease", func(d Driver) (Driver, error) { return WithLeases(d), nil }},
+		{"timeout", func(d Driver) (Driver, error) { return WithTimeout(d, nil), nil }},
+	} {
+		d, err = tc.wrap(d)
+		require.NoError(t, err, tc.name)
+
+		getter, ok := d.(DiffGetterDriver)
+		require.True(t, ok, tc.name)
+		_, err = getter.DiffGetter(tc.name)
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, tc.name, base.ids[len(base.ids)-1])
+
+		capDriver, ok := d.(CapabilityDriver)
+		require.True(t, ok, tc.name)
+		assert.True(t, capDriver.Capabilities().ReproducesExactDiffs, tc.name)
+	}
+	assert.NoError(t, d.Cleanup())
+}
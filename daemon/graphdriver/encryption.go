@@ -0,0 +1,584 @@
+package graphdriver
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/ioutils"
+	"github.com/docker/docker/pkg/system"
+)
+
+const (
+	// encChunkSize is the size of the plaintext chunks that are sealed
+	// individually, so that files never have to be held in memory at once.
+	encChunkSize = 64 * 1024
+	encNonceSize = 12
+	// encHeaderCounter is the chunk counter of the nonce authenticating the
+	// header of encrypted files, which no chunk uses.
+	encHeaderCounter = math.MaxUint32
+)
+
+var (
+	// encMagic starts the header of every file which is stored encrypted
+	// on disk.
+	encMagic = []byte("DKRENC01")
+
+	// ErrEncryptedFileCorrupt is returned when an encrypted file on disk
+	// cannot be authenticated with the configured key.
+	ErrEncryptedFileCorrupt = errors.New("encrypted layer file is corrupt or was encrypted with a different key")
+)
+
+// LayerDirsDriver is the interface for layered file system drivers which
+// keep the files of each layer in a directory of its own, and which only
+// use the directories of a layer and of its parents to mount it.
+type LayerDirsDriver interface {
+	// LayerDirs returns the directories the mounts of the layer id use,
+	// the one of id first, and the path, relative to each of them, of the
+	// directory holding the files of the layer.
+	LayerDirs(id string) (dirs []string, content string, err error)
+}
+
+// LayerDirs returns the directories of the layer id of d if d supports it,
+// and ErrNotSupported otherwise.
+func LayerDirs(d ProtoDriver, id string) ([]string, string, error) {
+	if dd, ok := d.(LayerDirsDriver); ok {
+		return dd.LayerDirs(id)
+	}
+	return nil, "", ErrNotSupported
+}
+
+// encryptedDriver wraps a Driver and keeps the regular files of its layers
+// encrypted at rest. While a layer is in use, the directories of the layer
+// and of its parents are replaced with decrypted copies held in memory, so
+// that callers of the driver only ever see plaintext and the plaintext never
+// reaches the disk.
+type encryptedDriver struct {
+	Driver
+	aead cipher.AEAD
+	err  error
+
+	mu sync.Mutex
+	// open maps the layer directories which are replaced with decrypted
+	// copies to their state.
+	open map[string]*openLayerDir
+}
+
+// openLayerDir is a layer directory replaced with a decrypted copy.
+type openLayerDir struct {
+	content string
+	refs    int
+	// written is set if the copy may have been written to, in which case
+	// it is encrypted back to disk when it is released.
+	written bool
+}
+
+// WithEncryption returns a Driver that stores the regular files of the
+// layers of d encrypted with AES-GCM using key, which must be 16, 24 or 32
+// bytes long. d must implement LayerDirsDriver, and layers are decrypted
+// into memory for as long as they are in use, which is only supported on
+// Linux. The layers which may have been written to are encrypted back to
+// disk when they are released. The returned driver does not expose the
+// optional interfaces (e.g. DiffGetterDriver) of d, as those would give
+// access to the encrypted data.
+func WithEncryption(d Driver, key []byte) Driver {
+	ed := &encryptedDriver{
+		Driver: d,
+		open:   make(map[string]*openLayerDir),
+	}
+	// Drivers which support LayerDirs list the directories of any ID.
+	if _, _, err := LayerDirs(d, ""); err == ErrNotSupported {
+		ed.err = fmt.Errorf("encryption is not supported by the %s storage driver", d)
+		return ed
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		ed.err = fmt.Errorf("invalid encryption key: %v", err)
+		return ed
+	}
+	ed.aead, ed.err = cipher.NewGCM(block)
+	return ed
+}
+
+func (d *encryptedDriver) String() string {
+	return d.Driver.String()
+}
+
+// Status returns the status of the underlying driver with the encryption
+// mode appended.
+func (d *encryptedDriver) Status() [][2]string {
+	return append(d.Driver.Status(), [2]string{"Encryption", "aes-gcm"})
+}
+
+// Create creates the layer with the underlying driver and encrypts any
+// content it was populated with.
+func (d *encryptedDriver) Create(id, parent string, opts *CreateOpts) error {
+	if d.err != nil {
+		return d.err
+	}
+	if err := d.Driver.Create(id, parent, opts); err != nil {
+		return err
+	}
+	return d.sealCopy(id, parent)
+}
+
+// CreateReadWrite creates the layer with the underlying driver and
+// encrypts any content it was populated with.
+func (d *encryptedDriver) CreateReadWrite(id, parent string, opts *CreateOpts) error {
+	if d.err != nil {
+		return d.err
+	}
+	if err := d.Driver.CreateReadWrite(id, parent, opts); err != nil {
+		return err
+	}
+	return d.sealCopy(id, parent)
+}
+
+// sealCopy encrypts the files the underlying driver copied from parent
+// into the new layer id, which are plaintext if parent is in use.
+func (d *encryptedDriver) sealCopy(id, parent string) error {
+	if parent == "" {
+		return nil
+	}
+	parentDirs, _, err := LayerDirs(d.Driver, parent)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, dir := range parentDirs {
+		if d.open[dir] != nil {
+			if err := d.openLayerLocked(id, true); err != nil {
+				return err
+			}
+			return d.closeLayerLocked(id)
+		}
+	}
+	return nil
+}
+
+// Get decrypts the layer into memory and mounts it.
+func (d *encryptedDriver) Get(id, mountLabel string) (string, error) {
+	if err := d.openLayer(id, true); err != nil {
+		return "", err
+	}
+	dir, err := d.Driver.Get(id, mountLabel)
+	if err != nil {
+		d.closeLayer(id)
+		return "", err
+	}
+	return dir, nil
+}
+
+// Put unmounts the layer and, once it is not in use anymore, encrypts it
+// back to disk.
+func (d *encryptedDriver) Put(id string) error {
+	err := d.Driver.Put(id)
+	if closeErr := d.closeLayer(id); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Remove drops the decrypted copy of the layer, if any, and removes it.
+func (d *encryptedDriver) Remove(id string) error {
+	if d.err != nil {
+		return d.Driver.Remove(id)
+	}
+	if dirs, _, err := LayerDirs(d.Driver, id); err == nil {
+		d.mu.Lock()
+		if od := d.open[dirs[0]]; od != nil {
+			delete(d.open, dirs[0])
+			if err := d.closeDir(dirs[0], od.content, false); err != nil {
+				d.mu.Unlock()
+				return err
+			}
+		}
+		d.mu.Unlock()
+	}
+	return d.Driver.Remove(id)
+}
+
+// Cleanup encrypts back to disk the layers still in use and cleans up the
+// underlying driver.
+func (d *encryptedDriver) Cleanup() error {
+	d.mu.Lock()
+	var err error
+	for dir, od := range d.open {
+		delete(d.open, dir)
+		if closeErr := d.closeDir(dir, od.content, od.written); err == nil {
+			err = closeErr
+		}
+	}
+	d.mu.Unlock()
+	if cleanupErr := d.Driver.Cleanup(); err == nil {
+		err = cleanupErr
+	}
+	return err
+}
+
+// Diff produces a plaintext archive of the changes between the layer and
+// its parent.
+func (d *encryptedDriver) Diff(id, parent string) (io.ReadCloser, error) {
+	release, err := d.openPair(id, parent)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := d.Driver.Diff(id, parent)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return ioutils.NewReadCloserWrapper(rc, func() error {
+		err := rc.Close()
+		release()
+		return err
+	}), nil
+}
+
+// Changes produces the list of changes between the plaintext content of
+// the layer and its parent.
+func (d *encryptedDriver) Changes(id, parent string) ([]archive.Change, error) {
+	release, err := d.openPair(id, parent)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return d.Driver.Changes(id, parent)
+}
+
+// ApplyDiff extracts diff into the decrypted copy of the layer and
+// encrypts the result.
+func (d *encryptedDriver) ApplyDiff(id, parent string, diff io.Reader) (int64, error) {
+	if err := d.openLayer(id, true); err != nil {
+		return 0, err
+	}
+	size, err := d.Driver.ApplyDiff(id, parent, diff)
+	if closeErr := d.closeLayer(id); err == nil {
+		err = closeErr
+	}
+	return size, err
+}
+
+// DiffSize calculates the size of the changes between the plaintext
+// content of the layer and its parent.
+func (d *encryptedDriver) DiffSize(id, parent string) (int64, error) {
+	release, err := d.openPair(id, parent)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return d.Driver.DiffSize(id, parent)
+}
+
+// openPair decrypts both id and parent (if any) and returns a function
+// releasing them again.
+func (d *encryptedDriver) openPair(id, parent string) (func(), error) {
+	if err := d.openLayer(id, false); err != nil {
+		return nil, err
+	}
+	if parent != "" {
+		if err := d.openLayer(parent, false); err != nil {
+			d.closeLayer(id)
+			return nil, err
+		}
+	}
+	return func() {
+		if parent != "" {
+			d.closeLayer(parent)
+		}
+		d.closeLayer(id)
+	}, nil
+}
+
+// openLayer replaces the directories of the layer id and of its parents
+// with decrypted copies, unless they already are. If written is set, the
+// copy of the directory of id is encrypted back to disk once released.
+func (d *encryptedDriver) openLayer(id string, written bool) error {
+	if d.err != nil {
+		return d.err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.openLayerLocked(id, written)
+}
+
+// openLayerLocked is openLayer, which must be called with d.mu held.
+func (d *encryptedDriver) openLayerLocked(id string, written bool) error {
+	dirs, content, err := LayerDirs(d.Driver, id)
+	if err != nil {
+		return err
+	}
+	for i, dir := range dirs {
+		od := d.open[dir]
+		if od == nil {
+			if err := d.openDir(dir, content); err != nil {
+				d.closeDirsLocked(dirs[:i])
+				return err
+			}
+			od = &openLayerDir{content: content}
+			d.open[dir] = od
+		}
+		od.refs++
+		if written && i == 0 {
+			od.written = true
+		}
+	}
+	return nil
+}
+
+// closeLayer releases the directories of the layer id and of its parents
+// opened with openLayer.
+func (d *encryptedDriver) closeLayer(id string) error {
+	if d.err != nil {
+		return d.err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.closeLayerLocked(id)
+}
+
+// closeLayerLocked is closeLayer, which must be called with d.mu held.
+func (d *encryptedDriver) closeLayerLocked(id string) error {
+	dirs, _, err := LayerDirs(d.Driver, id)
+	if err != nil {
+		return err
+	}
+	return d.closeDirsLocked(dirs)
+}
+
+// closeDirsLocked releases the layer directories dirs, encrypting back to
+// disk those which are not in use anymore and were written to. It must be
+// called with d.mu held.
+func (d *encryptedDriver) closeDirsLocked(dirs []string) error {
+	var err error
+	for _, dir := range dirs {
+		od := d.open[dir]
+		if od == nil {
+			continue
+		}
+		if od.refs--; od.refs > 0 {
+			continue
+		}
+		delete(d.open, dir)
+		if closeErr := d.closeDir(dir, od.content, od.written); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// walkRegularFiles calls fn for every regular file below root.
+func walkRegularFiles(root string, fn func(path string, fi os.FileInfo) error) error {
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		return fn(path, fi)
+	})
+}
+
+// isSealed returns whether the file at path was encrypted with seal, which
+// its header tells if it authenticates with the key of the driver. Files
+// which do not start with encMagic are plaintext, those which do but whose
+// header does not authenticate are corrupt.
+func (d *encryptedDriver) isSealed(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, len(encMagic)+encNonceSize-4+d.aead.Overhead())
+	if _, err := io.ReadFull(f, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	if !bytes.Equal(header[:len(encMagic)], encMagic) {
+		return false, nil
+	}
+	if _, err := d.openHeader(header); err != nil {
+		return false, fmt.Errorf("%s: %v", path, err)
+	}
+	return true, nil
+}
+
+// sealFile encrypts the file at path, whatever its content.
+func (d *encryptedDriver) sealFile(path string, fi os.FileInfo) error {
+	return rewriteFile(path, fi, d.seal)
+}
+
+// unsealFile decrypts the file at path if it is encrypted, so that the
+// files which were added to the layer before it was encrypted are kept.
+func (d *encryptedDriver) unsealFile(path string, fi os.FileInfo) error {
+	if sealed, err := d.isSealed(path); err != nil || !sealed {
+		return err
+	}
+	return rewriteFile(path, fi, d.unseal)
+}
+
+// rewriteFile replaces the content of path with the output of transform
+// while keeping the inode, and with it ownership, mode, links and extended
+// attributes, intact. The modification time is restored afterwards. It is
+// only used in the decrypted copies of layers, which are held in memory.
+func rewriteFile(path string, fi os.FileInfo, transform func(io.Writer, io.Reader) error) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".enc-")
+	if err != nil {
+		src.Close()
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	err = transform(tmp, src)
+	src.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if _, err := tmp.Seek(0, 0); err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, tmp); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return system.Chtimes(path, fi.ModTime(), fi.ModTime())
+}
+
+// headerNonce returns the nonce authenticating the header of a file whose
+// chunks are sealed with the nonce prefix.
+func headerNonce(prefix []byte) []byte {
+	nonce := make([]byte, encNonceSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encNonceSize-4:], encHeaderCounter)
+	return nonce
+}
+
+// openHeader authenticates the header of an encrypted file, made of
+// encMagic, the nonce prefix of its chunks and the tag of both, and returns
+// the nonce prefix.
+func (d *encryptedDriver) openHeader(header []byte) ([]byte, error) {
+	n := len(encMagic) + encNonceSize - 4
+	if len(header) != n+d.aead.Overhead() || !bytes.Equal(header[:len(encMagic)], encMagic) {
+		return nil, ErrEncryptedFileCorrupt
+	}
+	prefix := header[len(encMagic):n]
+	if _, err := d.aead.Open(nil, headerNonce(prefix), header[n:], header[:n]); err != nil {
+		return nil, ErrEncryptedFileCorrupt
+	}
+	return prefix, nil
+}
+
+// seal writes the encrypted form of r to w. The header holds encMagic and
+// a random nonce prefix, and is authenticated so that plaintext starting
+// with encMagic is not mistaken for ciphertext. The plaintext is split into
+// chunks which are sealed with the nonce prefix and a chunk counter. The
+// last chunk, which is always shorter than encChunkSize and may be empty,
+// is flagged through the additional data so that truncation is detected.
+func (d *encryptedDriver) seal(w io.Writer, r io.Reader) error {
+	prefix := make([]byte, encNonceSize-4)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return err
+	}
+	header := append(append([]byte{}, encMagic...), prefix...)
+	header = append(header, d.aead.Seal(nil, headerNonce(prefix), nil, header)...)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	nonce := make([]byte, encNonceSize)
+	copy(nonce, prefix)
+	buf := make([]byte, encChunkSize)
+	var out []byte
+	for counter := uint32(0); ; counter++ {
+		if counter == encHeaderCounter {
+			return errors.New("file too large to be encrypted")
+		}
+		n, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		binary.BigEndian.PutUint32(nonce[encNonceSize-4:], counter)
+		out = d.aead.Seal(out[:0], nonce, buf[:n], chunkAD(last))
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// unseal writes the decrypted form of r, as produced by seal, to w.
+func (d *encryptedDriver) unseal(w io.Writer, r io.Reader) error {
+	header := make([]byte, len(encMagic)+encNonceSize-4+d.aead.Overhead())
+	if _, err := io.ReadFull(r, header); err != nil {
+		return ErrEncryptedFileCorrupt
+	}
+	prefix, err := d.openHeader(header)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, encNonceSize)
+	copy(nonce, prefix)
+
+	buf := make([]byte, encChunkSize+d.aead.Overhead())
+	var out []byte
+	for counter := uint32(0); counter != encHeaderCounter; counter++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			return ErrEncryptedFileCorrupt
+		}
+		last := err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		binary.BigEndian.PutUint32(nonce[encNonceSize-4:], counter)
+		out, err = d.aead.Open(out[:0], nonce, buf[:n], chunkAD(last))
+		if err != nil {
+			return ErrEncryptedFileCorrupt
+		}
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+	return ErrEncryptedFileCorrupt
+}
+
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
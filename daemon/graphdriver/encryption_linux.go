@@ -0,0 +1,86 @@
+package graphdriver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/docker/docker/daemon/graphdriver/copy"
+	"github.com/docker/docker/pkg/mount"
+)
+
+// openDir replaces the layer directory dir with a copy of it held in a
+// tmpfs, in which the files below content are decrypted.
+func (d *encryptedDriver) openDir(dir, content string) error {
+	sealed := dir + "-sealed"
+	if _, err := os.Lstat(dir); os.IsNotExist(err) {
+		// Finish the replacement of dir closeDir was interrupted in.
+		if err := os.Rename(sealed, dir); err != nil {
+			return err
+		}
+	}
+	var buf syscall.Statfs_t
+	if err := syscall.Statfs(dir, &buf); err == nil && FsMagic(buf.Type) == FsMagicTmpFs {
+		if mounted, err := mount.Mounted(dir); err != nil {
+			return err
+		} else if mounted {
+			// The copy was left by a daemon which exited while the layer
+			// was in use. It holds the latest content of the layer, some
+			// of whose files may have been encrypted again already.
+			return walkRegularFiles(filepath.Join(dir, content), d.unsealFile)
+		}
+	}
+
+	staging, err := ioutil.TempDir("", "graphdriver-decrypted-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staging)
+	if err := mount.Mount("tmpfs", staging, "tmpfs", "mode=0700"); err != nil {
+		return err
+	}
+	defer mount.Unmount(staging)
+	if err := copy.DirCopy(dir, staging, 0); err != nil {
+		return err
+	}
+	if err := walkRegularFiles(filepath.Join(staging, content), d.unsealFile); err != nil {
+		return err
+	}
+	return mount.ForceMount(staging, dir, "bind", "bind")
+}
+
+// closeDir releases the decrypted copy of the layer directory dir. If
+// written is set, the copy is encrypted first, in memory, and then replaces
+// the content of dir on disk.
+func (d *encryptedDriver) closeDir(dir, content string, written bool) error {
+	if !written {
+		return mount.Unmount(dir)
+	}
+	if err := walkRegularFiles(filepath.Join(dir, content), d.sealFile); err != nil {
+		return err
+	}
+	sealed := dir + "-sealed"
+	if err := os.RemoveAll(sealed); err != nil {
+		return err
+	}
+	if err := copy.DirCopy(dir, sealed, 0); err != nil {
+		os.RemoveAll(sealed)
+		return err
+	}
+	if err := mount.Unmount(dir); err != nil {
+		os.RemoveAll(sealed)
+		return err
+	}
+	old := dir + "-old"
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.Rename(dir, old); err != nil {
+		return err
+	}
+	if err := os.Rename(sealed, dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(old)
+}
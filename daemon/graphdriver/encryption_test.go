@@ -0,0 +1,273 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/daemon/graphdriver/overlay2"
+	"github.com/docker/docker/daemon/graphdriver/vfs"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/mount"
+	"github.com/docker/docker/pkg/reexec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	reexec.Init()
+}
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+// newVfsDriver returns a vfs driver rooted in a temporary directory along
+// with that directory and a function cleaning it up.
+func newVfsDriver(t *testing.T) (graphdriver.Driver, string, func()) {
+	home, err := ioutil.TempDir("", "graphdriver-test")
+	require.NoError(t, err)
+	d, err := vfs.Init(home, nil, nil, nil)
+	require.NoError(t, err)
+	return d, home, func() { os.RemoveAll(home) }
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	base, home, cleanup := newVfsDriver(t)
+	defer cleanup()
+	d := graphdriver.WithEncryption(base, testKey)
+
+	small := []byte("top secret content")
+	large := bytes.Repeat([]byte("0123456789"), 20000)
+
+	require.NoError(t, d.Create("layer1", "", nil))
+	diff, err := archive.Generate("small", string(small), "dir/large", string(large))
+	require.NoError(t, err)
+	_, err = d.ApplyDiff("layer1", "", diff)
+	require.NoError(t, err)
+
+	for name, content := range map[string][]byte{"small": small, "dir/large": large} {
+		onDisk, err := ioutil.ReadFile(filepath.Join(home, "dir", "layer1", name))
+		require.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(onDisk, []byte("DKRENC01")), name)
+		assert.False(t, bytes.Contains(onDisk, content[:10]), name)
+	}
+
+	dir, err := d.Get("layer1", "")
+	require.NoError(t, err)
+	got, err := ioutil.ReadFile(filepath.Join(dir, "small"))
+	require.NoError(t, err)
+	assert.Equal(t, small, got)
+	got, err = ioutil.ReadFile(filepath.Join(dir, "dir", "large"))
+	require.NoError(t, err)
+	assert.Equal(t, large, got)
+	require.NoError(t, d.Put("layer1"))
+
+	onDisk, err := ioutil.ReadFile(filepath.Join(home, "dir", "layer1", "small"))
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(onDisk, []byte("DKRENC01")))
+
+	rc, err := d.Diff("layer1", "")
+	require.NoError(t, err)
+	files := map[string][]byte{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		content, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		files[hdr.Name] = content
+	}
+	require.NoError(t, rc.Close())
+	assert.Equal(t, small, files["small"])
+	assert.Equal(t, large, files["dir/large"])
+}
+
+func TestEncryptionSnapshotOfEncryptedParent(t *testing.T) {
+	base, home, cleanup := newVfsDriver(t)
+	defer cleanup()
+	d := graphdriver.WithEncryption(base, testKey)
+
+	require.NoError(t, d.Create("parent", "", nil))
+	diff, err := archive.Generate("file", "parent content")
+	require.NoError(t, err)
+	_, err = d.ApplyDiff("parent", "", diff)
+	require.NoError(t, err)
+
+	require.NoError(t, d.Create("child", "parent", nil))
+	onDisk, err := ioutil.ReadFile(filepath.Join(home, "dir", "child", "file"))
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(onDisk, []byte("DKRENC01")))
+
+	dir, err := d.Get("child", "")
+	require.NoError(t, err)
+	defer d.Put("child")
+	got, err := ioutil.ReadFile(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "parent content", string(got))
+}
+
+// readTar returns the content of the regular files of the archive rc.
+func readTar(t *testing.T, rc io.ReadCloser) map[string]string {
+	defer rc.Close()
+	files := map[string]string{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		require.NoError(t, err)
+		if hdr.Typeflag == tar.TypeReg {
+			content, err := ioutil.ReadAll(tr)
+			require.NoError(t, err)
+			files[hdr.Name] = string(content)
+		}
+	}
+}
+
+func TestEncryptionKeepsPlaintextInMemory(t *testing.T) {
+	base, home, cleanup := newVfsDriver(t)
+	defer cleanup()
+	d := graphdriver.WithEncryption(base, testKey)
+
+	// Plaintext which starts like ciphertext is encrypted all the same.
+	content := "DKRENC01 is not encrypted"
+	require.NoError(t, d.Create("layer1", "", nil))
+	diff, err := archive.Generate("file", content)
+	require.NoError(t, err)
+	_, err = d.ApplyDiff("layer1", "", diff)
+	require.NoError(t, err)
+
+	layerDir := filepath.Join(home, "dir", "layer1")
+	dir, err := d.Get("layer1", "")
+	require.NoError(t, err)
+	mounted, err := mount.Mounted(layerDir)
+	require.NoError(t, err)
+	assert.True(t, mounted)
+	magic, err := graphdriver.GetFSMagic(filepath.Join(layerDir, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, graphdriver.FsMagicTmpFs, magic)
+	got, err := ioutil.ReadFile(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, content, string(got))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "new"), []byte("new content"), 0644))
+	require.NoError(t, d.Put("layer1"))
+
+	mounted, err = mount.Mounted(layerDir)
+	require.NoError(t, err)
+	assert.False(t, mounted)
+	for name, plaintext := range map[string]string{"file": "is not encrypted", "new": "new content"} {
+		onDisk, err := ioutil.ReadFile(filepath.Join(layerDir, name))
+		require.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(onDisk, []byte("DKRENC01")), name)
+		assert.False(t, bytes.Contains(onDisk, []byte(plaintext)), name)
+	}
+
+	rc, err := d.Diff("layer1", "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"file": content, "new": "new content"}, readTar(t, rc))
+}
+
+func TestEncryptionAfterCrash(t *testing.T) {
+	base, home, cleanup := newVfsDriver(t)
+	defer cleanup()
+	d := graphdriver.WithEncryption(base, testKey)
+	require.NoError(t, d.Create("layer1", "", nil))
+	dir, err := d.Get("layer1", "")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("written before the crash"), 0644))
+
+	// The decrypted copy left behind by the crashed daemon, which only
+	// lives in memory, is picked up by the next one.
+	d = graphdriver.WithEncryption(base, testKey)
+	dir, err = d.Get("layer1", "")
+	require.NoError(t, err)
+	got, err := ioutil.ReadFile(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "written before the crash", string(got))
+	require.NoError(t, d.Put("layer1"))
+
+	layerDir := filepath.Join(home, "dir", "layer1")
+	mounted, err := mount.Mounted(layerDir)
+	require.NoError(t, err)
+	assert.False(t, mounted)
+	onDisk, err := ioutil.ReadFile(filepath.Join(layerDir, "file"))
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(onDisk, []byte("crash")))
+}
+
+func TestEncryptionOverlay2(t *testing.T) {
+	home, err := ioutil.TempDir("", "graphdriver-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	base, err := overlay2.Init(home, nil, nil, nil)
+	if err != nil {
+		t.Skipf("overlay2 is not supported: %v", err)
+	}
+	defer base.Cleanup()
+	d := graphdriver.WithEncryption(base, testKey)
+
+	require.NoError(t, d.Create("parent", "", nil))
+	diff, err := archive.Generate("file", "parent content")
+	require.NoError(t, err)
+	_, err = d.ApplyDiff("parent", "", diff)
+	require.NoError(t, err)
+	require.NoError(t, d.CreateReadWrite("child", "parent", nil))
+
+	dir, err := d.Get("child", "")
+	require.NoError(t, err)
+	got, err := ioutil.ReadFile(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "parent content", string(got))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "new"), []byte("child content"), 0644))
+	require.NoError(t, d.Put("child"))
+
+	// Reading the merged mount did not copy the files of parent up.
+	entries, err := ioutil.ReadDir(filepath.Join(home, "child", "diff"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "new", entries[0].Name())
+	for _, p := range []string{"parent/diff/file", "child/diff/new"} {
+		onDisk, err := ioutil.ReadFile(filepath.Join(home, p))
+		require.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(onDisk, []byte("DKRENC01")), p)
+		assert.False(t, bytes.Contains(onDisk, []byte("content")), p)
+	}
+
+	rc, err := d.Diff("child", "parent")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"new": "child content"}, readTar(t, rc))
+}
+
+func TestEncryptionWrongKey(t *testing.T) {
+	base, _, cleanup := newVfsDriver(t)
+	defer cleanup()
+
+	require.NoError(t, graphdriver.WithEncryption(base, testKey).Create("layer1", "", nil))
+	diff, err := archive.Generate("file", "content")
+	require.NoError(t, err)
+	_, err = graphdriver.WithEncryption(base, testKey).ApplyDiff("layer1", "", diff)
+	require.NoError(t, err)
+
+	other := graphdriver.WithEncryption(base, []byte("fedcba9876543210fedcba9876543210"))
+	_, err = other.Get("layer1", "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), graphdriver.ErrEncryptedFileCorrupt.Error())
+}
+
+func TestEncryptionInvalidKey(t *testing.T) {
+	base, _, cleanup := newVfsDriver(t)
+	defer cleanup()
+
+	err := graphdriver.WithEncryption(base, []byte("short")).Create("layer1", "", nil)
+	assert.Error(t, err)
+}
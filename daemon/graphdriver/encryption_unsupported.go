@@ -0,0 +1,17 @@
+// +build !linux
+
+package graphdriver
+
+import "errors"
+
+var errEncryptionNotSupported = errors.New("encryption is not supported on this platform")
+
+// openDir is not supported on this platform.
+func (d *encryptedDriver) openDir(dir, content string) error {
+	return errEncryptionNotSupported
+}
+
+// closeDir is not supported on this platform.
+func (d *encryptedDriver) closeDir(dir, content string, written bool) error {
+	return errEncryptionNotSupported
+}
@@ -0,0 +1,50 @@
+package graphdriver
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// defaultForceUnmountInterval is the delay between the attempts to unmount
+// a busy mount made before it is detached.
+const defaultForceUnmountInterval = 100 * time.Millisecond
+
+// ForceUnmount configures the escalation of an unmount failing with EBUSY
+// to a lazy unmount, which detaches the mount right away and releases it
+// once it is not used anymore. Detaching a mount which is still used hides
+// it from the driver, so it is disabled by default and only done after the
+// unmount was retried for a grace period.
+type ForceUnmount struct {
+	// After is how long the unmount is retried before the mount is
+	// detached. Zero disables the escalation.
+	After time.Duration
+	// Interval is the delay between the attempts. It defaults to 100ms.
+	Interval time.Duration
+}
+
+// Unmount unmounts target by calling unmount with no flags until it does
+// not fail with EBUSY anymore. If it still does after the grace period, the
+// escalation is logged and target is detached by calling unmount with
+// MNT_DETACH.
+func (f ForceUnmount) Unmount(target string, unmount func(flags int) error) error {
+	err := unmount(0)
+	if f.After <= 0 {
+		return err
+	}
+	interval := f.Interval
+	if interval <= 0 {
+		interval = defaultForceUnmountInterval
+	}
+	deadline := time.Now().Add(f.After)
+	for err == syscall.EBUSY && time.Now().Before(deadline) {
+		time.Sleep(interval)
+		err = unmount(0)
+	}
+	if err != syscall.EBUSY {
+		return err
+	}
+	logrus.Warnf("[graphdriver] %s is still busy after %v, detaching it lazily", target, f.After)
+	return unmount(syscall.MNT_DETACH)
+}
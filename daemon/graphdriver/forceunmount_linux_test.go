@@ -0,0 +1,49 @@
+package graphdriver
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBusyMount fails to be unmounted with EBUSY unless it is detached,
+// and records the flags of the attempts.
+type fakeBusyMount struct {
+	busyFor int
+	flags   []int
+}
+
+func (m *fakeBusyMount) unmount(flags int) error {
+	m.flags = append(m.flags, flags)
+	if flags&syscall.MNT_DETACH == 0 && len(m.flags) <= m.busyFor {
+		return syscall.EBUSY
+	}
+	return nil
+}
+
+func TestForceUnmountDetachesBusyMount(t *testing.T) {
+	m := &fakeBusyMount{busyFor: 1000}
+	f := ForceUnmount{After: 50 * time.Millisecond, Interval: 10 * time.Millisecond}
+	assert.NoError(t, f.Unmount("/mnt", m.unmount))
+	if assert.True(t, len(m.flags) > 2, "expected the unmount to be retried, got %v", m.flags) {
+		assert.Equal(t, syscall.MNT_DETACH, m.flags[len(m.flags)-1])
+		for _, flags := range m.flags[:len(m.flags)-1] {
+			assert.Equal(t, 0, flags)
+		}
+	}
+}
+
+func TestForceUnmountRetriesBeforeDetaching(t *testing.T) {
+	m := &fakeBusyMount{busyFor: 2}
+	f := ForceUnmount{After: time.Second, Interval: time.Millisecond}
+	assert.NoError(t, f.Unmount("/mnt", m.unmount))
+	assert.Equal(t, []int{0, 0, 0}, m.flags)
+}
+
+func TestForceUnmountDisabled(t *testing.T) {
+	m := &fakeBusyMount{busyFor: 1000}
+	assert.Equal(t, syscall.EBUSY, ForceUnmount{}.Unmount("/mnt", m.unmount))
+	assert.Equal(t, []int{0}, m.flags)
+}
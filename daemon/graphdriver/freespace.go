@@ -0,0 +1,18 @@
+package graphdriver
+
+// FreeSpaceDriver is the interface for drivers which can tell how much can
+// still be written to a layer.
+type FreeSpaceDriver interface {
+	// FreeSpace returns the number of bytes which can still be written to
+	// the layer id.
+	FreeSpace(id string) (int64, error)
+}
+
+// FreeSpace returns the number of bytes which can still be written to the
+// layer id of d if d supports it, and ErrNotSupported otherwise.
+func FreeSpace(d ProtoDriver, id string) (int64, error) {
+	if fd, ok := d.(FreeSpaceDriver); ok {
+		return fd.FreeSpace(id)
+	}
+	return 0, ErrNotSupported
+}
@@ -0,0 +1,13 @@
+package graphdriver
+
+import "syscall"
+
+// FreeSpaceOf returns the number of bytes available to unprivileged users
+// on the filesystem of path.
+func FreeSpaceOf(path string) (int64, error) {
+	var buf syscall.Statfs_t
+	if err := syscall.Statfs(path, &buf); err != nil {
+		return 0, err
+	}
+	return int64(buf.Bavail) * int64(buf.Bsize), nil
+}
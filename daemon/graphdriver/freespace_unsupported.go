@@ -0,0 +1,8 @@
+// +build !linux
+
+package graphdriver
+
+// FreeSpaceOf is not supported on this platform.
+func FreeSpaceOf(path string) (int64, error) {
+	return 0, ErrNotSupported
+}
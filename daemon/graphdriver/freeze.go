@@ -0,0 +1,86 @@
+package graphdriver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/docker/docker/pkg/mount"
+)
+
+// FrozenError is returned when writing to a layer which is frozen.
+type FrozenError struct {
+	// ID is the layer which was to be written to.
+	ID string
+}
+
+func (e *FrozenError) Error() string {
+	return fmt.Sprintf("graphdriver: layer %s is frozen", e.ID)
+}
+
+// FreezeDriver is the interface for drivers whose layers can be frozen, i.e.
+// made read-only for good, e.g. the layers of the finalized stages of a build
+// which are only to be used as parents from then on. Like pins, freezes are
+// persistent: they are kept on disk and survive restarts of the daemon.
+type FreezeDriver interface {
+	// Freeze freezes the layer id, which must exist: Get mounts it
+	// read-only and ApplyDiff to it fails with a *FrozenError. There is
+	// no way back. Freezing a frozen layer does nothing.
+	Freeze(id string) error
+	// IsFrozen returns whether the layer id is frozen.
+	IsFrozen(id string) bool
+}
+
+// Freeze freezes the layer id of d if d supports it, and returns
+// ErrNotSupported otherwise.
+func Freeze(d ProtoDriver, id string) error {
+	if fd, ok := d.(FreezeDriver); ok {
+		return fd.Freeze(id)
+	}
+	return ErrNotSupported
+}
+
+// IsFrozen returns whether the layer id of d is frozen, which it cannot be
+// if d does not support freezing.
+func IsFrozen(d ProtoDriver, id string) bool {
+	if fd, ok := d.(FreezeDriver); ok {
+		return fd.IsFrozen(id)
+	}
+	return false
+}
+
+// FreezeLayer marks a layer as frozen by creating its frozen file, the path
+// of the marker the driver keeps for it.
+func FreezeLayer(frozenFile string) error {
+	return ioutil.WriteFile(frozenFile, nil, 0600)
+}
+
+// IsLayerFrozen returns whether the layer whose frozen file is frozenFile is
+// frozen.
+func IsLayerFrozen(frozenFile string) bool {
+	_, err := os.Lstat(frozenFile)
+	return err == nil
+}
+
+// RemoveFrozenFile removes the frozen file of a layer which is removed.
+func RemoveFrozenFile(frozenFile string) error {
+	if err := os.Remove(frozenFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// MountFrozen makes the directory dir of a frozen layer read-only by bind
+// mounting it read-only on itself, unless it already is a mount point.
+func MountFrozen(dir string) error {
+	if err := mount.Mount(dir, dir, "none", "bind,ro"); err != nil {
+		return fmt.Errorf("failed to mount %s read-only: %v", dir, err)
+	}
+	return nil
+}
+
+// UnmountFrozen unmounts the read-only mount MountFrozen made on dir, if
+// any.
+func UnmountFrozen(dir string) error {
+	return mount.Unmount(dir)
+}
@@ -0,0 +1,76 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFreeze(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+	root, err := ioutil.TempDir("", "graphdriver-freeze")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	d, err := graphdriver.New("vfs", nil, graphdriver.Options{Root: root})
+	require.NoError(t, err)
+	require.NoError(t, d.Create("stage", "", nil))
+	dir, err := d.Get("stage", "")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("content"), 0644))
+	require.NoError(t, d.Put("stage"))
+
+	assert.False(t, graphdriver.IsFrozen(d, "stage"))
+	require.NoError(t, graphdriver.Freeze(d, "stage"))
+	require.NoError(t, graphdriver.Freeze(d, "stage"))
+	assert.True(t, graphdriver.IsFrozen(d, "stage"))
+	assert.Error(t, graphdriver.Freeze(d, "missing"))
+
+	checkFrozen := func(d graphdriver.Driver) {
+		dir, err := d.Get("stage", "")
+		require.NoError(t, err)
+		defer d.Put("stage")
+		content, err := ioutil.ReadFile(filepath.Join(dir, "file"))
+		require.NoError(t, err)
+		assert.Equal(t, "content", string(content))
+		assert.Error(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("changed"), 0644))
+		assert.Error(t, ioutil.WriteFile(filepath.Join(dir, "new"), nil, 0644))
+
+		diff, err := archive.Generate("new", "content")
+		require.NoError(t, err)
+		_, err = d.ApplyDiff("stage", "", diff)
+		assert.Equal(t, &graphdriver.FrozenError{ID: "stage"}, err)
+
+		// The layer can still be the parent of others.
+		require.NoError(t, d.Create("child", "stage", nil))
+		require.NoError(t, d.Remove("child"))
+	}
+	checkFrozen(d)
+	require.NoError(t, d.Cleanup())
+
+	// The freeze survives a restart of the driver.
+	d, err = graphdriver.New("vfs", nil, graphdriver.Options{Root: root})
+	require.NoError(t, err)
+	defer d.Cleanup()
+	assert.True(t, graphdriver.IsFrozen(d, "stage"))
+	checkFrozen(d)
+
+	require.NoError(t, d.Remove("stage"))
+	assert.False(t, d.Exists("stage"))
+	assert.False(t, graphdriver.IsFrozen(d, "stage"))
+}
+
+func TestFreezeNotSupported(t *testing.T) {
+	assert.Equal(t, graphdriver.ErrNotSupported, graphdriver.Freeze(upgradeDriver{}, "layer"))
+	assert.False(t, graphdriver.IsFrozen(upgradeDriver{}, "layer"))
+}
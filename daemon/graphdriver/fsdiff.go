@@ -1,6 +1,7 @@
 package graphdriver
 
 import (
+	"fmt"
 	"io"
 	"time"
 
@@ -15,8 +16,21 @@ var (
 	// ApplyUncompressedLayer defines the unpack method used by the graph
 	// driver.
 	ApplyUncompressedLayer = chrootarchive.ApplyUncompressedLayer
+
+	// MaxDiffEntrySize is the size in bytes above which the entries of a
+	// diff are rejected by ValidateDiff. There is no limit if it is 0.
+	MaxDiffEntrySize int64
 )
 
+// DiffValidator is the interface for drivers which can validate a diff
+// before it is applied.
+type DiffValidator interface {
+	// ValidateDiff reads diff and checks that it can safely be applied on
+	// top of parent, without writing anything. It returns the size of the
+	// layer the diff would be applied to.
+	ValidateDiff(parent string, diff io.Reader) (size int64, err error)
+}
+
 // NaiveDiffDriver takes a ProtoDriver and adds the
 // capability of the Diffing methods which it may or may not
 // support on its own. See the comment on the exported
@@ -128,6 +142,9 @@ func (gdw *NaiveDiffDriver) Changes(id, parent string) ([]archive.Change, error)
 // new layer in bytes.
 func (gdw *NaiveDiffDriver) ApplyDiff(id, parent string, diff io.Reader) (size int64, err error) {
 	driver := gdw.ProtoDriver
+	if IsFrozen(driver, id) {
+		return 0, &FrozenError{ID: id}
+	}
 
 	// Mount the root filesystem so we can apply the diff/layer.
 	layerFs, err := driver.Get(id, "")
@@ -148,6 +165,18 @@ func (gdw *NaiveDiffDriver) ApplyDiff(id, parent string, diff io.Reader) (size i
 	return
 }
 
+// ValidateDiff reads the changeset from the given diff and checks that it
+// does not write outside of the layer it would be applied to, that its
+// whiteouts are valid and that none of its entries is larger than
+// MaxDiffEntrySize, without writing anything. It returns the size the layer
+// would have in bytes.
+func (gdw *NaiveDiffDriver) ValidateDiff(parent string, diff io.Reader) (size int64, err error) {
+	if parent != "" && !gdw.ProtoDriver.Exists(parent) {
+		return 0, fmt.Errorf("parent layer %s does not exist", parent)
+	}
+	return archive.ValidateLayer(diff, MaxDiffEntrySize)
+}
+
 // DiffSize calculates the changes between the specified layer
 // and its parent and returns the size in bytes of the changes
 // relative to its base filesystem directory.
@@ -167,3 +196,83 @@ func (gdw *NaiveDiffDriver) DiffSize(id, parent string) (size int64, err error)
 
 	return archive.ChangesSize(layerFs, changes), nil
 }
+
+// Reconcile reconciles the layers of the underlying driver, if it supports
+// it.
+func (gdw *NaiveDiffDriver) Reconcile() ([]string, error) {
+	return Reconcile(gdw.ProtoDriver)
+}
+
+// LayerDirs returns the directories of the layer id of the underlying
+// driver, if it supports it.
+func (gdw *NaiveDiffDriver) LayerDirs(id string) ([]string, string, error) {
+	return LayerDirs(gdw.ProtoDriver, id)
+}
+
+// ListFiles lists the files of the layer id of the underlying driver, if it
+// supports it.
+func (gdw *NaiveDiffDriver) ListFiles(id string) ([]FileEntry, error) {
+	return ListFiles(gdw.ProtoDriver, id)
+}
+
+// SetShardedLayout switches the layout of the underlying driver, if it
+// supports it.
+func (gdw *NaiveDiffDriver) SetShardedLayout(sharded bool) error {
+	return SetShardedLayout(gdw.ProtoDriver, sharded)
+}
+
+// StatusJSON returns the status document of the underlying driver, if it
+// supports it.
+func (gdw *NaiveDiffDriver) StatusJSON() ([]byte, error) {
+	return StatusJSON(gdw.ProtoDriver)
+}
+
+// ReclaimableSpace returns the space removing the layers unusedIDs of the
+// underlying driver would free, if it supports it.
+func (gdw *NaiveDiffDriver) ReclaimableSpace(unusedIDs []string) (int64, error) {
+	return ReclaimableSpace(gdw.ProtoDriver, unusedIDs)
+}
+
+// FreeSpace returns the space left in the layer id of the underlying driver,
+// if it supports it.
+func (gdw *NaiveDiffDriver) FreeSpace(id string) (int64, error) {
+	return FreeSpace(gdw.ProtoDriver, id)
+}
+
+// Diagnostics writes the diagnostics bundle of the underlying driver to w, if
+// it supports it.
+func (gdw *NaiveDiffDriver) Diagnostics(w io.Writer) error {
+	return Diagnostics(gdw.ProtoDriver, w)
+}
+
+// Pin pins the layer id of the underlying driver, if it supports it.
+func (gdw *NaiveDiffDriver) Pin(id string) error {
+	return Pin(gdw.ProtoDriver, id)
+}
+
+// Unpin unpins the layer id of the underlying driver, if it supports it.
+func (gdw *NaiveDiffDriver) Unpin(id string) error {
+	return Unpin(gdw.ProtoDriver, id)
+}
+
+// Freeze freezes the layer id of the underlying driver, if it supports it.
+func (gdw *NaiveDiffDriver) Freeze(id string) error {
+	return Freeze(gdw.ProtoDriver, id)
+}
+
+// IsFrozen returns whether the layer id of the underlying driver is frozen.
+func (gdw *NaiveDiffDriver) IsFrozen(id string) bool {
+	return IsFrozen(gdw.ProtoDriver, id)
+}
+
+// GetAt mounts the layer id of the underlying driver at target, if it
+// supports it.
+func (gdw *NaiveDiffDriver) GetAt(id, mountLabel, target string) error {
+	return GetAt(gdw.ProtoDriver, id, mountLabel, target)
+}
+
+// PutAt unmounts the layer id of the underlying driver from target, if it
+// supports it.
+func (gdw *NaiveDiffDriver) PutAt(id, target string) error {
+	return PutAt(gdw.ProtoDriver, id, target)
+}
@@ -0,0 +1,169 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// craftDiff returns a diff holding the entries hdrs, with content of the
+// size of the regular files.
+func craftDiff(t *testing.T, hdrs ...*tar.Header) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, hdr := range hdrs {
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write(bytes.Repeat([]byte("a"), int(hdr.Size)))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	return buf
+}
+
+func TestValidateDiff(t *testing.T) {
+	base, home, cleanup := newVfsDriver(t)
+	defer cleanup()
+	d, ok := base.(graphdriver.DiffValidator)
+	require.True(t, ok)
+	require.NoError(t, base.Create("parent", "", nil))
+
+	size, err := d.ValidateDiff("parent", craftDiff(t,
+		&tar.Header{Name: "dir", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 10},
+		&tar.Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file"},
+		&tar.Header{Name: "dir/.wh.removed", Typeflag: tar.TypeReg, Mode: 0644},
+		&tar.Header{Name: "other/.wh..wh..opq", Typeflag: tar.TypeReg, Mode: 0644},
+	))
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), size)
+
+	_, err = d.ValidateDiff("missing", craftDiff(t))
+	assert.Error(t, err)
+
+	// Nothing was written by the validation.
+	entries, err := ioutil.ReadDir(filepath.Join(home, "dir"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestValidateDiffRejectsMaliciousDiffs(t *testing.T) {
+	base, _, cleanup := newVfsDriver(t)
+	defer cleanup()
+	d := base.(graphdriver.DiffValidator)
+
+	defer func(size int64) { graphdriver.MaxDiffEntrySize = size }(graphdriver.MaxDiffEntrySize)
+	graphdriver.MaxDiffEntrySize = 100
+
+	for _, tc := range []struct {
+		name string
+		hdr  *tar.Header
+	}{
+		{"path traversal", &tar.Header{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644}},
+		{"hardlink traversal", &tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"}},
+		{"symlink traversal", &tar.Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "../../../etc"}},
+		{"oversized entry", &tar.Header{Name: "big", Typeflag: tar.TypeReg, Mode: 0644, Size: 101}},
+		{"empty whiteout", &tar.Header{Name: "dir/.wh.", Typeflag: tar.TypeReg, Mode: 0644}},
+		{"parent whiteout", &tar.Header{Name: "dir/.wh...", Typeflag: tar.TypeReg, Mode: 0644}},
+		{"non-regular whiteout", &tar.Header{Name: "dir/.wh.file", Typeflag: tar.TypeDir, Mode: 0755}},
+		{"dangling aufs hardlink", &tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: ".wh..wh.plnk/missing"}},
+	} {
+		_, err := d.ValidateDiff("", craftDiff(t, tc.hdr))
+		assert.Error(t, err, tc.name)
+	}
+}
+
+func TestValidateDiffRejectsTruncatedDiffs(t *testing.T) {
+	base, _, cleanup := newVfsDriver(t)
+	defer cleanup()
+	d := base.(graphdriver.DiffValidator)
+
+	diff := craftDiff(t, &tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Size: 4096})
+	_, err := d.ValidateDiff("", bytes.NewReader(diff.Bytes()[:1024]))
+	assert.Error(t, err)
+}
+
+// peakHeapWriter discards what is written to it, and records the peak of the
+// heap in use, sampled every 64MiB written.
+type peakHeapWriter struct {
+	written int64
+	next    int64
+	peak    uint64
+}
+
+func (w *peakHeapWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	if w.written >= w.next {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		if m.HeapInuse > w.peak {
+			w.peak = m.HeapInuse
+		}
+		w.next += 64 << 20
+	}
+	return len(p), nil
+}
+
+func TestDiffStreamsLargeLayer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("diffs a multi-gigabyte layer")
+	}
+	d, home, cleanup := newVfsDriver(t)
+	defer cleanup()
+
+	const size = 3 << 30
+	require.NoError(t, d.Create("base", "", nil))
+	require.NoError(t, d.Create("top", "base", nil))
+	f, err := os.Create(filepath.Join(home, "dir", "top", "sparse"))
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(size))
+	require.NoError(t, f.Close())
+
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	limit := m.HeapInuse + 64<<20
+
+	// Both the diff against a parent and the one of the whole layer are
+	// streamed, the former through a compressor as on push.
+	for _, parent := range []string{"base", ""} {
+		w := &peakHeapWriter{}
+		var dst io.WriteCloser = nopWriteCloser{w}
+		if parent != "" {
+			dst, err = archive.CompressStream(w, archive.Gzip)
+			require.NoError(t, err)
+		}
+		rc, err := d.Diff("top", parent)
+		require.NoError(t, err)
+		_, err = io.Copy(dst, rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		require.NoError(t, dst.Close())
+
+		if parent == "" {
+			assert.True(t, w.written > size, "the diff holds %d bytes", w.written)
+		}
+		assert.True(t, w.peak < limit, "diffing against %q used %d bytes of heap, more than %d", parent, w.peak, limit)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -334,3 +334,21 @@ func DriverTestSetQuota(t *testing.T, drivername string) {
 	}
 
 }
+
+// DriverTestStatusFeatures verifies the driver reports every feature of
+// graphdriver.StatusFeatureKeys in its status with a boolean value.
+func DriverTestStatusFeatures(t testing.TB, drivername string, driverOptions ...string) {
+	driver := GetDriver(t, drivername, driverOptions...)
+	defer PutDriver(t)
+
+	status := make(map[string]string)
+	for _, pair := range driver.Status() {
+		status[pair[0]] = pair[1]
+	}
+	for _, key := range graphdriver.StatusFeatureKeys {
+		value, ok := status[key]
+		if assert.True(t, ok, "missing status key %q", key) {
+			assert.Contains(t, []string{"true", "false"}, value, "status key %q", key)
+		}
+	}
+}
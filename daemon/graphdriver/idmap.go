@@ -0,0 +1,72 @@
+package graphdriver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/docker/docker/pkg/ioutils"
+)
+
+// idMappingsState is the record of the ID mappings the layers of a driver
+// were created with.
+type idMappingsState struct {
+	UIDMaps []idtools.IDMap `json:"uid_maps"`
+	GIDMaps []idtools.IDMap `json:"gid_maps"`
+}
+
+func newIDMappingsState(uidMaps, gidMaps []idtools.IDMap) idMappingsState {
+	// Normalize empty mappings so that nil and empty slices compare equal.
+	var s idMappingsState
+	if len(uidMaps) > 0 {
+		s.UIDMaps = uidMaps
+	}
+	if len(gidMaps) > 0 {
+		s.GIDMaps = gidMaps
+	}
+	return s
+}
+
+// idMappingsPath returns the path of the file recording the ID mappings of
+// the driver name, which is kept next to its home directory in root.
+func idMappingsPath(root, name string) string {
+	return filepath.Join(root, name+"-idmap.json")
+}
+
+// checkIDMappings verifies the layers of the driver name in root were
+// created with the given ID mappings. Using them with different mappings
+// would give files in containers the wrong ownership, so this fails with
+// an error instead. The mappings are recorded if none were before.
+func checkIDMappings(root, name string, uidMaps, gidMaps []idtools.IDMap) error {
+	current := newIDMappingsState(uidMaps, gidMaps)
+	data, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+
+	p := idMappingsPath(root, name)
+	stored, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return ioutils.AtomicWriteFile(p, data, 0600)
+	}
+	if err != nil {
+		return err
+	}
+
+	var prior idMappingsState
+	if err := json.Unmarshal(stored, &prior); err != nil {
+		return fmt.Errorf("failed to read the ID mappings of the %s storage driver from %s: %v", name, p, err)
+	}
+	prior = newIDMappingsState(prior.UIDMaps, prior.GIDMaps)
+	priorData, err := json.Marshal(prior)
+	if err != nil {
+		return err
+	}
+	if string(priorData) != string(data) {
+		return fmt.Errorf("the %s storage driver state in %s was created with different user namespace ID mappings (uid: %v, gid: %v) than the current ones (uid: %v, gid: %v); restore the previous mappings or use a different data root", name, root, prior.UIDMaps, prior.GIDMaps, current.UIDMaps, current.GIDMaps)
+	}
+	return nil
+}
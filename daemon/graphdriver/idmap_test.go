@@ -0,0 +1,63 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRecordsIDMappings(t *testing.T) {
+	root, err := ioutil.TempDir("", "graphdriver-idmap")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	d, err := graphdriver.New("vfs", nil, graphdriver.Options{Root: root})
+	require.NoError(t, err)
+	require.NoError(t, d.Cleanup())
+
+	data, err := ioutil.ReadFile(filepath.Join(root, "vfs-idmap.json"))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"uid_maps":null,"gid_maps":null}`, string(data))
+
+	// Empty and nil mappings are the same.
+	d, err = graphdriver.New("vfs", nil, graphdriver.Options{
+		Root:    root,
+		UIDMaps: []idtools.IDMap{},
+		GIDMaps: []idtools.IDMap{},
+	})
+	require.NoError(t, err)
+	require.NoError(t, d.Cleanup())
+}
+
+func TestNewRejectsMismatchedIDMappings(t *testing.T) {
+	root, err := ioutil.TempDir("", "graphdriver-idmap")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	stored := `{"uid_maps":[{"container_id":0,"host_id":100000,"size":65536}],"gid_maps":[{"container_id":0,"host_id":100000,"size":65536}]}`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "vfs-idmap.json"), []byte(stored), 0600))
+
+	_, err = graphdriver.New("vfs", nil, graphdriver.Options{Root: root})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "was created with different user namespace ID mappings")
+
+	_, err = graphdriver.New("vfs", nil, graphdriver.Options{
+		Root:    root,
+		UIDMaps: []idtools.IDMap{{ContainerID: 0, HostID: 200000, Size: 65536}},
+		GIDMaps: []idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+	})
+	assert.Error(t, err)
+
+	maps := []idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}}
+	d, err := graphdriver.New("vfs", nil, graphdriver.Options{Root: root, UIDMaps: maps, GIDMaps: maps})
+	require.NoError(t, err)
+	assert.NoError(t, d.Cleanup())
+}
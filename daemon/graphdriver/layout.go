@@ -0,0 +1,88 @@
+package graphdriver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types/versions"
+	"github.com/docker/docker/pkg/ioutils"
+)
+
+// UpgradeDriver is the interface for drivers whose on-disk layout is
+// versioned, so that the layout written by an older daemon can be migrated
+// in place when it changes.
+type UpgradeDriver interface {
+	Driver
+	// LayoutVersion returns the version of the layout the driver writes,
+	// as dot-separated numbers.
+	LayoutVersion() string
+	// Upgrade migrates the layout of the driver from fromVersion to
+	// toVersion, which is the version returned by LayoutVersion.
+	Upgrade(fromVersion, toVersion string) error
+}
+
+// layoutState is the record of the version of the layout of a driver.
+type layoutState struct {
+	Version string `json:"version"`
+}
+
+// layoutPath returns the path of the file recording the layout version of
+// the driver name, which is kept next to its home directory in root.
+func layoutPath(root, name string) string {
+	return filepath.Join(root, name+"-layout.json")
+}
+
+// readLayoutVersion returns the layout version recorded for the driver name
+// in root, or "" if there is none.
+func readLayoutVersion(root, name string) (string, error) {
+	data, err := ioutil.ReadFile(layoutPath(root, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	var state layoutState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return "", fmt.Errorf("failed to read the layout version of the %s storage driver: %v", name, err)
+	}
+	return state.Version, nil
+}
+
+// checkLayout upgrades the layout of d in root if it was written by an
+// older version of the driver, and records its current version. Drivers
+// which do not implement UpgradeDriver are left alone, and so are layouts
+// which were not recorded yet, as they cannot be told apart from new ones.
+func checkLayout(root string, d Driver) error {
+	ud, ok := d.(UpgradeDriver)
+	if !ok {
+		return nil
+	}
+	name := d.String()
+	current := ud.LayoutVersion()
+	prior, err := readLayoutVersion(root, name)
+	if err != nil {
+		return err
+	}
+	if prior == current {
+		return nil
+	}
+	if prior != "" {
+		if versions.GreaterThan(prior, current) {
+			return fmt.Errorf("the %s storage driver state in %s has layout version %s, which is newer than the supported version %s", name, root, prior, current)
+		}
+		logrus.Infof("[graphdriver] upgrading the layout of the %s storage driver from version %s to %s", name, prior, current)
+		if err := ud.Upgrade(prior, current); err != nil {
+			return fmt.Errorf("failed to upgrade the layout of the %s storage driver from version %s to %s: %v", name, prior, current, err)
+		}
+	}
+	data, err := json.Marshal(layoutState{Version: current})
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(layoutPath(root, name), data, 0600)
+}
@@ -0,0 +1,92 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/daemon/graphdriver/vfs"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// upgrades records the upgrades of the layout of upgradeDriver.
+var upgrades [][2]string
+
+// upgradeDriver is a vfs driver whose layout is at version 2.
+type upgradeDriver struct {
+	graphdriver.Driver
+}
+
+func (d upgradeDriver) String() string {
+	return "vfs-upgrade"
+}
+
+func (d upgradeDriver) LayoutVersion() string {
+	return "2"
+}
+
+func (d upgradeDriver) Upgrade(fromVersion, toVersion string) error {
+	upgrades = append(upgrades, [2]string{fromVersion, toVersion})
+	return nil
+}
+
+func init() {
+	graphdriver.Register("vfs-upgrade", func(home string, options []string, uidMaps, gidMaps []idtools.IDMap) (graphdriver.Driver, error) {
+		d, err := vfs.Init(home, options, uidMaps, gidMaps)
+		if err != nil {
+			return nil, err
+		}
+		return upgradeDriver{d}, nil
+	})
+}
+
+func TestNewUpgradesOlderLayouts(t *testing.T) {
+	root, err := ioutil.TempDir("", "graphdriver-layout")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	marker := filepath.Join(root, "vfs-upgrade-layout.json")
+	upgrades = nil
+
+	// Layouts which were not recorded yet are not upgraded.
+	d, err := graphdriver.New("vfs-upgrade", nil, graphdriver.Options{Root: root})
+	require.NoError(t, err)
+	require.NoError(t, d.Cleanup())
+	assert.Empty(t, upgrades)
+	data, err := ioutil.ReadFile(marker)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"version":"2"}`, string(data))
+
+	require.NoError(t, ioutil.WriteFile(marker, []byte(`{"version":"1"}`), 0600))
+	d, err = graphdriver.New("vfs-upgrade", nil, graphdriver.Options{Root: root})
+	require.NoError(t, err)
+	require.NoError(t, d.Cleanup())
+	assert.Equal(t, [][2]string{{"1", "2"}}, upgrades)
+	data, err = ioutil.ReadFile(marker)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"version":"2"}`, string(data))
+
+	// The layout is only upgraded once.
+	d, err = graphdriver.New("vfs-upgrade", nil, graphdriver.Options{Root: root})
+	require.NoError(t, err)
+	require.NoError(t, d.Cleanup())
+	assert.Len(t, upgrades, 1)
+}
+
+func TestNewRejectsNewerLayouts(t *testing.T) {
+	root, err := ioutil.TempDir("", "graphdriver-layout")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	upgrades = nil
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "vfs-upgrade-layout.json"), []byte(`{"version":"3"}`), 0600))
+	_, err = graphdriver.New("vfs-upgrade", nil, graphdriver.Options{Root: root})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "newer than the supported version 2")
+	assert.Empty(t, upgrades)
+}
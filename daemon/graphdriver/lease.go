@@ -0,0 +1,119 @@
+package graphdriver
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/docker/docker/pkg/locker"
+)
+
+// ErrLayerLeased is returned when removing a layer which is leased.
+var ErrLayerLeased = errors.New("layer is leased")
+
+// LeaseDriver is the interface for layered file system drivers whose layers
+// can be pinned against removal, so that a layer about to be referenced is
+// not removed from under its user by a concurrent cleanup.
+type LeaseDriver interface {
+	Driver
+	// Lease pins the layers ids until release is called: removing them
+	// fails with ErrLayerLeased. Leases are counted, so that a layer can be
+	// leased by several users at once. Leasing fails if one of the layers
+	// does not exist, in which case none of them is leased.
+	Lease(ids []string) (release func(), err error)
+}
+
+// leaseDriver wraps a Driver and refuses to remove the layers which are
+// leased.
+type leaseDriver struct {
+	Driver
+	// locker serializes Lease and Remove for each layer, so that a layer
+	// cannot be leased while it is being removed.
+	locker *locker.Locker
+
+	mu     sync.Mutex
+	leases map[string]int
+}
+
+// leaseDiffGetterDriver is a leaseDriver which keeps the DiffGetter
+// method of the driver it wraps.
+type leaseDiffGetterDriver struct {
+	*leaseDriver
+	getter DiffGetterDriver
+}
+
+func (d *leaseDiffGetterDriver) DiffGetter(id string) (FileGetCloser, error) {
+	return d.getter.DiffGetter(id)
+}
+
+// WithLeases returns a LeaseDriver whose layers can be leased to protect
+// them against removal. The returned driver keeps the Capabilities and
+// DiffGetter methods of d, if it has them.
+func WithLeases(d Driver) LeaseDriver {
+	ld := &leaseDriver{
+		Driver: d,
+		locker: locker.New(),
+		leases: make(map[string]int),
+	}
+	if getter, ok := d.(DiffGetterDriver); ok {
+		return &leaseDiffGetterDriver{leaseDriver: ld, getter: getter}
+	}
+	return ld
+}
+
+// Capabilities returns the capabilities of the underlying driver.
+func (d *leaseDriver) Capabilities() Capabilities {
+	if capDriver, ok := d.Driver.(CapabilityDriver); ok {
+		return capDriver.Capabilities()
+	}
+	return Capabilities{}
+}
+
+// Lease pins the layers ids until the returned function is called.
+func (d *leaseDriver) Lease(ids []string) (func(), error) {
+	var leased []string
+	release := func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for _, id := range leased {
+			if d.leases[id]--; d.leases[id] <= 0 {
+				delete(d.leases, id)
+			}
+		}
+		leased = nil
+	}
+
+	for _, id := range ids {
+		d.locker.Lock(id)
+		if !d.Driver.Exists(id) {
+			d.locker.Unlock(id)
+			release()
+			return nil, fmt.Errorf("cannot lease layer %s: it does not exist", id)
+		}
+		d.mu.Lock()
+		d.leases[id]++
+		d.mu.Unlock()
+		d.locker.Unlock(id)
+		leased = append(leased, id)
+	}
+
+	var once sync.Once
+	return func() { once.Do(release) }, nil
+}
+
+// leased returns whether the layer id is leased.
+func (d *leaseDriver) leased(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.leases[id] > 0
+}
+
+// Remove removes the layer id, unless it is leased.
+func (d *leaseDriver) Remove(id string) error {
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
+	if d.leased(id) {
+		return ErrLayerLeased
+	}
+	return d.Driver.Remove(id)
+}
@@ -0,0 +1,94 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeasedLayerIsNotRemovedByGC(t *testing.T) {
+	base, home, cleanup := newVfsDriver(t)
+	defer cleanup()
+	d := graphdriver.WithLeases(base)
+
+	var ids []string
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("layer%d", i)
+		require.NoError(t, d.Create(id, "", nil))
+		ids = append(ids, id)
+	}
+	release, err := d.Lease([]string{"layer3", "layer7"})
+	require.NoError(t, err)
+
+	// A GC pass removes all the layers concurrently, skipping the leased
+	// ones.
+	var wg sync.WaitGroup
+	errs := make(chan error, len(ids))
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := d.Remove(id); err != nil && err != graphdriver.ErrLayerLeased {
+				errs <- err
+			}
+		}(id)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	layers, err := ioutil.ReadDir(filepath.Join(home, "dir"))
+	require.NoError(t, err)
+	var remaining []string
+	for _, l := range layers {
+		remaining = append(remaining, l.Name())
+	}
+	assert.Equal(t, []string{"layer3", "layer7"}, remaining)
+	assert.Equal(t, graphdriver.ErrLayerLeased, d.Remove("layer3"))
+
+	release()
+	release()
+	require.NoError(t, d.Remove("layer3"))
+	require.NoError(t, d.Remove("layer7"))
+	assert.False(t, d.Exists("layer3"))
+}
+
+func TestLeaseCountsUsers(t *testing.T) {
+	base, _, cleanup := newVfsDriver(t)
+	defer cleanup()
+	d := graphdriver.WithLeases(base)
+	require.NoError(t, d.Create("layer", "", nil))
+
+	release1, err := d.Lease([]string{"layer"})
+	require.NoError(t, err)
+	release2, err := d.Lease([]string{"layer"})
+	require.NoError(t, err)
+
+	release1()
+	assert.Equal(t, graphdriver.ErrLayerLeased, d.Remove("layer"))
+	release2()
+	assert.NoError(t, d.Remove("layer"))
+}
+
+func TestLeaseMissingLayer(t *testing.T) {
+	base, _, cleanup := newVfsDriver(t)
+	defer cleanup()
+	d := graphdriver.WithLeases(base)
+	require.NoError(t, d.Create("layer", "", nil))
+
+	_, err := d.Lease([]string{"layer", "missing"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "missing")
+	// The layers leased before the error are released.
+	assert.NoError(t, d.Remove("layer"))
+}
@@ -0,0 +1,94 @@
+package graphdriver
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// FileType is the type of a file listed by ListFiles.
+type FileType string
+
+const (
+	// FileTypeRegular is the type of regular files.
+	FileTypeRegular FileType = "file"
+	// FileTypeDir is the type of directories.
+	FileTypeDir FileType = "dir"
+	// FileTypeSymlink is the type of symbolic links.
+	FileTypeSymlink FileType = "symlink"
+	// FileTypeOther is the type of the other files, such as devices,
+	// sockets and named pipes.
+	FileTypeOther FileType = "other"
+)
+
+// FileEntry describes a file of a layer.
+type FileEntry struct {
+	// Path is the absolute, slash-separated path of the file in the
+	// layer, e.g. "/etc/hosts".
+	Path string
+	Size int64
+	Mode os.FileMode
+	Type FileType
+}
+
+// FileListerDriver is the interface for layered file system drivers that can
+// list the files of a layer without mounting it.
+type FileListerDriver interface {
+	// ListFiles returns the files the layer id adds or modifies over its
+	// parents, ordered by path. The files it removes are not listed. The
+	// drivers which do not keep the files of a layer apart from those of
+	// its parents list them all.
+	ListFiles(id string) ([]FileEntry, error)
+}
+
+// ListFiles lists the files of the layer id of d if d supports it, and
+// returns ErrNotSupported otherwise.
+func ListFiles(d ProtoDriver, id string) ([]FileEntry, error) {
+	if lister, ok := d.(FileListerDriver); ok {
+		return lister.ListFiles(id)
+	}
+	return nil, ErrNotSupported
+}
+
+// ListDir returns the entries of the files below root, ordered by path,
+// root being the "/" of their paths. The files for which skip, if it is not nil,
+// returns true are left out.
+func ListDir(root string, skip func(path string, fi os.FileInfo) (bool, error)) ([]FileEntry, error) {
+	var entries []FileEntry
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		if skip != nil {
+			if skipped, err := skip(path, fi); err != nil || skipped {
+				return err
+			}
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		entry := FileEntry{
+			Path: "/" + filepath.ToSlash(rel),
+			Mode: fi.Mode(),
+			Type: FileTypeOther,
+		}
+		switch {
+		case fi.Mode().IsRegular():
+			entry.Type = FileTypeRegular
+			entry.Size = fi.Size()
+		case fi.IsDir():
+			entry.Type = FileTypeDir
+		case fi.Mode()&os.ModeSymlink != 0:
+			entry.Type = FileTypeSymlink
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
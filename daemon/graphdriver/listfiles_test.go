@@ -0,0 +1,52 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListFiles(t *testing.T) {
+	d, _, cleanup := newVfsDriver(t)
+	defer cleanup()
+
+	require.NoError(t, d.Create("base", "", nil))
+	diff, err := archive.Generate("bin/app", "binary", "etc/app.conf", "key=value\n")
+	require.NoError(t, err)
+	_, err = d.ApplyDiff("base", "", diff)
+	require.NoError(t, err)
+
+	dir, err := d.Get("base", "")
+	require.NoError(t, err)
+	defer d.Put("base")
+	expected := []graphdriver.FileEntry{
+		{Path: "/bin", Type: graphdriver.FileTypeDir},
+		{Path: "/bin/app", Size: 6, Type: graphdriver.FileTypeRegular},
+		{Path: "/etc", Type: graphdriver.FileTypeDir},
+		{Path: "/etc/app.conf", Size: 10, Type: graphdriver.FileTypeRegular},
+	}
+	for i, entry := range expected {
+		fi, err := os.Lstat(filepath.Join(dir, entry.Path))
+		require.NoError(t, err)
+		expected[i].Mode = fi.Mode()
+	}
+
+	entries, err := graphdriver.ListFiles(d, "base")
+	require.NoError(t, err)
+	assert.Equal(t, expected, entries)
+
+	// The listing goes through the wrappers of New.
+	entries, err = graphdriver.ListFiles(graphdriver.WithSyncMode(d, "", graphdriver.SyncNone), "base")
+	require.NoError(t, err)
+	assert.Equal(t, expected, entries)
+
+	_, err = graphdriver.ListFiles(d, "missing")
+	assert.Error(t, err)
+}
@@ -0,0 +1,45 @@
+package graphdriver
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// LoopbackRootError is returned by New when the root of the driver is on a
+// loopback device and Options.RejectLoopbackRoot is set.
+type LoopbackRootError struct {
+	// Root is the root of the driver.
+	Root string
+	// BackingFile is the file backing the loopback device of Root.
+	BackingFile string
+}
+
+func (e *LoopbackRootError) Error() string {
+	return fmt.Sprintf("graphdriver: %s is on a loopback device backed by %s. %s", e.Root, e.BackingFile, loopbackRootAdvice)
+}
+
+// loopbackRootAdvice is the guidance given about a root on a loopback device.
+const loopbackRootAdvice = "Loopback devices backed by sparse files are prone to corruption and perform poorly: use a dedicated block device or partition for the data root of the daemon"
+
+// checkLoopbackRoot warns about root being on a loopback device, or fails
+// with a *LoopbackRootError if reject is set. Failing to inspect the device
+// of root is not an error, as it does not tell whether it is a loopback one.
+func checkLoopbackRoot(root string, reject bool) error {
+	backingFile, err := loopbackBackingFile(root)
+	if err != nil {
+		if err != ErrNotSupported {
+			logrus.Debugf("[graphdriver] failed to inspect the device of %s: %v", root, err)
+		}
+		return nil
+	}
+	if backingFile == "" {
+		return nil
+	}
+	lerr := &LoopbackRootError{Root: root, BackingFile: backingFile}
+	if reject {
+		return lerr
+	}
+	logrus.Warnf("[graphdriver] WARNING: %v", lerr)
+	return nil
+}
@@ -0,0 +1,50 @@
+package graphdriver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// sysDevBlock is the directory of sysfs holding the block devices by
+// device number, swapped in tests.
+var sysDevBlock = "/sys/dev/block"
+
+func major(device uint64) uint64 {
+	return ((device >> 8) & 0xfff) | ((device >> 32) & 0xfffff000)
+}
+
+func minor(device uint64) uint64 {
+	return (device & 0xff) | ((device >> 12) & 0xffffff00)
+}
+
+// loopbackBackingFile returns the file backing the loopback device the
+// filesystem of path is on, or "" if it is not on a loopback device. The
+// partitions of loopback devices are loopback devices as well.
+func loopbackBackingFile(path string) (string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return "", err
+	}
+	dev, err := filepath.EvalSymlinks(filepath.Join(sysDevBlock, fmt.Sprintf("%d:%d", major(uint64(st.Dev)), minor(uint64(st.Dev)))))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Not a block device, e.g. a tmpfs or a btrfs subvolume.
+			return "", nil
+		}
+		return "", err
+	}
+	for _, dir := range []string{dev, filepath.Dir(dev)} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "loop", "backing_file"))
+		if err == nil {
+			return strings.TrimSpace(string(data)), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,64 @@
+package graphdriver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withFakeSysDevBlock makes the device of root look like a loopback device
+// backed by backingFile, by faking the sysfs directory of the block devices,
+// and returns the function restoring it.
+func withFakeSysDevBlock(t *testing.T, root, backingFile string) func() {
+	var st syscall.Stat_t
+	require.NoError(t, syscall.Stat(root, &st))
+	dir, err := ioutil.TempDir("", "graphdriver-sys-dev-block")
+	require.NoError(t, err)
+	loopDir := filepath.Join(dir, fmt.Sprintf("%d:%d", major(uint64(st.Dev)), minor(uint64(st.Dev))), "loop")
+	require.NoError(t, os.MkdirAll(loopDir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(loopDir, "backing_file"), []byte(backingFile+"\n"), 0644))
+
+	sysDir := sysDevBlock
+	sysDevBlock = dir
+	return func() {
+		sysDevBlock = sysDir
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCheckLoopbackRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "graphdriver-loopback")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	var logs bytes.Buffer
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	logrus.SetOutput(&logs)
+
+	if backingFile, _ := loopbackBackingFile(root); backingFile != "" {
+		t.Skipf("%s is on a loopback device backed by %s", root, backingFile)
+	}
+	require.NoError(t, checkLoopbackRoot(root, true))
+	assert.Empty(t, logs.String())
+
+	defer withFakeSysDevBlock(t, root, "/var/lib/docker.img")()
+	backingFile, err := loopbackBackingFile(root)
+	require.NoError(t, err)
+	assert.Equal(t, "/var/lib/docker.img", backingFile)
+
+	require.NoError(t, checkLoopbackRoot(root, false))
+	assert.Contains(t, logs.String(), "level=warning")
+	assert.Contains(t, logs.String(), root+" is on a loopback device backed by /var/lib/docker.img")
+	assert.Contains(t, logs.String(), "use a dedicated block device")
+
+	err = checkLoopbackRoot(root, true)
+	assert.Equal(t, &LoopbackRootError{Root: root, BackingFile: "/var/lib/docker.img"}, err)
+}
@@ -0,0 +1,8 @@
+// +build !linux
+
+package graphdriver
+
+// loopbackBackingFile is not supported on this platform.
+func loopbackBackingFile(path string) (string, error) {
+	return "", ErrNotSupported
+}
@@ -0,0 +1,51 @@
+package graphdriver
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Migrate copies the layers identified by ids from src to dst, for example
+// to move the layers of a daemon to a different storage driver without
+// pulling the images again. ids must be ordered from the bottom of the stack
+// upwards, each layer being the parent of the next one: the content of each
+// layer is read with Diff relative to its parent on src and applied on top
+// of the same parent on dst. Layers which already exist on dst are skipped.
+func Migrate(src, dst Driver, ids []string) error {
+	parent := ""
+	for _, id := range ids {
+		if dst.Exists(id) {
+			logrus.Debugf("[graphdriver] migrate: %s already exists on %s, skipping", id, dst)
+			parent = id
+			continue
+		}
+		if err := migrateLayer(src, dst, id, parent); err != nil {
+			return fmt.Errorf("failed to migrate layer %s from %s to %s: %v", id, src, dst, err)
+		}
+		parent = id
+	}
+	return nil
+}
+
+func migrateLayer(src, dst Driver, id, parent string) (retErr error) {
+	if err := dst.Create(id, parent, nil); err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			if err := dst.Remove(id); err != nil {
+				logrus.Errorf("[graphdriver] migrate: failed to remove partially migrated layer %s: %v", id, err)
+			}
+		}
+	}()
+
+	diff, err := src.Diff(id, parent)
+	if err != nil {
+		return err
+	}
+	defer diff.Close()
+
+	_, err = dst.ApplyDiff(id, parent, diff)
+	return err
+}
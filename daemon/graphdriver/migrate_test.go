@@ -0,0 +1,135 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingDriver is a fake driver which records the layers created on it
+// and the diffs applied to them.
+type recordingDriver struct {
+	graphdriver.Driver
+	parents map[string]string
+	diffs   map[string][]byte
+}
+
+func newRecordingDriver() *recordingDriver {
+	return &recordingDriver{
+		parents: make(map[string]string),
+		diffs:   make(map[string][]byte),
+	}
+}
+
+func (d *recordingDriver) String() string {
+	return "recording"
+}
+
+func (d *recordingDriver) Create(id, parent string, opts *graphdriver.CreateOpts) error {
+	if _, exists := d.parents[id]; exists {
+		return fmt.Errorf("%s already exists", id)
+	}
+	if _, exists := d.parents[parent]; parent != "" && !exists {
+		return fmt.Errorf("parent %s does not exist", parent)
+	}
+	d.parents[id] = parent
+	return nil
+}
+
+func (d *recordingDriver) Exists(id string) bool {
+	_, exists := d.parents[id]
+	return exists
+}
+
+func (d *recordingDriver) Remove(id string) error {
+	delete(d.parents, id)
+	delete(d.diffs, id)
+	return nil
+}
+
+func (d *recordingDriver) ApplyDiff(id, parent string, diff io.Reader) (int64, error) {
+	b, err := ioutil.ReadAll(diff)
+	if err != nil {
+		return 0, err
+	}
+	d.diffs[id] = b
+	return int64(len(b)), nil
+}
+
+// tarContents returns the regular files of a tar archive with their content.
+func tarContents(t *testing.T, b []byte) map[string]string {
+	files := make(map[string]string)
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		require.NoError(t, err)
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		files[hdr.Name] = string(content)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	src, _, cleanup := newVfsDriver(t)
+	defer cleanup()
+
+	require.NoError(t, src.Create("base", "", nil))
+	diff, err := archive.Generate("etc/base", "base content")
+	require.NoError(t, err)
+	_, err = src.ApplyDiff("base", "", diff)
+	require.NoError(t, err)
+
+	require.NoError(t, src.Create("top", "base", nil))
+	diff, err = archive.Generate("etc/top", "top content")
+	require.NoError(t, err)
+	_, err = src.ApplyDiff("top", "base", diff)
+	require.NoError(t, err)
+
+	dst := newRecordingDriver()
+	require.NoError(t, graphdriver.Migrate(src, dst, []string{"base", "top"}))
+
+	assert.Equal(t, map[string]string{"base": "", "top": "base"}, dst.parents)
+	assert.Equal(t, map[string]string{"etc/base": "base content"}, tarContents(t, dst.diffs["base"]))
+	assert.Equal(t, map[string]string{"etc/top": "top content"}, tarContents(t, dst.diffs["top"]))
+}
+
+func TestMigrateSkipsExistingLayers(t *testing.T) {
+	src, _, cleanup := newVfsDriver(t)
+	defer cleanup()
+	require.NoError(t, src.Create("base", "", nil))
+	require.NoError(t, src.Create("top", "base", nil))
+
+	dst := newRecordingDriver()
+	require.NoError(t, dst.Create("base", "", nil))
+	require.NoError(t, graphdriver.Migrate(src, dst, []string{"base", "top"}))
+
+	assert.Equal(t, map[string]string{"base": "", "top": "base"}, dst.parents)
+	assert.NotContains(t, dst.diffs, "base")
+	assert.Contains(t, dst.diffs, "top")
+}
+
+func TestMigrateRemovesFailedLayer(t *testing.T) {
+	src, _, cleanup := newVfsDriver(t)
+	defer cleanup()
+
+	dst := newRecordingDriver()
+	err := graphdriver.Migrate(src, dst, []string{"missing"})
+	assert.Error(t, err)
+	assert.False(t, dst.Exists("missing"))
+}
@@ -0,0 +1,64 @@
+package graphdriver
+
+import (
+	"fmt"
+
+	"github.com/docker/docker/pkg/mount"
+)
+
+// MountAtDriver is the interface for drivers which can mount a layer at a
+// path chosen by the caller, e.g. to bind it into a container inspecting it,
+// rather than at the path Get returns.
+type MountAtDriver interface {
+	// GetAt mounts the layer id at target, an existing directory which is
+	// not a mount point. Each GetAt is to be balanced by a PutAt.
+	GetAt(id, mountLabel, target string) error
+	// PutAt unmounts the layer id from target.
+	PutAt(id, target string) error
+}
+
+// GetAt mounts the layer id of d at target if d supports it, and returns
+// ErrNotSupported otherwise.
+func GetAt(d ProtoDriver, id, mountLabel, target string) error {
+	if md, ok := d.(MountAtDriver); ok {
+		return md.GetAt(id, mountLabel, target)
+	}
+	return ErrNotSupported
+}
+
+// PutAt unmounts the layer id of d from target if d supports it, and
+// returns ErrNotSupported otherwise.
+func PutAt(d ProtoDriver, id, target string) error {
+	if md, ok := d.(MountAtDriver); ok {
+		return md.PutAt(id, target)
+	}
+	return ErrNotSupported
+}
+
+// BindLayer implements GetAt for the drivers whose layers are directories
+// once they are got: it gets the layer id of d and bind mounts it at target.
+func BindLayer(d ProtoDriver, id, mountLabel, target string) error {
+	if mounted, err := mount.Mounted(target); err != nil {
+		return err
+	} else if mounted {
+		return fmt.Errorf("cannot mount layer %s at %s: it is already a mount point", id, target)
+	}
+	dir, err := d.Get(id, mountLabel)
+	if err != nil {
+		return err
+	}
+	if err := mount.ForceMount(dir, target, "none", "bind"); err != nil {
+		d.Put(id)
+		return fmt.Errorf("cannot mount layer %s at %s: %v", id, target, err)
+	}
+	return nil
+}
+
+// UnbindLayer implements PutAt for the drivers using BindLayer: it unmounts
+// target and puts the layer id of d.
+func UnbindLayer(d ProtoDriver, id, target string) error {
+	if err := mount.Unmount(target); err != nil {
+		return err
+	}
+	return d.Put(id)
+}
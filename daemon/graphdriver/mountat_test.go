@@ -0,0 +1,52 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/pkg/mount"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetAt(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+	d, _, cleanup := newVfsDriver(t)
+	defer cleanup()
+	require.NoError(t, d.Create("layer", "", nil))
+	dir, err := d.Get("layer", "")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("content"), 0644))
+	require.NoError(t, d.Put("layer"))
+
+	target, err := ioutil.TempDir("", "graphdriver-getat")
+	require.NoError(t, err)
+	defer os.RemoveAll(target)
+
+	require.NoError(t, graphdriver.GetAt(d, "layer", "", target))
+	content, err := ioutil.ReadFile(filepath.Join(target, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(content))
+
+	// A target can only hold one layer at a time.
+	assert.Error(t, graphdriver.GetAt(d, "layer", "", target))
+
+	require.NoError(t, graphdriver.PutAt(d, "layer", target))
+	mounted, err := mount.Mounted(target)
+	require.NoError(t, err)
+	assert.False(t, mounted)
+	_, err = os.Stat(filepath.Join(target, "file"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestGetAtNotSupported(t *testing.T) {
+	assert.Equal(t, graphdriver.ErrNotSupported, graphdriver.GetAt(upgradeDriver{}, "layer", "", "/target"))
+	assert.Equal(t, graphdriver.ErrNotSupported, graphdriver.PutAt(upgradeDriver{}, "layer", "/target"))
+}
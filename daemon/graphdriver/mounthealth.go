@@ -0,0 +1,122 @@
+package graphdriver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// mountHealthStatTimeout is how long a mount may take to answer a stat
+// before it is considered stale, as stat blocks on some broken mounts.
+const mountHealthStatTimeout = 5 * time.Second
+
+// errNotMounted is reported for the active mounts which are not mounted
+// anymore.
+var errNotMounted = errors.New("not mounted anymore")
+
+// MountHealthCheck checks that the active mounts of a driver are still
+// usable, so that the containers running on top of a mount which went bad,
+// e.g. because its backing device failed, can be dealt with.
+type MountHealthCheck struct {
+	ctr     *RefCounter
+	checker Checker
+	notify  func(path string, err error)
+
+	mu    sync.Mutex
+	stale map[string]error
+}
+
+// NewMountHealthCheck returns a MountHealthCheck of the paths which are
+// active in ctr, using checker to check that they are still mounted. notify
+// is called once for every mount which goes bad.
+func NewMountHealthCheck(ctr *RefCounter, checker Checker, notify func(path string, err error)) *MountHealthCheck {
+	return &MountHealthCheck{
+		ctr:     ctr,
+		checker: checker,
+		notify:  notify,
+		stale:   make(map[string]error),
+	}
+}
+
+// Check checks the active mounts, notifies the ones which went bad since
+// the last check, and returns the paths of all the bad ones.
+func (h *MountHealthCheck) Check() []string {
+	active := h.ctr.Active()
+	stale := make(map[string]error)
+	for _, path := range active {
+		if err := checkMount(h.checker, path); err != nil {
+			stale[path] = err
+		}
+	}
+
+	h.mu.Lock()
+	var fresh []string
+	for path := range stale {
+		if _, known := h.stale[path]; !known {
+			fresh = append(fresh, path)
+		}
+	}
+	h.stale = stale
+	h.mu.Unlock()
+
+	sort.Strings(fresh)
+	for _, path := range fresh {
+		logrus.Errorf("[graphdriver] mount %s is stale: %v", path, stale[path])
+		if h.notify != nil {
+			h.notify(path, stale[path])
+		}
+	}
+
+	paths := make([]string, 0, len(stale))
+	for path := range stale {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Stale returns the number of bad mounts found by the last check.
+func (h *MountHealthCheck) Stale() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.stale)
+}
+
+// Run checks the active mounts every interval until stop is closed.
+func (h *MountHealthCheck) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.Check()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// checkMount returns an error if path is not mounted anymore, or if it
+// cannot be checked in time.
+func checkMount(checker Checker, path string) error {
+	errC := make(chan error, 1)
+	go func() {
+		if !checker.IsMounted(path) {
+			errC <- errNotMounted
+			return
+		}
+		_, err := os.Stat(path)
+		errC <- err
+	}()
+	select {
+	case err := <-errC:
+		return err
+	case <-time.After(mountHealthStatTimeout):
+		return fmt.Errorf("no answer within %v", mountHealthStatTimeout)
+	}
+}
@@ -0,0 +1,66 @@
+package graphdriver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeChecker map[string]bool
+
+func (c fakeChecker) IsMounted(path string) bool {
+	return c[path]
+}
+
+func TestMountHealthCheck(t *testing.T) {
+	root, err := ioutil.TempDir("", "graphdriver-mount-health")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	healthy := filepath.Join(root, "healthy")
+	unmounted := filepath.Join(root, "unmounted")
+	broken := filepath.Join(root, "broken")
+	released := filepath.Join(root, "released")
+	for _, dir := range []string{healthy, unmounted, broken, released} {
+		require.NoError(t, os.Mkdir(dir, 0755))
+	}
+	checker := fakeChecker{}
+	ctr := NewRefCounter(checker)
+	for _, dir := range []string{healthy, unmounted, broken, released} {
+		ctr.Increment(dir)
+		checker[dir] = true
+	}
+	ctr.Decrement(released)
+	checker[released] = false
+
+	notified := make(map[string]error)
+	h := NewMountHealthCheck(ctr, checker, func(path string, err error) {
+		notified[path] = err
+	})
+	assert.Empty(t, h.Check())
+	assert.Empty(t, notified)
+
+	// Simulate a mount which disappeared and one whose backing storage
+	// went away.
+	checker[unmounted] = false
+	require.NoError(t, os.Remove(broken))
+	assert.Equal(t, []string{broken, unmounted}, h.Check())
+	assert.Equal(t, 2, h.Stale())
+	assert.Equal(t, errNotMounted, notified[unmounted])
+	assert.True(t, os.IsNotExist(notified[broken]))
+
+	// Stale mounts are only notified once.
+	delete(notified, unmounted)
+	delete(notified, broken)
+	assert.Equal(t, []string{broken, unmounted}, h.Check())
+	assert.Empty(t, notified)
+
+	ctr.Decrement(unmounted)
+	ctr.Decrement(broken)
+	assert.Empty(t, h.Check())
+	assert.Equal(t, 0, h.Stale())
+}
@@ -0,0 +1,80 @@
+package graphdriver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/opencontainers/selinux/go-selinux/label"
+)
+
+// allocateMountLabel returns a mount label with an MCS level no container or
+// layer uses yet, from the allocator of the daemon, and an empty label when
+// SELinux is disabled. releaseMountLabel makes its level available again.
+var (
+	allocateMountLabel = func() (string, error) {
+		_, mountLabel, err := label.InitLabels(nil)
+		return mountLabel, err
+	}
+	releaseMountLabel = label.ReleaseLabel
+)
+
+// CreateWithUniqueLabel creates the read-write layer id of d like
+// CreateReadWrite, for a mount label with an MCS level of its own, so that
+// the processes of other containers cannot access its files even when they
+// run with the same SELinux type. opts.MountLabel is the template of the
+// label: the level of the allocated label replaces its own. An empty template
+// stands for the default label of containers. The label is returned, and
+// opts.MountLabel set to it; it is to be released with ReleaseMountLabel
+// once the layer is removed. When SELinux is disabled the template is used
+// as is.
+func CreateWithUniqueLabel(d ProtoDriver, id, parent string, opts *CreateOpts) (string, error) {
+	if opts == nil {
+		opts = &CreateOpts{}
+	}
+	allocated, err := allocateMountLabel()
+	if err != nil {
+		return "", err
+	}
+	mountLabel := opts.MountLabel
+	if allocated != "" {
+		if mountLabel, err = withLevel(opts.MountLabel, allocated); err != nil {
+			releaseMountLabel(allocated)
+			return "", err
+		}
+	}
+	if err := d.CreateReadWrite(id, parent, &CreateOpts{MountLabel: mountLabel, StorageOpt: opts.StorageOpt}); err != nil {
+		if allocated != "" {
+			releaseMountLabel(allocated)
+		}
+		return "", err
+	}
+	opts.MountLabel = mountLabel
+	return mountLabel, nil
+}
+
+// ReleaseMountLabel makes the MCS level of a label returned by
+// CreateWithUniqueLabel available again.
+func ReleaseMountLabel(mountLabel string) error {
+	if mountLabel == "" {
+		return nil
+	}
+	return releaseMountLabel(mountLabel)
+}
+
+// withLevel returns the SELinux label template, of the form
+// user:role:type[:level], with the level of allocated. The level, being
+// made of a sensitivity and categories, may itself hold colons.
+func withLevel(template, allocated string) (string, error) {
+	if template == "" {
+		return allocated, nil
+	}
+	fields := strings.SplitN(template, ":", 4)
+	if len(fields) < 3 {
+		return "", fmt.Errorf("invalid mount label template %q: it must be of the form user:role:type[:level]", template)
+	}
+	level := strings.SplitN(allocated, ":", 4)
+	if len(level) < 4 {
+		return "", fmt.Errorf("the allocated mount label %q has no level", allocated)
+	}
+	return strings.Join(append(fields[:3], level[3]), ":"), nil
+}
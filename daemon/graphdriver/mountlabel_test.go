@@ -0,0 +1,84 @@
+package graphdriver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// labelRecordingDriver is a Driver recording the mount labels its read-write
+// layers are created with.
+type labelRecordingDriver struct {
+	Driver
+	labels map[string]string
+	err    error
+}
+
+func (d *labelRecordingDriver) CreateReadWrite(id, parent string, opts *CreateOpts) error {
+	if d.err != nil {
+		return d.err
+	}
+	d.labels[id] = opts.MountLabel
+	return nil
+}
+
+// withFakeLabelAllocator makes the mount labels be allocated with increasing
+// categories, and returns the reserved levels and the function restoring the
+// allocator.
+func withFakeLabelAllocator() (map[string]bool, func()) {
+	allocate, release := allocateMountLabel, releaseMountLabel
+	reserved := make(map[string]bool)
+	next := 0
+	allocateMountLabel = func() (string, error) {
+		level := fmt.Sprintf("s0:c%d,c%d", next, next+1)
+		next += 2
+		reserved[level] = true
+		return "system_u:object_r:container_file_t:" + level, nil
+	}
+	releaseMountLabel = func(mountLabel string) error {
+		delete(reserved, strings.SplitN(mountLabel, ":", 4)[3])
+		return nil
+	}
+	return reserved, func() {
+		allocateMountLabel, releaseMountLabel = allocate, release
+	}
+}
+
+func TestCreateWithUniqueLabel(t *testing.T) {
+	reserved, restore := withFakeLabelAllocator()
+	defer restore()
+	d := &labelRecordingDriver{labels: make(map[string]string)}
+
+	opts := &CreateOpts{MountLabel: "system_u:object_r:svirt_sandbox_file_t:s0"}
+	first, err := CreateWithUniqueLabel(d, "first", "", opts)
+	require.NoError(t, err)
+	assert.Equal(t, "system_u:object_r:svirt_sandbox_file_t:s0:c0,c1", first)
+	assert.Equal(t, first, opts.MountLabel)
+
+	second, err := CreateWithUniqueLabel(d, "second", "", &CreateOpts{MountLabel: "system_u:object_r:svirt_sandbox_file_t:s0"})
+	require.NoError(t, err)
+	assert.Equal(t, "system_u:object_r:svirt_sandbox_file_t:s0:c2,c3", second)
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, map[string]string{"first": first, "second": second}, d.labels)
+
+	// Without a template, the label allocated is used as is.
+	third, err := CreateWithUniqueLabel(d, "third", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "system_u:object_r:container_file_t:s0:c4,c5", third)
+
+	require.NoError(t, ReleaseMountLabel(first))
+	assert.Equal(t, map[string]bool{"s0:c2,c3": true, "s0:c4,c5": true}, reserved)
+
+	// The level is released if the layer cannot be created.
+	d.err = errors.New("create failed")
+	_, err = CreateWithUniqueLabel(d, "failed", "", nil)
+	assert.EqualError(t, err, "create failed")
+	d.err = nil
+	_, err = CreateWithUniqueLabel(d, "invalid", "", &CreateOpts{MountLabel: "container_file_t"})
+	assert.EqualError(t, err, `invalid mount label template "container_file_t": it must be of the form user:role:type[:level]`)
+	assert.Equal(t, map[string]bool{"s0:c2,c3": true, "s0:c4,c5": true}, reserved)
+}
@@ -0,0 +1,180 @@
+package graphdriver
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// mountNamespace runs functions on an OS thread which has a mount namespace
+// of its own. Mounts made there do not propagate to the host and are
+// released by the kernel when the daemon exits, even if it crashes.
+type mountNamespace struct {
+	tid   int
+	calls chan func()
+	done  chan struct{}
+}
+
+func newMountNamespace() (*mountNamespace, error) {
+	ns := &mountNamespace{
+		calls: make(chan func()),
+		done:  make(chan struct{}),
+	}
+	errCh := make(chan error)
+	go func() {
+		runtime.LockOSThread()
+		if syscall.Gettid() == os.Getpid() {
+			// /proc/self shows the namespaces of the main thread to the
+			// whole process, so it must stay in those of the daemon. Hold
+			// it while the namespace is set up on another thread.
+			held := make(chan error)
+			go ns.serve(held)
+			err := <-held
+			runtime.UnlockOSThread()
+			errCh <- err
+			return
+		}
+		ns.serve(errCh)
+	}()
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// serve sets up the mount namespace on the current thread, reports the
+// result to errCh and then runs the calls made with run until it is closed.
+func (ns *mountNamespace) serve(errCh chan<- error) {
+	// The thread is never unlocked: once it left the namespace of the
+	// daemon, no other goroutine may be scheduled on it.
+	runtime.LockOSThread()
+	if err := syscall.Unshare(syscall.CLONE_NEWNS); err != nil {
+		errCh <- fmt.Errorf("failed to create a mount namespace: %v", err)
+		return
+	}
+	// Keep receiving the mounts of the host, but stop sending ours.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_SLAVE, ""); err != nil {
+		errCh <- fmt.Errorf("failed to make the mounts of the mount namespace slaves: %v", err)
+		return
+	}
+	ns.tid = syscall.Gettid()
+	errCh <- nil
+	for {
+		select {
+		case f := <-ns.calls:
+			f()
+		case <-ns.done:
+			return
+		}
+	}
+}
+
+// run calls f in the mount namespace and waits for it to return.
+func (ns *mountNamespace) run(f func()) {
+	called := make(chan struct{})
+	select {
+	case ns.calls <- func() {
+		defer close(called)
+		f()
+	}:
+		<-called
+	case <-ns.done:
+		f()
+	}
+}
+
+// path returns the path through which p, as seen from inside the mount
+// namespace, can be accessed from any other thread or process.
+func (ns *mountNamespace) path(p string) string {
+	return fmt.Sprintf("/proc/%d/task/%d/root%s", os.Getpid(), ns.tid, p)
+}
+
+func (ns *mountNamespace) close() {
+	close(ns.done)
+}
+
+// isolatedDriver wraps a Driver so that layers are mounted in a mount
+// namespace of their own.
+type isolatedDriver struct {
+	Driver
+	ns *mountNamespace
+}
+
+// isolatedDiffGetterDriver is an isolatedDriver which keeps the DiffGetter
+// method of the driver it wraps.
+type isolatedDiffGetterDriver struct {
+	*isolatedDriver
+	getter DiffGetterDriver
+}
+
+func (d *isolatedDiffGetterDriver) DiffGetter(id string) (FileGetCloser, error) {
+	return d.getter.DiffGetter(id)
+}
+
+// WithMountNamespace returns a Driver which mounts the layers of d in a
+// mount namespace of its own, so that they are not visible on the host. The
+// paths returned by Get lead into that namespace. If d does not implement
+// MountIsolationDriver or does not support it, d is returned unchanged. The
+// returned driver keeps the Capabilities and DiffGetter methods of d, if it
+// has them.
+func WithMountNamespace(d Driver) (Driver, error) {
+	md, ok := d.(MountIsolationDriver)
+	if !ok || !md.SupportsMountIsolation() {
+		logrus.Warnf("[graphdriver] %s does not support isolating its mounts, mounting layers on the host", d)
+		return d, nil
+	}
+	ns, err := newMountNamespace()
+	if err != nil {
+		return nil, err
+	}
+	id := &isolatedDriver{Driver: d, ns: ns}
+	if getter, ok := d.(DiffGetterDriver); ok {
+		return &isolatedDiffGetterDriver{isolatedDriver: id, getter: getter}, nil
+	}
+	return id, nil
+}
+
+// Capabilities returns the capabilities of the underlying driver.
+func (d *isolatedDriver) Capabilities() Capabilities {
+	if capDriver, ok := d.Driver.(CapabilityDriver); ok {
+		return capDriver.Capabilities()
+	}
+	return Capabilities{}
+}
+
+func (d *isolatedDriver) Get(id, mountLabel string) (dir string, err error) {
+	d.ns.run(func() {
+		dir, err = d.Driver.Get(id, mountLabel)
+	})
+	if err != nil {
+		return "", err
+	}
+	return d.ns.path(dir), nil
+}
+
+func (d *isolatedDriver) Put(id string) (err error) {
+	d.ns.run(func() {
+		err = d.Driver.Put(id)
+	})
+	return err
+}
+
+func (d *isolatedDriver) Remove(id string) (err error) {
+	d.ns.run(func() {
+		err = d.Driver.Remove(id)
+	})
+	return err
+}
+
+// Cleanup cleans up the underlying driver and releases the mount namespace,
+// along with any mount left in it.
+func (d *isolatedDriver) Cleanup() (err error) {
+	d.ns.run(func() {
+		err = d.Driver.Cleanup()
+	})
+	d.ns.close()
+	return err
+}
@@ -0,0 +1,54 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	_ "github.com/docker/docker/daemon/graphdriver/overlay2"
+	"github.com/docker/docker/pkg/mount"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsolatedMountsAreNotVisibleOnTheHost(t *testing.T) {
+	root, err := ioutil.TempDir("", "graphdriver-mountns")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	d, err := graphdriver.New("overlay2", nil, graphdriver.Options{Root: root, IsolateMounts: true})
+	if err != nil {
+		t.Skipf("overlay2 is not supported: %v", err)
+	}
+	defer d.Cleanup()
+	if md, ok := d.(graphdriver.MountIsolationDriver); ok && !md.SupportsMountIsolation() {
+		t.Skipf("%s does not support isolating its mounts", md)
+	}
+
+	require.NoError(t, d.Create("base", "", nil))
+	require.NoError(t, d.Create("layer", "base", nil))
+	dir, err := d.Get("layer", "")
+	require.NoError(t, err)
+
+	i := strings.Index(dir, root)
+	require.True(t, i > 0, "%s must lead into the mount namespace", dir)
+	hostDir := dir[i:]
+	mounted, err := mount.Mounted(hostDir)
+	require.NoError(t, err)
+	assert.False(t, mounted, "%s must not be mounted on the host", hostDir)
+
+	// The layer is usable through the returned path.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("isolated"), 0644))
+	content, err := ioutil.ReadFile(filepath.Join(root, "overlay2", "layer", "diff", "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "isolated", string(content))
+
+	require.NoError(t, d.Put("layer"))
+	require.NoError(t, d.Remove("layer"))
+	require.NoError(t, d.Remove("base"))
+}
@@ -0,0 +1,9 @@
+// +build !linux
+
+package graphdriver
+
+// WithMountNamespace returns d unchanged, as mount namespaces are not
+// supported on this platform.
+func WithMountNamespace(d Driver) (Driver, error) {
+	return d, nil
+}
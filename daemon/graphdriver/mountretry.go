@@ -0,0 +1,45 @@
+package graphdriver
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// MountRetry configures how a mount which fails with a transient error,
+// such as EBUSY on a busy host, is retried.
+type MountRetry struct {
+	// Retries is the number of attempts made after the first one failed.
+	Retries int
+	// Backoff is the delay before the first retry. It is doubled for
+	// every subsequent retry.
+	Backoff time.Duration
+}
+
+// DefaultMountRetry is the MountRetry used by drivers unless configured
+// otherwise.
+var DefaultMountRetry = MountRetry{Retries: 3, Backoff: 10 * time.Millisecond}
+
+// Mount calls mount until it succeeds, fails with an error which is not
+// transient or the retries are exhausted, and returns the last error.
+func (r MountRetry) Mount(mount func() error) error {
+	backoff := r.Backoff
+	for i := 0; ; i++ {
+		err := mount()
+		if err == nil || i >= r.Retries || !isTransientMountError(err) {
+			return err
+		}
+		logrus.Debugf("[graphdriver] mount failed with transient error, retrying in %v: %v", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isTransientMountError returns whether err is, or wraps, an errno for which
+// the mount may succeed when retried.
+func isTransientMountError(err error) bool {
+	errno, ok := errors.Cause(err).(syscall.Errno)
+	return ok && (errno == syscall.EBUSY || errno == syscall.EAGAIN || errno == syscall.EINTR)
+}
@@ -0,0 +1,57 @@
+package graphdriver
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMounter fails with err for the first failures calls.
+type fakeMounter struct {
+	failures int
+	err      error
+	calls    int
+}
+
+func (m *fakeMounter) mount() error {
+	m.calls++
+	if m.calls <= m.failures {
+		return m.err
+	}
+	return nil
+}
+
+func TestMountRetry(t *testing.T) {
+	retry := MountRetry{Retries: 3}
+	boom := errors.New("boom")
+	wrapped := errors.Wrap(syscall.EBUSY, "mountfrom re-exec error")
+	for _, testcase := range []struct {
+		name     string
+		mounter  *fakeMounter
+		calls    int
+		expected error
+	}{
+		{name: "success", mounter: &fakeMounter{}, calls: 1},
+		{name: "ebusy", mounter: &fakeMounter{failures: 2, err: syscall.EBUSY}, calls: 3},
+		{name: "eagain", mounter: &fakeMounter{failures: 3, err: syscall.EAGAIN}, calls: 4},
+		{name: "exhausted", mounter: &fakeMounter{failures: 5, err: syscall.EBUSY}, calls: 4, expected: syscall.EBUSY},
+		{name: "permanent errno", mounter: &fakeMounter{failures: 5, err: syscall.EINVAL}, calls: 1, expected: syscall.EINVAL},
+		{name: "eintr", mounter: &fakeMounter{failures: 1, err: syscall.EINTR}, calls: 2},
+		{name: "wrapped ebusy", mounter: &fakeMounter{failures: 2, err: wrapped}, calls: 3},
+		{name: "wrapped exhausted", mounter: &fakeMounter{failures: 5, err: wrapped}, calls: 4, expected: wrapped},
+		{name: "other error", mounter: &fakeMounter{failures: 5, err: boom}, calls: 1, expected: boom},
+	} {
+		err := retry.Mount(testcase.mounter.mount)
+		assert.Equal(t, testcase.expected, err, testcase.name)
+		assert.Equal(t, testcase.calls, testcase.mounter.calls, testcase.name)
+	}
+}
+
+func TestMountRetryDisabled(t *testing.T) {
+	m := &fakeMounter{failures: 1, err: syscall.EBUSY}
+	err := MountRetry{}.Mount(m.mount)
+	assert.Equal(t, syscall.EBUSY, err)
+	assert.Equal(t, 1, m.calls)
+}
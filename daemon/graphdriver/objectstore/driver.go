@@ -0,0 +1,305 @@
+// Package objectstore provides a storage driver which keeps the diffs of
+// layers in an S3-compatible object storage, and materializes them in a
+// local cache driver when they are used.
+package objectstore
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/docker/docker/pkg/locker"
+	"github.com/docker/docker/pkg/parsers"
+)
+
+const (
+	driverName = "objectstore"
+	// defaultCacheDriver is the driver the layers are materialized with
+	// unless the "objectstore.cache_driver" option is set.
+	defaultCacheDriver = "overlay2"
+	defaultRegion      = "us-east-1"
+)
+
+func init() {
+	graphdriver.Register(driverName, Init)
+}
+
+// Init returns a driver keeping the diffs of layers in the bucket set with
+// the "objectstore.bucket" option at the endpoint set with the
+// "objectstore.endpoint" option. Layers are materialized with the driver
+// set with the "objectstore.cache_driver" option, in home, which is passed
+// the options not prefixed with "objectstore.". Credentials are read from
+// the environment or the shared credentials file, like for the AWS CLI.
+// Without an endpoint, the driver is reported as not supported so that it
+// is skipped when a driver is picked automatically.
+func Init(home string, options []string, uidMaps, gidMaps []idtools.IDMap) (graphdriver.Driver, error) {
+	var (
+		endpoint, bucket string
+		region           = defaultRegion
+		cacheDriver      = defaultCacheDriver
+		opts             []string
+	)
+	for _, option := range options {
+		key, val, err := parsers.ParseKeyValueOpt(option)
+		if err != nil {
+			return nil, err
+		}
+		key = strings.ToLower(key)
+		switch {
+		case key == "objectstore.endpoint":
+			endpoint = val
+		case key == "objectstore.bucket":
+			bucket = val
+		case key == "objectstore.region":
+			region = val
+		case key == "objectstore.cache_driver":
+			cacheDriver = val
+		case strings.HasPrefix(key, "objectstore."):
+			return nil, fmt.Errorf("objectstore: Unknown option %s", key)
+		default:
+			opts = append(opts, option)
+		}
+	}
+	if endpoint == "" {
+		return nil, graphdriver.ErrNotSupported
+	}
+	if cacheDriver == driverName {
+		return nil, fmt.Errorf("objectstore: invalid cache driver %s", cacheDriver)
+	}
+
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvProvider{},
+		&credentials.SharedCredentialsProvider{},
+	})
+	store, err := NewS3Store(endpoint, bucket, region, creds)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := graphdriver.GetDriver(cacheDriver, nil, graphdriver.Options{
+		Root:          home,
+		DriverOptions: opts,
+		UIDMaps:       uidMaps,
+		GIDMaps:       gidMaps,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("objectstore: failed to initialize cache driver %s: %v", cacheDriver, err)
+	}
+	return NewDriver(cache, home, store), nil
+}
+
+// Driver keeps the diffs of read-only layers in a Store, and materializes
+// them with a cache driver on first use, so that the layers of a host can
+// be used on other hosts sharing the store. Read-write layers only exist
+// in the cache.
+type Driver struct {
+	graphdriver.Driver
+	home   string
+	store  Store
+	locker *locker.Locker
+}
+
+// NewDriver returns a Driver keeping the diffs of layers in store and
+// materializing them with cache. Diffs being uploaded are spooled in home.
+func NewDriver(cache graphdriver.Driver, home string, store Store) *Driver {
+	return &Driver{
+		Driver: cache,
+		home:   home,
+		store:  store,
+		locker: locker.New(),
+	}
+}
+
+// diffKey returns the key of the object holding the diff of the layer id.
+func diffKey(id string) string {
+	return path.Join("layers", id, "diff.tar")
+}
+
+// parentKey returns the key of the object holding the ID of the parent of
+// the layer id. It is written once the diff is, so that only complete
+// layers are found in the store.
+func parentKey(id string) string {
+	return path.Join("layers", id, "parent")
+}
+
+func (d *Driver) String() string {
+	return driverName
+}
+
+// Status returns the status of the cache driver with the store appended.
+func (d *Driver) Status() [][2]string {
+	return append([][2]string{
+		{"Object Storage", d.store.String()},
+		{"Cache Driver", d.Driver.String()},
+	}, d.Driver.Status()...)
+}
+
+// storedParent returns the parent of the layer id in the store.
+func (d *Driver) storedParent(id string) (string, error) {
+	rc, err := d.store.Get(parentKey(id))
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	parent, err := ioutil.ReadAll(rc)
+	return string(parent), err
+}
+
+// materialize creates the layer id and its parents in the cache driver
+// from their diffs in the store, unless they exist already.
+func (d *Driver) materialize(id string) error {
+	if id == "" {
+		return nil
+	}
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
+	if d.Driver.Exists(id) {
+		return nil
+	}
+
+	parent, err := d.storedParent(id)
+	if err == ErrObjectNotExist {
+		return fmt.Errorf("layer %s does not exist", id)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up layer %s in %s: %v", id, d.store, err)
+	}
+	if err := d.materialize(parent); err != nil {
+		return err
+	}
+
+	logrus.Debugf("[objectstore] materializing layer %s", id)
+	rc, err := d.store.Get(diffKey(id))
+	if err != nil {
+		return fmt.Errorf("failed to fetch layer %s from %s: %v", id, d.store, err)
+	}
+	defer rc.Close()
+	if err := d.Driver.Create(id, parent, nil); err != nil {
+		return err
+	}
+	if _, err := d.Driver.ApplyDiff(id, parent, rc); err != nil {
+		d.Driver.Remove(id)
+		return fmt.Errorf("failed to materialize layer %s: %v", id, err)
+	}
+	return nil
+}
+
+// Exists returns whether the layer id exists in the cache or in the store.
+func (d *Driver) Exists(id string) bool {
+	if d.Driver.Exists(id) {
+		return true
+	}
+	_, err := d.storedParent(id)
+	return err == nil
+}
+
+func (d *Driver) Create(id, parent string, opts *graphdriver.CreateOpts) error {
+	if err := d.materialize(parent); err != nil {
+		return err
+	}
+	return d.Driver.Create(id, parent, opts)
+}
+
+func (d *Driver) CreateReadWrite(id, parent string, opts *graphdriver.CreateOpts) error {
+	if err := d.materialize(parent); err != nil {
+		return err
+	}
+	return d.Driver.CreateReadWrite(id, parent, opts)
+}
+
+// Remove removes the layer id from the cache and from the store.
+func (d *Driver) Remove(id string) error {
+	if d.Driver.Exists(id) {
+		if err := d.Driver.Remove(id); err != nil {
+			return err
+		}
+	}
+	// The parent is removed first, so that a partially removed layer is
+	// not found in the store.
+	if err := d.store.Delete(parentKey(id)); err != nil {
+		return fmt.Errorf("failed to remove layer %s from %s: %v", id, d.store, err)
+	}
+	if err := d.store.Delete(diffKey(id)); err != nil {
+		return fmt.Errorf("failed to remove layer %s from %s: %v", id, d.store, err)
+	}
+	return nil
+}
+
+// Get materializes the layer id and its parents if needed, and mounts it.
+func (d *Driver) Get(id, mountLabel string) (string, error) {
+	if err := d.materialize(id); err != nil {
+		return "", err
+	}
+	return d.Driver.Get(id, mountLabel)
+}
+
+func (d *Driver) GetMetadata(id string) (map[string]string, error) {
+	if err := d.materialize(id); err != nil {
+		return nil, err
+	}
+	return d.Driver.GetMetadata(id)
+}
+
+// ApplyDiff applies diff to the layer id in the cache, and uploads it to
+// the store.
+func (d *Driver) ApplyDiff(id, parent string, diff io.Reader) (int64, error) {
+	f, err := ioutil.TempFile(d.home, "upload-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	tee := io.TeeReader(diff, f)
+	size, err := d.Driver.ApplyDiff(id, parent, tee)
+	if err != nil {
+		return 0, err
+	}
+	// The padding at the end of the archive is not read by ApplyDiff.
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return 0, err
+	}
+
+	if err := d.store.Put(diffKey(id), f); err != nil {
+		return 0, fmt.Errorf("failed to upload layer %s to %s: %v", id, d.store, err)
+	}
+	if err := d.store.Put(parentKey(id), strings.NewReader(parent)); err != nil {
+		return 0, fmt.Errorf("failed to upload layer %s to %s: %v", id, d.store, err)
+	}
+	return size, nil
+}
+
+// Diff returns the diff of the layer id from the store if it was uploaded
+// on top of parent, and from the cache otherwise.
+func (d *Driver) Diff(id, parent string) (io.ReadCloser, error) {
+	if stored, err := d.storedParent(id); err == nil && stored == parent {
+		if rc, err := d.store.Get(diffKey(id)); err == nil {
+			return rc, nil
+		}
+	}
+	if err := d.materialize(id); err != nil {
+		return nil, err
+	}
+	return d.Driver.Diff(id, parent)
+}
+
+func (d *Driver) Changes(id, parent string) ([]archive.Change, error) {
+	if err := d.materialize(id); err != nil {
+		return nil, err
+	}
+	return d.Driver.Changes(id, parent)
+}
+
+func (d *Driver) DiffSize(id, parent string) (int64, error) {
+	if err := d.materialize(id); err != nil {
+		return 0, err
+	}
+	return d.Driver.DiffSize(id, parent)
+}
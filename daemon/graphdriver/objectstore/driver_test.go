@@ -0,0 +1,139 @@
+// +build linux
+
+package objectstore
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/daemon/graphdriver/vfs"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is an in-memory S3-compatible endpoint serving a single bucket.
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		http.Error(w, "unsigned request", http.StatusForbidden)
+		return
+	}
+	prefix := "/" + s.bucket + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, prefix)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.objects[key] = data
+	case http.MethodGet:
+		data, ok := s.objects[key]
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestStore(t *testing.T) (*fakeS3, Store, func()) {
+	fake := &fakeS3{bucket: "layers", objects: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	store, err := NewS3Store(server.URL, fake.bucket, defaultRegion, credentials.NewStaticCredentials("id", "secret", ""))
+	require.NoError(t, err)
+	return fake, store, server.Close
+}
+
+func newTestDriver(t *testing.T, store Store) (*Driver, func()) {
+	home, err := ioutil.TempDir("", "objectstore-test")
+	require.NoError(t, err)
+	cache, err := vfs.Init(filepath.Join(home, "vfs"), nil, nil, nil)
+	require.NoError(t, err)
+	return NewDriver(cache, home, store), func() { os.RemoveAll(home) }
+}
+
+func TestLayerRoundTrip(t *testing.T) {
+	fake, store, closeStore := newTestStore(t)
+	defer closeStore()
+
+	d1, cleanup1 := newTestDriver(t, store)
+	defer cleanup1()
+	require.NoError(t, d1.Create("base", "", nil))
+	diff, err := archive.Generate("file", "base content")
+	require.NoError(t, err)
+	_, err = d1.ApplyDiff("base", "", diff)
+	require.NoError(t, err)
+	require.NoError(t, d1.Create("top", "base", nil))
+	diff, err = archive.Generate("dir/other", "top content")
+	require.NoError(t, err)
+	_, err = d1.ApplyDiff("top", "base", diff)
+	require.NoError(t, err)
+	assert.Contains(t, fake.objects, "layers/top/diff.tar")
+	assert.Equal(t, "base", string(fake.objects["layers/top/parent"]))
+
+	// A driver with an empty cache materializes the layers from the store.
+	d2, cleanup2 := newTestDriver(t, store)
+	defer cleanup2()
+	assert.True(t, d2.Exists("top"))
+	assert.False(t, d2.Exists("missing"))
+	dir, err := d2.Get("top", "")
+	require.NoError(t, err)
+	for name, expected := range map[string]string{"file": "base content", "dir/other": "top content"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+	require.NoError(t, d2.Put("top"))
+
+	rc, err := d2.Diff("top", "base")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	assert.Equal(t, fake.objects["layers/top/diff.tar"], data)
+
+	require.NoError(t, d2.Remove("top"))
+	assert.NotContains(t, fake.objects, "layers/top/diff.tar")
+	assert.NotContains(t, fake.objects, "layers/top/parent")
+	_, err = d2.Get("top", "")
+	assert.Error(t, err)
+}
+
+func TestInitWithoutEndpointIsNotSupported(t *testing.T) {
+	home, err := ioutil.TempDir("", "objectstore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	_, err = Init(home, []string{"objectstore.bucket=layers"}, nil, nil)
+	assert.Equal(t, graphdriver.ErrNotSupported, err)
+	_, err = Init(home, []string{"objectstore.endpoint=http://localhost", "objectstore.unknown=1"}, nil, nil)
+	assert.Error(t, err)
+}
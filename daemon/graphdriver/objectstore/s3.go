@@ -0,0 +1,132 @@
+package objectstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// ErrObjectNotExist is returned by a Store for objects which do not exist.
+var ErrObjectNotExist = errors.New("object does not exist")
+
+// Store is the object storage the diffs of layers are kept in.
+type Store interface {
+	// Put writes body as the content of the object key.
+	Put(key string, body io.ReadSeeker) error
+	// Get returns the content of the object key.
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the object key. Deleting an object which does not
+	// exist is not an error.
+	Delete(key string) error
+	// String returns a description of the store for docker info.
+	String() string
+}
+
+// s3Store is a Store keeping objects in a bucket of an S3-compatible
+// endpoint, addressed in path style, e.g. https://endpoint/bucket/key.
+type s3Store struct {
+	client   *http.Client
+	endpoint *url.URL
+	bucket   string
+	region   string
+	signer   *v4.Signer
+}
+
+// NewS3Store returns a Store keeping objects in bucket at the S3-compatible
+// endpoint, signing requests for region with creds.
+func NewS3Store(endpoint, bucket, region string, creds *credentials.Credentials) (Store, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object storage endpoint %s: %v", endpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid object storage endpoint %s: only http and https are supported", endpoint)
+	}
+	if bucket == "" || strings.Contains(bucket, "/") {
+		return nil, fmt.Errorf("invalid object storage bucket %q", bucket)
+	}
+	return &s3Store{
+		client:   &http.Client{},
+		endpoint: u,
+		bucket:   bucket,
+		region:   region,
+		signer:   v4.NewSigner(creds, func(s *v4.Signer) { s.DisableURIPathEscaping = true }),
+	}, nil
+}
+
+func (s *s3Store) String() string {
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(s.endpoint.String(), "/"), s.bucket)
+}
+
+// do sends a signed request for the object key and returns the response
+// if its status is successful.
+func (s *s3Store) do(method, key string, body io.ReadSeeker) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = path.Join("/", u.Path, s.bucket, key)
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		size, err := body.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
+	}
+	if _, err := s.signer.Sign(req, body, "s3", s.region, time.Now()); err != nil {
+		return nil, fmt.Errorf("failed to sign request for %s: %v", key, err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrObjectNotExist
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("%s %s: unexpected status %s: %s", method, key, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func (s *s3Store) Put(key string, body io.ReadSeeker) error {
+	resp, err := s.do(http.MethodPut, key, body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *s3Store) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Store) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil)
+	if err == ErrObjectNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,74 @@
+package graphdriver
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/docker/docker/pkg/ioutils"
+	"github.com/opencontainers/go-digest"
+)
+
+// OCILayerExporter is the interface for drivers which can export the diff
+// of a layer as an OCI layer blob of media type
+// application/vnd.oci.image.layer.v1.tar+gzip without going through Diff,
+// e.g. because they keep the compressed diffs of their layers.
+type OCILayerExporter interface {
+	// ExportOCILayer returns the gzip-compressed diff of the layer id
+	// against parent, with the digests of the blob and of the uncompressed
+	// diff, its diffID.
+	ExportOCILayer(id, parent string) (blob io.ReadCloser, blobDigest, diffID digest.Digest, err error)
+}
+
+// ExportOCILayer returns the diff of the layer id of d against parent as an
+// OCI layer blob, with the digests of the blob and of the uncompressed diff.
+// Drivers which do not implement OCILayerExporter have their Diff exported
+// by ExportOCIDiff.
+func ExportOCILayer(d Driver, id, parent string) (io.ReadCloser, digest.Digest, digest.Digest, error) {
+	if ed, ok := d.(OCILayerExporter); ok {
+		return ed.ExportOCILayer(id, parent)
+	}
+	diff, err := d.Diff(id, parent)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return ExportOCIDiff(diff)
+}
+
+// ExportOCIDiff compresses the uncompressed diff as an OCI layer blob and
+// returns it, with its digest and the one of diff, computed while the diff
+// is read, so that it is read only once. The blob is kept in a temporary
+// file until it is closed. ExportOCIDiff closes diff.
+func ExportOCIDiff(diff io.ReadCloser) (blob io.ReadCloser, blobDigest, diffID digest.Digest, err error) {
+	defer diff.Close()
+
+	f, err := ioutil.TempFile("", "graphdriver-oci-layer")
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	blobDigester := digest.Canonical.Digester()
+	diffIDDigester := digest.Canonical.Digester()
+	gz := gzip.NewWriter(io.MultiWriter(f, blobDigester.Hash()))
+	if _, err = io.Copy(io.MultiWriter(gz, diffIDDigester.Hash()), diff); err != nil {
+		return nil, "", "", err
+	}
+	if err = gz.Close(); err != nil {
+		return nil, "", "", err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return nil, "", "", err
+	}
+	blob = ioutils.NewReadCloserWrapper(f, func() error {
+		f.Close()
+		return os.Remove(f.Name())
+	})
+	return blob, blobDigester.Digest(), diffIDDigester.Digest(), nil
+}
@@ -0,0 +1,61 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportOCILayer(t *testing.T) {
+	d, _, cleanup := newVfsDriver(t)
+	defer cleanup()
+	require.NoError(t, d.Create("base", "", nil))
+	require.NoError(t, d.Create("layer", "base", nil))
+	dir, err := d.Get("layer", "")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte(strings.Repeat("content", 1000)), 0644))
+	require.NoError(t, d.Put("layer"))
+
+	blob, blobDigest, diffID, err := graphdriver.ExportOCILayer(d, "layer", "base")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(blob)
+	require.NoError(t, err)
+	require.NoError(t, blob.Close())
+
+	assert.Equal(t, digest.FromBytes(data), blobDigest)
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	diff, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromBytes(diff), diffID)
+
+	assert.Equal(t, map[string]string{"file": strings.Repeat("content", 1000)}, tarContents(t, diff))
+}
+
+// exporterDriver is a Driver exporting fixed OCI layer blobs.
+type exporterDriver struct {
+	graphdriver.Driver
+}
+
+func (exporterDriver) ExportOCILayer(id, parent string) (io.ReadCloser, digest.Digest, digest.Digest, error) {
+	return ioutil.NopCloser(strings.NewReader("blob")), digest.FromString("blob"), digest.FromString("diff"), nil
+}
+
+func TestExportOCILayerUsesExporter(t *testing.T) {
+	blob, blobDigest, diffID, err := graphdriver.ExportOCILayer(exporterDriver{}, "layer", "")
+	require.NoError(t, err)
+	defer blob.Close()
+	assert.Equal(t, digest.FromString("blob"), blobDigest)
+	assert.Equal(t, digest.FromString("diff"), diffID)
+}
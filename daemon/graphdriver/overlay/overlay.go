@@ -4,23 +4,26 @@ package overlay
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
-	"strconv"
+	"path/filepath"
 	"syscall"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/daemon/graphdriver/copy"
 	"github.com/docker/docker/daemon/graphdriver/overlayutils"
 	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/docker/pkg/fsutils"
 	"github.com/docker/docker/pkg/idtools"
 	"github.com/docker/docker/pkg/locker"
 	"github.com/docker/docker/pkg/mount"
+	"github.com/docker/docker/pkg/parsers/kernel"
 	"github.com/docker/docker/pkg/system"
 	"github.com/opencontainers/selinux/go-selinux/label"
 )
@@ -64,6 +67,16 @@ func (d *naiveDiffDriverWithApply) ApplyDiff(id, parent string, diff io.Reader)
 	return b, err
 }
 
+// StatusJSON returns the status document of the overlay driver.
+func (d *naiveDiffDriverWithApply) StatusJSON() ([]byte, error) {
+	return graphdriver.StatusJSON(d.Driver)
+}
+
+// Diagnostics writes the diagnostics bundle of the overlay driver to w.
+func (d *naiveDiffDriverWithApply) Diagnostics(w io.Writer) error {
+	return graphdriver.Diagnostics(d.Driver, w)
+}
+
 // This backend uses the overlay union filesystem for containers
 // plus hard link file sharing for images.
 
@@ -100,6 +113,8 @@ type Driver struct {
 	ctr           *graphdriver.RefCounter
 	supportsDType bool
 	locker        *locker.Locker
+	// errors keeps the last errors of the driver for its diagnostics.
+	errors graphdriver.ErrorLog
 }
 
 func init() {
@@ -119,9 +134,7 @@ func Init(home string, options []string, uidMaps, gidMaps []idtools.IDMap) (grap
 	if err != nil {
 		return nil, err
 	}
-	if fsName, ok := graphdriver.FsNames[fsMagic]; ok {
-		backingFs = fsName
-	}
+	backingFs = graphdriver.FsName(fsMagic)
 
 	switch fsMagic {
 	case graphdriver.FsMagicAufs, graphdriver.FsMagicBtrfs, graphdriver.FsMagicOverlay, graphdriver.FsMagicZfs, graphdriver.FsMagicEcryptfs:
@@ -138,17 +151,18 @@ func Init(home string, options []string, uidMaps, gidMaps []idtools.IDMap) (grap
 		return nil, err
 	}
 
-	if err := mount.MakePrivate(home); err != nil {
-		return nil, err
-	}
-
+	// Checked before the home directory is mounted, so that nothing is left
+	// behind when another driver is tried instead.
 	supportsDType, err := fsutils.SupportsDType(home)
 	if err != nil {
 		return nil, err
 	}
 	if !supportsDType {
-		// not a fatal error until v17.12 (#27443)
-		logrus.Warn(overlayutils.ErrDTypeNotSupported("overlay", backingFs))
+		return nil, overlayutils.ErrDTypeNotSupported("overlay", backingFs)
+	}
+
+	if err := mount.MakePrivate(home); err != nil {
+		return nil, err
 	}
 
 	d := &Driver{
@@ -189,12 +203,67 @@ func (d *Driver) String() string {
 }
 
 // Status returns current driver information in a two dimensional string array.
-// Output contains "Backing Filesystem" used in this implementation.
+// Output contains "Backing Filesystem" used in this implementation, followed
+// by the features listed in graphdriver.StatusFeatureKeys.
 func (d *Driver) Status() [][2]string {
-	return [][2]string{
-		{"Backing Filesystem", backingFs},
-		{"Supports d_type", strconv.FormatBool(d.supportsDType)},
+	features := graphdriver.FeatureStatus{SupportsDType: d.supportsDType}
+	return append([][2]string{{"Backing Filesystem", backingFs}}, features.Status()...)
+}
+
+// StatusJSON returns the status document of the driver. The driver is not
+// healthy if its home directory is not accessible or if some of its active
+// mounts went away.
+func (d *Driver) StatusJSON() ([]byte, error) {
+	problems := graphdriver.CheckHome(d.home)
+	check := graphdriver.NewMountHealthCheck(d.ctr, graphdriver.NewFsChecker(graphdriver.FsMagicOverlay), nil)
+	for _, path := range check.Check() {
+		problems = append(problems, fmt.Sprintf("mount %s is stale", path))
+	}
+	return graphdriver.StatusDocument{
+		Driver:            d.String(),
+		Home:              d.home,
+		BackingFilesystem: backingFs,
+		Features:          graphdriver.FeatureStatus{SupportsDType: d.supportsDType},
+		Problems:          problems,
+	}.JSON()
+}
+
+// Diagnostics writes the diagnostics bundle of the driver to w. Besides the
+// files common to all the drivers, it holds overlay.txt, which tells what
+// the kernel supports of overlay.
+func (d *Driver) Diagnostics(w io.Writer) error {
+	files := graphdriver.CommonDiagnostics(d, d.home, &d.errors)
+	files = append(files, graphdriver.DiagnosticsFile{Name: "overlay.txt", Data: overlayDiagnostics()})
+	return graphdriver.WriteDiagnostics(w, files)
+}
+
+// overlayDiagnostics probes the support of overlay by the kernel: its
+// version, whether overlay is a known filesystem, and the parameters of the
+// overlay module.
+func overlayDiagnostics() []byte {
+	var buf bytes.Buffer
+	if v, err := kernel.GetKernelVersion(); err != nil {
+		fmt.Fprintf(&buf, "kernel: error: %v\n", err)
+	} else {
+		fmt.Fprintf(&buf, "kernel: %s\n", v)
+	}
+
+	if data, err := ioutil.ReadFile("/proc/filesystems"); err != nil {
+		fmt.Fprintf(&buf, "filesystem: error: %v\n", err)
+	} else {
+		fmt.Fprintf(&buf, "filesystem: %t\n", bytes.Contains(data, []byte("\toverlay\n")))
+	}
+
+	params, _ := filepath.Glob("/sys/module/overlay/parameters/*")
+	for _, param := range params {
+		value, err := ioutil.ReadFile(param)
+		if err != nil {
+			fmt.Fprintf(&buf, "%s: error: %v\n", filepath.Base(param), err)
+			continue
+		}
+		fmt.Fprintf(&buf, "%s: %s\n", filepath.Base(param), bytes.TrimSpace(value))
 	}
+	return buf.Bytes()
 }
 
 // GetMetadata returns meta data about the overlay driver such as root, LowerDir, UpperDir, WorkDir and MergeDir used to store data.
@@ -264,6 +333,7 @@ func (d *Driver) Create(id, parent string, opts *graphdriver.CreateOpts) (retErr
 		// Clean up on failure
 		if retErr != nil {
 			os.RemoveAll(dir)
+			d.errors.Record("create "+id, retErr)
 		}
 	}()
 
@@ -329,7 +399,7 @@ func (d *Driver) Create(id, parent string, opts *graphdriver.CreateOpts) (retErr
 		return err
 	}
 
-	return copyDir(parentUpperDir, upperDir, 0)
+	return copy.DirCopy(parentUpperDir, upperDir, 0)
 }
 
 func (d *Driver) dir(id string) string {
@@ -365,6 +435,7 @@ func (d *Driver) Get(id string, mountLabel string) (s string, err error) {
 			if c := d.ctr.Decrement(mergedDir); c <= 0 {
 				syscall.Unmount(mergedDir, 0)
 			}
+			d.errors.Record("get "+id, err)
 		}
 	}()
 	lowerID, err := ioutil.ReadFile(path.Join(dir, "lower-id"))
@@ -445,7 +516,7 @@ func (d *Driver) ApplyDiff(id string, parent string, diff io.Reader) (size int64
 		}
 	}()
 
-	if err = copyDir(parentRootDir, tmpRootDir, copyHardlink); err != nil {
+	if err = copy.DirCopy(parentRootDir, tmpRootDir, copy.Hardlink); err != nil {
 		return 0, err
 	}
 
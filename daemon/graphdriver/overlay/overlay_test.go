@@ -50,6 +50,10 @@ func TestOverlayChanges(t *testing.T) {
 	graphtest.DriverTestChanges(t, "overlay")
 }
 
+func TestOverlayStatusFeatures(t *testing.T) {
+	graphtest.DriverTestStatusFeatures(t, "overlay")
+}
+
 func TestOverlayTeardown(t *testing.T) {
 	graphtest.PutDriver(t)
 }
@@ -0,0 +1,190 @@
+// +build linux
+
+package overlay2
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/docker/docker/pkg/parsers/kernel"
+)
+
+// Read-only layers can be backed by composefs images: the metadata of the
+// layer is stored in an erofs image referencing the file contents by their
+// fs-verity digest, and the layer is mounted with the image verified against
+// the digest recorded when the layer was applied. Modifying the image or the
+// contents of the layer then makes the mount or the reads fail.
+const (
+	composefsImage   = "composefs.cfs"
+	composefsDigest  = "composefs.digest"
+	composefsObjects = "composefs-objects"
+	composefsMount   = "composefs"
+
+	// fsIocEnableVerity is FS_IOC_ENABLE_VERITY from linux/fsverity.h.
+	fsIocEnableVerity = 0x40806685
+)
+
+// fsverityEnableArg is struct fsverity_enable_arg from linux/fsverity.h.
+type fsverityEnableArg struct {
+	version       uint32
+	hashAlgorithm uint32
+	blockSize     uint32
+	saltSize      uint32
+	saltPtr       uint64
+	sigSize       uint32
+	reserved1     uint32
+	sigPtr        uint64
+	reserved2     [11]uint64
+}
+
+// composefsSupported returns an error if layers cannot be backed by
+// composefs images on this host.
+func composefsSupported() error {
+	for _, tool := range []string{"mkcomposefs", "mount.composefs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("%s is not installed", tool)
+		}
+	}
+	// Data-only lower layers and fs-verity validation of overlay were added
+	// in kernel 6.6.
+	v, err := kernel.GetKernelVersion()
+	if err != nil {
+		return err
+	}
+	if kernel.CompareKernelVersion(*v, kernel.VersionInfo{Kernel: 6, Major: 6, Minor: 0}) < 0 {
+		return fmt.Errorf("kernel 6.6 or later is required")
+	}
+	return nil
+}
+
+// createComposefsImage creates the composefs image of the diff of the layer
+// in dir, and records the digest it is verified against when mounted.
+func createComposefsImage(dir string) error {
+	image := path.Join(dir, composefsImage)
+	cmd := exec.Command("mkcomposefs", "--digest-store="+path.Join(dir, composefsObjects), "--print-digest", path.Join(dir, "diff"), image)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("failed to create the composefs image of %s: %v: %s", dir, err, stderr.String())
+	}
+	if err := enableVerity(image); err != nil {
+		return fmt.Errorf("failed to enable fs-verity on %s: %v", image, err)
+	}
+	return ioutil.WriteFile(path.Join(dir, composefsDigest), []byte(strings.TrimSpace(string(out))), 0600)
+}
+
+// enableVerity enables fs-verity on the file at p, with the parameters
+// mkcomposefs computes digests with.
+func enableVerity(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	arg := fsverityEnableArg{
+		version:       1,
+		hashAlgorithm: 1, // FS_VERITY_HASH_ALG_SHA256
+		blockSize:     4096,
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocEnableVerity, uintptr(unsafe.Pointer(&arg))); errno != 0 && errno != syscall.EEXIST {
+		return errno
+	}
+	return nil
+}
+
+// hasComposefsImage returns whether the layer in dir is backed by a
+// composefs image.
+func hasComposefsImage(dir string) bool {
+	_, err := os.Stat(path.Join(dir, composefsDigest))
+	return err == nil
+}
+
+// mountComposefs mounts the composefs image of the layer in dir, verified
+// against its recorded digest, and returns the mount point. Mounts are
+// reference counted, as a layer is the lower layer of many others.
+func (d *Driver) mountComposefs(dir string) (string, error) {
+	mnt := path.Join(dir, composefsMount)
+	if count := d.ctr.Increment(mnt); count > 1 {
+		return mnt, nil
+	}
+	digest, err := ioutil.ReadFile(path.Join(dir, composefsDigest))
+	if err != nil {
+		d.ctr.Decrement(mnt)
+		return "", err
+	}
+	if err := os.MkdirAll(mnt, 0700); err != nil {
+		d.ctr.Decrement(mnt)
+		return "", err
+	}
+	opts := fmt.Sprintf("basedir=%s,digest=%s,verity", path.Join(dir, composefsObjects), digest)
+	if out, err := exec.Command("mount", "-t", "composefs", "-o", opts, path.Join(dir, composefsImage), mnt).CombinedOutput(); err != nil {
+		d.ctr.Decrement(mnt)
+		return "", fmt.Errorf("failed to mount the composefs image of %s: %v: %s", dir, err, out)
+	}
+	return mnt, nil
+}
+
+// unmountComposefs releases a mount made by mountComposefs.
+func (d *Driver) unmountComposefs(dir string) {
+	mnt := path.Join(dir, composefsMount)
+	if count := d.ctr.Decrement(mnt); count > 0 {
+		return
+	}
+	syscall.Unmount(mnt, syscall.MNT_DETACH)
+}
+
+// composefsLowers returns the directories of the layers backed by composefs
+// images among lowers, as listed in the lower file.
+func (d *Driver) composefsLowers(lowers []string) ([]string, error) {
+	var dirs []string
+	for _, l := range lowers {
+		target, err := os.Readlink(path.Join(d.home, l))
+		if err != nil {
+			return nil, err
+		}
+		// Links point to the diff directory of the layer.
+		dir := path.Dir(path.Join(d.home, linkDir, target))
+		if hasComposefsImage(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, nil
+}
+
+// mountComposefsLowers mounts the composefs images of the layers backed by
+// one among lowers, as listed in the lower file, and replaces them in lowers
+// by their mount points, relative to the home of the driver. It returns the
+// directories of the layers whose images were mounted.
+func (d *Driver) mountComposefsLowers(lowers []string) (mounted []string, err error) {
+	defer func() {
+		if err != nil {
+			for _, dir := range mounted {
+				d.unmountComposefs(dir)
+			}
+		}
+	}()
+	for i, l := range lowers {
+		target, err := os.Readlink(path.Join(d.home, l))
+		if err != nil {
+			return mounted, err
+		}
+		dir := path.Dir(path.Join(d.home, linkDir, target))
+		if !hasComposefsImage(dir) {
+			continue
+		}
+		if _, err := d.mountComposefs(dir); err != nil {
+			return mounted, err
+		}
+		mounted = append(mounted, dir)
+		lowers[i] = path.Join(path.Base(dir), composefsMount)
+	}
+	return mounted, nil
+}
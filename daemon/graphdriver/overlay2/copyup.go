@@ -0,0 +1,81 @@
+// +build linux
+
+package overlay2
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/symlink"
+	"github.com/pkg/errors"
+)
+
+// copyUpWorkers is the number of files copied up concurrently.
+const copyUpWorkers = 8
+
+// copyUpPaths copies up the regular files at paths, relative to the root of
+// the layer id, from its lower layers to its diff directory, rather than
+// leaving the kernel to copy each of them up on its first write, e.g. when
+// a container starts. The files below a directory are all copied up, and
+// paths which do not exist in the layer are skipped.
+func (d *Driver) copyUpPaths(id string, paths []string) (retErr error) {
+	mnt, err := d.Get(id, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := d.Put(id); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	var files []string
+	for _, p := range paths {
+		full, err := symlink.FollowSymlinkInScope(filepath.Join(mnt, p), mnt)
+		if err != nil {
+			return err
+		}
+		err = filepath.Walk(full, func(p string, fi os.FileInfo, err error) error {
+			if os.IsNotExist(err) && p == full {
+				logrus.Debugf("overlay2: not copying up %s in layer %s: it does not exist", p, id)
+				return nil
+			}
+			if err == nil && fi.Mode().IsRegular() {
+				files = append(files, p)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// The kernel copies a file up when it is opened for writing, without
+	// the file being changed.
+	work := make(chan string)
+	errs := make(chan error, len(files))
+	var wg sync.WaitGroup
+	for i := 0; i < copyUpWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range work {
+				f, err := os.OpenFile(p, os.O_WRONLY, 0)
+				if err != nil {
+					errs <- errors.Wrapf(err, "failed to copy up %s", p)
+					continue
+				}
+				f.Close()
+			}
+		}()
+	}
+	for _, p := range files {
+		work <- p
+	}
+	close(work)
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
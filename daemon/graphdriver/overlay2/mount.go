@@ -9,9 +9,12 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/docker/docker/pkg/reexec"
+	"github.com/pkg/errors"
 )
 
 func init() {
@@ -46,8 +49,11 @@ func mountFrom(dir, device, target, mType string, flags uintptr, label string) e
 		return fmt.Errorf("mountfrom error on pipe creation: %v", err)
 	}
 
+	// The child writes the errno of a failed mount to stdout, so that
+	// the error can be told apart, e.g. to retry transient ones.
+	errnoOutput := bytes.NewBuffer(nil)
 	output := bytes.NewBuffer(nil)
-	cmd.Stdout = output
+	cmd.Stdout = errnoOutput
 	cmd.Stderr = output
 
 	if err := cmd.Start(); err != nil {
@@ -60,6 +66,9 @@ func mountFrom(dir, device, target, mType string, flags uintptr, label string) e
 	w.Close()
 
 	if err := cmd.Wait(); err != nil {
+		if errno, perr := strconv.Atoi(strings.TrimSpace(errnoOutput.String())); perr == nil && errno > 0 {
+			return errors.Wrapf(syscall.Errno(errno), "mountfrom re-exec error: %v: output: %s", err, output)
+		}
 		return fmt.Errorf("mountfrom re-exec error: %v: output: %s", err, output)
 	}
 	return nil
@@ -81,6 +90,9 @@ func mountFromMain() {
 	}
 
 	if err := syscall.Mount(options.Device, options.Target, options.Type, uintptr(options.Flag), options.Label); err != nil {
+		if errno, ok := err.(syscall.Errno); ok {
+			fmt.Fprint(os.Stdout, int(errno))
+		}
 		fatal(err)
 	}
 
@@ -4,7 +4,6 @@ package overlay2
 
 import (
 	"bufio"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -16,6 +15,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 
@@ -55,7 +55,8 @@ var (
 // changes to the layer. The "lower" file contains all the lower layer
 // mounts separated by ":" and ordered from uppermost to lowermost
 // layers. The overlay itself is mounted in the "merged" directory,
-// and the "work" dir is needed for overlay to work.
+// and the "work" dir is needed for overlay to work. A layer which is
+// pinned against removal has a "pinned" file.
 
 // The "link" file for each layer contains a unique string for the layer.
 // Under the "l" directory at the root there will be a symbolic link
@@ -73,6 +74,7 @@ const (
 	driverName = "overlay2"
 	linkDir    = "l"
 	lowerFile  = "lower"
+	pinFile    = "pinned"
 	maxDepth   = 128
 
 	// idLength represents the number of random characters
@@ -88,6 +90,25 @@ const (
 type overlayOptions struct {
 	overrideKernelCheck bool
 	quota               quota.Quota
+	mountRetry          graphdriver.MountRetry
+	maxDepth            int
+	deferredRemoval     bool
+	composefs           bool
+	mountHealthInterval time.Duration
+	noatime             bool
+	nodiratime          bool
+	// index and metacopy are "on" or "off" to set the overlay features of
+	// the same name on mount, and empty to leave them to the kernel
+	// defaults.
+	index    string
+	metacopy string
+	// tmpfsSize is the size of the tmpfs a layer is created on, set per
+	// layer by the "tmpfs" storage option. 0 keeps the layer on disk.
+	tmpfsSize uint64
+	// copyUp lists the paths, relative to the root of the layer, copied
+	// up when the layer is created, set per layer by the "copyup" storage
+	// option.
+	copyUp []string
 }
 
 // Driver contains information about the home directory and the list of active mounts that are created using this driver.
@@ -101,6 +122,15 @@ type Driver struct {
 	naiveDiff     graphdriver.DiffDriver
 	supportsDType bool
 	locker        *locker.Locker
+	removal       *graphdriver.DeferredRemoval
+	stopSweep     chan struct{}
+	mountHealth   *graphdriver.MountHealthCheck
+	stopHealth    chan struct{}
+
+	// mountOpts holds the mount data the mounted layers were mounted with,
+	// which is reported by GetMetadata.
+	mountOptsMu sync.Mutex
+	mountOpts   map[string]string
 }
 
 var (
@@ -109,6 +139,14 @@ var (
 
 	useNaiveDiffLock sync.Once
 	useNaiveDiffOnly bool
+
+	// removalSweepInterval is how often the layers whose removal was
+	// deferred are checked for being released.
+	removalSweepInterval = time.Minute
+
+	// overlayParamsDir holds a file for each parameter of the overlay
+	// module, among which the features the kernel supports.
+	overlayParamsDir = "/sys/module/overlay/parameters"
 )
 
 func init() {
@@ -144,9 +182,7 @@ func Init(home string, options []string, uidMaps, gidMaps []idtools.IDMap) (grap
 	if err != nil {
 		return nil, err
 	}
-	if fsName, ok := graphdriver.FsNames[fsMagic]; ok {
-		backingFs = fsName
-	}
+	backingFs = graphdriver.FsName(fsMagic)
 
 	// check if they are running over btrfs, aufs, zfs, overlay, or ecryptfs
 	switch fsMagic {
@@ -174,26 +210,58 @@ func Init(home string, options []string, uidMaps, gidMaps []idtools.IDMap) (grap
 		return nil, err
 	}
 
+	// Checked before the home directory is mounted, so that nothing is left
+	// behind when another driver is tried instead.
+	supportsDType, err := fsutils.SupportsDType(home)
+	if err != nil {
+		return nil, err
+	}
+	if !supportsDType {
+		return nil, overlayutils.ErrDTypeNotSupported("overlay2", backingFs)
+	}
+
 	if err := mount.MakePrivate(home); err != nil {
 		return nil, err
 	}
 
-	supportsDType, err := fsutils.SupportsDType(home)
-	if err != nil {
+	if err := checkFeatureSupport(opts); err != nil {
 		return nil, err
 	}
-	if !supportsDType {
-		// not a fatal error until v17.12 (#27443)
-		logrus.Warn(overlayutils.ErrDTypeNotSupported("overlay2", backingFs))
+
+	if opts.composefs {
+		if err := composefsSupported(); err != nil {
+			logrus.Warnf("overlay2: layers will not be backed by composefs images: %v", err)
+			opts.composefs = false
+		}
 	}
 
+	checker := graphdriver.NewFsChecker(graphdriver.FsMagicOverlay)
 	d := &Driver{
 		home:          home,
 		uidMaps:       uidMaps,
 		gidMaps:       gidMaps,
-		ctr:           graphdriver.NewRefCounter(graphdriver.NewFsChecker(graphdriver.FsMagicOverlay)),
+		ctr:           graphdriver.NewRefCounter(checker),
+		options:       *opts,
 		supportsDType: supportsDType,
 		locker:        locker.New(),
+		mountOpts:     make(map[string]string),
+	}
+
+	if opts.deferredRemoval {
+		d.removal = graphdriver.NewDeferredRemoval(func(dir string) bool {
+			return checker.IsMounted(path.Join(dir, "merged"))
+		})
+		if err := d.removal.Restore(home); err != nil {
+			return nil, err
+		}
+		d.stopSweep = make(chan struct{})
+		go d.removal.Run(removalSweepInterval, d.stopSweep)
+	}
+
+	if opts.mountHealthInterval > 0 {
+		d.mountHealth = graphdriver.NewMountHealthCheck(d.ctr, checker, nil)
+		d.stopHealth = make(chan struct{})
+		go d.mountHealth.Run(opts.mountHealthInterval, d.stopHealth)
 	}
 
 	d.naiveDiff = graphdriver.NewNaiveDiffDriver(d, uidMaps, gidMaps)
@@ -211,7 +279,10 @@ func Init(home string, options []string, uidMaps, gidMaps []idtools.IDMap) (grap
 }
 
 func parseOptions(options []string) (*overlayOptions, error) {
-	o := &overlayOptions{}
+	o := &overlayOptions{
+		mountRetry: graphdriver.DefaultMountRetry,
+		maxDepth:   maxDepth,
+	}
 	for _, option := range options {
 		key, val, err := parsers.ParseKeyValueOpt(option)
 		if err != nil {
@@ -224,6 +295,67 @@ func parseOptions(options []string) (*overlayOptions, error) {
 			if err != nil {
 				return nil, err
 			}
+		case "overlay2.mount_retries":
+			retries, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, err
+			}
+			if retries < 0 {
+				return nil, fmt.Errorf("overlay2: invalid value for %s: %d", key, retries)
+			}
+			o.mountRetry.Retries = retries
+		case "overlay2.max_depth":
+			depth, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, err
+			}
+			if depth < 1 || depth > maxDepth {
+				return nil, fmt.Errorf("overlay2: invalid value for %s: %d, must be between 1 and %d", key, depth, maxDepth)
+			}
+			o.maxDepth = depth
+		case "overlay2.deferred_removal":
+			o.deferredRemoval, err = strconv.ParseBool(val)
+			if err != nil {
+				return nil, err
+			}
+		case "overlay2.composefs":
+			o.composefs, err = strconv.ParseBool(val)
+			if err != nil {
+				return nil, err
+			}
+		case "overlay2.mount_health_interval":
+			interval, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, err
+			}
+			if interval < 0 {
+				return nil, fmt.Errorf("overlay2: invalid value for %s: %s", key, val)
+			}
+			o.mountHealthInterval = interval
+		case "overlay2.noatime":
+			o.noatime, err = strconv.ParseBool(val)
+			if err != nil {
+				return nil, err
+			}
+		case "overlay2.nodiratime":
+			o.nodiratime, err = strconv.ParseBool(val)
+			if err != nil {
+				return nil, err
+			}
+		case "overlay2.index", "overlay2.metacopy":
+			enabled, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, err
+			}
+			feature := "off"
+			if enabled {
+				feature = "on"
+			}
+			if key == "overlay2.index" {
+				o.index = feature
+			} else {
+				o.metacopy = feature
+			}
 
 		default:
 			return nil, fmt.Errorf("overlay2: Unknown option %s\n", key)
@@ -232,6 +364,59 @@ func parseOptions(options []string) (*overlayOptions, error) {
 	return o, nil
 }
 
+// mountFlags returns the flags layers are mounted with.
+func (o *overlayOptions) mountFlags() uintptr {
+	var flags uintptr
+	if o.noatime {
+		flags |= syscall.MS_NOATIME
+	}
+	if o.nodiratime {
+		flags |= syscall.MS_NODIRATIME
+	}
+	return flags
+}
+
+// featureOpts returns the mount options setting the overlay features which
+// were configured explicitly.
+func (o *overlayOptions) featureOpts() string {
+	var opts string
+	if o.index != "" {
+		opts += ",index=" + o.index
+	}
+	if o.metacopy != "" {
+		opts += ",metacopy=" + o.metacopy
+	}
+	return opts
+}
+
+// overlayFeatures are the overlay features which can be set explicitly,
+// with the kernel they were introduced in.
+var overlayFeatures = []struct {
+	name   string
+	kernel string
+}{
+	{"index", "4.13"},
+	{"metacopy", "4.19"},
+}
+
+// checkFeatureSupport returns an error if the overlay features configured
+// explicitly are not supported by the kernel.
+func checkFeatureSupport(o *overlayOptions) error {
+	values := map[string]string{"index": o.index, "metacopy": o.metacopy}
+	for _, feature := range overlayFeatures {
+		if values[feature.name] == "" {
+			continue
+		}
+		if _, err := os.Stat(path.Join(overlayParamsDir, feature.name)); err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("overlay2: overlay2.%s is not supported by the kernel, which must be %s or later", feature.name, feature.kernel)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
 func supportsOverlay() error {
 	// We can try to modprobe overlay first before looking at
 	// proc/filesystems for when overlay is supported
@@ -253,6 +438,13 @@ func supportsOverlay() error {
 	return graphdriver.ErrNotSupported
 }
 
+// useNaiveDiff returns whether the diffs of the layers of d must be computed
+// by comparing them to their parent. With metacopy, the files of the upper
+// directories whose metadata only changed do not hold their content.
+func (d *Driver) useNaiveDiff() bool {
+	return d.options.metacopy == "on" || useNaiveDiff(d.home)
+}
+
 func useNaiveDiff(home string) bool {
 	useNaiveDiffLock.Do(func() {
 		if err := hasOpaqueCopyUpBug(home); err != nil {
@@ -268,13 +460,25 @@ func (d *Driver) String() string {
 }
 
 // Status returns current driver information in a two dimensional string array.
-// Output contains "Backing Filesystem" used in this implementation.
+// Output contains "Backing Filesystem" used in this implementation, followed
+// by the features listed in graphdriver.StatusFeatureKeys.
 func (d *Driver) Status() [][2]string {
-	return [][2]string{
-		{"Backing Filesystem", backingFs},
-		{"Supports d_type", strconv.FormatBool(d.supportsDType)},
-		{"Native Overlay Diff", strconv.FormatBool(!useNaiveDiff(d.home))},
+	features := graphdriver.FeatureStatus{
+		SupportsDType:     d.supportsDType,
+		NativeOverlayDiff: !d.useNaiveDiff(),
+	}
+	status := append([][2]string{{"Backing Filesystem", backingFs}}, features.Status()...)
+	if d.mountHealth != nil {
+		status = append(status, [2]string{"Stale Mounts", strconv.Itoa(d.mountHealth.Stale())})
 	}
+	return status
+}
+
+// SupportsMountIsolation returns whether layers can be mounted in an
+// isolated mount namespace, which is not the case when diffs are produced
+// by mounting the layers.
+func (d *Driver) SupportsMountIsolation() bool {
+	return !d.useNaiveDiff()
 }
 
 // GetMetadata returns meta data about the overlay driver such as
@@ -290,6 +494,11 @@ func (d *Driver) GetMetadata(id string) (map[string]string, error) {
 		"MergedDir": path.Join(dir, "merged"),
 		"UpperDir":  path.Join(dir, "diff"),
 	}
+	d.mountOptsMu.Lock()
+	if opts, ok := d.mountOpts[id]; ok {
+		metadata["MountOptions"] = opts
+	}
+	d.mountOptsMu.Unlock()
 
 	lowerDirs, err := d.getLowerDirs(id)
 	if err != nil {
@@ -306,6 +515,12 @@ func (d *Driver) GetMetadata(id string) (map[string]string, error) {
 // is being shutdown. For now, we just have to unmount the bind mounted
 // we had created.
 func (d *Driver) Cleanup() error {
+	if d.stopSweep != nil {
+		close(d.stopSweep)
+	}
+	if d.stopHealth != nil {
+		close(d.stopHealth)
+	}
 	return mount.Unmount(d.home)
 }
 
@@ -319,8 +534,27 @@ func (d *Driver) CreateReadWrite(id, parent string, opts *graphdriver.CreateOpts
 // The parent filesystem is used to configure these directories for the overlay.
 func (d *Driver) Create(id, parent string, opts *graphdriver.CreateOpts) (retErr error) {
 
-	if opts != nil && len(opts.StorageOpt) != 0 && !projectQuotaSupported {
-		return fmt.Errorf("--storage-opt is supported only for overlay over xfs with 'pquota' mount option")
+	driver := &Driver{}
+	if opts != nil && len(opts.StorageOpt) > 0 {
+		if err := d.parseStorageOpt(opts.StorageOpt, driver); err != nil {
+			return err
+		}
+		if driver.options.quota.Size > 0 && !projectQuotaSupported {
+			return fmt.Errorf("--storage-opt size is supported only for overlay over xfs with 'pquota' mount option")
+		}
+		if driver.options.quota.Size > 0 && driver.options.tmpfsSize > 0 {
+			return fmt.Errorf("--storage-opt size cannot be used with tmpfs")
+		}
+	}
+
+	// Check the depth of the chain before anything is created, rather than
+	// leaving it to fail at mount time.
+	var lower string
+	if parent != "" {
+		var err error
+		if lower, err = d.getLower(parent); err != nil {
+			return err
+		}
 	}
 
 	dir := d.dir(id)
@@ -339,21 +573,25 @@ func (d *Driver) Create(id, parent string, opts *graphdriver.CreateOpts) (retErr
 	defer func() {
 		// Clean up on failure
 		if retErr != nil {
-			os.RemoveAll(dir)
+			system.EnsureRemoveAll(dir)
 		}
 	}()
 
-	if opts != nil && len(opts.StorageOpt) > 0 {
-		driver := &Driver{}
-		if err := d.parseStorageOpt(opts.StorageOpt, driver); err != nil {
+	if driver.options.quota.Size > 0 {
+		// Set container disk quota limit
+		if err := d.quotaCtl.SetQuota(dir, driver.options.quota); err != nil {
 			return err
 		}
-
-		if driver.options.quota.Size > 0 {
-			// Set container disk quota limit
-			if err := d.quotaCtl.SetQuota(dir, driver.options.quota); err != nil {
-				return err
-			}
+	}
+	if driver.options.tmpfsSize > 0 {
+		// Throwaway layers, such as the ones of build steps, live on a
+		// tmpfs in full: their diff and work directories must be on the
+		// same filesystem. The tmpfs is unmounted when the layer is
+		// removed, and the layer, left without its link file after a
+		// reboot, is removed by Reconcile.
+		data := fmt.Sprintf("size=%d,mode=0700,uid=%d,gid=%d", driver.options.tmpfsSize, rootUID, rootGID)
+		if err := mount.Mount("tmpfs", dir, "tmpfs", data); err != nil {
+			return fmt.Errorf("error creating tmpfs for layer %s: %v", id, err)
 		}
 	}
 
@@ -383,22 +621,23 @@ func (d *Driver) Create(id, parent string, opts *graphdriver.CreateOpts) (retErr
 		return err
 	}
 
-	lower, err := d.getLower(parent)
-	if err != nil {
-		return err
-	}
 	if lower != "" {
 		if err := ioutil.WriteFile(path.Join(dir, lowerFile), []byte(lower), 0666); err != nil {
 			return err
 		}
 	}
 
+	if len(driver.options.copyUp) > 0 {
+		return d.copyUpPaths(id, driver.options.copyUp)
+	}
 	return nil
 }
 
 // Parse overlay storage options
 func (d *Driver) parseStorageOpt(storageOpt map[string]string, driver *Driver) error {
-	// Read size to set the disk project quota per container
+	// Read size to set the disk project quota per container, tmpfs to
+	// create the layer on a tmpfs of that size, and copyup to copy up the
+	// comma-separated paths when the layer is created
 	for key, val := range storageOpt {
 		key := strings.ToLower(key)
 		switch key {
@@ -408,6 +647,21 @@ func (d *Driver) parseStorageOpt(storageOpt map[string]string, driver *Driver) e
 				return err
 			}
 			driver.options.quota.Size = uint64(size)
+		case "tmpfs":
+			size, err := units.RAMInBytes(val)
+			if err != nil {
+				return err
+			}
+			if size <= 0 {
+				return fmt.Errorf("invalid tmpfs size %s: it must be positive", val)
+			}
+			driver.options.tmpfsSize = uint64(size)
+		case "copyup":
+			for _, p := range strings.Split(val, ",") {
+				if p = strings.TrimSpace(p); p != "" {
+					driver.options.copyUp = append(driver.options.copyUp, p)
+				}
+			}
 		default:
 			return fmt.Errorf("Unknown option %s", key)
 		}
@@ -436,8 +690,8 @@ func (d *Driver) getLower(parent string) (string, error) {
 		parentLowers := strings.Split(string(parentLower), ":")
 		lowers = append(lowers, parentLowers...)
 	}
-	if len(lowers) > maxDepth {
-		return "", errors.New("max depth exceeded")
+	if len(lowers) > d.options.maxDepth {
+		return "", fmt.Errorf("cannot create a layer on top of %s: it would have %d parent layers, exceeding the maximum of %d; flatten the image to reduce its number of layers, e.g. by combining instructions in the Dockerfile", parent, len(lowers), d.options.maxDepth)
 	}
 	return strings.Join(lowers, ":"), nil
 }
@@ -468,6 +722,9 @@ func (d *Driver) Remove(id string) error {
 	d.locker.Lock(id)
 	defer d.locker.Unlock(id)
 	dir := d.dir(id)
+	if graphdriver.IsLayerPinned(path.Join(dir, pinFile)) {
+		return &graphdriver.PinnedError{ID: id}
+	}
 	lid, err := ioutil.ReadFile(path.Join(dir, "link"))
 	if err == nil {
 		if err := os.RemoveAll(path.Join(d.home, linkDir, string(lid))); err != nil {
@@ -475,12 +732,80 @@ func (d *Driver) Remove(id string) error {
 		}
 	}
 
+	// Rather than unmounting a layer which is still in use, move it out of
+	// the way and let the sweep remove it once it is released.
+	if d.removal != nil && d.removal.InUse(dir) {
+		return d.removal.Defer(dir)
+	}
+
 	if err := system.EnsureRemoveAll(dir); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 	return nil
 }
 
+// Reconcile removes what is left of the layers whose creation or removal was
+// interrupted, and the links to layers which no longer exist. Create writes
+// the link file of a layer once its diff directory and its link exist, and
+// Remove starts by removing the link, so a layer missing any of them is
+// incomplete. Directories of deferred removals which are still mounted are
+// left alone.
+func (d *Driver) Reconcile() ([]string, error) {
+	items, err := ioutil.ReadDir(d.home)
+	if err != nil {
+		return nil, err
+	}
+	removingSuffix := graphdriver.RemovingPath("")
+	var ids []string
+	for _, item := range items {
+		name := item.Name()
+		if !item.IsDir() || name == linkDir {
+			continue
+		}
+		dir := path.Join(d.home, name)
+		id := strings.TrimSuffix(name, removingSuffix)
+		if id == name && d.isComplete(dir) {
+			continue
+		}
+		if mounted, err := mount.Mounted(path.Join(dir, "merged")); err != nil || mounted {
+			continue
+		}
+		logrus.Warnf("overlay2: removing the incomplete layer %s", id)
+		if err := system.EnsureRemoveAll(dir); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+
+	links, err := ioutil.ReadDir(path.Join(d.home, linkDir))
+	if err != nil {
+		return ids, err
+	}
+	for _, link := range links {
+		p := path.Join(d.home, linkDir, link.Name())
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			if err := os.Remove(p); err != nil {
+				return ids, err
+			}
+		}
+	}
+	return ids, nil
+}
+
+// isComplete returns whether the layer directory dir has its diff
+// directory, its link file and the link the file names.
+func (d *Driver) isComplete(dir string) bool {
+	if _, err := os.Stat(path.Join(dir, "diff")); err != nil {
+		return false
+	}
+	lid, err := ioutil.ReadFile(path.Join(dir, "link"))
+	if err != nil || len(lid) == 0 {
+		return false
+	}
+	_, err = os.Lstat(path.Join(d.home, linkDir, string(lid)))
+	return err == nil
+}
+
 // Get creates and mounts the required file system for the given id and returns the mount path.
 func (d *Driver) Get(id string, mountLabel string) (s string, err error) {
 	d.locker.Lock(id)
@@ -514,11 +839,25 @@ func (d *Driver) Get(id string, mountLabel string) (s string, err error) {
 
 	workDir := path.Join(dir, "work")
 	splitLowers := strings.Split(string(lowers), ":")
+	if d.options.composefs {
+		var composefsDirs []string
+		composefsDirs, err = d.mountComposefsLowers(splitLowers)
+		if err != nil {
+			return "", err
+		}
+		defer func() {
+			if err != nil {
+				for _, dir := range composefsDirs {
+					d.unmountComposefs(dir)
+				}
+			}
+		}()
+	}
 	absLowers := make([]string, len(splitLowers))
 	for i, s := range splitLowers {
 		absLowers[i] = path.Join(d.home, s)
 	}
-	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(absLowers, ":"), path.Join(dir, "diff"), path.Join(dir, "work"))
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(absLowers, ":"), path.Join(dir, "diff"), path.Join(dir, "work")) + d.options.featureOpts()
 	mountData := label.FormatMountLabel(opts, mountLabel)
 	mount := syscall.Mount
 	mountTarget := mergedDir
@@ -539,7 +878,7 @@ func (d *Driver) Get(id string, mountLabel string) (s string, err error) {
 	// fit within a page and relative links make the mount data much
 	// smaller at the expense of requiring a fork exec to chroot.
 	if len(mountData) > pageSize {
-		opts = fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", string(lowers), path.Join(id, "diff"), path.Join(id, "work"))
+		opts = fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(splitLowers, ":"), path.Join(id, "diff"), path.Join(id, "work")) + d.options.featureOpts()
 		mountData = label.FormatMountLabel(opts, mountLabel)
 		if len(mountData) > pageSize {
 			return "", fmt.Errorf("cannot mount layer, mount label too large %d", len(mountData))
@@ -551,9 +890,21 @@ func (d *Driver) Get(id string, mountLabel string) (s string, err error) {
 		mountTarget = path.Join(id, "merged")
 	}
 
-	if err := mount("overlay", mountTarget, "overlay", 0, mountData); err != nil {
+	if err := d.options.mountRetry.Mount(func() error {
+		return mount("overlay", mountTarget, "overlay", d.options.mountFlags(), mountData)
+	}); err != nil {
 		return "", fmt.Errorf("error creating overlay mount to %s: %v", mergedDir, err)
 	}
+	d.mountOptsMu.Lock()
+	d.mountOpts[id] = mountData
+	d.mountOptsMu.Unlock()
+	defer func() {
+		if err != nil {
+			d.mountOptsMu.Lock()
+			delete(d.mountOpts, id)
+			d.mountOptsMu.Unlock()
+		}
+	}()
 
 	// chown "workdir/work" to the remapped root UID/GID. Overlay fs inside a
 	// user namespace requires this to move a directory from lower to upper.
@@ -574,7 +925,15 @@ func (d *Driver) Put(id string) error {
 	d.locker.Lock(id)
 	defer d.locker.Unlock(id)
 	dir := d.dir(id)
-	_, err := ioutil.ReadFile(path.Join(dir, lowerFile))
+	// The layer may have been removed while in use, in which case its
+	// mount has moved along with its directory.
+	mountDir := dir
+	if d.removal != nil {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			mountDir = graphdriver.RemovingPath(dir)
+		}
+	}
+	lowers, err := ioutil.ReadFile(path.Join(mountDir, lowerFile))
 	if err != nil {
 		// If no lower, no mount happened and just return directly
 		if os.IsNotExist(err) {
@@ -583,16 +942,45 @@ func (d *Driver) Put(id string) error {
 		return err
 	}
 
-	mountpoint := path.Join(dir, "merged")
-	if count := d.ctr.Decrement(mountpoint); count > 0 {
+	if count := d.ctr.Decrement(path.Join(dir, "merged")); count > 0 {
 		return nil
 	}
+	mountpoint := path.Join(mountDir, "merged")
 	if err := syscall.Unmount(mountpoint, syscall.MNT_DETACH); err != nil {
 		logrus.Debugf("Failed to unmount %s overlay: %s - %v", id, mountpoint, err)
 	}
+	d.mountOptsMu.Lock()
+	delete(d.mountOpts, id)
+	d.mountOptsMu.Unlock()
+	if d.options.composefs {
+		composefsDirs, err := d.composefsLowers(strings.Split(string(lowers), ":"))
+		if err != nil {
+			return err
+		}
+		for _, dir := range composefsDirs {
+			d.unmountComposefs(dir)
+		}
+	}
 	return nil
 }
 
+// LayerDirs returns the directory of the layer id and the ones of its
+// parents, whose files are in their diff directory.
+func (d *Driver) LayerDirs(id string) ([]string, string, error) {
+	if d.options.composefs {
+		return nil, "", fmt.Errorf("the layers of %s are mounted through composefs", d)
+	}
+	lowers, err := d.getLowerDirs(id)
+	if err != nil {
+		return nil, "", err
+	}
+	dirs := []string{d.dir(id)}
+	for _, lower := range lowers {
+		dirs = append(dirs, path.Dir(lower))
+	}
+	return dirs, "diff", nil
+}
+
 // Exists checks to see if the id is already mounted.
 func (d *Driver) Exists(id string) bool {
 	_, err := os.Stat(d.dir(id))
@@ -638,9 +1026,98 @@ func (d *Driver) ApplyDiff(id string, parent string, diff io.Reader) (size int64
 		return 0, err
 	}
 
+	if d.options.composefs {
+		if err := createComposefsImage(d.dir(id)); err != nil {
+			return 0, err
+		}
+	}
+
 	return directory.Size(applyDir)
 }
 
+// Warm reads the files of the diff directories of the layers ids into the
+// page cache. The layers need not be mounted, as their mounts read the
+// files of the same inodes.
+func (d *Driver) Warm(ids []string) error {
+	dirs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !d.Exists(id) {
+			return fmt.Errorf("layer %s does not exist", id)
+		}
+		dirs = append(dirs, d.getDiffPath(id))
+	}
+	return graphdriver.WarmDirs(dirs...)
+}
+
+// ListFiles returns the files of the diff directory of the layer id, which
+// holds the files it adds or modifies. The whiteouts of the files it
+// removes are left out.
+func (d *Driver) ListFiles(id string) ([]graphdriver.FileEntry, error) {
+	if !d.Exists(id) {
+		return nil, fmt.Errorf("layer %s does not exist", id)
+	}
+	return graphdriver.ListDir(d.getDiffPath(id), func(path string, fi os.FileInfo) (bool, error) {
+		return isWhiteout(fi), nil
+	})
+}
+
+// ReclaimableSpace returns the disk space removing the directories of the
+// layers unusedIDs would free. The merged directories of the layers which
+// are mounted are not counted.
+func (d *Driver) ReclaimableSpace(unusedIDs []string) (int64, error) {
+	dirs := make([]string, 0, len(unusedIDs))
+	for _, id := range unusedIDs {
+		dirs = append(dirs, d.dir(id))
+	}
+	return graphdriver.DiskUsage(dirs...)
+}
+
+// FreeSpace returns the space available on the filesystem of the diff
+// directory of the layer id. The quota of the layer, if it has one, is not
+// taken into account.
+func (d *Driver) FreeSpace(id string) (int64, error) {
+	return graphdriver.FreeSpaceOf(d.getDiffPath(id))
+}
+
+// GetAt mounts the layer id as Get does, and bind mounts the result at
+// target.
+func (d *Driver) GetAt(id, mountLabel, target string) error {
+	return graphdriver.BindLayer(d, id, mountLabel, target)
+}
+
+// PutAt unmounts the layer id from target and puts it.
+func (d *Driver) PutAt(id, target string) error {
+	return graphdriver.UnbindLayer(d, id, target)
+}
+
+// Pin pins the layer id against removal by creating its "pinned" file.
+func (d *Driver) Pin(id string) error {
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
+	dir := d.dir(id)
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	return graphdriver.PinLayer(path.Join(dir, pinFile))
+}
+
+// Unpin removes the "pinned" file of the layer id.
+func (d *Driver) Unpin(id string) error {
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
+	return graphdriver.UnpinLayer(path.Join(d.dir(id), pinFile))
+}
+
+// isWhiteout returns whether fi is the whiteout of a removed file, a 0/0
+// character device.
+func isWhiteout(fi os.FileInfo) bool {
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	s, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && s.Rdev == 0
+}
+
 func (d *Driver) getDiffPath(id string) string {
 	dir := d.dir(id)
 
@@ -651,7 +1128,7 @@ func (d *Driver) getDiffPath(id string) string {
 // and its parent and returns the size in bytes of the changes
 // relative to its base filesystem directory.
 func (d *Driver) DiffSize(id, parent string) (size int64, err error) {
-	if useNaiveDiff(d.home) || !d.isParent(id, parent) {
+	if d.useNaiveDiff() || !d.isParent(id, parent) {
 		return d.naiveDiff.DiffSize(id, parent)
 	}
 	return directory.Size(d.getDiffPath(id))
@@ -660,7 +1137,7 @@ func (d *Driver) DiffSize(id, parent string) (size int64, err error) {
 // Diff produces an archive of the changes between the specified
 // layer and its parent layer which may be "".
 func (d *Driver) Diff(id, parent string) (io.ReadCloser, error) {
-	if useNaiveDiff(d.home) || !d.isParent(id, parent) {
+	if d.useNaiveDiff() || !d.isParent(id, parent) {
 		return d.naiveDiff.Diff(id, parent)
 	}
 
@@ -677,7 +1154,7 @@ func (d *Driver) Diff(id, parent string) (io.ReadCloser, error) {
 // Changes produces a list of changes between the specified layer
 // and its parent layer. If parent is "", then all changes will be ADD changes.
 func (d *Driver) Changes(id, parent string) ([]archive.Change, error) {
-	if useNaiveDiff(d.home) || !d.isParent(id, parent) {
+	if d.useNaiveDiff() || !d.isParent(id, parent) {
 		return d.naiveDiff.Changes(id, parent)
 	}
 	// Overlay doesn't have snapshots, so we need to get changes from all parent
@@ -690,3 +1167,20 @@ func (d *Driver) Changes(id, parent string) ([]archive.Change, error) {
 
 	return archive.OverlayChanges(layers, diffPath)
 }
+
+// ChangesSince produces a list of the changes made to the specified layer
+// after since, based on the modification times of the entries, including
+// whiteouts, of its upper directory.
+func (d *Driver) ChangesSince(id string, since time.Time) ([]archive.Change, error) {
+	diffPath := d.getDiffPath(id)
+	layers, err := d.getLowerDirs(id)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := archive.OverlayChanges(layers, diffPath)
+	if err != nil {
+		return nil, err
+	}
+	return graphdriver.FilterChangesSince(diffPath, changes, since)
+}
@@ -3,14 +3,23 @@
 package overlay2
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
+	"reflect"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/docker/docker/daemon/graphdriver"
 	"github.com/docker/docker/daemon/graphdriver/graphtest"
 	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/locker"
+	"github.com/docker/docker/pkg/mount"
 	"github.com/docker/docker/pkg/reexec"
 )
 
@@ -78,6 +87,10 @@ func TestOverlayChanges(t *testing.T) {
 	graphtest.DriverTestChanges(t, driverName)
 }
 
+func TestOverlayStatusFeatures(t *testing.T) {
+	graphtest.DriverTestStatusFeatures(t, driverName)
+}
+
 func TestOverlayTeardown(t *testing.T) {
 	graphtest.PutDriver(t)
 }
@@ -119,3 +132,804 @@ func BenchmarkDiff20Layers(b *testing.B) {
 func BenchmarkRead20Layers(b *testing.B) {
 	graphtest.DriverBenchDeepLayerRead(b, 20, driverName)
 }
+
+func TestParseOptionsMountRetries(t *testing.T) {
+	o, err := parseOptions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.mountRetry != graphdriver.DefaultMountRetry {
+		t.Fatalf("expected default mount retry, got %+v", o.mountRetry)
+	}
+
+	o, err = parseOptions([]string{"overlay2.mount_retries=5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.mountRetry.Retries != 5 || o.mountRetry.Backoff != graphdriver.DefaultMountRetry.Backoff {
+		t.Fatalf("unexpected mount retry %+v", o.mountRetry)
+	}
+
+	if _, err := parseOptions([]string{"overlay2.mount_retries=-1"}); err == nil {
+		t.Fatal("expected an error for a negative number of retries")
+	}
+}
+
+func TestFeatureOptions(t *testing.T) {
+	o, err := parseOptions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts := o.featureOpts(); opts != "" {
+		t.Fatalf("expected the features to be left to the kernel, got %q", opts)
+	}
+
+	o, err = parseOptions([]string{"overlay2.index=false", "overlay2.metacopy=true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts := o.featureOpts(); opts != ",index=off,metacopy=on" {
+		t.Fatalf("unexpected feature options %q", opts)
+	}
+	if _, err := parseOptions([]string{"overlay2.index=maybe"}); err == nil {
+		t.Fatal("expected an error for an invalid index value")
+	}
+
+	params, err := ioutil.TempDir("", "overlay2-params")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(params)
+	if err := ioutil.WriteFile(path.Join(params, "index"), []byte("Y\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(dir string) { overlayParamsDir = dir }(overlayParamsDir)
+	overlayParamsDir = params
+
+	if err := checkFeatureSupport(&overlayOptions{index: "off"}); err != nil {
+		t.Fatal(err)
+	}
+	err = checkFeatureSupport(&overlayOptions{index: "on", metacopy: "on"})
+	expected := "overlay2: overlay2.metacopy is not supported by the kernel, which must be 4.19 or later"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected %q, got %v", expected, err)
+	}
+}
+
+func TestFeatureOptionsArePassedToMount(t *testing.T) {
+	home, err := ioutil.TempDir("", "overlay2-features")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	driver, err := Init(home, []string{"overlay2.index=off"}, nil, nil)
+	if err != nil {
+		t.Skipf("overlay2 with index is not supported: %v", err)
+	}
+	defer driver.Cleanup()
+	d := driver.(*Driver)
+
+	if err := d.Create("base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateReadWrite("top", "base", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get("top", ""); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Put("top")
+	metadata, err := d.GetMetadata("top")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts := metadata["MountOptions"]; !strings.HasSuffix(opts, ",index=off") {
+		t.Fatalf("expected the layer to be mounted with index=off, got %q", opts)
+	}
+}
+
+func TestCreateExceedingMaxDepth(t *testing.T) {
+	home, err := ioutil.TempDir("", "overlay2-max-depth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	if err := os.MkdirAll(path.Join(home, linkDir), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Driver{
+		home:    home,
+		options: overlayOptions{maxDepth: 3},
+		locker:  locker.New(),
+	}
+	parent := ""
+	for i := 0; i < 4; i++ {
+		id := fmt.Sprintf("layer%d", i)
+		if err := d.Create(id, parent, nil); err != nil {
+			t.Fatalf("failed to create %s: %v", id, err)
+		}
+		parent = id
+	}
+
+	err = d.Create("layer4", parent, nil)
+	if err == nil || !strings.Contains(err.Error(), "exceeding the maximum of 3; flatten the image") {
+		t.Fatalf("expected a max depth error, got %v", err)
+	}
+	if _, err := os.Stat(d.dir("layer4")); !os.IsNotExist(err) {
+		t.Fatalf("expected layer directory not to be created, got %v", err)
+	}
+	links, err := ioutil.ReadDir(path.Join(home, linkDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 4 {
+		t.Fatalf("expected 4 links, got %d", len(links))
+	}
+}
+
+func TestRemoveInUseLayerIsDeferred(t *testing.T) {
+	defer func(interval time.Duration) {
+		removalSweepInterval = interval
+	}(removalSweepInterval)
+	removalSweepInterval = 10 * time.Millisecond
+
+	home, err := ioutil.TempDir("", "overlay2-deferred-removal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	driver, err := Init(home, []string{"overlay2.deferred_removal=true"}, nil, nil)
+	if err != nil {
+		t.Skipf("overlay2 is not supported: %v", err)
+	}
+	defer driver.Cleanup()
+	d := driver.(*Driver)
+
+	if err := d.Create("base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create("layer", "base", nil); err != nil {
+		t.Fatal(err)
+	}
+	mnt, err := d.Get("layer", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Remove("layer"); err != nil {
+		t.Fatalf("removing an in-use layer should be deferred, got %v", err)
+	}
+	if d.Exists("layer") {
+		t.Fatal("expected the removed layer not to exist anymore")
+	}
+	removing := graphdriver.RemovingPath(d.dir("layer"))
+	time.Sleep(5 * removalSweepInterval)
+	if !d.removal.InUse(removing) {
+		t.Fatalf("expected %s to be moved along with the layer", mnt)
+	}
+	if _, err := ioutil.ReadDir(path.Join(removing, "merged")); err != nil {
+		t.Fatalf("expected the in-use layer to be kept until released: %v", err)
+	}
+
+	if err := d.Put("layer"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := os.Stat(removing)
+		if os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s to be removed after the layer was released: %v", removing, err)
+		}
+		time.Sleep(removalSweepInterval)
+	}
+}
+
+func TestComposefsMountAndTamperDetection(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting composefs images requires root")
+	}
+	if err := composefsSupported(); err != nil {
+		t.Skipf("composefs is not supported: %v", err)
+	}
+
+	home, err := ioutil.TempDir("", "overlay2-composefs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	probe := path.Join(home, "verity-probe")
+	if err := ioutil.WriteFile(probe, []byte("probe"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := enableVerity(probe); err != nil {
+		t.Skipf("fs-verity is not supported by the backing filesystem: %v", err)
+	}
+
+	driver, err := Init(path.Join(home, "overlay2"), []string{"overlay2.composefs=true"}, nil, nil)
+	if err != nil {
+		t.Skipf("overlay2 is not supported: %v", err)
+	}
+	defer driver.Cleanup()
+	d := driver.(*Driver)
+
+	content, err := ioutil.TempDir("", "overlay2-composefs-content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(content)
+	if err := ioutil.WriteFile(path.Join(content, "file"), []byte("verified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := archive.Tar(content, archive.Uncompressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer layer.Close()
+
+	if err := d.Create("base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.ApplyDiff("base", "", layer); err != nil {
+		t.Fatal(err)
+	}
+	if !hasComposefsImage(d.dir("base")) {
+		t.Fatal("expected the applied layer to be backed by a composefs image")
+	}
+	if err := d.Create("top", "base", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	mnt, err := d.Get("top", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path.Join(mnt, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "verified" {
+		t.Fatalf("unexpected content %q", data)
+	}
+	if err := d.Put("top"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the image by a modified copy.
+	image := path.Join(d.dir("base"), composefsImage)
+	data, err = ioutil.ReadFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := ioutil.WriteFile(image+".tampered", data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(image+".tampered", image); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get("top", ""); err == nil {
+		d.Put("top")
+		t.Fatal("expected mounting a layer on top of a tampered image to fail")
+	}
+}
+
+func TestMountOptionsAreReported(t *testing.T) {
+	home, err := ioutil.TempDir("", "overlay2-mount-options")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	driver, err := Init(home, nil, nil, nil)
+	if err != nil {
+		t.Skipf("overlay2 is not supported: %v", err)
+	}
+	defer driver.Cleanup()
+	d := driver.(*Driver)
+
+	if err := d.Create("base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateReadWrite("top", "base", nil); err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := d.GetMetadata("top")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts, ok := metadata["MountOptions"]; ok {
+		t.Fatalf("expected no mount options before the layer is mounted, got %q", opts)
+	}
+
+	if _, err := d.Get("top", ""); err != nil {
+		t.Fatal(err)
+	}
+	metadata, err = d.GetMetadata("top")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", path.Join(home, linkDir, mustReadLink(t, d, "base")), path.Join(d.dir("top"), "diff"), path.Join(d.dir("top"), "work"))
+	if opts := metadata["MountOptions"]; opts != expected {
+		t.Fatalf("expected mount options %q, got %q", expected, opts)
+	}
+
+	if err := d.Put("top"); err != nil {
+		t.Fatal(err)
+	}
+	metadata, err = d.GetMetadata("top")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts, ok := metadata["MountOptions"]; ok {
+		t.Fatalf("expected no mount options after the layer is unmounted, got %q", opts)
+	}
+}
+
+// mustReadLink returns the short name of the link to the layer id.
+func mustReadLink(t *testing.T, d *Driver, id string) string {
+	link, err := ioutil.ReadFile(path.Join(d.dir(id), "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(link)
+}
+
+func TestNoatimeMountOptions(t *testing.T) {
+	home, err := ioutil.TempDir("", "overlay2-noatime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	driver, err := Init(home, []string{"overlay2.noatime=true", "overlay2.nodiratime=true"}, nil, nil)
+	if err != nil {
+		t.Skipf("overlay2 is not supported: %v", err)
+	}
+	defer driver.Cleanup()
+	d := driver.(*Driver)
+
+	if err := d.Create("base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateReadWrite("top", "base", nil); err != nil {
+		t.Fatal(err)
+	}
+	mnt, err := d.Get("top", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Put("top")
+
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mounts {
+		if m.Mountpoint != mnt {
+			continue
+		}
+		opts := strings.Split(m.Opts, ",")
+		for _, expected := range []string{"noatime", "nodiratime"} {
+			if !contains(opts, expected) {
+				t.Fatalf("expected %s to be mounted with %s, got %q", mnt, expected, m.Opts)
+			}
+		}
+		return
+	}
+	t.Fatalf("%s is not mounted", mnt)
+}
+
+func TestWarm(t *testing.T) {
+	home, err := ioutil.TempDir("", "overlay2-warm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	driver, err := Init(home, nil, nil, nil)
+	if err != nil {
+		t.Skipf("overlay2 is not supported: %v", err)
+	}
+	defer driver.Cleanup()
+	d := driver.(*Driver)
+
+	if err := d.Create("base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("#!/bin/sh\n")
+	if err := ioutil.WriteFile(path.Join(d.getDiffPath("base"), "entrypoint"), content, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateReadWrite("top", "base", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := graphdriver.Warm(d, []string{"base", "top"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Warm([]string{"missing"}); err == nil {
+		t.Fatal("expected warming a missing layer to fail")
+	}
+
+	mnt, err := d.Get("top", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Put("top")
+	got, err := ioutil.ReadFile(path.Join(mnt, "entrypoint"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("expected %q, got %q", content, got)
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	home, err := ioutil.TempDir("", "overlay2-list-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	driver, err := Init(home, nil, nil, nil)
+	if err != nil {
+		t.Skipf("overlay2 is not supported: %v", err)
+	}
+	defer driver.Cleanup()
+	d := driver.(*Driver)
+
+	if err := d.Create("base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(d.getDiffPath("base"), "removed"), []byte("base"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create("top", "base", nil); err != nil {
+		t.Fatal(err)
+	}
+	topDiff := d.getDiffPath("top")
+	if err := os.Mkdir(path.Join(topDiff, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(topDiff, "etc", "app.conf"), []byte("key=value\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mknod(path.Join(topDiff, "removed"), syscall.S_IFCHR, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := graphdriver.ListFiles(d, "top")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []graphdriver.FileEntry{
+		{Path: "/etc", Mode: os.ModeDir | 0755, Type: graphdriver.FileTypeDir},
+		{Path: "/etc/app.conf", Size: 10, Mode: 0600, Type: graphdriver.FileTypeRegular},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("expected %v, got %v", expected, entries)
+	}
+
+	if _, err := d.ListFiles("missing"); err == nil {
+		t.Fatal("expected listing a missing layer to fail")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	home, err := ioutil.TempDir("", "overlay2-reconcile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	driver, err := Init(home, nil, nil, nil)
+	if err != nil {
+		t.Skipf("overlay2 is not supported: %v", err)
+	}
+	defer driver.Cleanup()
+	d := driver.(*Driver)
+
+	for _, id := range []string{"base", "unlinked", "nolinkfile", "nodiff"} {
+		if err := d.Create(id, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.CreateReadWrite("top", "base", nil); err != nil {
+		t.Fatal(err)
+	}
+	// A removal interrupted after removing the link, a creation interrupted
+	// before writing the link file, a removal which got to the diff
+	// directory, a deferred removal and a link to a missing layer.
+	if err := os.Remove(path.Join(home, linkDir, mustReadLink(t, d, "unlinked"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path.Join(d.dir("nolinkfile"), "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(d.getDiffPath("nodiff")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path.Join(graphdriver.RemovingPath(d.dir("deferred")), "diff"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../gone/diff", path.Join(home, linkDir, "DANGLING")); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := graphdriver.Reconcile(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"deferred", "nodiff", "nolinkfile", "unlinked"}
+	if strings.Join(ids, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v to be reconciled, got %v", expected, ids)
+	}
+	for _, id := range expected {
+		if d.Exists(id) {
+			t.Fatalf("expected %s to be removed", id)
+		}
+	}
+	if _, err := os.Lstat(path.Join(home, linkDir, "DANGLING")); !os.IsNotExist(err) {
+		t.Fatalf("expected the dangling link to be removed, got %v", err)
+	}
+
+	// The complete layers are left alone.
+	if _, err := d.Get("top", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put("top"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// TestLowerPageCacheIsShared checks that the layers of containers sharing a
+// lower layer read its files through the same inodes, so that the page cache
+// of the lower layer is shared. This is best-effort, as the pages may be
+// evicted while the test runs.
+func TestLowerPageCacheIsShared(t *testing.T) {
+	home, err := ioutil.TempDir("", "overlay2-page-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	driver, err := Init(home, nil, nil, nil)
+	if err != nil {
+		t.Skipf("overlay2 is not supported: %v", err)
+	}
+	defer driver.Cleanup()
+	d := driver.(*Driver)
+
+	if err := d.Create("base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	lower := path.Join(d.dir("base"), "diff", "file")
+	if err := ioutil.WriteFile(lower, make([]byte, 16*os.Getpagesize()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var lowerStat syscall.Stat_t
+	if err := syscall.Stat(lower, &lowerStat); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"c1", "c2"} {
+		if err := d.CreateReadWrite(id, "base", nil); err != nil {
+			t.Fatal(err)
+		}
+		mnt, err := d.Get(id, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Put(id)
+
+		var st syscall.Stat_t
+		if err := syscall.Stat(path.Join(mnt, "file"), &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.Ino != lowerStat.Ino {
+			t.Fatalf("expected %s to read the file of the lower layer (inode %d), got inode %d", id, lowerStat.Ino, st.Ino)
+		}
+
+		resident, err := residentPages(path.Join(mnt, "file"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resident == 0 {
+			t.Fatalf("expected the pages of the lower layer written to be in the page cache of %s", id)
+		}
+	}
+}
+
+func TestCreateOnTmpfs(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting a tmpfs requires root")
+	}
+	home, err := ioutil.TempDir("", "overlay2-tmpfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	driver, err := Init(home, nil, nil, nil)
+	if err != nil {
+		t.Skipf("overlay2 is not supported: %v", err)
+	}
+	defer driver.Cleanup()
+	d := driver.(*Driver)
+
+	if err := d.Create("base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(d.dir("base"), "diff", "lower"), []byte("lower"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := &graphdriver.CreateOpts{StorageOpt: map[string]string{"tmpfs": "16m"}}
+	if err := d.CreateReadWrite("scratch", "base", opts); err != nil {
+		t.Fatal(err)
+	}
+	dir := d.dir("scratch")
+	if mounted, err := mount.Mounted(dir); err != nil || !mounted {
+		t.Fatalf("expected %s to be a mount point: %v", dir, err)
+	}
+	for _, sub := range []string{"diff", "work"} {
+		magic, err := graphdriver.GetFSMagic(path.Join(dir, sub))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if magic != graphdriver.FsMagicTmpFs {
+			t.Fatalf("expected %s to be on tmpfs, got %s", sub, graphdriver.FsName(magic))
+		}
+	}
+
+	mnt, err := d.Get("scratch", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(mnt, "upper"), []byte("upper"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"lower": "lower", "upper": "upper"} {
+		data, err := ioutil.ReadFile(path.Join(mnt, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Fatalf("expected %s to hold %q, got %q", name, expected, data)
+		}
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, "diff", "upper"))
+	if err != nil || string(data) != "upper" {
+		t.Fatalf("expected the write to land on the tmpfs: %q, %v", data, err)
+	}
+	if err := d.Put("scratch"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Remove("scratch"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed, got %v", dir, err)
+	}
+
+	for _, storageOpt := range []map[string]string{{"tmpfs": "0"}, {"tmpfs": "big"}, {"tmpfs": "16m", "size": "16m"}} {
+		opts := &graphdriver.CreateOpts{StorageOpt: storageOpt}
+		if err := d.CreateReadWrite("invalid", "base", opts); err == nil {
+			t.Fatalf("expected %v to be refused", storageOpt)
+		}
+	}
+}
+
+func TestCreateCopyUp(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting an overlay requires root")
+	}
+	home, err := ioutil.TempDir("", "overlay2-copyup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	driver, err := Init(home, nil, nil, nil)
+	if err != nil {
+		t.Skipf("overlay2 is not supported: %v", err)
+	}
+	defer driver.Cleanup()
+	d := driver.(*Driver)
+
+	if err := d.Create("base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	base := path.Join(d.dir("base"), "diff")
+	if err := os.MkdirAll(path.Join(base, "etc", "conf.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"etc/hosts", "etc/conf.d/app", "etc/conf.d/db", "untouched"} {
+		if err := ioutil.WriteFile(path.Join(base, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := &graphdriver.CreateOpts{StorageOpt: map[string]string{"copyup": "/etc/hosts, etc/conf.d,missing"}}
+	if err := d.CreateReadWrite("container", "base", opts); err != nil {
+		t.Fatal(err)
+	}
+
+	diff := path.Join(d.dir("container"), "diff")
+	for _, name := range []string{"etc/hosts", "etc/conf.d/app", "etc/conf.d/db"} {
+		data, err := ioutil.ReadFile(path.Join(diff, name))
+		if err != nil {
+			t.Fatalf("expected %s to be copied up: %v", name, err)
+		}
+		if string(data) != name {
+			t.Fatalf("expected %s to hold %q, got %q", name, name, data)
+		}
+	}
+	if _, err := os.Lstat(path.Join(diff, "untouched")); !os.IsNotExist(err) {
+		t.Fatalf("expected untouched not to be copied up, got %v", err)
+	}
+
+	// The copied up files are written to without the kernel copying
+	// them up again.
+	mnt, err := d.Get("container", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(mnt, "etc", "hosts"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put("container"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(path.Join(diff, "etc", "hosts")); err != nil || string(data) != "changed" {
+		t.Fatalf("expected the write to land in the diff directory: %q, %v", data, err)
+	}
+	if data, err := ioutil.ReadFile(path.Join(base, "etc", "hosts")); err != nil || string(data) != "etc/hosts" {
+		t.Fatalf("expected the lower layer to be unchanged: %q, %v", data, err)
+	}
+}
+
+// residentPages maps the file at path and returns how many of its pages are
+// in the page cache.
+func residentPages(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.Munmap(data)
+
+	pageSize := os.Getpagesize()
+	vec := make([]byte, (len(data)+pageSize-1)/pageSize)
+	if _, _, errno := syscall.Syscall(syscall.SYS_MINCORE, uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), uintptr(unsafe.Pointer(&vec[0]))); errno != 0 {
+		return 0, errno
+	}
+	resident := 0
+	for _, v := range vec {
+		resident += int(v & 1)
+	}
+	return resident, nil
+}
@@ -3,16 +3,17 @@
 package overlayutils
 
 import (
-	"errors"
 	"fmt"
+
+	"github.com/docker/docker/daemon/graphdriver"
 )
 
 // ErrDTypeNotSupported denotes that the backing filesystem doesn't support d_type.
 func ErrDTypeNotSupported(driver, backingFs string) error {
-	msg := fmt.Sprintf("%s: the backing %s filesystem is formatted without d_type support, which leads to incorrect behavior.", driver, backingFs)
+	reason := fmt.Sprintf("the backing %s filesystem is formatted without d_type support, which leads to incorrect behavior.", backingFs)
 	if backingFs == "xfs" {
-		msg += " Reformat the filesystem with ftype=1 to enable d_type support."
+		reason += " Reformat the filesystem with ftype=1 to enable d_type support."
 	}
-	msg += " Running without d_type support will no longer be supported in Docker 17.12."
-	return errors.New(msg)
+	reason += " Backing filesystems without d_type support are not supported."
+	return &graphdriver.NotSupportedError{Driver: driver, Reason: reason}
 }
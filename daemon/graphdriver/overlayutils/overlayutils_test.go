@@ -0,0 +1,18 @@
+// +build linux
+
+package overlayutils
+
+import (
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrDTypeNotSupported(t *testing.T) {
+	err := ErrDTypeNotSupported("overlay2", "xfs")
+	assert.IsType(t, &graphdriver.NotSupportedError{}, err)
+	assert.EqualError(t, err, "overlay2 is not supported: the backing xfs filesystem is formatted without d_type support, which leads to incorrect behavior. Reformat the filesystem with ftype=1 to enable d_type support. Backing filesystems without d_type support are not supported.")
+
+	assert.EqualError(t, ErrDTypeNotSupported("overlay", "extfs"), "overlay is not supported: the backing extfs filesystem is formatted without d_type support, which leads to incorrect behavior. Backing filesystems without d_type support are not supported.")
+}
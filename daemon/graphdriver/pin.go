@@ -0,0 +1,70 @@
+package graphdriver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// PinnedError is returned when removing a layer which is pinned.
+type PinnedError struct {
+	// ID is the layer which was to be removed.
+	ID string
+}
+
+func (e *PinnedError) Error() string {
+	return fmt.Sprintf("graphdriver: layer %s is pinned", e.ID)
+}
+
+// PinDriver is the interface for drivers whose layers can be pinned against
+// removal, e.g. the layers of build caches and base images which are still
+// useful. Unlike leases, pins are persistent: they are kept on disk and
+// survive restarts of the daemon.
+type PinDriver interface {
+	// Pin pins the layer id, which must exist: removing it fails with a
+	// *PinnedError until it is unpinned. Pinning a pinned layer does
+	// nothing.
+	Pin(id string) error
+	// Unpin unpins the layer id. Unpinning a layer which is not pinned does
+	// nothing.
+	Unpin(id string) error
+}
+
+// Pin pins the layer id of d if d supports it, and returns ErrNotSupported
+// otherwise.
+func Pin(d ProtoDriver, id string) error {
+	if pd, ok := d.(PinDriver); ok {
+		return pd.Pin(id)
+	}
+	return ErrNotSupported
+}
+
+// Unpin unpins the layer id of d if d supports it, and returns
+// ErrNotSupported otherwise.
+func Unpin(d ProtoDriver, id string) error {
+	if pd, ok := d.(PinDriver); ok {
+		return pd.Unpin(id)
+	}
+	return ErrNotSupported
+}
+
+// PinLayer pins a layer by creating its pin file, the path of the marker
+// the driver keeps for it.
+func PinLayer(pinFile string) error {
+	return ioutil.WriteFile(pinFile, nil, 0600)
+}
+
+// UnpinLayer unpins a layer by removing its pin file.
+func UnpinLayer(pinFile string) error {
+	if err := os.Remove(pinFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// IsLayerPinned returns whether the layer whose pin file is pinFile is
+// pinned.
+func IsLayerPinned(pinFile string) bool {
+	_, err := os.Lstat(pinFile)
+	return err == nil
+}
@@ -0,0 +1,48 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPin(t *testing.T) {
+	root, err := ioutil.TempDir("", "graphdriver-pin")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	d, err := graphdriver.New("vfs", nil, graphdriver.Options{Root: root})
+	require.NoError(t, err)
+	require.NoError(t, d.Create("base", "", nil))
+	require.NoError(t, graphdriver.Pin(d, "base"))
+	require.NoError(t, graphdriver.Pin(d, "base"))
+	assert.Error(t, graphdriver.Pin(d, "missing"))
+
+	err = d.Remove("base")
+	assert.Equal(t, &graphdriver.PinnedError{ID: "base"}, err)
+	assert.True(t, d.Exists("base"))
+	require.NoError(t, d.Cleanup())
+
+	// The pin survives a restart of the driver.
+	d, err = graphdriver.New("vfs", nil, graphdriver.Options{Root: root})
+	require.NoError(t, err)
+	defer d.Cleanup()
+	assert.IsType(t, &graphdriver.PinnedError{}, d.Remove("base"))
+	assert.True(t, d.Exists("base"))
+
+	require.NoError(t, graphdriver.Unpin(d, "base"))
+	require.NoError(t, graphdriver.Unpin(d, "base"))
+	require.NoError(t, d.Remove("base"))
+	assert.False(t, d.Exists("base"))
+}
+
+func TestPinNotSupported(t *testing.T) {
+	assert.Equal(t, graphdriver.ErrNotSupported, graphdriver.Pin(upgradeDriver{}, "layer"))
+	assert.Equal(t, graphdriver.ErrNotSupported, graphdriver.Unpin(upgradeDriver{}, "layer"))
+}
@@ -38,6 +38,5 @@ func newPluginDriver(name string, pl plugingetter.CompatPlugin, config Options)
 			}
 		}
 	}
-	proxy := &graphDriverProxy{name, pl, Capabilities{}}
-	return proxy, proxy.Init(filepath.Join(home, name), config.DriverOptions, config.UIDMaps, config.GIDMaps)
+	return NewProxyDriver(name, pl, filepath.Join(home, name), config.DriverOptions, config.UIDMaps, config.GIDMaps)
 }
@@ -43,6 +43,13 @@ type graphDriverInitRequest struct {
 	GIDMaps []idtools.IDMap `json:"GIDMaps"`
 }
 
+// NewProxyDriver returns a Driver which forwards all calls to pl using the
+// graphdriver plugin protocol, after initializing it with home and opts.
+func NewProxyDriver(name string, pl plugingetter.CompatPlugin, home string, opts []string, uidMaps, gidMaps []idtools.IDMap) (Driver, error) {
+	proxy := &graphDriverProxy{name, pl, Capabilities{}}
+	return proxy, proxy.Init(home, opts, uidMaps, gidMaps)
+}
+
 func (d *graphDriverProxy) Init(home string, opts []string, uidMaps, gidMaps []idtools.IDMap) error {
 	if !d.p.IsV1() {
 		if cp, ok := d.p.(plugingetter.CountedPlugin); ok {
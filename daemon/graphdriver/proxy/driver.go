@@ -0,0 +1,77 @@
+// Package proxy provides a storage driver which forwards all calls to an
+// external process speaking the graphdriver plugin protocol, so that drivers
+// can be prototyped out-of-process without being packaged as a plugin.
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/docker/docker/pkg/parsers"
+	"github.com/docker/docker/pkg/plugins"
+)
+
+func init() {
+	graphdriver.Register("proxy", Init)
+}
+
+// Init returns a driver forwarding to the process listening on the address
+// set with the "proxy.address" option, e.g. "unix:///run/mydriver.sock".
+// Options not prefixed with "proxy." are passed on to the external driver.
+// Without an address, the driver is reported as not supported so that it is
+// skipped when a driver is picked automatically.
+func Init(home string, options []string, uidMaps, gidMaps []idtools.IDMap) (graphdriver.Driver, error) {
+	var (
+		address string
+		opts    []string
+	)
+	for _, option := range options {
+		key, val, err := parsers.ParseKeyValueOpt(option)
+		if err != nil {
+			return nil, err
+		}
+		key = strings.ToLower(key)
+		switch {
+		case key == "proxy.address":
+			address = val
+		case strings.HasPrefix(key, "proxy."):
+			return nil, fmt.Errorf("proxy: Unknown option %s", key)
+		default:
+			opts = append(opts, option)
+		}
+	}
+	if address == "" {
+		return nil, graphdriver.ErrNotSupported
+	}
+
+	client, err := plugins.NewClient(address, nil)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: invalid address %s: %v", address, err)
+	}
+	return graphdriver.NewProxyDriver("proxy", &remote{client: client}, home, opts, uidMaps, gidMaps)
+}
+
+// remote is the external driver process, exposed in the form expected by
+// graphdriver.NewProxyDriver. Paths returned by the process are used as is,
+// so they must be absolute paths in the daemon's mount namespace.
+type remote struct {
+	client *plugins.Client
+}
+
+func (r *remote) Client() *plugins.Client {
+	return r.client
+}
+
+func (r *remote) Name() string {
+	return "proxy"
+}
+
+func (r *remote) BasePath() string {
+	return ""
+}
+
+func (r *remote) IsV1() bool {
+	return true
+}
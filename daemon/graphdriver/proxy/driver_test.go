@@ -0,0 +1,193 @@
+// +build linux
+
+package proxy
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/daemon/graphdriver/vfs"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/reexec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	reexec.Init()
+}
+
+type fakeRequest struct {
+	ID     string
+	Parent string
+	Home   string
+	Opts   []string
+}
+
+type fakeResponse struct {
+	Err     string           `json:",omitempty"`
+	Dir     string           `json:",omitempty"`
+	Exists  bool             `json:",omitempty"`
+	Status  [][2]string      `json:",omitempty"`
+	Changes []archive.Change `json:",omitempty"`
+	Size    int64            `json:",omitempty"`
+}
+
+// fakeServer serves the graphdriver plugin protocol on a unix socket,
+// backed by an in-process vfs driver.
+type fakeServer struct {
+	driver graphdriver.Driver
+	opts   []string
+}
+
+func (s *fakeServer) handle(mux *http.ServeMux, method string, fn func(req fakeRequest) (fakeResponse, error)) {
+	mux.HandleFunc("/GraphDriver."+method, func(w http.ResponseWriter, r *http.Request) {
+		var req fakeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		resp, err := fn(req)
+		if err != nil {
+			resp.Err = err.Error()
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+func startFakeServer(t *testing.T, dir string) (*fakeServer, string, func()) {
+	s := &fakeServer{}
+	mux := http.NewServeMux()
+	s.handle(mux, "Init", func(req fakeRequest) (fakeResponse, error) {
+		var err error
+		s.opts = req.Opts
+		s.driver, err = vfs.Init(req.Home, nil, nil, nil)
+		return fakeResponse{}, err
+	})
+	s.handle(mux, "Create", func(req fakeRequest) (fakeResponse, error) {
+		return fakeResponse{}, s.driver.Create(req.ID, req.Parent, nil)
+	})
+	s.handle(mux, "CreateReadWrite", func(req fakeRequest) (fakeResponse, error) {
+		return fakeResponse{}, s.driver.CreateReadWrite(req.ID, req.Parent, nil)
+	})
+	s.handle(mux, "Remove", func(req fakeRequest) (fakeResponse, error) {
+		return fakeResponse{}, s.driver.Remove(req.ID)
+	})
+	s.handle(mux, "Get", func(req fakeRequest) (fakeResponse, error) {
+		dir, err := s.driver.Get(req.ID, "")
+		return fakeResponse{Dir: dir}, err
+	})
+	s.handle(mux, "Put", func(req fakeRequest) (fakeResponse, error) {
+		return fakeResponse{}, s.driver.Put(req.ID)
+	})
+	s.handle(mux, "Exists", func(req fakeRequest) (fakeResponse, error) {
+		return fakeResponse{Exists: s.driver.Exists(req.ID)}, nil
+	})
+	s.handle(mux, "Status", func(req fakeRequest) (fakeResponse, error) {
+		return fakeResponse{Status: [][2]string{{"Backend", s.driver.String()}}}, nil
+	})
+	s.handle(mux, "Changes", func(req fakeRequest) (fakeResponse, error) {
+		changes, err := s.driver.Changes(req.ID, req.Parent)
+		return fakeResponse{Changes: changes}, err
+	})
+	mux.HandleFunc("/GraphDriver.Diff", func(w http.ResponseWriter, r *http.Request) {
+		var req fakeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		rc, err := s.driver.Diff(req.ID, req.Parent)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rc.Close()
+		io.Copy(w, rc)
+	})
+	mux.HandleFunc("/GraphDriver.ApplyDiff", func(w http.ResponseWriter, r *http.Request) {
+		var resp fakeResponse
+		size, err := s.driver.ApplyDiff(r.URL.Query().Get("id"), r.URL.Query().Get("parent"), r.Body)
+		if err != nil {
+			resp.Err = err.Error()
+		}
+		resp.Size = size
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	socket := filepath.Join(dir, "driver.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	go http.Serve(l, mux)
+	return s, "unix://" + socket, func() { l.Close() }
+}
+
+func TestProxyDriver(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "graphdriver-proxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	server, address, stop := startFakeServer(t, tmp)
+	defer stop()
+	home := filepath.Join(tmp, "proxy")
+	d, err := Init(home, []string{"proxy.address=" + address, "vfs.option=1"}, nil, nil)
+	require.NoError(t, err)
+	defer d.Cleanup()
+
+	assert.Equal(t, "proxy", d.String())
+	assert.Equal(t, []string{"vfs.option=1"}, server.opts)
+	assert.Equal(t, [][2]string{{"Backend", "vfs"}}, d.Status())
+
+	require.NoError(t, d.Create("base", "", nil))
+	assert.True(t, d.Exists("base"))
+	assert.False(t, d.Exists("missing"))
+
+	diff, err := archive.Generate("file", "content")
+	require.NoError(t, err)
+	_, err = d.ApplyDiff("base", "", diff)
+	require.NoError(t, err)
+
+	require.NoError(t, d.CreateReadWrite("top", "base", nil))
+	dir, err := d.Get("top", "")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(home, "dir", "top"), dir)
+	content, err := ioutil.ReadFile(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(content))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "added"), []byte("added"), 0644))
+	require.NoError(t, d.Put("top"))
+
+	changes, err := d.Changes("top", "base")
+	require.NoError(t, err)
+	assert.Equal(t, []archive.Change{{Path: "/added", Kind: archive.ChangeAdd}}, changes)
+
+	rc, err := d.Diff("top", "base")
+	require.NoError(t, err)
+	var names []string
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	require.NoError(t, rc.Close())
+	assert.Equal(t, []string{"added"}, names)
+
+	require.NoError(t, d.Remove("top"))
+	assert.False(t, d.Exists("top"))
+
+	err = d.Create("orphan", "missing", nil)
+	assert.Error(t, err)
+}
+
+func TestProxyDriverOptions(t *testing.T) {
+	_, err := Init("/nonexistent", nil, nil, nil)
+	assert.Equal(t, graphdriver.ErrNotSupported, err)
+
+	_, err = Init("/nonexistent", []string{"proxy.unknown=1"}, nil, nil)
+	assert.EqualError(t, err, "proxy: Unknown option proxy.unknown")
+}
@@ -0,0 +1,22 @@
+package graphdriver
+
+// ReclaimableSpaceDriver is the interface for drivers which can tell how
+// much disk space removing layers would free.
+type ReclaimableSpaceDriver interface {
+	// ReclaimableSpace returns the number of bytes of disk space removing
+	// the layers unusedIDs would free. This is the space allocated to
+	// their files, rather than the apparent size of the files, and the
+	// blocks the layers share with each other are only counted once,
+	// while those they share with other layers are not counted.
+	ReclaimableSpace(unusedIDs []string) (int64, error)
+}
+
+// ReclaimableSpace returns the number of bytes of disk space removing the
+// layers unusedIDs of d would free if d supports it, and ErrNotSupported
+// otherwise.
+func ReclaimableSpace(d ProtoDriver, unusedIDs []string) (int64, error) {
+	if rd, ok := d.(ReclaimableSpaceDriver); ok {
+		return rd.ReclaimableSpace(unusedIDs)
+	}
+	return 0, ErrNotSupported
+}
@@ -0,0 +1,151 @@
+package graphdriver
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// fsIocFiemap is the FS_IOC_FIEMAP ioctl, which maps the extents of a
+	// file.
+	fsIocFiemap = 0xc020660b
+	// fiemapExtentLast and fiemapExtentShared are the flags of the last
+	// extent of a file and of the extents shared with other files, e.g.
+	// by reflinks.
+	fiemapExtentLast   = 0x1
+	fiemapExtentShared = 0x2000
+	// fiemapExtentCount is the number of extents mapped per ioctl.
+	fiemapExtentCount = 32
+)
+
+// fiemapExtent is struct fiemap_extent.
+type fiemapExtent struct {
+	logical  uint64
+	physical uint64
+	length   uint64
+	_        [2]uint64
+	flags    uint32
+	_        [3]uint32
+}
+
+// fiemap is struct fiemap followed by its extents.
+type fiemap struct {
+	start         uint64
+	length        uint64
+	flags         uint32
+	mappedExtents uint32
+	extentCount   uint32
+	_             uint32
+	extents       [fiemapExtentCount]fiemapExtent
+}
+
+// sharedBytes returns the number of bytes of the file path which are in
+// extents shared with other files. Filesystems which cannot map the extents
+// of files do not share them, so 0 is returned for them.
+func sharedBytes(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var shared int64
+	m := fiemap{length: ^uint64(0), extentCount: fiemapExtentCount}
+	for {
+		m.mappedExtents = 0
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(&m))); errno != 0 {
+			if errno == syscall.EOPNOTSUPP || errno == syscall.ENOTTY {
+				return 0, nil
+			}
+			return 0, errno
+		}
+		if m.mappedExtents == 0 {
+			return shared, nil
+		}
+		for _, e := range m.extents[:m.mappedExtents] {
+			if e.flags&fiemapExtentShared != 0 {
+				shared += int64(e.length)
+			}
+			if e.flags&fiemapExtentLast != 0 {
+				return shared, nil
+			}
+		}
+		last := m.extents[m.mappedExtents-1]
+		m.start = last.logical + last.length
+	}
+}
+
+// diskInode is an inode found by DiskUsage.
+type diskInode struct {
+	size  int64
+	links uint64
+	seen  uint64
+}
+
+// DiskUsage returns the number of bytes of disk space the files below dirs
+// would free if they were removed. The blocks allocated to files are
+// counted rather than their apparent size. Files hardlinked below dirs are
+// counted once, and not at all if they are also linked elsewhere, and so
+// are the extents of files shared with other files, e.g. by reflinks.
+// Mounts below dirs are not walked.
+func DiskUsage(dirs ...string) (int64, error) {
+	var total int64
+	inodes := make(map[[2]uint64]*diskInode)
+	for _, dir := range dirs {
+		var rootDev uint64
+		err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			st, ok := fi.Sys().(*syscall.Stat_t)
+			if !ok {
+				return nil
+			}
+			if path == dir {
+				rootDev = uint64(st.Dev)
+			} else if uint64(st.Dev) != rootDev {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			size := st.Blocks * 512
+			if fi.IsDir() {
+				total += size
+				return nil
+			}
+			key := [2]uint64{uint64(st.Dev), st.Ino}
+			inode, ok := inodes[key]
+			if !ok {
+				if fi.Mode().IsRegular() {
+					shared, err := sharedBytes(path)
+					if err != nil {
+						return err
+					}
+					size -= shared
+				}
+				if size < 0 {
+					size = 0
+				}
+				inode = &diskInode{size: size, links: uint64(st.Nlink)}
+				inodes[key] = inode
+			}
+			inode.seen++
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	for _, inode := range inodes {
+		if inode.seen >= inode.links {
+			total += inode.size
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,66 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// diskSize returns the disk space allocated to path.
+func diskSize(t *testing.T, path string) int64 {
+	var st syscall.Stat_t
+	require.NoError(t, syscall.Lstat(path, &st))
+	return st.Blocks * 512
+}
+
+func TestReclaimableSpaceSharedFiles(t *testing.T) {
+	d, _, cleanup := newVfsDriver(t)
+	defer cleanup()
+
+	dirs := make(map[string]string)
+	for _, id := range []string{"a", "b"} {
+		require.NoError(t, d.Create(id, "", nil))
+		dir, err := d.Get(id, "")
+		require.NoError(t, err)
+		dirs[id] = dir
+	}
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dirs["a"], "shared"), data, 0644))
+	require.NoError(t, os.Link(filepath.Join(dirs["a"], "shared"), filepath.Join(dirs["b"], "shared")))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dirs["b"], "own"), data, 0644))
+	shared := diskSize(t, filepath.Join(dirs["a"], "shared"))
+	own := diskSize(t, filepath.Join(dirs["b"], "own"))
+	require.True(t, shared > 0 && own > 0)
+
+	// The shared file is still used by the other layer.
+	size, err := graphdriver.ReclaimableSpace(d, []string{"a"})
+	require.NoError(t, err)
+	assert.Equal(t, diskSize(t, dirs["a"]), size)
+	size, err = graphdriver.ReclaimableSpace(d, []string{"b"})
+	require.NoError(t, err)
+	assert.Equal(t, diskSize(t, dirs["b"])+own, size)
+
+	// The shared file is counted once.
+	size, err = graphdriver.ReclaimableSpace(d, []string{"a", "b"})
+	require.NoError(t, err)
+	assert.Equal(t, diskSize(t, dirs["a"])+diskSize(t, dirs["b"])+shared+own, size)
+
+	// Layers which do not exist free nothing.
+	size, err = graphdriver.ReclaimableSpace(d, []string{"missing"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+}
+
+func TestReclaimableSpaceNotSupported(t *testing.T) {
+	_, err := graphdriver.ReclaimableSpace(upgradeDriver{}, []string{"a"})
+	assert.Equal(t, graphdriver.ErrNotSupported, err)
+}
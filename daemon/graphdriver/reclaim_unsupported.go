@@ -0,0 +1,8 @@
+// +build !linux
+
+package graphdriver
+
+// DiskUsage is not supported on this platform.
+func DiskUsage(dirs ...string) (int64, error) {
+	return 0, ErrNotSupported
+}
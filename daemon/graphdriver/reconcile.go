@@ -0,0 +1,21 @@
+package graphdriver
+
+// ReconcileDriver is the interface for layered file system drivers that can
+// detect and repair the layers left in an inconsistent state by a daemon
+// which did not shut down cleanly.
+type ReconcileDriver interface {
+	// Reconcile removes what is left of the layers whose creation or
+	// removal was interrupted, repairs the layers which can be repaired,
+	// and returns the ids of the layers it removed or repaired. It must
+	// be called before the driver is used.
+	Reconcile() ([]string, error)
+}
+
+// Reconcile reconciles the layers of d if it supports it, and does nothing
+// otherwise.
+func Reconcile(d ProtoDriver) ([]string, error) {
+	if reconciler, ok := d.(ReconcileDriver); ok {
+		return reconciler.Reconcile()
+	}
+	return nil, nil
+}
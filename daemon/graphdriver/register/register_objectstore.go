@@ -0,0 +1,8 @@
+// +build !exclude_graphdriver_objectstore,linux
+
+package register
+
+import (
+	// register the objectstore graphdriver
+	_ "github.com/docker/docker/daemon/graphdriver/objectstore"
+)
@@ -0,0 +1,8 @@
+// +build !exclude_graphdriver_proxy,!windows
+
+package register
+
+import (
+	// register the proxy graphdriver
+	_ "github.com/docker/docker/daemon/graphdriver/proxy"
+)
@@ -0,0 +1,357 @@
+package graphdriver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/ioutils"
+	"github.com/opencontainers/go-digest"
+)
+
+// RemoteLayerDriver is the interface for layered file system drivers which
+// can register a layer whose content is served by a remote backend, instead
+// of extracting it when it is pulled.
+type RemoteLayerDriver interface {
+	Driver
+	// ApplyRemoteDiff creates the layer id on top of parent, whose content
+	// is the diff described by desc. The content is fetched when the layer,
+	// or a layer on top of it, is first mounted with Get.
+	ApplyRemoteDiff(id, parent string, desc RemoteDescriptor) error
+}
+
+// RemoteDescriptor describes the diff of a remotely-backed layer.
+type RemoteDescriptor struct {
+	MediaType string        `json:"mediaType,omitempty"`
+	Digest    digest.Digest `json:"digest"`
+	Size      int64         `json:"size"`
+	URLs      []string      `json:"urls,omitempty"`
+}
+
+// RemoteFetcher returns the uncompressed diff of a remotely-backed layer.
+type RemoteFetcher func(desc RemoteDescriptor) (io.ReadCloser, error)
+
+// remoteLayerState is the record of the layers of a remoteLayerDriver whose
+// content was not fetched yet.
+type remoteLayerState struct {
+	// Pending maps the IDs of the layers which were not fetched yet to the
+	// descriptions of their diffs.
+	Pending map[string]RemoteDescriptor `json:"pending"`
+	// Parents maps the IDs of the layers on top of pending layers to the
+	// IDs of their parents.
+	Parents map[string]string `json:"parents"`
+}
+
+// remoteLayerDriver wraps a Driver and creates the layers registered with
+// ApplyRemoteDiff empty, applying their diff on first use.
+type remoteLayerDriver struct {
+	Driver
+	fetch RemoteFetcher
+	path  string
+	// unionParents is set if the layers of the driver reference their
+	// parents instead of copying them, so that the parents of a layer can
+	// be fetched after it is created.
+	unionParents bool
+
+	// fetchMu serializes the fetches of layers.
+	fetchMu sync.Mutex
+
+	mu    sync.Mutex
+	state remoteLayerState
+}
+
+// remoteLayerDiffGetterDriver is a remoteLayerDriver which keeps the DiffGetter
+// method of the driver it wraps.
+type remoteLayerDiffGetterDriver struct {
+	*remoteLayerDriver
+	getter DiffGetterDriver
+}
+
+func (d *remoteLayerDiffGetterDriver) DiffGetter(id string) (FileGetCloser, error) {
+	if err := d.ensureFetched(id); err != nil {
+		return nil, err
+	}
+	return d.getter.DiffGetter(id)
+}
+
+// remoteLayerPath returns the path of the file recording the pending remote
+// layers of the driver name, which is kept next to its home directory in
+// root.
+func remoteLayerPath(root, name string) string {
+	return filepath.Join(root, name+"-remote.json")
+}
+
+// referencesParents returns whether the layers of d reference the layers
+// they are created on top of, instead of copying them.
+func referencesParents(d Driver) bool {
+	switch d.String() {
+	case "aufs", "overlay", "overlay2":
+		return true
+	}
+	return false
+}
+
+// WithRemoteLayers returns a RemoteLayerDriver which fetches the diffs of
+// the layers registered with ApplyRemoteDiff using fetch, and applies them
+// with d. The layers which were not fetched yet are recorded in root, so
+// that they are fetched after a restart. If the layers of d are copies of
+// their parents, the parents are fetched when a layer is created on top of
+// them. The returned driver keeps the Capabilities and DiffGetter methods
+// of d, if it has them.
+func WithRemoteLayers(d Driver, root string, fetch RemoteFetcher) (RemoteLayerDriver, error) {
+	rd := &remoteLayerDriver{
+		Driver:       d,
+		fetch:        fetch,
+		path:         remoteLayerPath(root, d.String()),
+		unionParents: referencesParents(d),
+		state: remoteLayerState{
+			Pending: make(map[string]RemoteDescriptor),
+			Parents: make(map[string]string),
+		},
+	}
+
+	data, err := ioutil.ReadFile(rd.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var state remoteLayerState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, err
+		}
+		if state.Pending != nil {
+			rd.state.Pending = state.Pending
+		}
+		if state.Parents != nil {
+			rd.state.Parents = state.Parents
+		}
+	}
+	if getter, ok := d.(DiffGetterDriver); ok {
+		return &remoteLayerDiffGetterDriver{remoteLayerDriver: rd, getter: getter}, nil
+	}
+	return rd, nil
+}
+
+// Capabilities returns the capabilities of the underlying driver.
+func (d *remoteLayerDriver) Capabilities() Capabilities {
+	if capDriver, ok := d.Driver.(CapabilityDriver); ok {
+		return capDriver.Capabilities()
+	}
+	return Capabilities{}
+}
+
+// save records the state of the driver. It must be called with mu held.
+func (d *remoteLayerDriver) save() error {
+	data, err := json.Marshal(d.state)
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(d.path, data, 0600)
+}
+
+// hasPending returns whether id or one of its parents was not fetched yet.
+// It must be called with mu held.
+func (d *remoteLayerDriver) hasPending(id string) bool {
+	for ; id != ""; id = d.state.Parents[id] {
+		if _, ok := d.state.Pending[id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareParent fetches parent before a layer is created on top of it if
+// the driver copies parents.
+func (d *remoteLayerDriver) prepareParent(parent string) error {
+	if d.unionParents || parent == "" {
+		return nil
+	}
+	return d.ensureFetched(parent)
+}
+
+// recordParent records the parent of id if it is on top of a layer which
+// was not fetched yet.
+func (d *remoteLayerDriver) recordParent(id, parent string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.hasPending(parent) {
+		return nil
+	}
+	d.state.Parents[id] = parent
+	return d.save()
+}
+
+// ensureFetched fetches and applies the diffs of id and its parents which
+// were not fetched yet, starting from the bottom-most one.
+func (d *remoteLayerDriver) ensureFetched(id string) error {
+	d.fetchMu.Lock()
+	defer d.fetchMu.Unlock()
+
+	type pendingLayer struct {
+		id, parent string
+		desc       RemoteDescriptor
+	}
+	var chain []pendingLayer
+	d.mu.Lock()
+	for ; id != ""; id = d.state.Parents[id] {
+		if desc, ok := d.state.Pending[id]; ok {
+			chain = append(chain, pendingLayer{id: id, parent: d.state.Parents[id], desc: desc})
+		}
+	}
+	d.mu.Unlock()
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		l := chain[i]
+		if err := d.fetchLayer(l.id, l.parent, l.desc); err != nil {
+			return fmt.Errorf("failed to fetch remote layer %s (%s): %v", l.id, l.desc.Digest, err)
+		}
+	}
+	return nil
+}
+
+// fetchLayer fetches the diff of the layer id and applies it.
+func (d *remoteLayerDriver) fetchLayer(id, parent string, desc RemoteDescriptor) error {
+	logrus.Debugf("[graphdriver] fetching remote layer %s (%s)", id, desc.Digest)
+	rc, err := d.fetch(desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	verifier := desc.Digest.Verifier()
+	diff := io.TeeReader(rc, verifier)
+	if _, err := d.Driver.ApplyDiff(id, parent, diff); err != nil {
+		return err
+	}
+	// The padding at the end of the archive is not read by ApplyDiff.
+	if _, err := io.Copy(ioutil.Discard, diff); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("digest mismatch, expected %s", desc.Digest)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.state.Pending, id)
+	return d.save()
+}
+
+// Status returns the status of the underlying driver with the number of
+// layers which were not fetched yet appended.
+func (d *remoteLayerDriver) Status() [][2]string {
+	d.mu.Lock()
+	pending := len(d.state.Pending)
+	d.mu.Unlock()
+	return append(d.Driver.Status(), [2]string{"Pending Remote Layers", strconv.Itoa(pending)})
+}
+
+// ApplyRemoteDiff creates the layer id empty and records desc, so that its
+// diff is fetched on first use.
+func (d *remoteLayerDriver) ApplyRemoteDiff(id, parent string, desc RemoteDescriptor) error {
+	if err := desc.Digest.Validate(); err != nil {
+		return fmt.Errorf("invalid descriptor of remote layer %s: %v", id, err)
+	}
+	if err := d.prepareParent(parent); err != nil {
+		return err
+	}
+	if err := d.Driver.Create(id, parent, nil); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.state.Pending[id] = desc
+	if parent != "" {
+		d.state.Parents[id] = parent
+	}
+	if err := d.save(); err != nil {
+		delete(d.state.Pending, id)
+		delete(d.state.Parents, id)
+		d.Driver.Remove(id)
+		return err
+	}
+	return nil
+}
+
+func (d *remoteLayerDriver) Create(id, parent string, opts *CreateOpts) error {
+	if err := d.prepareParent(parent); err != nil {
+		return err
+	}
+	if err := d.Driver.Create(id, parent, opts); err != nil {
+		return err
+	}
+	return d.recordParent(id, parent)
+}
+
+func (d *remoteLayerDriver) CreateReadWrite(id, parent string, opts *CreateOpts) error {
+	if err := d.prepareParent(parent); err != nil {
+		return err
+	}
+	if err := d.Driver.CreateReadWrite(id, parent, opts); err != nil {
+		return err
+	}
+	return d.recordParent(id, parent)
+}
+
+// Remove removes the layer id, and forgets about its diff if it was not
+// fetched yet.
+func (d *remoteLayerDriver) Remove(id string) error {
+	if err := d.Driver.Remove(id); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, pending := d.state.Pending[id]
+	_, hasParent := d.state.Parents[id]
+	if !pending && !hasParent {
+		return nil
+	}
+	delete(d.state.Pending, id)
+	delete(d.state.Parents, id)
+	return d.save()
+}
+
+// Get fetches the diffs of id and its parents which were not fetched yet,
+// and mounts the layer.
+func (d *remoteLayerDriver) Get(id, mountLabel string) (string, error) {
+	if err := d.ensureFetched(id); err != nil {
+		return "", err
+	}
+	return d.Driver.Get(id, mountLabel)
+}
+
+func (d *remoteLayerDriver) Diff(id, parent string) (io.ReadCloser, error) {
+	if err := d.ensureFetched(id); err != nil {
+		return nil, err
+	}
+	return d.Driver.Diff(id, parent)
+}
+
+func (d *remoteLayerDriver) Changes(id, parent string) ([]archive.Change, error) {
+	if err := d.ensureFetched(id); err != nil {
+		return nil, err
+	}
+	return d.Driver.Changes(id, parent)
+}
+
+func (d *remoteLayerDriver) ApplyDiff(id, parent string, diff io.Reader) (int64, error) {
+	if err := d.ensureFetched(id); err != nil {
+		return 0, err
+	}
+	return d.Driver.ApplyDiff(id, parent, diff)
+}
+
+func (d *remoteLayerDriver) DiffSize(id, parent string) (int64, error) {
+	if err := d.ensureFetched(id); err != nil {
+		return 0, err
+	}
+	return d.Driver.DiffSize(id, parent)
+}
@@ -0,0 +1,176 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/daemon/graphdriver/overlay2"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRemote serves the diffs of layers on demand and counts the fetches.
+type fakeRemote struct {
+	mu      sync.Mutex
+	diffs   map[digest.Digest][]byte
+	fetches map[digest.Digest]int
+}
+
+func newFakeRemote() *fakeRemote {
+	return &fakeRemote{
+		diffs:   make(map[digest.Digest][]byte),
+		fetches: make(map[digest.Digest]int),
+	}
+}
+
+// add stores a diff holding files and returns its descriptor.
+func (r *fakeRemote) add(t *testing.T, files map[string]string) graphdriver.RemoteDescriptor {
+	dir, err := ioutil.TempDir("", "graphdriver-remote-diff")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for name, content := range files {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	rc, err := archive.Tar(dir, archive.Uncompressed)
+	require.NoError(t, err)
+	defer rc.Close()
+	diff, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+
+	dgst := digest.FromBytes(diff)
+	r.mu.Lock()
+	r.diffs[dgst] = diff
+	r.mu.Unlock()
+	return graphdriver.RemoteDescriptor{Digest: dgst, Size: int64(len(diff))}
+}
+
+func (r *fakeRemote) fetch(desc graphdriver.RemoteDescriptor) (io.ReadCloser, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	diff, ok := r.diffs[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("unknown diff %s", desc.Digest)
+	}
+	r.fetches[desc.Digest]++
+	return ioutil.NopCloser(bytes.NewReader(diff)), nil
+}
+
+func (r *fakeRemote) fetchCount(desc graphdriver.RemoteDescriptor) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fetches[desc.Digest]
+}
+
+func TestRemoteLayersAreFetchedOnFirstGet(t *testing.T) {
+	home, err := ioutil.TempDir("", "graphdriver-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	base, err := overlay2.Init(filepath.Join(home, "overlay2"), nil, nil, nil)
+	if err != nil {
+		t.Skipf("overlay2 is not supported: %v", err)
+	}
+	defer base.Cleanup()
+	remote := newFakeRemote()
+	d, err := graphdriver.WithRemoteLayers(base, home, remote.fetch)
+	require.NoError(t, err)
+
+	lower := remote.add(t, map[string]string{"lower": "lower content"})
+	upper := remote.add(t, map[string]string{"upper": "upper content"})
+	require.NoError(t, d.ApplyRemoteDiff("lower", "", lower))
+	require.NoError(t, d.ApplyRemoteDiff("upper", "lower", upper))
+	require.NoError(t, d.CreateReadWrite("container", "upper", nil))
+	assert.True(t, d.Exists("upper"))
+	assert.Equal(t, 0, remote.fetchCount(lower))
+	assert.Equal(t, 0, remote.fetchCount(upper))
+
+	dir, err := d.Get("container", "")
+	require.NoError(t, err)
+	for name, content := range map[string]string{"lower": "lower content", "upper": "upper content"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.Equal(t, content, string(data))
+	}
+	require.NoError(t, d.Put("container"))
+	assert.Equal(t, 1, remote.fetchCount(lower))
+	assert.Equal(t, 1, remote.fetchCount(upper))
+
+	// Fetched layers are not fetched again, including after a restart.
+	d, err = graphdriver.WithRemoteLayers(base, home, remote.fetch)
+	require.NoError(t, err)
+	_, err = d.Get("upper", "")
+	require.NoError(t, err)
+	require.NoError(t, d.Put("upper"))
+	assert.Equal(t, 1, remote.fetchCount(upper))
+}
+
+func TestRemoteLayersAreFetchedBeforeCopy(t *testing.T) {
+	base, home, cleanup := newVfsDriver(t)
+	defer cleanup()
+	remote := newFakeRemote()
+	d, err := graphdriver.WithRemoteLayers(base, home, remote.fetch)
+	require.NoError(t, err)
+
+	lower := remote.add(t, map[string]string{"lower": "lower content"})
+	require.NoError(t, d.ApplyRemoteDiff("lower", "", lower))
+	assert.Equal(t, 0, remote.fetchCount(lower))
+
+	// vfs copies the parent of a layer when creating it.
+	require.NoError(t, d.CreateReadWrite("container", "lower", nil))
+	assert.Equal(t, 1, remote.fetchCount(lower))
+	dir, err := d.Get("container", "")
+	require.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "lower"))
+	require.NoError(t, err)
+	assert.Equal(t, "lower content", string(data))
+	require.NoError(t, d.Put("container"))
+	assert.Equal(t, 1, remote.fetchCount(lower))
+}
+
+func TestRemoteLayersArePendingAfterRestart(t *testing.T) {
+	base, home, cleanup := newVfsDriver(t)
+	defer cleanup()
+	remote := newFakeRemote()
+	d, err := graphdriver.WithRemoteLayers(base, home, remote.fetch)
+	require.NoError(t, err)
+
+	desc := remote.add(t, map[string]string{"file": "content"})
+	require.NoError(t, d.ApplyRemoteDiff("layer", "", desc))
+
+	d, err = graphdriver.WithRemoteLayers(base, home, remote.fetch)
+	require.NoError(t, err)
+	dir, err := d.Get("layer", "")
+	require.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+	require.NoError(t, d.Put("layer"))
+	assert.Equal(t, 1, remote.fetchCount(desc))
+}
+
+func TestRemoteLayerDigestMismatch(t *testing.T) {
+	base, home, cleanup := newVfsDriver(t)
+	defer cleanup()
+	remote := newFakeRemote()
+	d, err := graphdriver.WithRemoteLayers(base, home, remote.fetch)
+	require.NoError(t, err)
+
+	desc := remote.add(t, map[string]string{"file": "content"})
+	other := remote.add(t, map[string]string{"file": "other content"})
+	remote.diffs[desc.Digest] = remote.diffs[other.Digest]
+	require.NoError(t, d.ApplyRemoteDiff("layer", "", desc))
+
+	_, err = d.Get("layer", "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "digest mismatch")
+}
@@ -0,0 +1,108 @@
+package graphdriver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/system"
+)
+
+const removingSuffix = "-removing"
+
+// DeferredRemoval removes the directories of layers which were still in use
+// when they were removed, once they are no longer in use. Their removal is
+// deferred instead of failing or unmounting them from under their users.
+type DeferredRemoval struct {
+	inUse   func(dir string) bool
+	mu      sync.Mutex
+	pending map[string]struct{}
+}
+
+// NewDeferredRemoval returns a DeferredRemoval which uses inUse to check
+// whether the directory of a layer is still in use.
+func NewDeferredRemoval(inUse func(dir string) bool) *DeferredRemoval {
+	return &DeferredRemoval{
+		inUse:   inUse,
+		pending: make(map[string]struct{}),
+	}
+}
+
+// RemovingPath returns the path the directory of a layer is moved to when
+// its removal is deferred.
+func RemovingPath(dir string) string {
+	return dir + removingSuffix
+}
+
+// InUse returns whether the directory of a layer is still in use.
+func (r *DeferredRemoval) InUse(dir string) bool {
+	return r.inUse(dir)
+}
+
+// Defer moves dir out of the way, so that the layer no longer exists for the
+// driver, and schedules it for removal by Sweep.
+func (r *DeferredRemoval) Defer(dir string) error {
+	removing := RemovingPath(dir)
+	if err := os.Rename(dir, removing); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.pending[removing] = struct{}{}
+	r.mu.Unlock()
+	logrus.Debugf("[graphdriver] %s is in use, deferring its removal", dir)
+	return nil
+}
+
+// Restore schedules for removal the directories of root which were moved
+// out of the way by a previous daemon, which stopped before it could remove
+// them.
+func (r *DeferredRemoval) Restore(root string) error {
+	items, err := ioutil.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, item := range items {
+		if item.IsDir() && strings.HasSuffix(item.Name(), removingSuffix) {
+			r.pending[filepath.Join(root, item.Name())] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// Sweep removes the scheduled directories which are no longer in use and
+// returns the number of directories which are still pending.
+func (r *DeferredRemoval) Sweep() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for dir := range r.pending {
+		if r.inUse(dir) {
+			continue
+		}
+		if err := system.EnsureRemoveAll(dir); err != nil {
+			logrus.Warnf("[graphdriver] failed to remove %s, will retry: %v", dir, err)
+			continue
+		}
+		delete(r.pending, dir)
+	}
+	return len(r.pending)
+}
+
+// Run calls Sweep every interval until stop is closed.
+func (r *DeferredRemoval) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.Sweep()
+		case <-stop:
+			return
+		}
+	}
+}
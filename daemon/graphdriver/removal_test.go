@@ -0,0 +1,54 @@
+package graphdriver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeferredRemoval(t *testing.T) {
+	root, err := ioutil.TempDir("", "graphdriver-deferred-removal")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, "layer")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "diff"), 0755))
+
+	inUse := map[string]bool{RemovingPath(dir): true}
+	r := NewDeferredRemoval(func(dir string) bool { return inUse[dir] })
+	require.NoError(t, r.Defer(dir))
+
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err), "the layer directory must be moved out of the way")
+	assert.Equal(t, 1, r.Sweep())
+	_, err = os.Stat(RemovingPath(dir))
+	assert.NoError(t, err, "a directory in use must not be removed")
+
+	inUse[RemovingPath(dir)] = false
+	assert.Equal(t, 0, r.Sweep())
+	_, err = os.Stat(RemovingPath(dir))
+	assert.True(t, os.IsNotExist(err), "a released directory must be removed")
+}
+
+func TestDeferredRemovalRestore(t *testing.T) {
+	root, err := ioutil.TempDir("", "graphdriver-deferred-removal")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	for _, name := range []string{"layer", "layer" + removingSuffix} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, name), 0755))
+	}
+
+	r := NewDeferredRemoval(func(string) bool { return false })
+	require.NoError(t, r.Restore(root))
+	assert.Equal(t, 0, r.Sweep())
+
+	_, err = os.Stat(filepath.Join(root, "layer"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(root, "layer"+removingSuffix))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,330 @@
+package graphdriver
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/ioutils"
+	"github.com/docker/docker/pkg/stringid"
+)
+
+// rwPoolState is the record of the layers of a rwPoolDriver, which is kept
+// so that layers handed out from the pool are found again after a restart,
+// and layers left in the pool are removed.
+type rwPoolState struct {
+	// Aliases maps the IDs of the layers handed out from the pool to the
+	// IDs they were created with.
+	Aliases map[string]string `json:"aliases"`
+	// Pooled lists the layers which were not handed out yet.
+	Pooled []pooledLayer `json:"pooled"`
+}
+
+type pooledLayer struct {
+	ID     string `json:"id"`
+	Parent string `json:"parent"`
+}
+
+// rwPoolDriver wraps a Driver and keeps empty read-write layers ready on
+// top of the parents read-write layers are created on, so that creating
+// the read-write layer of a container does not wait for the driver.
+type rwPoolDriver struct {
+	Driver
+	size int
+	path string
+
+	mu        sync.Mutex
+	aliases   map[string]string
+	pools     map[string][]pooledLayer
+	refilling map[string]chan struct{}
+	closed    bool
+}
+
+// rwPoolDiffGetterDriver is a rwPoolDriver which keeps the DiffGetter
+// method of the driver it wraps.
+type rwPoolDiffGetterDriver struct {
+	*rwPoolDriver
+	getter DiffGetterDriver
+}
+
+func (d *rwPoolDiffGetterDriver) DiffGetter(id string) (FileGetCloser, error) {
+	return d.getter.DiffGetter(d.resolve(id))
+}
+
+// rwPoolPath returns the path of the file recording the state of the
+// read-write layer pool of the driver name, which is kept next to its home
+// directory in root.
+func rwPoolPath(root, name string) string {
+	return filepath.Join(root, name+"-rwpool.json")
+}
+
+// WithRWLayerPool returns a Driver which keeps up to size empty read-write
+// layers ready on top of each parent CreateReadWrite was called with, and
+// creates the read-write layers without options from them. Pooled layers
+// are only ever handed out once. The state of the pool is stored in root.
+// The returned driver keeps the Capabilities and DiffGetter methods of d, if
+// it has them.
+func WithRWLayerPool(d Driver, root string, size int) (Driver, error) {
+	pd := &rwPoolDriver{
+		Driver:    d,
+		size:      size,
+		path:      rwPoolPath(root, d.String()),
+		aliases:   make(map[string]string),
+		pools:     make(map[string][]pooledLayer),
+		refilling: make(map[string]chan struct{}),
+	}
+
+	data, err := ioutil.ReadFile(pd.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var state rwPoolState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, err
+		}
+		if state.Aliases != nil {
+			pd.aliases = state.Aliases
+		}
+		// Layers left in the pool are not reused, as it is not known
+		// whether they were modified while the daemon was down.
+		for _, l := range state.Pooled {
+			if err := d.Remove(l.ID); err != nil {
+				logrus.Warnf("[graphdriver] failed to remove pooled layer %s: %v", l.ID, err)
+			}
+		}
+	}
+	if err := pd.save(); err != nil {
+		return nil, err
+	}
+	if getter, ok := d.(DiffGetterDriver); ok {
+		return &rwPoolDiffGetterDriver{rwPoolDriver: pd, getter: getter}, nil
+	}
+	return pd, nil
+}
+
+// Capabilities returns the capabilities of the underlying driver.
+func (d *rwPoolDriver) Capabilities() Capabilities {
+	if capDriver, ok := d.Driver.(CapabilityDriver); ok {
+		return capDriver.Capabilities()
+	}
+	return Capabilities{}
+}
+
+// save records the state of the pool. It must be called with mu held.
+func (d *rwPoolDriver) save() error {
+	state := rwPoolState{Aliases: d.aliases}
+	for _, pool := range d.pools {
+		state.Pooled = append(state.Pooled, pool...)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(d.path, data, 0600)
+}
+
+// resolve returns the ID the layer id was created with.
+func (d *rwPoolDriver) resolve(id string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if backing, ok := d.aliases[id]; ok {
+		return backing
+	}
+	return id
+}
+
+// take removes a layer from the pool of parent and returns its ID, or ""
+// if there is none.
+func (d *rwPoolDriver) take(parent string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pool := d.pools[parent]
+	for len(pool) > 0 {
+		l := pool[len(pool)-1]
+		pool = pool[:len(pool)-1]
+		if l.Parent == parent && d.Driver.Exists(l.ID) {
+			d.pools[parent] = pool
+			return l.ID
+		}
+		logrus.Warnf("[graphdriver] discarding pooled layer %s, which is not a layer on top of %s anymore", l.ID, parent)
+	}
+	delete(d.pools, parent)
+	return ""
+}
+
+// refill creates layers on top of parent in the background until its pool
+// is full.
+func (d *rwPoolDriver) refill(parent string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed || d.refilling[parent] != nil || len(d.pools[parent]) >= d.size {
+		return
+	}
+	done := make(chan struct{})
+	d.refilling[parent] = done
+	go func() {
+		defer func() {
+			d.mu.Lock()
+			delete(d.refilling, parent)
+			d.mu.Unlock()
+			close(done)
+		}()
+		for {
+			d.mu.Lock()
+			full := d.closed || len(d.pools[parent]) >= d.size
+			d.mu.Unlock()
+			if full {
+				return
+			}
+			id := stringid.GenerateRandomID()
+			if err := d.Driver.CreateReadWrite(id, parent, nil); err != nil {
+				logrus.Warnf("[graphdriver] failed to create a pooled layer on top of %s: %v", parent, err)
+				return
+			}
+			d.mu.Lock()
+			d.pools[parent] = append(d.pools[parent], pooledLayer{ID: id, Parent: parent})
+			err := d.save()
+			d.mu.Unlock()
+			if err != nil {
+				logrus.Warnf("[graphdriver] failed to record pooled layer %s: %v", id, err)
+			}
+		}
+	}()
+}
+
+// drain waits for the pool of parent to be refilled and removes its layers.
+func (d *rwPoolDriver) drain(parent string) {
+	d.mu.Lock()
+	done := d.refilling[parent]
+	d.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+
+	d.mu.Lock()
+	pool, ok := d.pools[parent]
+	if !ok {
+		d.mu.Unlock()
+		return
+	}
+	delete(d.pools, parent)
+	err := d.save()
+	d.mu.Unlock()
+	if err != nil {
+		logrus.Warnf("[graphdriver] failed to record the read-write layer pool: %v", err)
+	}
+	for _, l := range pool {
+		if err := d.Driver.Remove(l.ID); err != nil {
+			logrus.Warnf("[graphdriver] failed to remove pooled layer %s: %v", l.ID, err)
+		}
+	}
+}
+
+// Status returns the status of the underlying driver with the size of the
+// pool appended.
+func (d *rwPoolDriver) Status() [][2]string {
+	return append(d.Driver.Status(), [2]string{"RW Layer Pool Size", strconv.Itoa(d.size)})
+}
+
+// CreateReadWrite hands out a layer from the pool of parent if there is
+// one and no options are given, and refills the pool.
+func (d *rwPoolDriver) CreateReadWrite(id, parent string, opts *CreateOpts) error {
+	parent = d.resolve(parent)
+	if opts != nil && (opts.MountLabel != "" || len(opts.StorageOpt) > 0) {
+		return d.Driver.CreateReadWrite(id, parent, opts)
+	}
+	defer d.refill(parent)
+
+	if backing := d.take(parent); backing != "" {
+		d.mu.Lock()
+		d.aliases[id] = backing
+		err := d.save()
+		d.mu.Unlock()
+		return err
+	}
+	return d.Driver.CreateReadWrite(id, parent, opts)
+}
+
+func (d *rwPoolDriver) Create(id, parent string, opts *CreateOpts) error {
+	return d.Driver.Create(id, d.resolve(parent), opts)
+}
+
+// Remove removes the layer id along with the layers pooled on top of it.
+func (d *rwPoolDriver) Remove(id string) error {
+	backing := d.resolve(id)
+	d.drain(backing)
+	if err := d.Driver.Remove(backing); err != nil {
+		return err
+	}
+	if backing == id {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.aliases, id)
+	return d.save()
+}
+
+func (d *rwPoolDriver) Get(id, mountLabel string) (string, error) {
+	return d.Driver.Get(d.resolve(id), mountLabel)
+}
+
+func (d *rwPoolDriver) Put(id string) error {
+	return d.Driver.Put(d.resolve(id))
+}
+
+func (d *rwPoolDriver) Exists(id string) bool {
+	return d.Driver.Exists(d.resolve(id))
+}
+
+func (d *rwPoolDriver) GetMetadata(id string) (map[string]string, error) {
+	return d.Driver.GetMetadata(d.resolve(id))
+}
+
+func (d *rwPoolDriver) Diff(id, parent string) (io.ReadCloser, error) {
+	return d.Driver.Diff(d.resolve(id), d.resolve(parent))
+}
+
+func (d *rwPoolDriver) Changes(id, parent string) ([]archive.Change, error) {
+	return d.Driver.Changes(d.resolve(id), d.resolve(parent))
+}
+
+func (d *rwPoolDriver) ApplyDiff(id, parent string, diff io.Reader) (int64, error) {
+	return d.Driver.ApplyDiff(d.resolve(id), d.resolve(parent), diff)
+}
+
+func (d *rwPoolDriver) DiffSize(id, parent string) (int64, error) {
+	return d.Driver.DiffSize(d.resolve(id), d.resolve(parent))
+}
+
+// Cleanup removes the pooled layers and cleans up the underlying driver.
+func (d *rwPoolDriver) Cleanup() error {
+	d.mu.Lock()
+	d.closed = true
+	var parents []string
+	for parent := range d.pools {
+		parents = append(parents, parent)
+	}
+	for parent := range d.refilling {
+		parents = append(parents, parent)
+	}
+	d.mu.Unlock()
+	for _, parent := range parents {
+		d.drain(parent)
+	}
+
+	d.mu.Lock()
+	err := d.save()
+	d.mu.Unlock()
+	if err != nil {
+		logrus.Warnf("[graphdriver] failed to record the read-write layer pool: %v", err)
+	}
+	return d.Driver.Cleanup()
+}
@@ -0,0 +1,136 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/daemon/graphdriver/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitForLayers waits until the vfs driver in home holds n layers.
+func waitForLayers(t testing.TB, home string, n int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		layers, err := ioutil.ReadDir(filepath.Join(home, "dir"))
+		require.NoError(t, err)
+		if len(layers) == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d layers, got %d", n, len(layers))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRWLayerPoolReusedLayerIsEmpty(t *testing.T) {
+	base, home, cleanup := newVfsDriver(t)
+	defer cleanup()
+	d, err := graphdriver.WithRWLayerPool(base, home, 2)
+	require.NoError(t, err)
+
+	require.NoError(t, d.Create("image", "", nil))
+	dir, err := d.Get("image", "")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "image-file"), []byte("image"), 0644))
+	require.NoError(t, d.Put("image"))
+
+	// The first layer on top of the image fills its pool.
+	require.NoError(t, d.CreateReadWrite("first", "image", nil))
+	waitForLayers(t, home, 4)
+
+	dir, err = d.Get("first", "")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "container-file"), []byte("container"), 0644))
+	require.NoError(t, d.Put("first"))
+	require.NoError(t, d.Remove("first"))
+	assert.False(t, d.Exists("first"))
+
+	require.NoError(t, d.CreateReadWrite("second", "image", nil))
+	assert.True(t, d.Exists("second"))
+	dir, err = d.Get("second", "")
+	require.NoError(t, err)
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, "image-file", files[0].Name())
+	}
+	require.NoError(t, d.Put("second"))
+
+	// Layers handed out from the pool are found again after a restart, and
+	// those left in the pool are removed.
+	waitForLayers(t, home, 4)
+	require.NoError(t, d.Cleanup())
+	waitForLayers(t, home, 2)
+	d, err = graphdriver.WithRWLayerPool(base, home, 2)
+	require.NoError(t, err)
+	assert.True(t, d.Exists("second"))
+	require.NoError(t, d.Remove("second"))
+	require.NoError(t, d.Remove("image"))
+	waitForLayers(t, home, 0)
+}
+
+func TestRWLayerPoolSkipsLayersWithOptions(t *testing.T) {
+	base, home, cleanup := newVfsDriver(t)
+	defer cleanup()
+	d, err := graphdriver.WithRWLayerPool(base, home, 1)
+	require.NoError(t, err)
+	defer d.Cleanup()
+
+	require.NoError(t, d.Create("image", "", nil))
+	require.NoError(t, d.CreateReadWrite("first", "image", nil))
+	waitForLayers(t, home, 3)
+
+	require.NoError(t, d.CreateReadWrite("labeled", "image", &graphdriver.CreateOpts{MountLabel: "label"}))
+	_, err = os.Stat(filepath.Join(home, "dir", "labeled"))
+	assert.NoError(t, err, "a layer created with options must not come from the pool")
+}
+
+func benchmarkCreateReadWrite(b *testing.B, poolSize int) {
+	home, err := ioutil.TempDir("", "graphdriver-rwpool")
+	require.NoError(b, err)
+	defer os.RemoveAll(home)
+	var d graphdriver.Driver
+	d, err = vfs.Init(home, nil, nil, nil)
+	require.NoError(b, err)
+	if poolSize > 0 {
+		d, err = graphdriver.WithRWLayerPool(d, home, poolSize)
+		require.NoError(b, err)
+	}
+	defer d.Cleanup()
+
+	require.NoError(b, d.Create("image", "", nil))
+	dir, err := d.Get("image", "")
+	require.NoError(b, err)
+	for i := 0; i < 100; i++ {
+		require.NoError(b, ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", i)), make([]byte, 16*1024), 0644))
+	}
+	require.NoError(b, d.Put("image"))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, d.CreateReadWrite("container", "image", nil))
+		b.StopTimer()
+		require.NoError(b, d.Remove("container"))
+		// Let the pool catch up, as it would between short-lived containers.
+		waitForLayers(b, home, 1+poolSize)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkCreateReadWrite(b *testing.B) {
+	benchmarkCreateReadWrite(b, 0)
+}
+
+func BenchmarkCreateReadWritePooled(b *testing.B) {
+	benchmarkCreateReadWrite(b, 4)
+}
@@ -0,0 +1,145 @@
+package graphdriver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// shardPrefixLength is the number of leading characters of the layer ids
+// naming the subdirectories the layers are sharded into.
+const shardPrefixLength = 2
+
+// ShardedLayoutDriver is the interface for drivers which can keep the
+// directories of their layers in subdirectories named after the first
+// characters of the layer ids, e.g. <home>/ab/abcdef..., rather than in a
+// single directory, which becomes slow on some filesystems once it holds
+// tens of thousands of layers.
+type ShardedLayoutDriver interface {
+	// SetShardedLayout switches the driver to the sharded layout, or back
+	// to the flat one, moving the directories of the existing layers.
+	SetShardedLayout(sharded bool) error
+}
+
+// SetShardedLayout switches d to the sharded or the flat layout if d
+// supports it. The flat layout is the only one of the other drivers, so
+// ErrNotSupported is returned if sharded is true.
+func SetShardedLayout(d ProtoDriver, sharded bool) error {
+	if sd, ok := d.(ShardedLayoutDriver); ok {
+		return sd.SetShardedLayout(sharded)
+	}
+	if sharded {
+		return ErrNotSupported
+	}
+	return nil
+}
+
+// isShardDir returns whether fi, an entry of a directory of layers, is a
+// shard rather than a layer. Layer ids are longer than the shard prefix.
+func isShardDir(fi os.FileInfo) bool {
+	return fi.IsDir() && len(fi.Name()) == shardPrefixLength
+}
+
+// LayerPath returns the path of the entry name, typically a layer id, in
+// the directory of layers dir, in the sharded or the flat layout.
+func LayerPath(dir, name string, sharded bool) string {
+	if !sharded || len(name) <= shardPrefixLength {
+		return filepath.Join(dir, name)
+	}
+	return filepath.Join(dir, name[:shardPrefixLength], name)
+}
+
+// LayerEntries returns the names of the entries of the directory of layers
+// dir in the sharded or the flat layout, ordered by name, or nil if dir does
+// not exist.
+func LayerEntries(dir string, sharded bool) ([]string, error) {
+	items, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, item := range items {
+		if !sharded || !isShardDir(item) {
+			names = append(names, item.Name())
+			continue
+		}
+		shard, err := ioutil.ReadDir(filepath.Join(dir, item.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range shard {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ShardLayers moves the entries of the directory of layers dir to the
+// sharded or the flat layout. The entries already in place are left alone,
+// so that a migration which was interrupted is completed by the next one,
+// and a directory in the other layout is detected and migrated.
+func ShardLayers(dir string, sharded bool) error {
+	items, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	moved := 0
+	for _, item := range items {
+		name := item.Name()
+		if sharded {
+			if isShardDir(item) || len(name) <= shardPrefixLength {
+				continue
+			}
+			if err := os.MkdirAll(filepath.Join(dir, name[:shardPrefixLength]), 0700); err != nil {
+				return err
+			}
+			if err := os.Rename(filepath.Join(dir, name), LayerPath(dir, name, true)); err != nil {
+				return err
+			}
+			moved++
+			continue
+		}
+		if !isShardDir(item) {
+			continue
+		}
+		shard := filepath.Join(dir, name)
+		entries, err := ioutil.ReadDir(shard)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := os.Rename(filepath.Join(shard, entry.Name()), filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+			moved++
+		}
+		if err := os.Remove(shard); err != nil {
+			return err
+		}
+	}
+	if moved > 0 {
+		layout := "flat"
+		if sharded {
+			layout = "sharded"
+		}
+		logrus.Infof("[graphdriver] moved %d layers of %s to the %s layout", moved, dir, layout)
+	}
+	return nil
+}
+
+// errShardedLayout is returned when the layout requested for a driver
+// cannot be set up.
+func errShardedLayout(name string, err error) error {
+	return fmt.Errorf("failed to set up the layout of the %s storage driver: %v", name, err)
+}
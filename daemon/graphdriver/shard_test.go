@@ -0,0 +1,90 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewShardLayers(t *testing.T) {
+	root, err := ioutil.TempDir("", "graphdriver-shard")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "vfs", "dir")
+	id := "abcdef0123456789"
+
+	d, err := graphdriver.New("vfs", nil, graphdriver.Options{Root: root})
+	require.NoError(t, err)
+	require.NoError(t, d.Create(id, "", nil))
+	require.NoError(t, d.Cleanup())
+	_, err = os.Stat(filepath.Join(dir, id))
+	require.NoError(t, err)
+
+	// The flat layout of the prior daemon is migrated.
+	d, err = graphdriver.New("vfs", nil, graphdriver.Options{Root: root, ShardLayers: true})
+	require.NoError(t, err)
+	layerDir, err := d.Get(id, "")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "ab", id), layerDir)
+	require.NoError(t, d.Put(id))
+	require.NoError(t, d.Create("abc123", id, nil))
+	assert.True(t, d.Exists("abc123"))
+	require.NoError(t, d.Cleanup())
+
+	names, err := graphdriver.LayerEntries(dir, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"abc123", id}, names)
+
+	// And so is the sharded one.
+	d, err = graphdriver.New("vfs", nil, graphdriver.Options{Root: root})
+	require.NoError(t, err)
+	assert.True(t, d.Exists(id))
+	require.NoError(t, d.Remove("abc123"))
+	require.NoError(t, d.Cleanup())
+	items, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	assert.Equal(t, id, items[0].Name())
+}
+
+func TestNewShardLayersNotSupported(t *testing.T) {
+	root, err := ioutil.TempDir("", "graphdriver-shard")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	_, err = graphdriver.New("vfs-upgrade", nil, graphdriver.Options{Root: root, ShardLayers: true})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to set up the layout of the vfs-upgrade storage driver")
+}
+
+func TestShardLayersInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graphdriver-shard")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A migration to the sharded layout interrupted after moving aaaa.
+	for _, p := range []string{"aa/aaaa", "aabb", "bbbb-creating", "cc"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, p), 0700))
+	}
+	require.NoError(t, graphdriver.ShardLayers(dir, true))
+	for _, p := range []string{"aa/aaaa", "aa/aabb", "bb/bbbb-creating", "cc"} {
+		_, err := os.Stat(filepath.Join(dir, p))
+		assert.NoError(t, err, p)
+	}
+	names, err := graphdriver.LayerEntries(dir, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"aaaa", "aabb", "bbbb-creating"}, names)
+	assert.Equal(t, filepath.Join(dir, "bb", "bbbb-creating"), graphdriver.LayerPath(dir, "bbbb-creating", true))
+
+	require.NoError(t, graphdriver.ShardLayers(dir, false))
+	names, err = graphdriver.LayerEntries(dir, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"aaaa", "aabb", "bbbb-creating"}, names)
+}
@@ -0,0 +1,113 @@
+package graphdriver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Keys under which drivers report their features in Status, so that they
+// are rendered uniformly by "docker info" and can be parsed by tooling.
+// The values are always "true" or "false".
+const (
+	StatusSupportsDType     = "Supports d_type"
+	StatusNativeOverlayDiff = "Native Overlay Diff"
+	StatusUserXattr         = "userxattr"
+	StatusMetacopy          = "Using metacopy"
+)
+
+// StatusFeatureKeys lists the feature keys in the order they are reported.
+var StatusFeatureKeys = []string{
+	StatusSupportsDType,
+	StatusNativeOverlayDiff,
+	StatusUserXattr,
+	StatusMetacopy,
+}
+
+// FeatureStatus holds the features a driver reports in its Status.
+type FeatureStatus struct {
+	// SupportsDType is whether the backing filesystem returns the file
+	// type in directory entries.
+	SupportsDType bool `json:"supportsDType"`
+	// NativeOverlayDiff is whether diffs are produced from the upper
+	// directory of an overlay mount rather than by comparing layers.
+	NativeOverlayDiff bool `json:"nativeOverlayDiff"`
+	// UserXattr is whether overlay is mounted with the "userxattr" option,
+	// storing its metadata in the "user." instead of "trusted." namespace.
+	UserXattr bool `json:"userXattr"`
+	// Metacopy is whether overlay copies up only the metadata of a file
+	// when it is modified.
+	Metacopy bool `json:"metacopy"`
+}
+
+// Status returns the features as Status key/value pairs.
+func (f FeatureStatus) Status() [][2]string {
+	return [][2]string{
+		{StatusSupportsDType, strconv.FormatBool(f.SupportsDType)},
+		{StatusNativeOverlayDiff, strconv.FormatBool(f.NativeOverlayDiff)},
+		{StatusUserXattr, strconv.FormatBool(f.UserXattr)},
+		{StatusMetacopy, strconv.FormatBool(f.Metacopy)},
+	}
+}
+
+// StatusJSONVersion is the version of the documents returned by StatusJSON.
+// It changes when fields are removed or change meaning, but not when fields
+// are added.
+const StatusJSONVersion = 1
+
+// StatusDocument describes the configuration and the health of a driver, for
+// programs rather than for display.
+type StatusDocument struct {
+	// Version is StatusJSONVersion.
+	Version int    `json:"version"`
+	Driver  string `json:"driver"`
+	// Home is the directory the driver keeps its layers in.
+	Home string `json:"home"`
+	// BackingFilesystem is the filesystem of Home, if the driver reports
+	// it.
+	BackingFilesystem string        `json:"backingFilesystem,omitempty"`
+	Features          FeatureStatus `json:"features"`
+	// Healthy is whether no problems were found.
+	Healthy bool `json:"healthy"`
+	// Problems lists the problems found, if any.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// JSON returns the JSON encoding of the document, with its version and its
+// health filled in.
+func (s StatusDocument) JSON() ([]byte, error) {
+	s.Version = StatusJSONVersion
+	s.Healthy = len(s.Problems) == 0
+	return json.Marshal(s)
+}
+
+// StatusJSONDriver is the interface for drivers which can describe their
+// configuration and health in a StatusDocument.
+type StatusJSONDriver interface {
+	// StatusJSON returns the JSON encoding of the StatusDocument of the
+	// driver.
+	StatusJSON() ([]byte, error)
+}
+
+// StatusJSON returns the JSON encoding of the StatusDocument of d if d
+// supports it, and ErrNotSupported otherwise.
+func StatusJSON(d ProtoDriver) ([]byte, error) {
+	if sd, ok := d.(StatusJSONDriver); ok {
+		return sd.StatusJSON()
+	}
+	return nil, ErrNotSupported
+}
+
+// CheckHome returns the problems of the home directory of a driver, which
+// must be an accessible directory.
+func CheckHome(home string) []string {
+	fi, err := os.Stat(home)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if !fi.IsDir() {
+		return []string{fmt.Sprintf("%s is not a directory", home)}
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package graphdriver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeatureStatus(t *testing.T) {
+	status := FeatureStatus{SupportsDType: true, Metacopy: true}.Status()
+	assert.Equal(t, [][2]string{
+		{"Supports d_type", "true"},
+		{"Native Overlay Diff", "false"},
+		{"userxattr", "false"},
+		{"Using metacopy", "true"},
+	}, status)
+
+	for i, key := range StatusFeatureKeys {
+		assert.Equal(t, key, status[i][0])
+	}
+}
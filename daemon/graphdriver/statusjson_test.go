@@ -0,0 +1,118 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jsonField is the schema of a field of a JSON object: the type of its
+// value, as decoded by encoding/json, whether it may be left out, and the
+// schema of the fields of its value if it is an object.
+type jsonField struct {
+	kind     string
+	optional bool
+	fields   map[string]jsonField
+}
+
+// statusSchema is the schema of the version 1 status documents.
+var statusSchema = map[string]jsonField{
+	"version":           {kind: "number"},
+	"driver":            {kind: "string"},
+	"home":              {kind: "string"},
+	"backingFilesystem": {kind: "string", optional: true},
+	"features": {kind: "object", fields: map[string]jsonField{
+		"supportsDType":     {kind: "boolean"},
+		"nativeOverlayDiff": {kind: "boolean"},
+		"userXattr":         {kind: "boolean"},
+		"metacopy":          {kind: "boolean"},
+	}},
+	"healthy":  {kind: "boolean"},
+	"problems": {kind: "array", optional: true},
+}
+
+func jsonKind(v interface{}) string {
+	switch v.(type) {
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "null"
+}
+
+// validateJSON checks that the object obj has the fields of schema, and no
+// others.
+func validateJSON(t *testing.T, schema map[string]jsonField, obj map[string]interface{}, path string) {
+	for name, field := range schema {
+		v, ok := obj[name]
+		if !ok {
+			assert.True(t, field.optional, "missing field %s%s", path, name)
+			continue
+		}
+		if !assert.Equal(t, field.kind, jsonKind(v), "type of field %s%s", path, name) {
+			continue
+		}
+		if field.fields != nil {
+			validateJSON(t, field.fields, v.(map[string]interface{}), path+name+".")
+		}
+	}
+	for name := range obj {
+		_, ok := schema[name]
+		assert.True(t, ok, "unexpected field %s%s", path, name)
+	}
+}
+
+func TestStatusJSON(t *testing.T) {
+	root, err := ioutil.TempDir("", "graphdriver-status")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	d, err := graphdriver.New("vfs", nil, graphdriver.Options{Root: root})
+	require.NoError(t, err)
+	defer d.Cleanup()
+	data, err := graphdriver.StatusJSON(d)
+	require.NoError(t, err)
+	var obj map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &obj))
+	validateJSON(t, statusSchema, obj, "")
+
+	var status graphdriver.StatusDocument
+	require.NoError(t, json.Unmarshal(data, &status))
+	assert.Equal(t, graphdriver.StatusJSONVersion, status.Version)
+	assert.Equal(t, "vfs", status.Driver)
+	assert.Equal(t, filepath.Join(root, "vfs"), status.Home)
+	assert.True(t, status.Healthy)
+	assert.Empty(t, status.Problems)
+
+	// The driver is unhealthy once its home directory is gone.
+	require.NoError(t, os.RemoveAll(filepath.Join(root, "vfs")))
+	data, err = graphdriver.StatusJSON(d)
+	require.NoError(t, err)
+	obj = nil
+	require.NoError(t, json.Unmarshal(data, &obj))
+	validateJSON(t, statusSchema, obj, "")
+	status = graphdriver.StatusDocument{}
+	require.NoError(t, json.Unmarshal(data, &status))
+	assert.False(t, status.Healthy)
+	assert.Len(t, status.Problems, 1)
+}
+
+func TestStatusJSONNotSupported(t *testing.T) {
+	_, err := graphdriver.StatusJSON(upgradeDriver{})
+	assert.Equal(t, graphdriver.ErrNotSupported, err)
+}
@@ -0,0 +1,208 @@
+package graphdriver
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// SyncMode controls whether a driver syncs the layers it writes to disk, which
+// trades durability for speed.
+type SyncMode string
+
+const (
+	// SyncFull syncs the content of a layer once it is applied, as well as
+	// the creation and removal of layers. It is the default.
+	SyncFull SyncMode = "full"
+	// SyncOrdered only syncs the content of a layer once it is applied, so
+	// that it is on disk before the layer is recorded as applied. Layers
+	// created or removed right before a crash may reappear or be missing.
+	SyncOrdered SyncMode = "ordered"
+	// SyncNone never syncs. Layers written right before a crash may be
+	// missing, empty or partially written after it, and must be removed and
+	// pulled again.
+	SyncNone SyncMode = "none"
+)
+
+// ParseSyncMode parses s as a SyncMode. An empty string is SyncFull.
+func ParseSyncMode(s string) (SyncMode, error) {
+	switch mode := SyncMode(s); mode {
+	case "":
+		return SyncFull, nil
+	case SyncFull, SyncOrdered, SyncNone:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid sync mode %q: must be %q, %q or %q", s, SyncFull, SyncOrdered, SyncNone)
+}
+
+// syncDriver wraps a Driver and syncs the filesystems of the layers it
+// writes according to its mode.
+type syncDriver struct {
+	Driver
+	root string
+	mode SyncMode
+}
+
+// syncDiffGetterDriver is a syncDriver which keeps the DiffGetter method of
+// the driver it wraps.
+type syncDiffGetterDriver struct {
+	*syncDriver
+	getter DiffGetterDriver
+}
+
+func (d *syncDiffGetterDriver) DiffGetter(id string) (FileGetCloser, error) {
+	return d.getter.DiffGetter(id)
+}
+
+// WithSyncMode returns a Driver which syncs the layers d writes according
+// to mode. The creation and removal of layers are synced by syncing the
+// filesystem of root, which should hold the home directory of d. The
+// returned driver keeps the Capabilities and DiffGetter methods of d, if
+// it has them.
+func WithSyncMode(d Driver, root string, mode SyncMode) Driver {
+	sd := &syncDriver{Driver: d, root: root, mode: mode}
+	if getter, ok := d.(DiffGetterDriver); ok {
+		return &syncDiffGetterDriver{syncDriver: sd, getter: getter}
+	}
+	return sd
+}
+
+// Capabilities returns the capabilities of the underlying driver.
+func (d *syncDriver) Capabilities() Capabilities {
+	if capDriver, ok := d.Driver.(CapabilityDriver); ok {
+		return capDriver.Capabilities()
+	}
+	return Capabilities{}
+}
+
+// Warm warms the layers of the underlying driver, if it supports it. As
+// the driver returned by New is always wrapped by a syncDriver, this keeps
+// the layers it creates warmable.
+func (d *syncDriver) Warm(ids []string) error {
+	return Warm(d.Driver, ids)
+}
+
+// ListFiles lists the files of the layer id of the underlying driver, if it
+// supports it.
+func (d *syncDriver) ListFiles(id string) ([]FileEntry, error) {
+	return ListFiles(d.Driver, id)
+}
+
+// SetShardedLayout switches the layout of the underlying driver, if it
+// supports it.
+func (d *syncDriver) SetShardedLayout(sharded bool) error {
+	return SetShardedLayout(d.Driver, sharded)
+}
+
+// StatusJSON returns the status document of the underlying driver, if it
+// supports it.
+func (d *syncDriver) StatusJSON() ([]byte, error) {
+	return StatusJSON(d.Driver)
+}
+
+// ReclaimableSpace returns the space removing the layers unusedIDs of the
+// underlying driver would free, if it supports it.
+func (d *syncDriver) ReclaimableSpace(unusedIDs []string) (int64, error) {
+	return ReclaimableSpace(d.Driver, unusedIDs)
+}
+
+// FreeSpace returns the space left in the layer id of the underlying driver,
+// if it supports it.
+func (d *syncDriver) FreeSpace(id string) (int64, error) {
+	return FreeSpace(d.Driver, id)
+}
+
+// Diagnostics writes the diagnostics bundle of the underlying driver to w, if
+// it supports it.
+func (d *syncDriver) Diagnostics(w io.Writer) error {
+	return Diagnostics(d.Driver, w)
+}
+
+// Pin pins the layer id of the underlying driver, if it supports it.
+func (d *syncDriver) Pin(id string) error {
+	return Pin(d.Driver, id)
+}
+
+// Unpin unpins the layer id of the underlying driver, if it supports it.
+func (d *syncDriver) Unpin(id string) error {
+	return Unpin(d.Driver, id)
+}
+
+// Freeze freezes the layer id of the underlying driver, if it supports it.
+func (d *syncDriver) Freeze(id string) error {
+	return Freeze(d.Driver, id)
+}
+
+// IsFrozen returns whether the layer id of the underlying driver is frozen.
+func (d *syncDriver) IsFrozen(id string) bool {
+	return IsFrozen(d.Driver, id)
+}
+
+// ExportOCILayer exports the diff of the layer id of the underlying driver
+// as an OCI layer blob.
+func (d *syncDriver) ExportOCILayer(id, parent string) (io.ReadCloser, digest.Digest, digest.Digest, error) {
+	return ExportOCILayer(d.Driver, id, parent)
+}
+
+// GetAt mounts the layer id of the underlying driver at target, if it
+// supports it.
+func (d *syncDriver) GetAt(id, mountLabel, target string) error {
+	return GetAt(d.Driver, id, mountLabel, target)
+}
+
+// PutAt unmounts the layer id of the underlying driver from target, if it
+// supports it.
+func (d *syncDriver) PutAt(id, target string) error {
+	return PutAt(d.Driver, id, target)
+}
+
+// syncRoot syncs the filesystem of the root of the driver in full mode.
+func (d *syncDriver) syncRoot() error {
+	if d.mode != SyncFull {
+		return nil
+	}
+	if err := syncFilesystem(d.root); err != nil {
+		return fmt.Errorf("failed to sync %s: %v", d.root, err)
+	}
+	return nil
+}
+
+func (d *syncDriver) Create(id, parent string, opts *CreateOpts) error {
+	if err := d.Driver.Create(id, parent, opts); err != nil {
+		return err
+	}
+	return d.syncRoot()
+}
+
+func (d *syncDriver) CreateReadWrite(id, parent string, opts *CreateOpts) error {
+	if err := d.Driver.CreateReadWrite(id, parent, opts); err != nil {
+		return err
+	}
+	return d.syncRoot()
+}
+
+func (d *syncDriver) Remove(id string) error {
+	if err := d.Driver.Remove(id); err != nil {
+		return err
+	}
+	return d.syncRoot()
+}
+
+// ApplyDiff applies the diff and syncs the filesystem of the layer unless
+// syncs are disabled.
+func (d *syncDriver) ApplyDiff(id, parent string, diff io.Reader) (int64, error) {
+	size, err := d.Driver.ApplyDiff(id, parent, diff)
+	if err != nil || d.mode == SyncNone {
+		return size, err
+	}
+	dir, err := d.Driver.Get(id, "")
+	if err != nil {
+		return 0, err
+	}
+	defer d.Driver.Put(id)
+	if err := syncFilesystem(dir); err != nil {
+		return 0, fmt.Errorf("failed to sync layer %s: %v", id, err)
+	}
+	return size, nil
+}
@@ -0,0 +1,20 @@
+package graphdriver
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// syncFilesystem flushes the filesystem holding path to disk.
+func syncFilesystem(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, _, errno := unix.Syscall(unix.SYS_SYNCFS, f.Fd(), 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
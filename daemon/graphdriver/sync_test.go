@@ -0,0 +1,61 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSyncMode(t *testing.T) {
+	for s, expected := range map[string]graphdriver.SyncMode{
+		"":        graphdriver.SyncFull,
+		"full":    graphdriver.SyncFull,
+		"ordered": graphdriver.SyncOrdered,
+		"none":    graphdriver.SyncNone,
+	} {
+		mode, err := graphdriver.ParseSyncMode(s)
+		require.NoError(t, err)
+		assert.Equal(t, expected, mode)
+	}
+	_, err := graphdriver.ParseSyncMode("fast")
+	assert.Error(t, err)
+}
+
+func TestSyncModeKeepsLayerContent(t *testing.T) {
+	content, err := ioutil.TempDir("", "graphdriver-sync-content")
+	require.NoError(t, err)
+	defer os.RemoveAll(content)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(content, "file"), []byte("content"), 0644))
+
+	for _, mode := range []graphdriver.SyncMode{graphdriver.SyncFull, graphdriver.SyncOrdered, graphdriver.SyncNone} {
+		base, home, cleanup := newVfsDriver(t)
+		d := graphdriver.WithSyncMode(base, home, mode)
+
+		diff, err := archive.Tar(content, archive.Uncompressed)
+		require.NoError(t, err)
+		require.NoError(t, d.Create("layer", "", nil))
+		_, err = d.ApplyDiff("layer", "", diff)
+		diff.Close()
+		require.NoError(t, err, "mode %s", mode)
+		require.NoError(t, d.CreateReadWrite("container", "layer", nil))
+
+		dir, err := d.Get("container", "")
+		require.NoError(t, err)
+		data, err := ioutil.ReadFile(filepath.Join(dir, "file"))
+		require.NoError(t, err)
+		assert.Equal(t, "content", string(data), "mode %s", mode)
+		require.NoError(t, d.Put("container"))
+
+		require.NoError(t, d.Remove("container"))
+		assert.False(t, d.Exists("container"), "mode %s", mode)
+		cleanup()
+	}
+}
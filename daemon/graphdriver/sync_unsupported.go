@@ -0,0 +1,9 @@
+// +build !linux
+
+package graphdriver
+
+// syncFilesystem does nothing, as syncing a single filesystem is not
+// supported on this platform.
+func syncFilesystem(path string) error {
+	return nil
+}
@@ -0,0 +1,60 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantsDoNotShareLayers(t *testing.T) {
+	root, err := ioutil.TempDir("", "graphdriver-tenant")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	for _, tenant := range []string{"a", "b"} {
+		d, err := graphdriver.New("vfs", nil, graphdriver.Options{Root: root, Tenant: tenant})
+		require.NoError(t, err)
+		require.NoError(t, d.Create("layer", "", nil))
+		diff, err := archive.Generate("tenant", tenant)
+		require.NoError(t, err)
+		_, err = d.ApplyDiff("layer", "", diff)
+		require.NoError(t, err)
+		require.NoError(t, d.Cleanup())
+	}
+
+	for _, tenant := range []string{"a", "b"} {
+		d, err := graphdriver.New("vfs", nil, graphdriver.Options{Root: root, Tenant: tenant})
+		require.NoError(t, err)
+		dir, err := d.Get("layer", "")
+		require.NoError(t, err)
+		data, err := ioutil.ReadFile(filepath.Join(dir, "tenant"))
+		require.NoError(t, err)
+		assert.Equal(t, tenant, string(data))
+		require.NoError(t, d.Put("layer"))
+
+		// Removing the layer of a tenant leaves the other one alone.
+		require.NoError(t, d.Remove("layer"))
+		require.NoError(t, d.Cleanup())
+	}
+	_, err = os.Stat(filepath.Join(root, "vfs"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestInvalidTenant(t *testing.T) {
+	root, err := ioutil.TempDir("", "graphdriver-tenant")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	for _, tenant := range []string{"..", "a/b"} {
+		_, err := graphdriver.New("vfs", nil, graphdriver.Options{Root: root, Tenant: tenant})
+		assert.Error(t, err, tenant)
+	}
+}
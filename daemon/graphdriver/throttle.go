@@ -0,0 +1,76 @@
+package graphdriver
+
+import (
+	"io"
+	"sync"
+
+	"github.com/docker/docker/pkg/ioutils"
+)
+
+// throttledDriver wraps a Driver and bounds the number of diffs it applies
+// and generates at the same time.
+type throttledDriver struct {
+	Driver
+	slots chan struct{}
+}
+
+// throttledDiffGetterDriver is a throttledDriver which keeps the DiffGetter
+// method of the driver it wraps.
+type throttledDiffGetterDriver struct {
+	*throttledDriver
+	getter DiffGetterDriver
+}
+
+func (d *throttledDiffGetterDriver) DiffGetter(id string) (FileGetCloser, error) {
+	return d.getter.DiffGetter(id)
+}
+
+// WithIOThrottle returns a Driver which runs at most limit ApplyDiff and
+// Diff operations of d at the same time, the others waiting for their turn,
+// so that pulling or pushing many layers does not saturate the IO of the
+// disk the layers are stored on. A Diff holds its turn until the returned
+// stream is closed. d is returned as is if limit is not positive. The
+// returned driver keeps the Capabilities and DiffGetter methods of d, if it
+// has them.
+func WithIOThrottle(d Driver, limit int) Driver {
+	if limit <= 0 {
+		return d
+	}
+	td := &throttledDriver{Driver: d, slots: make(chan struct{}, limit)}
+	if getter, ok := d.(DiffGetterDriver); ok {
+		return &throttledDiffGetterDriver{throttledDriver: td, getter: getter}
+	}
+	return td
+}
+
+// Capabilities returns the capabilities of the underlying driver.
+func (d *throttledDriver) Capabilities() Capabilities {
+	if capDriver, ok := d.Driver.(CapabilityDriver); ok {
+		return capDriver.Capabilities()
+	}
+	return Capabilities{}
+}
+
+// ApplyDiff applies the diff once it is its turn.
+func (d *throttledDriver) ApplyDiff(id, parent string, diff io.Reader) (int64, error) {
+	d.slots <- struct{}{}
+	defer func() { <-d.slots }()
+	return d.Driver.ApplyDiff(id, parent, diff)
+}
+
+// Diff generates the diff once it is its turn, which ends when the diff is
+// closed.
+func (d *throttledDriver) Diff(id, parent string) (io.ReadCloser, error) {
+	d.slots <- struct{}{}
+	var once sync.Once
+	release := func() { once.Do(func() { <-d.slots }) }
+	rc, err := d.Driver.Diff(id, parent)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return ioutils.NewReadCloserWrapper(rc, func() error {
+		defer release()
+		return rc.Close()
+	}), nil
+}
@@ -0,0 +1,104 @@
+package graphdriver
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// concurrencyDriver is a Driver recording the largest number of ApplyDiff
+// and Diff operations it ran at the same time.
+type concurrencyDriver struct {
+	Driver
+	mu      sync.Mutex
+	running int
+	max     int
+}
+
+func (d *concurrencyDriver) enter() {
+	d.mu.Lock()
+	d.running++
+	if d.running > d.max {
+		d.max = d.running
+	}
+	d.mu.Unlock()
+}
+
+func (d *concurrencyDriver) leave() {
+	d.mu.Lock()
+	d.running--
+	d.mu.Unlock()
+}
+
+func (d *concurrencyDriver) ApplyDiff(id, parent string, diff io.Reader) (int64, error) {
+	d.enter()
+	defer d.leave()
+	time.Sleep(10 * time.Millisecond)
+	return io.Copy(ioutil.Discard, diff)
+}
+
+func (d *concurrencyDriver) Diff(id, parent string) (io.ReadCloser, error) {
+	d.enter()
+	return &leavingReadCloser{Reader: strings.NewReader("diff"), leave: d.leave}, nil
+}
+
+// leavingReadCloser calls leave when it is closed.
+type leavingReadCloser struct {
+	io.Reader
+	leave func()
+}
+
+func (rc *leavingReadCloser) Close() error {
+	time.Sleep(10 * time.Millisecond)
+	rc.leave()
+	return nil
+}
+
+func TestIOThrottle(t *testing.T) {
+	cd := &concurrencyDriver{}
+	d := WithIOThrottle(cd, 2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := d.ApplyDiff("layer", "", strings.NewReader("diff"))
+			assert.NoError(t, err)
+		}()
+		go func() {
+			defer wg.Done()
+			rc, err := d.Diff("layer", "")
+			if assert.NoError(t, err) {
+				assert.NoError(t, rc.Close())
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 2, cd.max)
+	assert.Equal(t, 0, cd.running)
+}
+
+func TestIOThrottleUnlimited(t *testing.T) {
+	cd := &concurrencyDriver{}
+	assert.True(t, WithIOThrottle(cd, 0) == Driver(cd))
+}
+
+func TestIOThrottleDiffClosedTwice(t *testing.T) {
+	d := WithIOThrottle(&concurrencyDriver{}, 1)
+	rc, err := d.Diff("layer", "")
+	require.NoError(t, err)
+	// Closing a diff twice must not give back a turn it does not hold,
+	// nor block.
+	require.NoError(t, rc.Close())
+	require.NoError(t, rc.Close())
+	_, err = d.ApplyDiff("layer", "", strings.NewReader("diff"))
+	require.NoError(t, err)
+}
@@ -0,0 +1,241 @@
+package graphdriver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/archive"
+)
+
+// TimeoutError is returned by the driver returned by WithTimeout when a
+// method does not complete in time.
+type TimeoutError struct {
+	// Method is the name of the method, e.g. "Get".
+	Method string
+	// ID is the layer the method was called for.
+	ID string
+	// After is the timeout the method exceeded.
+	After time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("graphdriver: %s of layer %s timed out after %v", e.Method, e.ID, e.After)
+}
+
+// Timeout returns true, as net.Error does for timeouts.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// errApplyDiffCancelled is returned to a driver reading the diff of an
+// ApplyDiff which timed out.
+var errApplyDiffCancelled = errors.New("the diff was cancelled after a timeout")
+
+// timeoutDriver wraps a Driver and bounds the time its methods take.
+type timeoutDriver struct {
+	Driver
+	timeouts map[string]time.Duration
+}
+
+// timeoutDiffGetterDriver is a timeoutDriver which keeps the DiffGetter
+// method of the driver it wraps.
+type timeoutDiffGetterDriver struct {
+	*timeoutDriver
+	getter DiffGetterDriver
+}
+
+func (d *timeoutDiffGetterDriver) DiffGetter(id string) (FileGetCloser, error) {
+	return d.getter.DiffGetter(id)
+}
+
+// WithTimeout returns a Driver whose methods fail with a *TimeoutError when
+// they take longer than timeouts lists for their name. The methods which can
+// be bounded are Get, Put, Create, CreateReadWrite, Remove, GetMetadata,
+// Diff, ApplyDiff, Changes and DiffSize; the others, and those without a
+// timeout, are called directly.
+//
+// The methods of d are not interruptible, so a call which timed out keeps
+// running in the background. When it eventually succeeds, its effect is
+// undone where possible, so that the caller is not left with a layer or
+// a mount it was told it did not get: the layers created are removed, the
+// layers mounted are unmounted and the diffs produced are closed. The diff
+// of an ApplyDiff which timed out fails to read, which makes most drivers
+// give up. The returned driver keeps the
+// Capabilities and DiffGetter methods of d, if it has them.
+func WithTimeout(d Driver, timeouts map[string]time.Duration) Driver {
+	td := &timeoutDriver{Driver: d, timeouts: timeouts}
+	if getter, ok := d.(DiffGetterDriver); ok {
+		return &timeoutDiffGetterDriver{timeoutDriver: td, getter: getter}
+	}
+	return td
+}
+
+// Capabilities returns the capabilities of the underlying driver.
+func (d *timeoutDriver) Capabilities() Capabilities {
+	if capDriver, ok := d.Driver.(CapabilityDriver); ok {
+		return capDriver.Capabilities()
+	}
+	return Capabilities{}
+}
+
+// call calls f, the method of the layer id, and returns its error, or a
+// *TimeoutError if it does not return in time. In that case, undo is
+// called once f succeeds, if it is not nil. The results f sets must only be
+// read if it succeeded, as it keeps running after a timeout.
+func (d *timeoutDriver) call(method, id string, f func() error, undo func()) error {
+	timeout := d.timeouts[method]
+	if timeout <= 0 {
+		return f()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+
+	logrus.Warnf("[graphdriver] %s of layer %s did not complete after %v", method, id, timeout)
+	go func() {
+		err := <-done
+		if err != nil {
+			logrus.Warnf("[graphdriver] %s of layer %s failed after timing out: %v", method, id, err)
+			return
+		}
+		logrus.Warnf("[graphdriver] %s of layer %s completed after timing out", method, id)
+		if undo != nil {
+			undo()
+		}
+	}()
+	return &TimeoutError{Method: method, ID: id, After: timeout}
+}
+
+func (d *timeoutDriver) Get(id, mountLabel string) (string, error) {
+	var dir string
+	err := d.call("Get", id, func() (err error) {
+		dir, err = d.Driver.Get(id, mountLabel)
+		return err
+	}, func() {
+		d.Driver.Put(id)
+	})
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func (d *timeoutDriver) Put(id string) error {
+	return d.call("Put", id, func() error {
+		return d.Driver.Put(id)
+	}, nil)
+}
+
+func (d *timeoutDriver) Create(id, parent string, opts *CreateOpts) error {
+	return d.call("Create", id, func() error {
+		return d.Driver.Create(id, parent, opts)
+	}, func() {
+		d.Driver.Remove(id)
+	})
+}
+
+func (d *timeoutDriver) CreateReadWrite(id, parent string, opts *CreateOpts) error {
+	return d.call("CreateReadWrite", id, func() error {
+		return d.Driver.CreateReadWrite(id, parent, opts)
+	}, func() {
+		d.Driver.Remove(id)
+	})
+}
+
+func (d *timeoutDriver) Remove(id string) error {
+	return d.call("Remove", id, func() error {
+		return d.Driver.Remove(id)
+	}, nil)
+}
+
+func (d *timeoutDriver) GetMetadata(id string) (map[string]string, error) {
+	var metadata map[string]string
+	err := d.call("GetMetadata", id, func() (err error) {
+		metadata, err = d.Driver.GetMetadata(id)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+func (d *timeoutDriver) Diff(id, parent string) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	err := d.call("Diff", id, func() (err error) {
+		rc, err = d.Driver.Diff(id, parent)
+		return err
+	}, func() {
+		rc.Close()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+func (d *timeoutDriver) ApplyDiff(id, parent string, diff io.Reader) (int64, error) {
+	var size int64
+	cancellable := &cancellableReader{r: diff, cancelled: make(chan struct{})}
+	err := d.call("ApplyDiff", id, func() (err error) {
+		size, err = d.Driver.ApplyDiff(id, parent, cancellable)
+		return err
+	}, nil)
+	if _, ok := err.(*TimeoutError); ok {
+		close(cancellable.cancelled)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (d *timeoutDriver) Changes(id, parent string) ([]archive.Change, error) {
+	var changes []archive.Change
+	err := d.call("Changes", id, func() (err error) {
+		changes, err = d.Driver.Changes(id, parent)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+func (d *timeoutDriver) DiffSize(id, parent string) (int64, error) {
+	var size int64
+	err := d.call("DiffSize", id, func() (err error) {
+		size, err = d.Driver.DiffSize(id, parent)
+		return err
+	}, nil)
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// cancellableReader is a reader which fails once cancelled is closed.
+type cancellableReader struct {
+	r         io.Reader
+	cancelled chan struct{}
+}
+
+func (r *cancellableReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.cancelled:
+		return 0, errApplyDiffCancelled
+	default:
+	}
+	return r.r.Read(p)
+}
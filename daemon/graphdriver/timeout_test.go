@@ -0,0 +1,120 @@
+package graphdriver
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowDriver is a Driver whose Get and Create take delay, and whose
+// ApplyDiff reads the diff until it fails. It records the calls which
+// complete.
+type slowDriver struct {
+	Driver
+	delay time.Duration
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (d *slowDriver) record(call string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls = append(d.calls, call)
+}
+
+func (d *slowDriver) recorded() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.calls...)
+}
+
+func (d *slowDriver) Get(id, mountLabel string) (string, error) {
+	time.Sleep(d.delay)
+	d.record("Get " + id)
+	return "/mnt/" + id, nil
+}
+
+func (d *slowDriver) Put(id string) error {
+	d.record("Put " + id)
+	return nil
+}
+
+func (d *slowDriver) Create(id, parent string, opts *CreateOpts) error {
+	time.Sleep(d.delay)
+	d.record("Create " + id)
+	return nil
+}
+
+func (d *slowDriver) Remove(id string) error {
+	d.record("Remove " + id)
+	return nil
+}
+
+func (d *slowDriver) ApplyDiff(id, parent string, diff io.Reader) (int64, error) {
+	n, err := io.Copy(ioutil.Discard, diff)
+	if err == errApplyDiffCancelled {
+		d.record("ApplyDiff " + id + " cancelled")
+	}
+	return n, err
+}
+
+// waitForCalls waits for the calls of d to be expected.
+func waitForCalls(t *testing.T, d *slowDriver, expected ...string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if calls := d.recorded(); len(calls) >= len(expected) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, expected, d.recorded())
+}
+
+func TestWithTimeout(t *testing.T) {
+	slow := &slowDriver{delay: 200 * time.Millisecond}
+	d := WithTimeout(slow, map[string]time.Duration{
+		"Get":       10 * time.Millisecond,
+		"Put":       10 * time.Second,
+		"Create":    10 * time.Millisecond,
+		"ApplyDiff": 10 * time.Millisecond,
+	})
+
+	// A layer mounted after the timeout is unmounted.
+	_, err := d.Get("layer1", "")
+	require.IsType(t, &TimeoutError{}, err)
+	assert.Equal(t, &TimeoutError{Method: "Get", ID: "layer1", After: 10 * time.Millisecond}, err)
+	assert.EqualError(t, err, "graphdriver: Get of layer layer1 timed out after 10ms")
+	waitForCalls(t, slow, "Get layer1", "Put layer1")
+
+	// A layer created after the timeout is removed.
+	slow.calls = nil
+	err = d.Create("layer2", "", nil)
+	require.IsType(t, &TimeoutError{}, err)
+	waitForCalls(t, slow, "Create layer2", "Remove layer2")
+
+	// The diff of an ApplyDiff which timed out fails to read.
+	slow.calls = nil
+	_, err = d.ApplyDiff("layer3", "", zeroReader{})
+	require.IsType(t, &TimeoutError{}, err)
+	waitForCalls(t, slow, "ApplyDiff layer3 cancelled")
+
+	// The methods which complete in time, or have no timeout, are not
+	// affected.
+	slow.calls = nil
+	assert.NoError(t, d.Put("layer1"))
+	assert.NoError(t, d.Remove("layer2"))
+	assert.Equal(t, []string{"Put layer1", "Remove layer2"}, slow.recorded())
+
+	slow.delay = 0
+	slow.calls = nil
+	dir, err := d.Get("layer4", "")
+	require.NoError(t, err)
+	assert.Equal(t, "/mnt/layer4", dir)
+	assert.Equal(t, []string{"Get layer4"}, slow.recorded())
+}
@@ -0,0 +1,61 @@
+package graphdriver
+
+import (
+	"github.com/Sirupsen/logrus"
+)
+
+// trimFilesystem discards the unused blocks of the filesystem holding path.
+// It is a variable so that tests can replace it.
+var trimFilesystem = fstrim
+
+// trimDriver wraps a Driver and trims the filesystem of its layers after it
+// removes one.
+type trimDriver struct {
+	Driver
+	root string
+}
+
+// trimDiffGetterDriver is a trimDriver which keeps the DiffGetter method of
+// the driver it wraps.
+type trimDiffGetterDriver struct {
+	*trimDriver
+	getter DiffGetterDriver
+}
+
+func (d *trimDiffGetterDriver) DiffGetter(id string) (FileGetCloser, error) {
+	return d.getter.DiffGetter(id)
+}
+
+// WithTrimOnRemove returns a Driver which discards the blocks freed by the
+// removal of a layer of d right away, as fstrim(8) does, so that
+// thin-provisioned and SSD-backed stores get the space back without waiting
+// for a periodic trim. The filesystem trimmed is the one of root, which
+// should hold the home directory of d. Trimming is best-effort: its failures
+// are logged, and do not fail the removal. The returned driver keeps the
+// Capabilities and DiffGetter methods of d, if it has them.
+func WithTrimOnRemove(d Driver, root string) Driver {
+	td := &trimDriver{Driver: d, root: root}
+	if getter, ok := d.(DiffGetterDriver); ok {
+		return &trimDiffGetterDriver{trimDriver: td, getter: getter}
+	}
+	return td
+}
+
+// Capabilities returns the capabilities of the underlying driver.
+func (d *trimDriver) Capabilities() Capabilities {
+	if capDriver, ok := d.Driver.(CapabilityDriver); ok {
+		return capDriver.Capabilities()
+	}
+	return Capabilities{}
+}
+
+// Remove removes the layer id and, if it succeeds, trims the filesystem.
+func (d *trimDriver) Remove(id string) error {
+	if err := d.Driver.Remove(id); err != nil {
+		return err
+	}
+	if err := trimFilesystem(d.root); err != nil {
+		logrus.Warnf("graphdriver: failed to trim %s after removing layer %s: %v", d.root, id, err)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package graphdriver
+
+import (
+	"math"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fitrim is the FITRIM ioctl, _IOWR('X', 121, struct fstrim_range).
+const fitrim = 0xc0105879
+
+// fstrimRange is struct fstrim_range of linux/fs.h.
+type fstrimRange struct {
+	start  uint64
+	len    uint64
+	minLen uint64
+}
+
+// fstrim discards the unused blocks of the filesystem holding path. Its
+// changes are synced first, so that the blocks freed by the last changes
+// are discarded as well.
+func fstrim(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, _, errno := unix.Syscall(unix.SYS_SYNCFS, f.Fd(), 0, 0); errno != 0 {
+		return errno
+	}
+	r := fstrimRange{len: math.MaxUint64}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fitrim, uintptr(unsafe.Pointer(&r))); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package graphdriver
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// removeDriver is a Driver whose Remove fails with err.
+type removeDriver struct {
+	Driver
+	err error
+}
+
+func (d *removeDriver) Remove(id string) error {
+	return d.err
+}
+
+// withFakeTrim makes the filesystems be trimmed by recording their paths
+// and failing with err, and returns the paths and the function restoring
+// the trim.
+func withFakeTrim(err error) (*[]string, func()) {
+	trim := trimFilesystem
+	var trimmed []string
+	trimFilesystem = func(path string) error {
+		trimmed = append(trimmed, path)
+		return err
+	}
+	return &trimmed, func() { trimFilesystem = trim }
+}
+
+func TestTrimOnRemove(t *testing.T) {
+	trimmed, restore := withFakeTrim(nil)
+	defer restore()
+
+	d := WithTrimOnRemove(&removeDriver{}, "/var/lib/docker")
+	assert.NoError(t, d.Remove("layer"))
+	assert.Equal(t, []string{"/var/lib/docker"}, *trimmed)
+
+	// Nothing is freed by a removal which fails.
+	d = WithTrimOnRemove(&removeDriver{err: errors.New("busy")}, "/var/lib/docker")
+	assert.EqualError(t, d.Remove("layer"), "busy")
+	assert.Len(t, *trimmed, 1)
+}
+
+func TestTrimOnRemoveIgnoresTrimFailures(t *testing.T) {
+	trimmed, restore := withFakeTrim(errors.New("operation not supported"))
+	defer restore()
+
+	d := WithTrimOnRemove(&removeDriver{}, "/var/lib/docker")
+	assert.NoError(t, d.Remove("layer"))
+	assert.Len(t, *trimmed, 1)
+}
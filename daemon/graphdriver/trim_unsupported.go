@@ -0,0 +1,9 @@
+// +build !linux
+
+package graphdriver
+
+// fstrim returns ErrNotSupported, as trimming a filesystem is not supported
+// on this platform.
+func fstrim(path string) error {
+	return ErrNotSupported
+}
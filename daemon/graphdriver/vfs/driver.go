@@ -2,8 +2,11 @@ package vfs
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/docker/docker/daemon/graphdriver"
 	"github.com/docker/docker/pkg/chrootarchive"
@@ -17,6 +20,21 @@ var (
 	CopyWithTar = chrootarchive.NewArchiver(nil).CopyWithTar
 )
 
+const (
+	// creatingSuffix and removingSuffix are appended to the directories of
+	// the layers being created and removed, so that the layers left over by
+	// an interrupted creation or removal can be told apart.
+	creatingSuffix = "-creating"
+	removingSuffix = "-removing"
+	// pinnedSuffix is appended to the directory of a layer to name its pin
+	// file, which is kept next to the directory as the directory only
+	// holds the content of the layer.
+	pinnedSuffix = "-pinned"
+	// frozenSuffix is appended to the directory of a layer to name the
+	// file marking it frozen.
+	frozenSuffix = "-frozen"
+)
+
 func init() {
 	graphdriver.Register("vfs", Init)
 }
@@ -32,6 +50,7 @@ func Init(home string, options []string, uidMaps, gidMaps []idtools.IDMap) (grap
 	if err := idtools.MkdirAllAndChown(home, 0700, rootIDs); err != nil {
 		return nil, err
 	}
+	d.supportsDType = supportsDType(home)
 	return graphdriver.NewNaiveDiffDriver(d, uidMaps, gidMaps), nil
 }
 
@@ -40,17 +59,34 @@ func Init(home string, options []string, uidMaps, gidMaps []idtools.IDMap) (grap
 // In order to support layering, files are copied from the parent layer into the new layer. There is no copy-on-write support.
 // Driver must be wrapped in NaiveDiffDriver to be used as a graphdriver.Driver
 type Driver struct {
-	home       string
-	idMappings *idtools.IDMappings
+	home          string
+	idMappings    *idtools.IDMappings
+	supportsDType bool
+	// sharded makes the directories of the layers be sharded by the first
+	// characters of their ids. See graphdriver.ShardedLayoutDriver.
+	sharded bool
+	// errors keeps the last errors of the driver for its diagnostics.
+	errors graphdriver.ErrorLog
 }
 
 func (d *Driver) String() string {
 	return "vfs"
 }
 
-// Status is used for implementing the graphdriver.ProtoDriver interface. VFS does not currently have any status information.
+// Status is used for implementing the graphdriver.ProtoDriver interface. VFS only reports the features listed in graphdriver.StatusFeatureKeys.
 func (d *Driver) Status() [][2]string {
-	return nil
+	return graphdriver.FeatureStatus{SupportsDType: d.supportsDType}.Status()
+}
+
+// StatusJSON returns the status document of the driver, which is healthy as
+// long as its home directory is accessible.
+func (d *Driver) StatusJSON() ([]byte, error) {
+	return graphdriver.StatusDocument{
+		Driver:   d.String(),
+		Home:     d.home,
+		Features: graphdriver.FeatureStatus{SupportsDType: d.supportsDType},
+		Problems: graphdriver.CheckHome(d.home),
+	}.JSON()
 }
 
 // GetMetadata is used for implementing the graphdriver.ProtoDriver interface. VFS does not currently have any meta data.
@@ -58,8 +94,20 @@ func (d *Driver) GetMetadata(id string) (map[string]string, error) {
 	return nil, nil
 }
 
-// Cleanup is used to implement graphdriver.ProtoDriver. There is no cleanup required for this driver.
+// Cleanup unmounts the directories of the frozen layers, which Get mounts
+// read-only again when the driver is used next.
 func (d *Driver) Cleanup() error {
+	names, err := graphdriver.LayerEntries(filepath.Join(d.home, "dir"), d.sharded)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if id := strings.TrimSuffix(name, frozenSuffix); id != name {
+			if err := graphdriver.UnmountFrozen(d.dir(id)); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -70,45 +118,149 @@ func (d *Driver) CreateReadWrite(id, parent string, opts *graphdriver.CreateOpts
 }
 
 // Create prepares the filesystem for the VFS driver and copies the directory for the given id under the parent.
-func (d *Driver) Create(id, parent string, opts *graphdriver.CreateOpts) error {
+// The layer is populated in a temporary directory, which is only renamed to
+// the directory of the layer once complete.
+func (d *Driver) Create(id, parent string, opts *graphdriver.CreateOpts) (retErr error) {
 	if opts != nil && len(opts.StorageOpt) != 0 {
 		return fmt.Errorf("--storage-opt is not supported for vfs")
 	}
 
 	dir := d.dir(id)
+	creating := dir + creatingSuffix
 	rootIDs := d.idMappings.RootPair()
 	if err := idtools.MkdirAllAndChown(filepath.Dir(dir), 0700, rootIDs); err != nil {
 		return err
 	}
-	if err := idtools.MkdirAndChown(dir, 0755, rootIDs); err != nil {
+	// Start afresh if a previous creation was interrupted.
+	if err := system.EnsureRemoveAll(creating); err != nil {
 		return err
 	}
+	if err := idtools.MkdirAndChown(creating, 0755, rootIDs); err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			system.EnsureRemoveAll(creating)
+			d.errors.Record("create "+id, retErr)
+		}
+	}()
 	labelOpts := []string{"level:s0"}
 	if _, mountLabel, err := label.InitLabels(labelOpts); err == nil {
-		label.SetFileLabel(dir, mountLabel)
+		label.SetFileLabel(creating, mountLabel)
 	}
-	if parent == "" {
-		return nil
-	}
-	parentDir, err := d.Get(parent, "")
-	if err != nil {
-		return fmt.Errorf("%s: %s", parent, err)
+	if parent != "" {
+		parentDir, err := d.Get(parent, "")
+		if err != nil {
+			return fmt.Errorf("%s: %s", parent, err)
+		}
+		if err := CopyWithTar(parentDir, creating); err != nil {
+			return err
+		}
 	}
-	return CopyWithTar(parentDir, dir)
+	return os.Rename(creating, dir)
 }
 
 func (d *Driver) dir(id string) string {
-	return filepath.Join(d.home, "dir", filepath.Base(id))
+	return graphdriver.LayerPath(filepath.Join(d.home, "dir"), filepath.Base(id), d.sharded)
 }
 
-// Remove deletes the content from the directory for a given id.
-func (d *Driver) Remove(id string) error {
-	if err := system.EnsureRemoveAll(d.dir(id)); err != nil {
+// SetShardedLayout switches the directories of the layers to the sharded or
+// the flat layout, moving those of the existing layers. It must be called
+// before the driver is used.
+func (d *Driver) SetShardedLayout(sharded bool) error {
+	if err := graphdriver.ShardLayers(filepath.Join(d.home, "dir"), sharded); err != nil {
 		return err
 	}
+	d.sharded = sharded
 	return nil
 }
 
+// Remove deletes the content from the directory for a given id. The
+// directory is first moved out of the way, so that a layer whose removal is
+// interrupted does not look like a complete layer.
+func (d *Driver) Remove(id string) (retErr error) {
+	defer func() {
+		d.errors.Record("remove "+id, retErr)
+	}()
+	dir := d.dir(id)
+	if graphdriver.IsLayerPinned(dir + pinnedSuffix) {
+		return &graphdriver.PinnedError{ID: id}
+	}
+	// A mount point cannot be renamed.
+	if err := graphdriver.UnmountFrozen(dir); err != nil {
+		return err
+	}
+	removing := dir + removingSuffix
+	if err := os.Rename(dir, removing); err != nil {
+		if os.IsNotExist(err) {
+			return graphdriver.RemoveFrozenFile(dir + frozenSuffix)
+		}
+		return err
+	}
+	if err := system.EnsureRemoveAll(removing); err != nil {
+		return err
+	}
+	return graphdriver.RemoveFrozenFile(dir + frozenSuffix)
+}
+
+// Pin pins the layer id against removal by creating its pin file.
+func (d *Driver) Pin(id string) error {
+	dir := d.dir(id)
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	return graphdriver.PinLayer(dir + pinnedSuffix)
+}
+
+// Unpin removes the pin file of the layer id.
+func (d *Driver) Unpin(id string) error {
+	return graphdriver.UnpinLayer(d.dir(id) + pinnedSuffix)
+}
+
+// Freeze freezes the layer id by creating its frozen file and mounting its
+// directory read-only.
+func (d *Driver) Freeze(id string) error {
+	dir := d.dir(id)
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	if err := graphdriver.MountFrozen(dir); err != nil {
+		return err
+	}
+	if err := graphdriver.FreezeLayer(dir + frozenSuffix); err != nil {
+		graphdriver.UnmountFrozen(dir)
+		return err
+	}
+	return nil
+}
+
+// IsFrozen returns whether the layer id has a frozen file.
+func (d *Driver) IsFrozen(id string) bool {
+	return graphdriver.IsLayerFrozen(d.dir(id) + frozenSuffix)
+}
+
+// Reconcile removes the directories of the layers whose creation or removal
+// was interrupted.
+func (d *Driver) Reconcile() ([]string, error) {
+	names, err := graphdriver.LayerEntries(filepath.Join(d.home, "dir"), d.sharded)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, name := range names {
+		id := strings.TrimSuffix(strings.TrimSuffix(name, creatingSuffix), removingSuffix)
+		if id == name {
+			continue
+		}
+		if err := system.EnsureRemoveAll(d.dir(name)); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
 // Get returns the directory for the given id.
 func (d *Driver) Get(id, mountLabel string) (string, error) {
 	dir := d.dir(id)
@@ -117,9 +269,47 @@ func (d *Driver) Get(id, mountLabel string) (string, error) {
 	} else if !st.IsDir() {
 		return "", fmt.Errorf("%s: not a directory", dir)
 	}
+	// The read-only mount of a frozen layer does not survive reboots.
+	if d.IsFrozen(id) {
+		if err := graphdriver.MountFrozen(dir); err != nil {
+			return "", err
+		}
+	}
 	return dir, nil
 }
 
+// ListFiles returns the files of the directory of the layer id. As vfs
+// copies the files of the parent into each layer, they are listed as well.
+func (d *Driver) ListFiles(id string) ([]graphdriver.FileEntry, error) {
+	dir, err := d.Get(id, "")
+	if err != nil {
+		return nil, err
+	}
+	return graphdriver.ListDir(dir, nil)
+}
+
+// ReclaimableSpace returns the disk space removing the directories of the
+// layers unusedIDs would free.
+func (d *Driver) ReclaimableSpace(unusedIDs []string) (int64, error) {
+	dirs := make([]string, 0, len(unusedIDs))
+	for _, id := range unusedIDs {
+		dirs = append(dirs, d.dir(id))
+	}
+	return graphdriver.DiskUsage(dirs...)
+}
+
+// FreeSpace returns the space available on the filesystem of the directory
+// of the layer id.
+func (d *Driver) FreeSpace(id string) (int64, error) {
+	return graphdriver.FreeSpaceOf(d.dir(id))
+}
+
+// Diagnostics writes the diagnostics bundle of the driver to w. vfs has
+// nothing to add to the files common to all the drivers.
+func (d *Driver) Diagnostics(w io.Writer) error {
+	return graphdriver.WriteDiagnostics(w, graphdriver.CommonDiagnostics(d, d.home, &d.errors))
+}
+
 // Put is a noop for vfs that return nil for the error, since this driver has no runtime resources to clean up.
 func (d *Driver) Put(id string) error {
 	// The vfs driver has no runtime resources (e.g. mounts)
@@ -127,6 +317,22 @@ func (d *Driver) Put(id string) error {
 	return nil
 }
 
+// GetAt bind mounts the directory of the layer id at target.
+func (d *Driver) GetAt(id, mountLabel, target string) error {
+	return graphdriver.BindLayer(d, id, mountLabel, target)
+}
+
+// PutAt unmounts the directory of the layer id from target.
+func (d *Driver) PutAt(id, target string) error {
+	return graphdriver.UnbindLayer(d, id, target)
+}
+
+// LayerDirs returns the directory of the layer id, which holds a copy of
+// its parents.
+func (d *Driver) LayerDirs(id string) ([]string, string, error) {
+	return []string{d.dir(id)}, "", nil
+}
+
 // Exists checks to see if the directory exists for the given id.
 func (d *Driver) Exists(id string) bool {
 	_, err := os.Stat(d.dir(id))
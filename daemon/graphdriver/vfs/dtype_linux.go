@@ -0,0 +1,10 @@
+package vfs
+
+import "github.com/docker/docker/pkg/fsutils"
+
+// supportsDType returns whether the filesystem of home returns the file type
+// in directory entries.
+func supportsDType(home string) bool {
+	supported, err := fsutils.SupportsDType(home)
+	return err == nil && supported
+}
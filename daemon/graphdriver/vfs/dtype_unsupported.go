@@ -0,0 +1,9 @@
+// +build !linux
+
+package vfs
+
+// supportsDType returns false as the file type in directory entries is only
+// detected on Linux.
+func supportsDType(home string) bool {
+	return false
+}
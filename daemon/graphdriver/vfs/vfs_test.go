@@ -3,9 +3,14 @@
 package vfs
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/docker/docker/daemon/graphdriver"
 	"github.com/docker/docker/daemon/graphdriver/graphtest"
+	"github.com/docker/docker/pkg/stringid"
 
 	"github.com/docker/docker/pkg/reexec"
 )
@@ -32,6 +37,149 @@ func TestVfsCreateSnap(t *testing.T) {
 	graphtest.DriverTestCreateSnap(t, "vfs")
 }
 
+func TestVfsStatusFeatures(t *testing.T) {
+	graphtest.DriverTestStatusFeatures(t, "vfs")
+}
+
 func TestVfsTeardown(t *testing.T) {
 	graphtest.PutDriver(t)
 }
+
+func TestVfsReconcile(t *testing.T) {
+	home, err := ioutil.TempDir("", "vfs-reconcile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	d, err := Init(home, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create("base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(home, "dir", "base", "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Seed the leftovers of an interrupted creation and removal.
+	for _, name := range []string{"created-creating", "removed-removing"} {
+		if err := os.MkdirAll(filepath.Join(home, "dir", name, "partial"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids, err := graphdriver.Reconcile(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] != "created" || ids[1] != "removed" {
+		t.Fatalf("expected the created and removed layers to be reconciled, got %v", ids)
+	}
+	items, err := ioutil.ReadDir(filepath.Join(home, "dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Name() != "base" {
+		t.Fatalf("expected only the base layer to be left, got %v", items)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(home, "dir", "base", "file"))
+	if err != nil || string(content) != "content" {
+		t.Fatalf("expected the base layer to be left alone, got %q (%v)", content, err)
+	}
+
+	ids, err = graphdriver.Reconcile(d)
+	if err != nil || len(ids) != 0 {
+		t.Fatalf("expected nothing left to reconcile, got %v (%v)", ids, err)
+	}
+}
+
+func TestVfsShardedLayout(t *testing.T) {
+	home, err := ioutil.TempDir("", "vfs-sharded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	d, err := Init(home, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create half of the layers in the flat layout, to be migrated.
+	var ids []string
+	parent := ""
+	for i := 0; i < 200; i++ {
+		if i == 100 {
+			if err := graphdriver.SetShardedLayout(d, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		id := stringid.GenerateRandomID()
+		if err := d.Create(id, parent, nil); err != nil {
+			t.Fatal(err)
+		}
+		dir, err := d.Get(id, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, id), []byte(id), 0644); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		parent = id
+	}
+
+	items, err := ioutil.ReadDir(filepath.Join(home, "dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items {
+		if len(item.Name()) != 2 {
+			t.Fatalf("expected only shards in the sharded layout, got %s", item.Name())
+		}
+	}
+	for _, id := range ids {
+		dir, err := d.Get(id, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dir != filepath.Join(home, "dir", id[:2], id) {
+			t.Fatalf("unexpected directory %s for layer %s", dir, id)
+		}
+		// vfs copies the files of the parents.
+		if _, err := os.Stat(filepath.Join(dir, ids[0])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, id := range ids[150:] {
+		if err := d.Remove(id); err != nil {
+			t.Fatal(err)
+		}
+		if d.Exists(id) {
+			t.Fatalf("expected layer %s to be removed", id)
+		}
+	}
+
+	// Switching back to the flat layout moves the layers again.
+	if err := graphdriver.SetShardedLayout(d, false); err != nil {
+		t.Fatal(err)
+	}
+	names, err := graphdriver.LayerEntries(filepath.Join(home, "dir"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 150 {
+		t.Fatalf("expected 150 layers in the flat layout, got %d", len(names))
+	}
+	for _, id := range ids[:150] {
+		dir, err := d.Get(id, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, id))
+		if err != nil || string(content) != id {
+			t.Fatalf("expected layer %s to be kept, got %q (%v)", id, content, err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package graphdriver
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WarmDriver is the interface for layered file system drivers that can read
+// the files of layers into the page cache ahead of their use.
+type WarmDriver interface {
+	// Warm reads the files of the layers ids, typically the layers of an
+	// image, into the page cache, so that the first containers started
+	// from them do not wait on the disk.
+	Warm(ids []string) error
+}
+
+// Warm reads the layers ids of d into the page cache if d supports it, and
+// does nothing otherwise.
+func Warm(d Driver, ids []string) error {
+	if warmer, ok := d.(WarmDriver); ok {
+		return warmer.Warm(ids)
+	}
+	return nil
+}
+
+// warmFileSizeLimit is the size of the largest files read by WarmDirs. The
+// executables, libraries and configuration files a container needs to start
+// are below it, while large data files would only evict them.
+const warmFileSizeLimit = 4 << 20
+
+// WarmDirs reads the regular files below dirs into the page cache, skipping
+// those larger than warmFileSizeLimit. The content of the files is left
+// alone. Files which disappear while being walked are skipped.
+func WarmDirs(dirs ...string) error {
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !info.Mode().IsRegular() || info.Size() == 0 || info.Size() > warmFileSizeLimit {
+				return nil
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(ioutil.Discard, f)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
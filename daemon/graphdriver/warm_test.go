@@ -0,0 +1,52 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWarm(t *testing.T) {
+	d, _, cleanup := newVfsDriver(t)
+	defer cleanup()
+
+	large := bytes.Repeat([]byte("0123456789"), 500000)
+	files := map[string][]byte{
+		"bin/app":      []byte("binary"),
+		"etc/app.conf": []byte("key=value\n"),
+		"data/large":   large,
+	}
+	require.NoError(t, d.Create("base", "", nil))
+	diff, err := archive.Generate("bin/app", string(files["bin/app"]), "data/large", string(large))
+	require.NoError(t, err)
+	_, err = d.ApplyDiff("base", "", diff)
+	require.NoError(t, err)
+	require.NoError(t, d.Create("top", "base", nil))
+	diff, err = archive.Generate("etc/app.conf", string(files["etc/app.conf"]))
+	require.NoError(t, err)
+	_, err = d.ApplyDiff("top", "base", diff)
+	require.NoError(t, err)
+
+	// vfs does not support warming, which is a no-op, even through the
+	// wrappers of New.
+	assert.NoError(t, graphdriver.Warm(d, []string{"base", "top"}))
+	assert.NoError(t, graphdriver.Warm(graphdriver.WithSyncMode(d, "", graphdriver.SyncNone), []string{"base", "top"}))
+
+	dir, err := d.Get("top", "")
+	require.NoError(t, err)
+	defer d.Put("top")
+	require.NoError(t, graphdriver.WarmDirs(dir, filepath.Join(dir, "missing")))
+	for name, content := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.Equal(t, content, got, name)
+	}
+}
@@ -0,0 +1,151 @@
+package graphdriver
+
+import (
+	"archive/tar"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/ioutils"
+)
+
+// WhiteoutFormat is the representation used for deleted files and opaque
+// directories in the archive produced by a diff.
+type WhiteoutFormat int
+
+const (
+	// AUFSWhiteoutFormat represents deleted files as empty files prefixed
+	// with ".wh." and opaque directories with a ".wh..wh..opq" file. This is
+	// the format produced by Diff and the one used by the OCI image spec.
+	AUFSWhiteoutFormat WhiteoutFormat = iota
+	// OverlayWhiteoutFormat represents deleted files as character devices
+	// with device number 0/0 and opaque directories with the
+	// "trusted.overlay.opaque" extended attribute set to "y".
+	OverlayWhiteoutFormat
+)
+
+// WhiteoutFormatDiffDriver is the interface for drivers which can natively
+// produce diffs using a chosen whiteout format.
+type WhiteoutFormatDiffDriver interface {
+	// DiffWithWhiteoutFormat produces an archive of the changes between
+	// the specified layer and its parent layer which may be "", using
+	// format to represent whiteouts.
+	DiffWithWhiteoutFormat(id, parent string, format WhiteoutFormat) (io.ReadCloser, error)
+}
+
+// DiffWithWhiteoutFormat produces an archive of the changes between the
+// specified layer and its parent layer which may be "", using format to
+// represent whiteouts. Drivers which do not implement
+// WhiteoutFormatDiffDriver have the archive produced by Diff translated.
+func DiffWithWhiteoutFormat(d Driver, id, parent string, format WhiteoutFormat) (io.ReadCloser, error) {
+	if wd, ok := d.(WhiteoutFormatDiffDriver); ok {
+		return wd.DiffWithWhiteoutFormat(id, parent, format)
+	}
+	rc, err := d.Diff(id, parent)
+	if err != nil || format == AUFSWhiteoutFormat {
+		return rc, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(aufsToOverlayWhiteouts(pw, rc))
+	}()
+	return ioutils.NewReadCloserWrapper(pr, func() error {
+		pr.Close()
+		return rc.Close()
+	}), nil
+}
+
+// aufsToOverlayWhiteouts copies the tar stream in r to w, converting AUFS
+// style whiteouts to overlay style ones.
+func aufsToOverlayWhiteouts(w io.Writer, r io.Reader) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+
+	// Opaque markers follow the header of the directory they apply to, so
+	// the directory header is written again with the opaque attribute set.
+	dirs := make(map[string]*tar.Header)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimSuffix(hdr.Name, "/")
+		dir, base := path.Split(name)
+
+		switch {
+		case base == archive.WhiteoutOpaqueDir:
+			dir = strings.TrimSuffix(dir, "/")
+			if dir == "" {
+				// The root of a layer cannot be made opaque.
+				continue
+			}
+			orig, ok := dirs[dir]
+			if !ok {
+				orig = &tar.Header{
+					Name:    dir + "/",
+					Mode:    0755,
+					Uid:     hdr.Uid,
+					Gid:     hdr.Gid,
+					ModTime: hdr.ModTime,
+				}
+			}
+			dirHdr := &tar.Header{
+				Typeflag:   tar.TypeDir,
+				Name:       orig.Name,
+				Mode:       orig.Mode,
+				Uid:        orig.Uid,
+				Gid:        orig.Gid,
+				Uname:      orig.Uname,
+				Gname:      orig.Gname,
+				ModTime:    orig.ModTime,
+				AccessTime: orig.AccessTime,
+				ChangeTime: orig.ChangeTime,
+				Xattrs:     map[string]string{"trusted.overlay.opaque": "y"},
+			}
+			for k, v := range orig.Xattrs {
+				dirHdr.Xattrs[k] = v
+			}
+			if err := tw.WriteHeader(dirHdr); err != nil {
+				return err
+			}
+			continue
+		case strings.HasPrefix(base, archive.WhiteoutMetaPrefix):
+			// Other AUFS metadata has no overlay equivalent.
+			continue
+		case strings.HasPrefix(base, archive.WhiteoutPrefix):
+			wo := &tar.Header{
+				Typeflag:   tar.TypeChar,
+				Name:       dir + strings.TrimPrefix(base, archive.WhiteoutPrefix),
+				Uid:        hdr.Uid,
+				Gid:        hdr.Gid,
+				Uname:      hdr.Uname,
+				Gname:      hdr.Gname,
+				ModTime:    hdr.ModTime,
+				AccessTime: hdr.AccessTime,
+				ChangeTime: hdr.ChangeTime,
+			}
+			if err := tw.WriteHeader(wo); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if hdr.Typeflag == tar.TypeDir {
+			dirs[name] = hdr
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
@@ -0,0 +1,150 @@
+// +build linux
+
+package graphdriver_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tarDiffDriver is a driver whose Diff returns a fixed archive.
+type tarDiffDriver struct {
+	graphdriver.Driver
+	diff []byte
+}
+
+func (d *tarDiffDriver) Diff(id, parent string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(d.diff)), nil
+}
+
+func readTarHeaders(t *testing.T, r io.Reader) []*tar.Header {
+	var hdrs []*tar.Header
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return hdrs
+		}
+		require.NoError(t, err)
+		hdrs = append(hdrs, hdr)
+	}
+}
+
+// createDeletionLayers creates a parent layer holding two files and a child
+// layer in which one of them was deleted.
+func createDeletionLayers(t *testing.T, d graphdriver.Driver) {
+	require.NoError(t, d.Create("parent", "", nil))
+	diff, err := archive.Generate("kept", "kept", "deleted", "deleted")
+	require.NoError(t, err)
+	_, err = d.ApplyDiff("parent", "", diff)
+	require.NoError(t, err)
+
+	require.NoError(t, d.Create("child", "parent", nil))
+	dir, err := d.Get("child", "")
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(filepath.Join(dir, "deleted")))
+	require.NoError(t, d.Put("child"))
+}
+
+func TestDiffWithAUFSWhiteoutFormat(t *testing.T) {
+	d, _, cleanup := newVfsDriver(t)
+	defer cleanup()
+	createDeletionLayers(t, d)
+
+	rc, err := graphdriver.DiffWithWhiteoutFormat(d, "child", "parent", graphdriver.AUFSWhiteoutFormat)
+	require.NoError(t, err)
+	hdrs := readTarHeaders(t, rc)
+	require.NoError(t, rc.Close())
+	require.Len(t, hdrs, 1)
+	assert.Equal(t, ".wh.deleted", hdrs[0].Name)
+	assert.Equal(t, byte(tar.TypeReg), hdrs[0].Typeflag)
+
+	// Applying the diff to a copy of the parent deletes the file again.
+	require.NoError(t, d.Create("copy", "parent", nil))
+	rc, err = graphdriver.DiffWithWhiteoutFormat(d, "child", "parent", graphdriver.AUFSWhiteoutFormat)
+	require.NoError(t, err)
+	_, err = d.ApplyDiff("copy", "parent", rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+
+	dir, err := d.Get("copy", "")
+	require.NoError(t, err)
+	defer d.Put("copy")
+	_, err = os.Stat(filepath.Join(dir, "deleted"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "kept"))
+	assert.NoError(t, err)
+}
+
+func TestDiffWithOverlayWhiteoutFormat(t *testing.T) {
+	d, _, cleanup := newVfsDriver(t)
+	defer cleanup()
+	createDeletionLayers(t, d)
+
+	rc, err := graphdriver.DiffWithWhiteoutFormat(d, "child", "parent", graphdriver.OverlayWhiteoutFormat)
+	require.NoError(t, err)
+	hdrs := readTarHeaders(t, rc)
+	require.NoError(t, rc.Close())
+	require.Len(t, hdrs, 1)
+	assert.Equal(t, "deleted", hdrs[0].Name)
+	assert.Equal(t, byte(tar.TypeChar), hdrs[0].Typeflag)
+	assert.Equal(t, int64(0), hdrs[0].Devmajor)
+	assert.Equal(t, int64(0), hdrs[0].Devminor)
+
+	// Unpacking the diff as is yields an overlay whiteout device.
+	target, err := ioutil.TempDir("", "graphdriver-whiteout")
+	require.NoError(t, err)
+	defer os.RemoveAll(target)
+	rc, err = graphdriver.DiffWithWhiteoutFormat(d, "child", "parent", graphdriver.OverlayWhiteoutFormat)
+	require.NoError(t, err)
+	require.NoError(t, archive.Untar(rc, target, &archive.TarOptions{NoLchown: true}))
+	require.NoError(t, rc.Close())
+
+	fi, err := os.Lstat(filepath.Join(target, "deleted"))
+	require.NoError(t, err)
+	assert.True(t, fi.Mode()&os.ModeCharDevice != 0)
+	assert.Equal(t, uint64(0), uint64(fi.Sys().(*syscall.Stat_t).Rdev))
+}
+
+func TestDiffWithOverlayWhiteoutFormatOpaqueDir(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0700},
+		{Name: "dir/.wh..wh..opq", Typeflag: tar.TypeReg},
+		{Name: "other/.wh..wh..opq", Typeflag: tar.TypeReg},
+		{Name: "other/.wh.file", Typeflag: tar.TypeReg},
+	} {
+		require.NoError(t, tw.WriteHeader(hdr))
+	}
+	require.NoError(t, tw.Close())
+
+	d := &tarDiffDriver{diff: buf.Bytes()}
+	rc, err := graphdriver.DiffWithWhiteoutFormat(d, "id", "", graphdriver.OverlayWhiteoutFormat)
+	require.NoError(t, err)
+	hdrs := readTarHeaders(t, rc)
+	require.NoError(t, rc.Close())
+
+	require.Len(t, hdrs, 4)
+	assert.Equal(t, "dir/", hdrs[0].Name)
+	assert.Empty(t, hdrs[0].Xattrs["trusted.overlay.opaque"])
+	assert.Equal(t, "dir/", hdrs[1].Name)
+	assert.Equal(t, int64(0700), hdrs[1].Mode)
+	assert.Equal(t, "y", hdrs[1].Xattrs["trusted.overlay.opaque"])
+	assert.Equal(t, "other/", hdrs[2].Name)
+	assert.Equal(t, byte(tar.TypeDir), hdrs[2].Typeflag)
+	assert.Equal(t, "y", hdrs[2].Xattrs["trusted.overlay.opaque"])
+	assert.Equal(t, "other/file", hdrs[3].Name)
+	assert.Equal(t, byte(tar.TypeChar), hdrs[3].Typeflag)
+}
@@ -1,6 +1,8 @@
 package daemon
 
 import (
+	"time"
+
 	"github.com/docker/docker/container"
 	"golang.org/x/net/context"
 )
@@ -20,3 +22,15 @@ func (daemon *Daemon) ContainerWait(ctx context.Context, name string, condition
 
 	return cntr.Wait(ctx, condition), nil
 }
+
+// ContainerWaitSince is like ContainerWait, but resumes a wait that began
+// at since and was interrupted, for example by a daemon restart. If the
+// container stopped in the meantime, its status is returned right away.
+func (daemon *Daemon) ContainerWaitSince(ctx context.Context, name string, condition container.WaitCondition, since time.Time) (<-chan container.StateStatus, error) {
+	cntr, err := daemon.GetContainer(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return cntr.WaitSince(ctx, condition, since), nil
+}
@@ -92,6 +92,11 @@ func (img *Image) RunConfig() *container.Config {
 	return img.Config
 }
 
+// Platform returns the operating system and the architecture of the image.
+func (img *Image) Platform() (string, string) {
+	return img.OS, img.Architecture
+}
+
 // MarshalJSON serializes the image to JSON. It sorts the top-level keys so
 // that JSON that's been manipulated by a push/pull cycle with a legacy
 // registry won't end up with a different key order.
@@ -962,6 +962,36 @@ func (s *DockerSuite) TestContainerAPIWait(c *check.C) {
 	c.Assert(waitres.StatusCode, checker.Equals, int64(0))
 }
 
+func (s *DockerSuite) TestContainerAPIWaitOutputTail(c *check.C) {
+	testRequires(c, DaemonIsLinux)
+	name := "test-api-wait-output-tail"
+	dockerCmd(c, "run", "--name", name, "busybox", "sh", "-c", "echo one; echo two; echo three >&2; exit 3")
+
+	status, body, err := request.SockRequest("POST", "/containers/"+name+"/wait?tail=2", nil, daemonHost())
+	c.Assert(err, checker.IsNil)
+	c.Assert(status, checker.Equals, http.StatusOK)
+
+	var waitres containertypes.ContainerWaitOKBody
+	c.Assert(json.Unmarshal(body, &waitres), checker.IsNil)
+	c.Assert(waitres.StatusCode, checker.Equals, int64(3))
+	c.Assert(waitres.Output, checker.Not(checker.Contains), "one")
+	c.Assert(waitres.Output, checker.Contains, "two")
+	c.Assert(waitres.Output, checker.Contains, "three")
+
+	// The output of containers which exited successfully is not returned.
+	name = "test-api-wait-output-tail-success"
+	dockerCmd(c, "run", "--name", name, "busybox", "echo", "one")
+
+	status, body, err = request.SockRequest("POST", "/containers/"+name+"/wait?tail=2", nil, daemonHost())
+	c.Assert(err, checker.IsNil)
+	c.Assert(status, checker.Equals, http.StatusOK)
+
+	waitres = containertypes.ContainerWaitOKBody{}
+	c.Assert(json.Unmarshal(body, &waitres), checker.IsNil)
+	c.Assert(waitres.StatusCode, checker.Equals, int64(0))
+	c.Assert(waitres.Output, checker.Equals, "")
+}
+
 func (s *DockerSuite) TestContainerAPICopyNotExistsAnyMore(c *check.C) {
 	name := "test-container-api-copy"
 	dockerCmd(c, "run", "--name", name, "busybox", "touch", "/test.txt")
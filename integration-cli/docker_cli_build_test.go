@@ -6068,6 +6068,38 @@ func (s *DockerRegistrySuite) TestBuildCopyFromImplicitPullingFrom(c *check.C) {
 	cli.Docker(cli.Args("run", "build1", "cat", "baz")).Assert(c, icmd.Expected{Out: "abc"})
 }
 
+func (s *DockerRegistrySuite) TestBuildCopyFromPulledImageWithPull(c *check.C) {
+	repoName := fmt.Sprintf("%v/dockercli/testcopyfrom", privateRegistryURL)
+
+	ctx := fakecontext.New(c, "",
+		fakecontext.WithDockerfile(`
+		FROM busybox
+		COPY foo bar`),
+		fakecontext.WithFiles(map[string]string{
+			"foo": "abc",
+		}))
+	defer ctx.Close()
+
+	cli.BuildCmd(c, repoName, build.WithExternalBuildContext(ctx))
+	cli.DockerCmd(c, "push", repoName)
+	cli.DockerCmd(c, "rmi", repoName)
+
+	// With --pull the image is pulled once, and the stage is not pulled.
+	dockerfile := `
+		FROM busybox AS stage
+		RUN echo def > /stagefile
+		FROM busybox
+		COPY --from=%[1]s bar baz
+		COPY --from=stage /stagefile /stagefile
+		COPY --from=%[1]s bar baz2`
+	ctx = fakecontext.New(c, "", fakecontext.WithDockerfile(fmt.Sprintf(dockerfile, repoName)))
+	defer ctx.Close()
+
+	cli.BuildCmd(c, "build1", cli.WithFlags("--pull"), build.WithExternalBuildContext(ctx))
+
+	cli.Docker(cli.Args("run", "build1", "cat", "baz", "baz2", "stagefile")).Assert(c, icmd.Expected{Out: "abcabcdef"})
+}
+
 func (s *DockerSuite) TestBuildFromPreviousBlock(c *check.C) {
 	dockerfile := `
 		FROM busybox as foo
@@ -25,6 +25,9 @@ import (
 	"crypto/x509"
 
 	"github.com/cloudflare/cfssl/helpers"
+	"github.com/docker/docker/api"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
 	"github.com/docker/docker/integration-cli/checker"
 	"github.com/docker/docker/integration-cli/cli"
 	"github.com/docker/docker/integration-cli/daemon"
@@ -38,6 +41,7 @@ import (
 	"github.com/docker/libtrust"
 	"github.com/go-check/check"
 	"github.com/kr/pty"
+	"golang.org/x/net/context"
 )
 
 // TestLegacyDaemonCommand test starting docker daemon using "deprecated" docker daemon
@@ -2980,3 +2984,38 @@ func (s *DockerDaemonSuite) TestShmSizeReload(c *check.C) {
 	c.Assert(err, check.IsNil, check.Commentf("Output: %s", out))
 	c.Assert(strings.TrimSpace(out), check.Equals, fmt.Sprintf("%v", size))
 }
+
+// TestDaemonRestartResumesContainerWait verifies that a client waiting on a
+// container re-attaches to the wait after the daemon restarts, and receives
+// the exit code of the container which exited while the daemon was down.
+func (s *DockerDaemonSuite) TestDaemonRestartResumesContainerWait(c *check.C) {
+	s.d.StartWithBusybox(c, "--live-restore")
+
+	out, err := s.d.Cmd("run", "-d", "busybox", "top")
+	c.Assert(err, checker.IsNil, check.Commentf("output: %s", out))
+	id := strings.TrimSpace(out)
+
+	pid, err := s.d.InspectField(id, "{{.State.Pid}}")
+	c.Assert(err, checker.IsNil)
+	p, err := strconv.Atoi(pid)
+	c.Assert(err, checker.IsNil)
+
+	cli, err := client.NewClient(s.d.Sock(), api.DefaultVersion, nil, nil)
+	c.Assert(err, checker.IsNil)
+	defer cli.Close()
+
+	resultC, errC := cli.ContainerWait(context.Background(), id, container.WaitConditionNextExit)
+
+	s.d.Stop(c)
+	c.Assert(syscall.Kill(p, syscall.SIGKILL), checker.IsNil)
+	s.d.Start(c, "--live-restore")
+
+	select {
+	case err := <-errC:
+		c.Fatalf("wait failed: %v", err)
+	case res := <-resultC:
+		c.Assert(res.StatusCode, checker.Equals, int64(137))
+	case <-time.After(60 * time.Second):
+		c.Fatal("timeout waiting for resumed wait to return")
+	}
+}
@@ -108,7 +108,7 @@ type Layer interface {
 	DiffSize() (int64, error)
 
 	// Metadata returns the low level storage metadata associated
-	// with layer.
+	// with layer, along with its chain ID under the ChainID key.
 	Metadata() (map[string]string, error)
 }
 
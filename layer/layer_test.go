@@ -770,3 +770,63 @@ func TestTarStreamVerification(t *testing.T) {
 		t.Fatalf("wrong error returned from tarstream: %q", err)
 	}
 }
+
+func TestMetadataChainID(t *testing.T) {
+	ls, _, cleanup := newTestStore(t)
+	defer cleanup()
+
+	tar1, err := tarFromFiles(newTestFile("/etc/profile", []byte("# Base configuration"), 0644))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tar2, err := tarFromFiles(newTestFile("/root/.bashrc", []byte("# Root configuration"), 0644))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layer1, err := ls.Register(bytes.NewReader(tar1), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer2, err := ls.Register(bytes.NewReader(tar2), layer1.ChainID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The chain ID of the first layer is its diff ID, and the one of each
+	// layer above it the digest of the chain ID of its parent and of its
+	// diff ID.
+	diffID1 := digest.FromBytes(tar1)
+	diffID2 := digest.FromBytes(tar2)
+	expected := digest.FromBytes([]byte(diffID1.String() + " " + diffID2.String()))
+
+	metadata, err := layer2.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata["ChainID"] != expected.String() {
+		t.Fatalf("Unexpected chain ID %q, expected %q", metadata["ChainID"], expected)
+	}
+	metadata, err = layer1.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata["ChainID"] != diffID1.String() {
+		t.Fatalf("Unexpected chain ID %q, expected %q", metadata["ChainID"], diffID1)
+	}
+
+	mount, err := ls.CreateRWLayer("test-metadata", layer2.ChainID(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err = mount.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := metadata["ChainID"]; ok {
+		t.Fatalf("Unexpected chain ID in the metadata of a read-write layer: %v", metadata)
+	}
+	if _, err := ls.ReleaseRWLayer(mount); err != nil {
+		t.Fatal(err)
+	}
+}
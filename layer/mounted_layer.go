@@ -3,6 +3,7 @@ package layer
 import (
 	"io"
 
+	"github.com/docker/docker/daemon/graphdriver"
 	"github.com/docker/docker/pkg/archive"
 )
 
@@ -57,6 +58,12 @@ func (ml *mountedLayer) Metadata() (map[string]string, error) {
 	return ml.layerStore.driver.GetMetadata(ml.mountID)
 }
 
+// FreeSpace returns the number of bytes which can still be written to the
+// layer, if its storage driver can tell.
+func (ml *mountedLayer) FreeSpace() (int64, error) {
+	return graphdriver.FreeSpace(ml.layerStore.driver, ml.mountID)
+}
+
 func (ml *mountedLayer) getReference() RWLayer {
 	ref := &referencedRWLayer{
 		mountedLayer: ml,
@@ -97,3 +104,19 @@ func (rl *referencedRWLayer) Mount(mountLabel string) (string, error) {
 func (rl *referencedRWLayer) Unmount() error {
 	return rl.layerStore.driver.Put(rl.mountedLayer.mountID)
 }
+
+// FreeSpace returns the number of bytes which can still be written to the
+// writable layer rwl, or -1 if its storage driver cannot tell.
+func FreeSpace(rwl RWLayer) (int64, error) {
+	fl, ok := rwl.(interface {
+		FreeSpace() (int64, error)
+	})
+	if !ok {
+		return -1, nil
+	}
+	free, err := fl.FreeSpace()
+	if err == graphdriver.ErrNotSupported {
+		return -1, nil
+	}
+	return free, err
+}
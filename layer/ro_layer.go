@@ -85,7 +85,15 @@ func (rl *roLayer) DiffSize() (size int64, err error) {
 }
 
 func (rl *roLayer) Metadata() (map[string]string, error) {
-	return rl.layerStore.driver.GetMetadata(rl.cacheID)
+	metadata, err := rl.layerStore.driver.GetMetadata(rl.cacheID)
+	if err != nil {
+		return nil, err
+	}
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	metadata["ChainID"] = rl.chainID.String()
+	return metadata, nil
 }
 
 type referencedCacheLayer struct {
@@ -83,6 +83,8 @@ const (
 	Gzip
 	// Xz is xz compression algorithm.
 	Xz
+	// Zstd is zstd compression algorithm.
+	Zstd
 )
 
 const (
@@ -93,18 +95,20 @@ const (
 	OverlayWhiteoutFormat
 )
 
-// IsArchivePath checks if the (possibly compressed) file at the given path
-// starts with a tar file header.
+// IsArchivePath checks if the (possibly compressed, see
+// DecompressNestedStream) file at the given path starts with a tar file
+// header.
 func IsArchivePath(path string) bool {
 	file, err := os.Open(path)
 	if err != nil {
 		return false
 	}
 	defer file.Close()
-	rdr, err := DecompressStream(file)
+	rdr, err := DecompressNestedStream(file)
 	if err != nil {
 		return false
 	}
+	defer rdr.Close()
 	r := tar.NewReader(rdr)
 	_, err = r.Next()
 	return err == nil
@@ -116,6 +120,7 @@ func DetectCompression(source []byte) Compression {
 		Bzip2: {0x42, 0x5A, 0x68},
 		Gzip:  {0x1F, 0x8B, 0x08},
 		Xz:    {0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00},
+		Zstd:  {0x28, 0xB5, 0x2F, 0xFD},
 	} {
 		if len(source) < len(m) {
 			logrus.Debug("Len too short")
@@ -134,6 +139,12 @@ func xzDecompress(archive io.Reader) (io.ReadCloser, <-chan struct{}, error) {
 	return cmdStream(exec.Command(args[0], args[1:]...), archive)
 }
 
+func zstdDecompress(archive io.Reader) (io.ReadCloser, <-chan struct{}, error) {
+	args := []string{"zstd", "-d", "-c", "-q"}
+
+	return cmdStream(exec.Command(args[0], args[1:]...), archive)
+}
+
 // DecompressStream decompresses the archive and returns a ReaderCloser with the decompressed archive.
 func DecompressStream(archive io.Reader) (io.ReadCloser, error) {
 	p := pools.BufioReader32KPool
@@ -175,11 +186,67 @@ func DecompressStream(archive io.Reader) (io.ReadCloser, error) {
 			<-chdone
 			return readBufWrapper.Close()
 		}), nil
+	case Zstd:
+		zstdReader, chdone, err := zstdDecompress(buf)
+		if err != nil {
+			return nil, err
+		}
+		readBufWrapper := p.NewReadCloserWrapper(buf, zstdReader)
+		return ioutils.NewReadCloserWrapper(readBufWrapper, func() error {
+			<-chdone
+			return readBufWrapper.Close()
+		}), nil
 	default:
 		return nil, fmt.Errorf("Unsupported compression format %s", (&compression).Extension())
 	}
 }
 
+// maxNestedCompression is the number of layers of compression
+// DecompressNestedStream removes at most, so that a stream crafted to nest
+// them indefinitely is rejected instead of being decompressed forever.
+const maxNestedCompression = 4
+
+// DecompressNestedStream decompresses the archive like DecompressStream,
+// and keeps decompressing the result as long as it is compressed, e.g. for a
+// tar compressed with xz and then with gzip. An archive with more than
+// maxNestedCompression layers of compression is an error.
+func DecompressNestedStream(archive io.Reader) (io.ReadCloser, error) {
+	var layers []io.ReadCloser
+	closeLayers := func() error {
+		var err error
+		for i := len(layers) - 1; i >= 0; i-- {
+			if cerr := layers[i].Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}
+
+	r := archive
+	for {
+		buf := bufio.NewReader(r)
+		bs, err := buf.Peek(10)
+		if err != nil && err != io.EOF {
+			closeLayers()
+			return nil, err
+		}
+		if DetectCompression(bs) == Uncompressed {
+			return ioutils.NewReadCloserWrapper(buf, closeLayers), nil
+		}
+		if len(layers) == maxNestedCompression {
+			closeLayers()
+			return nil, fmt.Errorf("archive has more than %d layers of compression", maxNestedCompression)
+		}
+		decompressed, err := DecompressStream(buf)
+		if err != nil {
+			closeLayers()
+			return nil, err
+		}
+		layers = append(layers, decompressed)
+		r = decompressed
+	}
+}
+
 // CompressStream compresseses the dest with specified compression algorithm.
 func CompressStream(dest io.Writer, compression Compression) (io.WriteCloser, error) {
 	p := pools.BufioWriter32KPool
@@ -192,8 +259,8 @@ func CompressStream(dest io.Writer, compression Compression) (io.WriteCloser, er
 		gzWriter := gzip.NewWriter(dest)
 		writeBufWrapper := p.NewWriteCloserWrapper(buf, gzWriter)
 		return writeBufWrapper, nil
-	case Bzip2, Xz:
-		// archive/bzip2 does not support writing, and there is no xz support at all
+	case Bzip2, Xz, Zstd:
+		// archive/bzip2 does not support writing, and there is no xz or zstd support at all
 		// However, this is not a problem as docker only currently generates gzipped tars
 		return nil, fmt.Errorf("Unsupported compression format %s", (&compression).Extension())
 	default:
@@ -299,6 +366,8 @@ func (compression *Compression) Extension() string {
 		return "tar.gz"
 	case Xz:
 		return "tar.xz"
+	case Zstd:
+		return "tar.zst"
 	}
 	return ""
 }
@@ -920,7 +989,8 @@ loop:
 // Untar reads a stream of bytes from `archive`, parses it as a tar archive,
 // and unpacks it into the directory at `dest`.
 // The archive may be compressed with one of the following algorithms:
-//  identity (uncompressed), gzip, bzip2, xz.
+//  identity (uncompressed), gzip, bzip2, xz, zstd.
+// Nested compression is removed as well, see DecompressNestedStream.
 // FIXME: specify behavior when target path exists vs. doesn't exist.
 func Untar(tarArchive io.Reader, dest string, options *TarOptions) error {
 	return untarHandler(tarArchive, dest, options, true)
@@ -948,7 +1018,7 @@ func untarHandler(tarArchive io.Reader, dest string, options *TarOptions, decomp
 
 	r := tarArchive
 	if decompress {
-		decompressedArchive, err := DecompressStream(tarArchive)
+		decompressedArchive, err := DecompressNestedStream(tarArchive)
 		if err != nil {
 			return err
 		}
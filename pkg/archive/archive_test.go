@@ -3,6 +3,7 @@ package archive
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -132,6 +133,118 @@ func TestDecompressStreamXz(t *testing.T) {
 	testDecompressStream(t, "xz", "xz -f")
 }
 
+func TestDecompressStreamZstd(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd not present")
+	}
+	testDecompressStream(t, "zst", "zstd -f -q --rm")
+}
+
+// testUntarNestedCompression compresses a tar archive with compressCommand,
+// run in its directory, and checks that the file name is unpacked.
+func testUntarNestedCompression(t *testing.T, name, compressCommand string) {
+	tmpDir, err := ioutil.TempDir("", "docker-archive-nested")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tarStream, err := Generate("file", "content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarData, err := ioutil.ReadAll(tarStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "archive.tar"), tarData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("sh", "-c", compressCommand)
+	cmd.Dir = tmpDir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to compress the archive: %s", output)
+	}
+
+	src := filepath.Join(tmpDir, name)
+	if !IsArchivePath(src) {
+		t.Fatalf("Did not recognise %s as an archive", name)
+	}
+	dest := filepath.Join(tmpDir, "dest")
+	if err := defaultUntarPath(src, dest); err != nil {
+		t.Fatalf("Failed to untar %s: %v", name, err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dest, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "content" {
+		t.Fatalf("Unexpected content %q", content)
+	}
+}
+
+func TestUntarNestedCompressionGzip(t *testing.T) {
+	testUntarNestedCompression(t, "archive.tar.gz", "gzip -f archive.tar")
+}
+
+func TestUntarNestedCompressionBzip2(t *testing.T) {
+	testUntarNestedCompression(t, "archive.tar.bz2", "bzip2 -f archive.tar")
+}
+
+func TestUntarNestedCompressionXz(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Xz not present in msys2")
+	}
+	testUntarNestedCompression(t, "archive.tar.xz", "xz -f archive.tar")
+}
+
+func TestUntarNestedCompressionXzGzip(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Xz not present in msys2")
+	}
+	testUntarNestedCompression(t, "archive.tar.xz.gz", "xz -f archive.tar && gzip -f archive.tar.xz")
+}
+
+func TestDecompressNestedStreamDepth(t *testing.T) {
+	tarStream, err := Generate("file", "content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(tarStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= maxNestedCompression+1; i++ {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data = buf.Bytes()
+
+		r, err := DecompressNestedStream(bytes.NewReader(data))
+		if i > maxNestedCompression {
+			if err == nil {
+				r.Close()
+				t.Fatalf("Expected an error for %d layers of compression", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Failed to decompress %d layers of compression: %v", i, err)
+		}
+		if _, err := tar.NewReader(r).Next(); err != nil {
+			t.Fatalf("Failed to read the tar stream below %d layers of compression: %v", i, err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func TestCompressStreamXzUnsupported(t *testing.T) {
 	dest, err := os.Create(tmp + "dest")
 	if err != nil {
@@ -207,6 +320,13 @@ func TestExtensionXz(t *testing.T) {
 		t.Fatalf("The extension of a bzip2 archive should be 'tar.xz'")
 	}
 }
+func TestExtensionZstd(t *testing.T) {
+	compression := Zstd
+	output := compression.Extension()
+	if output != "tar.zst" {
+		t.Fatalf("The extension of a zstd archive should be 'tar.zst'")
+	}
+}
 
 func TestCmdStreamLargeStderr(t *testing.T) {
 	cmd := exec.Command("sh", "-c", "dd if=/dev/zero bs=1k count=1000 of=/dev/stderr; echo hello")
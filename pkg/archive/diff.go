@@ -219,6 +219,83 @@ func UnpackLayer(dest string, layer io.Reader, options *TarOptions) (size int64,
 	return size, nil
 }
 
+// ValidateLayer reads the diff in the standard layer format from `layer`
+// and checks that UnpackLayer would not write outside of its destination,
+// without writing anything. Entries larger than maxEntrySize bytes are
+// rejected, unless maxEntrySize is 0. The stream `layer` can only be
+// uncompressed.
+// Returns the size in bytes of the contents of the layer.
+func ValidateLayer(layer io.Reader, maxEntrySize int64) (size int64, err error) {
+	// The paths are checked against a destination which is never written
+	// to, so that they are handled exactly like UnpackLayer does.
+	dest := filepath.FromSlash("/layer")
+	tr := tar.NewReader(layer)
+	aufsHardlinks := make(map[string]struct{})
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if hdr.Size < 0 || (maxEntrySize > 0 && hdr.Size > maxEntrySize) {
+			return 0, fmt.Errorf("%q is too large: %d bytes", hdr.Name, hdr.Size)
+		}
+		size += hdr.Size
+		hdr.Name = filepath.Clean(hdr.Name)
+
+		if strings.HasPrefix(hdr.Name, WhiteoutMetaPrefix) {
+			if strings.HasPrefix(hdr.Name, WhiteoutLinkDir) && hdr.Typeflag == tar.TypeReg {
+				aufsHardlinks[filepath.Base(hdr.Name)] = struct{}{}
+			}
+			if hdr.Name != WhiteoutOpaqueDir {
+				continue
+			}
+		}
+		path := filepath.Join(dest, hdr.Name)
+		rel, err := filepath.Rel(dest, path)
+		if err != nil {
+			return 0, err
+		}
+		if strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			return 0, breakoutError(fmt.Errorf("%q is outside of the layer", hdr.Name))
+		}
+
+		base := filepath.Base(path)
+		if strings.HasPrefix(base, WhiteoutPrefix) {
+			originalBase := base[len(WhiteoutPrefix):]
+			if base != WhiteoutOpaqueDir && (originalBase == "" || originalBase == "." || originalBase == "..") {
+				return 0, fmt.Errorf("invalid whiteout %q", hdr.Name)
+			}
+			if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+				return 0, fmt.Errorf("invalid whiteout %q: not a regular file", hdr.Name)
+			}
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeLink:
+			if strings.HasPrefix(filepath.Clean(hdr.Linkname), WhiteoutLinkDir) {
+				if _, ok := aufsHardlinks[filepath.Base(hdr.Linkname)]; !ok {
+					return 0, fmt.Errorf("Invalid aufs hardlink")
+				}
+				break
+			}
+			if !strings.HasPrefix(filepath.Join(dest, hdr.Linkname), dest) {
+				return 0, breakoutError(fmt.Errorf("invalid hardlink %q -> %q", hdr.Name, hdr.Linkname))
+			}
+		case tar.TypeSymlink:
+			if !strings.HasPrefix(filepath.Join(filepath.Dir(path), hdr.Linkname), dest) {
+				return 0, breakoutError(fmt.Errorf("invalid symlink %q -> %q", hdr.Name, hdr.Linkname))
+			}
+		}
+	}
+	return size, nil
+}
+
 // ApplyLayer parses a diff in the standard layer format from `layer`,
 // and applies it to the directory `dest`. The stream `layer` can be
 // compressed or uncompressed.
@@ -22,7 +22,8 @@ func NewArchiver(idMappings *idtools.IDMappings) *archive.Archiver {
 // Untar reads a stream of bytes from `archive`, parses it as a tar archive,
 // and unpacks it into the directory at `dest`.
 // The archive may be compressed with one of the following algorithms:
-//  identity (uncompressed), gzip, bzip2, xz.
+//  identity (uncompressed), gzip, bzip2, xz, zstd.
+// Nested compression is removed as well, see archive.DecompressNestedStream.
 func Untar(tarArchive io.Reader, dest string, options *archive.TarOptions) error {
 	return untarHandler(tarArchive, dest, options, true)
 }
@@ -58,7 +59,7 @@ func untarHandler(tarArchive io.Reader, dest string, options *archive.TarOptions
 
 	r := ioutil.NopCloser(tarArchive)
 	if decompress {
-		decompressedArchive, err := archive.DecompressStream(tarArchive)
+		decompressedArchive, err := archive.DecompressNestedStream(tarArchive)
 		if err != nil {
 			return err
 		}
@@ -60,7 +60,21 @@ func NewPatternMatcher(patterns []string) (*PatternMatcher, error) {
 // Matches matches path against all the patterns. Matches is not safe to be
 // called concurrently
 func (pm *PatternMatcher) Matches(file string) (bool, error) {
-	matched := false
+	pattern, err := pm.MatchingPattern(file)
+	if err != nil {
+		return false, err
+	}
+	if pattern != nil {
+		logrus.Debugf("Skipping excluded path: %s (matched by %s)", file, pattern)
+	}
+	return pattern != nil, nil
+}
+
+// MatchingPattern returns the pattern which excludes path, that is the last
+// pattern matching path if it is not an exclusion, or nil if path is not
+// excluded. MatchingPattern is not safe to be called concurrently
+func (pm *PatternMatcher) MatchingPattern(file string) (*Pattern, error) {
+	var matched *Pattern
 	file = filepath.FromSlash(file)
 	parentPath := filepath.Dir(file)
 	parentPathDirs := strings.Split(parentPath, string(os.PathSeparator))
@@ -74,7 +88,7 @@ func (pm *PatternMatcher) Matches(file string) (bool, error) {
 
 		match, err := pattern.match(file)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
 
 		if !match && parentPath != "." {
@@ -85,14 +99,13 @@ func (pm *PatternMatcher) Matches(file string) (bool, error) {
 		}
 
 		if match {
-			matched = !negative
+			matched = pattern
+			if negative {
+				matched = nil
+			}
 		}
 	}
 
-	if matched {
-		logrus.Debugf("Skipping excluded path: %s", file)
-	}
-
 	return matched, nil
 }
 
@@ -225,6 +225,33 @@ func TestPatternMatches(t *testing.T) {
 	}
 }
 
+// MatchingPattern should return the last pattern excluding the path.
+func TestMatchingPattern(t *testing.T) {
+	pm, err := NewPatternMatcher([]string{"docs", "docs/*.md", "!docs/README.md", "docs/*.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, expected := range map[string]string{
+		"docs/guide.md":    "docs/*.md",
+		"docs/notes.txt":   "docs/*.txt",
+		"docs/images/a":    "docs",
+		"docs/README.md":   "",
+		"src/fileutils.go": "",
+	} {
+		pattern, err := pm.MatchingPattern(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if pattern != nil {
+			got = pattern.String()
+		}
+		if got != expected {
+			t.Errorf("expected %s to be excluded by %q, got %q", file, expected, got)
+		}
+	}
+}
+
 // An exclusion followed by an inclusion should return true.
 func TestExclusionPatternMatchesPatternBefore(t *testing.T) {
 	match, _ := Matches("fileutils.go", []string{"!fileutils.go", "*.go"})
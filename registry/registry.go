@@ -42,6 +42,13 @@ func newTLSConfig(hostname string, isSecure bool) (*tls.Config, error) {
 	return tlsConfig, nil
 }
 
+// NewHostTLSConfig returns the TLS configuration to connect to hostname,
+// which trusts the CA certificates and uses the client certificates stored
+// for hostname in CertsDir in addition to the system ones.
+func NewHostTLSConfig(hostname string) (*tls.Config, error) {
+	return newTLSConfig(hostname, true)
+}
+
 func hasFile(files []os.FileInfo, name string) bool {
 	for _, f := range files {
 		if f.Name() == name {